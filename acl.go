@@ -0,0 +1,242 @@
+package dicompot
+
+// This file implements the access control policy of a ServiceProvider: which
+// called AE titles it answers to, which calling AE titles may connect from
+// where, and which services they may use.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+// AccessServices is a set of DIMSE services.
+type AccessServices uint8
+
+const (
+	AccessEcho       AccessServices = 1 << iota // C-ECHO
+	AccessQuery                                 // C-FIND
+	AccessRetrieve                              // C-GET, C-MOVE
+	AccessStore                                 // C-STORE
+	AccessNormalized                            // N-EVENT-REPORT, N-GET, N-SET, N-ACTION, N-CREATE, N-DELETE
+
+	AccessAll = AccessEcho | AccessQuery | AccessRetrieve | AccessStore | AccessNormalized
+)
+
+// Names of the services, as used by ParseAccessServices.
+var accessServiceNames = []struct {
+	name     string
+	services AccessServices
+}{
+	{"echo", AccessEcho},
+	{"query", AccessQuery},
+	{"retrieve", AccessRetrieve},
+	{"store", AccessStore},
+	{"normalized", AccessNormalized},
+	{"all", AccessAll},
+}
+
+// ParseAccessServices parses service names: echo, query, retrieve, store,
+// normalized, all.
+func ParseAccessServices(names []string) (AccessServices, error) {
+	var services AccessServices
+	for _, name := range names {
+		found := false
+		for _, s := range accessServiceNames {
+			if strings.EqualFold(name, s.name) {
+				services |= s.services
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("dicom.ParseAccessServices: unknown service %q", name)
+		}
+	}
+	return services, nil
+}
+
+func (s AccessServices) String() string {
+	if s == AccessAll {
+		return "all"
+	}
+	var names []string
+	for _, n := range accessServiceNames[:len(accessServiceNames)-1] {
+		if s&n.services != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// AccessRule binds a calling AE title to source addresses and services.
+type AccessRule struct {
+	// CallingAETitle, without padding. "*" matches any title.
+	CallingAETitle string
+	// Source addresses the title may connect from. Empty for any address.
+	IPs []*net.IPNet
+	// Services the title may use. Zero allows all of them.
+	Services AccessServices
+}
+
+// AccessPolicy decides which associations a ServiceProvider accepts, and
+// which commands it serves on them.
+//
+// An A-ASSOCIATE-RQ is rejected with reason "called AE title not recognized"
+// if its called AE title is not in CalledAETitles, and with "calling AE
+// title not recognized" if no rule matches its calling AE title and source
+// address. The first matching rule sets the services allowed; other commands
+// are refused with StatusNotAuthorized.
+type AccessPolicy struct {
+	// Called AE titles the provider answers to. If empty, the called AE
+	// title is checked against ServiceProviderParams.AETitle, unless
+	// Enforce is "no".
+	CalledAETitles []string
+	// Rules are tried in order. If empty, any calling AE title may use all
+	// services from anywhere.
+	Rules []AccessRule
+}
+
+func (r *AccessRule) allows(services AccessServices) bool {
+	return r == nil || r.Services == 0 || r.Services&services != 0
+}
+
+// Check the called AE title. aeTitle and enforce are the ones of the
+// ServiceProviderParams.
+func (p *AccessPolicy) calledAETitleAllowed(calledAETitle, aeTitle, enforce string) bool {
+	if p == nil || len(p.CalledAETitles) == 0 {
+		return enforce == "no" || calledAETitle == strings.TrimSpace(aeTitle)
+	}
+	for _, ae := range p.CalledAETitles {
+		if ae == calledAETitle {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the rule for the calling AE title and address. Returns a nil rule
+// without error if every client is allowed, and the reason of the refusal if
+// none matches.
+func (p *AccessPolicy) match(callingAETitle string, ip string) (*AccessRule, error) {
+	if p == nil || len(p.Rules) == 0 {
+		return nil, nil
+	}
+	addr := net.ParseIP(ip)
+	knownTitle := false
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.CallingAETitle != "*" && r.CallingAETitle != callingAETitle {
+			continue
+		}
+		knownTitle = knownTitle || r.CallingAETitle != "*"
+		if len(r.IPs) == 0 {
+			return r, nil
+		}
+		for _, ipNet := range r.IPs {
+			if addr != nil && ipNet.Contains(addr) {
+				return r, nil
+			}
+		}
+	}
+	if knownTitle {
+		return nil, fmt.Errorf("calling AE title %q not allowed from %s", callingAETitle, ip)
+	}
+	return nil, fmt.Errorf("unknown calling AE title %q", callingAETitle)
+}
+
+// The service a DIMSE request belongs to, and its name.
+func commandService(msg dimse.Message) (AccessServices, string) {
+	switch msg.(type) {
+	case *dimse.CEchoRq:
+		return AccessEcho, "C-ECHO"
+	case *dimse.CFindRq:
+		return AccessQuery, "C-FIND"
+	case *dimse.CGetRq:
+		return AccessRetrieve, "C-GET"
+	case *dimse.CMoveRq:
+		return AccessRetrieve, "C-MOVE"
+	case *dimse.CStoreRq:
+		return AccessStore, "C-STORE"
+	default:
+		return AccessNormalized, nServiceCommandName(msg)
+	}
+}
+
+// Wrap a provider callback so that requests the calling AE title isn't
+// authorized for get a StatusNotAuthorized response instead.
+func withAccessCheck(cb serviceCallback) serviceCallback {
+	return func(msg dimse.Message, data *dimse.Data, cs *serviceCommandState) {
+		service, command := commandService(msg)
+		if cs.cm.access.allows(service) {
+			cb(msg, data, cs)
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"Command": command,
+			"AETitle": cs.cm.callingAETitle,
+			"ID":      cs.cm.label,
+		}).Warn("Command refused")
+		status := dimse.Status{
+			Status:       dimse.StatusNotAuthorized,
+			ErrorComment: fmt.Sprintf("%s not authorized for %s", command, cs.cm.callingAETitle),
+		}
+		rsp, err := newRefusalResponse(msg, status)
+		if err != nil {
+			cs.disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+			return
+		}
+		cs.sendMessage(rsp, nil)
+		recordCommand(cs, command, status)
+	}
+}
+
+// Build the final response to a request, with no data set.
+func newRefusalResponse(msg dimse.Message, status dimse.Status) (dimse.Message, error) {
+	switch c := msg.(type) {
+	case *dimse.CEchoRq:
+		return &dimse.CEchoRsp{
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}, nil
+	case *dimse.CFindRq:
+		return &dimse.CFindRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}, nil
+	case *dimse.CGetRq:
+		return &dimse.CGetRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}, nil
+	case *dimse.CMoveRq:
+		return &dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}, nil
+	case *dimse.CStoreRq:
+		return &dimse.CStoreRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+			Status:                    status,
+		}, nil
+	default:
+		sopClassUID, sopInstanceUID := nServiceTarget(msg)
+		return newNServiceResponse(msg, sopClassUID, sopInstanceUID, status, false)
+	}
+}
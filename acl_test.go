@@ -0,0 +1,196 @@
+package dicompot
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+func TestCalledAETitleAllowed(t *testing.T) {
+	tests := []struct {
+		policy  *AccessPolicy
+		called  string
+		aeTitle string
+		enforce string
+		want    bool
+	}{
+		{nil, "DICOMPOT", "DICOMPOT", "yes", true},
+		{nil, "DICOMPOT", "DICOMPOT  ", "yes", true},
+		{nil, "PACS", "DICOMPOT", "yes", false},
+		{nil, "PACS", "DICOMPOT", "no", true},
+		{&AccessPolicy{}, "PACS", "DICOMPOT", "no", true},
+		{&AccessPolicy{CalledAETitles: []string{"PACS", "RADIANT"}}, "RADIANT", "DICOMPOT", "yes", true},
+		{&AccessPolicy{CalledAETitles: []string{"PACS"}}, "DICOMPOT", "DICOMPOT", "yes", false},
+		{&AccessPolicy{CalledAETitles: []string{"PACS"}}, "ORTHANC", "DICOMPOT", "no", false},
+	}
+	for _, test := range tests {
+		if got := test.policy.calledAETitleAllowed(test.called, test.aeTitle, test.enforce); got != test.want {
+			t.Errorf("calledAETitleAllowed(%v, %q, %q, %q) = %v, want %v",
+				test.policy, test.called, test.aeTitle, test.enforce, got, test.want)
+		}
+	}
+}
+
+func TestAccessPolicyMatch(t *testing.T) {
+	policy := &AccessPolicy{Rules: []AccessRule{
+		{CallingAETitle: "WS01", IPs: []*net.IPNet{mustParseCIDR("10.1.0.0/16")}, Services: AccessEcho | AccessQuery},
+		{CallingAETitle: "WS01", IPs: []*net.IPNet{mustParseCIDR("10.2.0.0/16")}, Services: AccessAll},
+		{CallingAETitle: "MODALITY", Services: AccessStore},
+		{CallingAETitle: "*", IPs: []*net.IPNet{mustParseCIDR("192.0.2.0/24")}, Services: AccessEcho},
+	}}
+	tests := []struct {
+		calling string
+		ip      string
+		rule    int // Index of the rule, -1 if refused
+	}{
+		{"WS01", "10.1.2.3", 0},
+		{"WS01", "10.2.2.3", 1},
+		{"WS01", "10.3.2.3", -1},
+		{"WS01", "192.0.2.1", 3},
+		{"MODALITY", "203.0.113.1", 2},
+		{"ANY", "192.0.2.1", 3},
+		{"ANY", "203.0.113.1", -1},
+		{"WS01", "not an address", -1},
+	}
+	for _, test := range tests {
+		rule, err := policy.match(test.calling, test.ip)
+		if test.rule < 0 {
+			if err == nil {
+				t.Errorf("match(%q, %q) = %+v, want refusal", test.calling, test.ip, rule)
+			}
+			continue
+		}
+		if err != nil || rule != &policy.Rules[test.rule] {
+			t.Errorf("match(%q, %q) = %+v, %v, want rule %d", test.calling, test.ip, rule, err, test.rule)
+		}
+	}
+
+	for _, p := range []*AccessPolicy{nil, {CalledAETitles: []string{"PACS"}}} {
+		if rule, err := p.match("ANY", "203.0.113.1"); rule != nil || err != nil {
+			t.Errorf("match without rules = %v, %v, want nil, nil", rule, err)
+		}
+	}
+}
+
+func TestAccessPolicyMatchReason(t *testing.T) {
+	policy := &AccessPolicy{Rules: []AccessRule{
+		{CallingAETitle: "WS01", IPs: []*net.IPNet{mustParseCIDR("10.1.0.0/16")}},
+	}}
+	tests := []struct {
+		calling string
+		want    string
+	}{
+		{"WS01", `calling AE title "WS01" not allowed from 10.3.2.3`},
+		{"WS02", `unknown calling AE title "WS02"`},
+	}
+	for _, test := range tests {
+		_, err := policy.match(test.calling, "10.3.2.3")
+		if err == nil || err.Error() != test.want {
+			t.Errorf("match(%q) error = %v, want %s", test.calling, err, test.want)
+		}
+	}
+}
+
+func TestAccessRuleAllows(t *testing.T) {
+	tests := []struct {
+		rule     *AccessRule
+		services AccessServices
+		want     bool
+	}{
+		{nil, AccessStore, true},
+		{&AccessRule{}, AccessStore, true},
+		{&AccessRule{Services: AccessEcho | AccessQuery}, AccessQuery, true},
+		{&AccessRule{Services: AccessEcho | AccessQuery}, AccessRetrieve, false},
+		{&AccessRule{Services: AccessAll}, AccessNormalized, true},
+	}
+	for _, test := range tests {
+		if got := test.rule.allows(test.services); got != test.want {
+			t.Errorf("%+v.allows(%v) = %v, want %v", test.rule, test.services, got, test.want)
+		}
+	}
+}
+
+func TestParseAccessServices(t *testing.T) {
+	tests := []struct {
+		names  []string
+		want   AccessServices
+		str    string
+		wantOK bool
+	}{
+		{nil, 0, "none", true},
+		{[]string{"echo"}, AccessEcho, "echo", true},
+		{[]string{"Query", "RETRIEVE"}, AccessQuery | AccessRetrieve, "query,retrieve", true},
+		{[]string{"store", "normalized"}, AccessStore | AccessNormalized, "store,normalized", true},
+		{[]string{"echo", "all"}, AccessAll, "all", true},
+		{[]string{"echo", "delete"}, 0, "", false},
+	}
+	for _, test := range tests {
+		got, err := ParseAccessServices(test.names)
+		if (err == nil) != test.wantOK || got != test.want {
+			t.Errorf("ParseAccessServices(%q) = %v, %v, want %v, ok %v", test.names, got, err, test.want, test.wantOK)
+			continue
+		}
+		if test.wantOK && got.String() != test.str {
+			t.Errorf("%q.String() = %q, want %q", test.names, got.String(), test.str)
+		}
+	}
+}
+
+func TestCommandService(t *testing.T) {
+	tests := []struct {
+		msg     dimse.Message
+		service AccessServices
+		name    string
+	}{
+		{&dimse.CEchoRq{}, AccessEcho, "C-ECHO"},
+		{&dimse.CFindRq{}, AccessQuery, "C-FIND"},
+		{&dimse.CGetRq{}, AccessRetrieve, "C-GET"},
+		{&dimse.CMoveRq{}, AccessRetrieve, "C-MOVE"},
+		{&dimse.CStoreRq{}, AccessStore, "C-STORE"},
+		{&dimse.NActionRq{}, AccessNormalized, "N-ACTION"},
+		{&dimse.NGetRq{}, AccessNormalized, "N-GET"},
+	}
+	for _, test := range tests {
+		service, name := commandService(test.msg)
+		if service != test.service || name != test.name {
+			t.Errorf("commandService(%T) = %v, %q, want %v, %q", test.msg, service, name, test.service, test.name)
+		}
+	}
+}
+
+func TestNewRefusalResponse(t *testing.T) {
+	status := dimse.Status{Status: dimse.StatusNotAuthorized}
+	tests := []struct {
+		msg dimse.Message
+		rsp dimse.Message
+	}{
+		{&dimse.CEchoRq{MessageID: 7}, &dimse.CEchoRsp{}},
+		{&dimse.CFindRq{MessageID: 7, AffectedSOPClassUID: testVerificationSOPClass}, &dimse.CFindRsp{}},
+		{&dimse.CGetRq{MessageID: 7, AffectedSOPClassUID: testVerificationSOPClass}, &dimse.CGetRsp{}},
+		{&dimse.CMoveRq{MessageID: 7, AffectedSOPClassUID: testVerificationSOPClass}, &dimse.CMoveRsp{}},
+		{&dimse.CStoreRq{MessageID: 7, AffectedSOPClassUID: testVerificationSOPClass}, &dimse.CStoreRsp{}},
+		{&dimse.NActionRq{MessageID: 7, RequestedSOPClassUID: testVerificationSOPClass, RequestedSOPInstanceUID: "1.2.3"}, &dimse.NActionRsp{}},
+	}
+	for _, test := range tests {
+		rsp, err := newRefusalResponse(test.msg, status)
+		if err != nil {
+			t.Errorf("newRefusalResponse(%T): %v", test.msg, err)
+			continue
+		}
+		if got, want := rsp.CommandField(), test.rsp.CommandField(); got != want {
+			t.Errorf("newRefusalResponse(%T) = %T, want %T", test.msg, rsp, test.rsp)
+		}
+		if rsp.GetStatus() == nil || rsp.GetStatus().Status != dimse.StatusNotAuthorized {
+			t.Errorf("newRefusalResponse(%T) status = %v, want %v", test.msg, rsp.GetStatus(), status)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package dicompot
+
+// This file tracks the AE titles clients try, to harvest the dictionaries
+// used to brute force the called AE title, and implements the lure that lets
+// brute forcers in to see what they do next.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LurePolicy accepts associations with a wrong called AE title, when Enforce
+// is not "no". The associations accepted this way are marked as post brute
+// force, see ConnectionState.PostBruteForce.
+type LurePolicy struct {
+	// Accept once the source address has had this many called AE titles
+	// rejected. Zero disables the trigger.
+	AfterFailures int
+	// Accept right away if the called AE title is one of these. Case
+	// insensitive.
+	WeakAETitles []string
+}
+
+// AETitleCount is an AE title tried by clients.
+type AETitleCount struct {
+	Title     string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// AETitleSource holds the AE titles tried from one address, in the order
+// they were first tried.
+type AETitleSource struct {
+	IP       string
+	Called   []AETitleCount
+	Calling  []AETitleCount
+	Failures int // Called AE titles rejected.
+	Lured    int // Associations accepted by the LurePolicy.
+}
+
+// Max number of source addresses, titles per source and titles overall
+// remembered. Titles beyond the limits are not recorded.
+const (
+	maxAETitleSources   = 10000
+	maxAETitlesBySource = 256
+	maxAETitles         = 100000
+)
+
+type aeTitleList struct {
+	entries []*AETitleCount
+	index   map[string]*AETitleCount
+}
+
+func (l *aeTitleList) add(title string, now time.Time, max int) {
+	if l.index == nil {
+		l.index = make(map[string]*AETitleCount)
+	}
+	e, ok := l.index[title]
+	if !ok {
+		if len(l.entries) >= max {
+			return
+		}
+		e = &AETitleCount{Title: title, FirstSeen: now}
+		l.entries = append(l.entries, e)
+		l.index[title] = e
+	}
+	e.Count++
+	e.LastSeen = now
+}
+
+func (l *aeTitleList) list() []AETitleCount {
+	list := make([]AETitleCount, len(l.entries))
+	for i, e := range l.entries {
+		list[i] = *e
+	}
+	return list
+}
+
+type aeTitleSource struct {
+	called   aeTitleList
+	calling  aeTitleList
+	failures int
+	lured    int
+	lastSeen time.Time
+}
+
+type aeTitleTracker struct {
+	lure *LurePolicy // Nil if there is no lure.
+
+	mu      sync.Mutex
+	sources map[string]*aeTitleSource // Keyed by IP address.
+	called  aeTitleList
+	calling aeTitleList
+}
+
+func newAETitleTracker(lure *LurePolicy) *aeTitleTracker {
+	return &aeTitleTracker{lure: lure, sources: make(map[string]*aeTitleSource)}
+}
+
+// Must be called with t.mu held.
+func (t *aeTitleTracker) source(ip string) *aeTitleSource {
+	s, ok := t.sources[ip]
+	if !ok {
+		if len(t.sources) >= maxAETitleSources {
+			// Evict the source idle for the longest time.
+			var oldest string
+			for k, v := range t.sources {
+				if oldest == "" || v.lastSeen.Before(t.sources[oldest].lastSeen) {
+					oldest = k
+				}
+			}
+			delete(t.sources, oldest)
+		}
+		s = &aeTitleSource{}
+		t.sources[ip] = s
+	}
+	return s
+}
+
+// Record the AE titles of an A-ASSOCIATE-RQ. "rejected" tells whether the
+// called AE title is wrong. Returns whether the association is to be
+// accepted anyway. Nil-safe.
+func (t *aeTitleTracker) attempt(ip, calledAETitle, callingAETitle string, rejected bool, label string) bool {
+	if t == nil {
+		return false
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.source(ip)
+	s.lastSeen = now
+	s.called.add(calledAETitle, now, maxAETitlesBySource)
+	s.calling.add(callingAETitle, now, maxAETitlesBySource)
+	t.called.add(calledAETitle, now, maxAETitles)
+	t.calling.add(callingAETitle, now, maxAETitles)
+	if !rejected {
+		return false
+	}
+
+	trigger := ""
+	if t.lure != nil {
+		for _, ae := range t.lure.WeakAETitles {
+			if strings.EqualFold(ae, calledAETitle) {
+				trigger = "WeakAETitle"
+				break
+			}
+		}
+		if trigger == "" && t.lure.AfterFailures > 0 && s.failures >= t.lure.AfterFailures {
+			trigger = "Failures"
+		}
+	}
+	if trigger == "" {
+		s.failures++
+		return false
+	}
+	s.lured++
+	observeLure(trigger)
+	logrus.WithFields(logrus.Fields{
+		"IP":       ip,
+		"AETitle":  calledAETitle,
+		"Trigger":  trigger,
+		"Failures": s.failures,
+		"ID":       label,
+	}).Warn("Lure")
+	return true
+}
+
+// Sort by count, then by first use.
+func sortAETitles(list []AETitleCount) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].FirstSeen.Before(list[j].FirstSeen)
+	})
+}
+
+// AETitles returns the called and calling AE titles tried by all clients,
+// most frequent first.
+func (sp *ServiceProvider) AETitles() (called []AETitleCount, calling []AETitleCount) {
+	t := sp.aeTitles
+	t.mu.Lock()
+	called, calling = t.called.list(), t.calling.list()
+	t.mu.Unlock()
+	sortAETitles(called)
+	sortAETitles(calling)
+	return called, calling
+}
+
+// AETitleSources returns the AE titles tried from each address, the
+// addresses with the most rejected titles first.
+func (sp *ServiceProvider) AETitleSources() []AETitleSource {
+	t := sp.aeTitles
+	t.mu.Lock()
+	sources := make([]AETitleSource, 0, len(t.sources))
+	for ip, s := range t.sources {
+		sources = append(sources, AETitleSource{
+			IP:       ip,
+			Called:   s.called.list(),
+			Calling:  s.calling.list(),
+			Failures: s.failures,
+			Lured:    s.lured,
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Failures != sources[j].Failures {
+			return sources[i].Failures > sources[j].Failures
+		}
+		return sources[i].IP < sources[j].IP
+	})
+	return sources
+}
@@ -0,0 +1,160 @@
+package dicompot
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLureAttempt(t *testing.T) {
+	type attempt struct {
+		called   string
+		rejected bool
+		want     bool // Lured
+	}
+	tests := []struct {
+		name     string
+		lure     *LurePolicy
+		attempts []attempt
+	}{
+		{"no lure", nil, []attempt{
+			{"PACS", true, false},
+			{"ORTHANC", true, false},
+			{"ANY-SCP", true, false},
+		}},
+		{"accepted anyway", &LurePolicy{AfterFailures: 1, WeakAETitles: []string{"PACS"}}, []attempt{
+			{"DICOMPOT", false, false},
+			{"PACS", false, false},
+		}},
+		{"weak title", &LurePolicy{WeakAETitles: []string{"PACS", "any-scp"}}, []attempt{
+			{"ORTHANC", true, false},
+			{"pacs", true, true},
+			{"ANY-SCP", true, true},
+			{"STORESCP", true, false},
+		}},
+		{"after failures", &LurePolicy{AfterFailures: 2}, []attempt{
+			{"A", true, false},
+			{"B", true, false},
+			{"C", true, true},
+			{"D", true, true},
+		}},
+		{"lured titles are not failures", &LurePolicy{AfterFailures: 2, WeakAETitles: []string{"PACS"}}, []attempt{
+			{"PACS", true, true},
+			{"A", true, false},
+			{"PACS", true, true},
+			{"B", true, false},
+			{"C", true, true},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newAETitleTracker(test.lure)
+			for i, a := range test.attempts {
+				if got := tracker.attempt("192.0.2.7", a.called, "SCU", a.rejected, "1"); got != a.want {
+					t.Errorf("attempt %d (%s): lured = %v, want %v", i, a.called, got, a.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLureBySource(t *testing.T) {
+	tracker := newAETitleTracker(&LurePolicy{AfterFailures: 1})
+	tracker.attempt("192.0.2.7", "A", "SCU", true, "1")
+	if tracker.attempt("192.0.2.8", "B", "SCU", true, "2") {
+		t.Errorf("second address lured by the failures of the first")
+	}
+	if !tracker.attempt("192.0.2.7", "B", "SCU", true, "3") {
+		t.Errorf("first address not lured after its failure")
+	}
+}
+
+func TestAETitleTrackerNil(t *testing.T) {
+	var tracker *aeTitleTracker
+	if tracker.attempt("192.0.2.7", "PACS", "SCU", true, "1") {
+		t.Errorf("nil tracker lured")
+	}
+}
+
+func TestAETitleStatistics(t *testing.T) {
+	tracker := newAETitleTracker(nil)
+	sp := &ServiceProvider{aeTitles: tracker}
+	for _, a := range []struct{ ip, called, calling string }{
+		{"192.0.2.7", "PACS", "SCU"},
+		{"192.0.2.7", "ORTHANC", "SCU"},
+		{"192.0.2.7", "PACS", "SCU"},
+		{"192.0.2.8", "ORTHANC", "FINDSCU"},
+		{"192.0.2.8", "ORTHANC", "FINDSCU"},
+		{"192.0.2.9", "DCM4CHEE", "SCU"},
+	} {
+		tracker.attempt(a.ip, a.called, a.calling, a.called != "DCM4CHEE", "1")
+	}
+
+	called, calling := sp.AETitles()
+	wantCalled := []struct {
+		title string
+		count int
+	}{{"ORTHANC", 3}, {"PACS", 2}, {"DCM4CHEE", 1}}
+	if len(called) != len(wantCalled) {
+		t.Fatalf("AETitles() called = %v", called)
+	}
+	for i, w := range wantCalled {
+		if called[i].Title != w.title || called[i].Count != w.count {
+			t.Errorf("called[%d] = %s %d, want %s %d", i, called[i].Title, called[i].Count, w.title, w.count)
+		}
+	}
+	if len(calling) != 2 || calling[0].Title != "SCU" || calling[0].Count != 4 {
+		t.Errorf("AETitles() calling = %v, want SCU 4 first", calling)
+	}
+
+	sources := sp.AETitleSources()
+	wantSources := []struct {
+		ip       string
+		failures int
+		called   int
+	}{{"192.0.2.7", 3, 2}, {"192.0.2.8", 2, 1}, {"192.0.2.9", 0, 1}}
+	if len(sources) != len(wantSources) {
+		t.Fatalf("AETitleSources() = %v", sources)
+	}
+	for i, w := range wantSources {
+		s := sources[i]
+		if s.IP != w.ip || s.Failures != w.failures || len(s.Called) != w.called {
+			t.Errorf("sources[%d] = %s, %d failures, %d called, want %s, %d, %d",
+				i, s.IP, s.Failures, len(s.Called), w.ip, w.failures, w.called)
+		}
+	}
+	if first := sources[0].Called[0]; first.Title != "PACS" || first.Count != 2 {
+		t.Errorf("first called title of %s = %s %d, want PACS 2", sources[0].IP, first.Title, first.Count)
+	}
+}
+
+func TestAETitleListBounded(t *testing.T) {
+	var l aeTitleList
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		l.add(strconv.Itoa(i), now, 3)
+	}
+	l.add("0", now, 3)
+	list := l.list()
+	if len(list) != 3 || list[0].Title != "0" || list[0].Count != 2 {
+		t.Errorf("list() = %v, want 3 titles, 0 tried twice", list)
+	}
+}
+
+func TestAETitleSourcesBounded(t *testing.T) {
+	tracker := newAETitleTracker(nil)
+	for i := 0; i < maxAETitleSources; i++ {
+		tracker.attempt("10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256), "PACS", "SCU", true, "1")
+	}
+	// The source idle for the longest time makes room.
+	tracker.mu.Lock()
+	tracker.sources["10.0.0.5"].lastSeen = time.Time{}
+	tracker.mu.Unlock()
+	tracker.attempt("192.0.2.7", "PACS", "SCU", true, "1")
+	if len(tracker.sources) != maxAETitleSources {
+		t.Errorf("len(sources) = %d, want %d", len(tracker.sources), maxAETitleSources)
+	}
+	if _, ok := tracker.sources["10.0.0.5"]; ok {
+		t.Errorf("oldest source not evicted")
+	}
+}
@@ -0,0 +1,275 @@
+package dicompot
+
+// This file implements the protocol anomaly detector. It looks at the raw
+// PDUs and at the DIMSE messages of provider associations and reports traffic
+// that real DICOM implementations don't send: scanners, fuzzers and exploits
+// tend to stand out this way even when the association fails.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/pdu"
+	"github.com/sirupsen/logrus"
+)
+
+// AnomalyRule identifies a kind of protocol anomaly. The IDs are stable, they
+// may be used in alerting rules.
+type AnomalyRule struct {
+	ID          string
+	Description string
+}
+
+// Anomaly rules.
+var (
+	AnomalyPDULength          = AnomalyRule{"DP-1001", "PDU length does not match its contents"}
+	AnomalyPDUOversized       = AnomalyRule{"DP-1002", "PDU length above the negotiated maximum"}
+	AnomalyUnknownPDUType     = AnomalyRule{"DP-1003", "Unknown PDU type"}
+	AnomalyItemOrder          = AnomalyRule{"DP-2001", "Non-standard item ordering in A-ASSOCIATE"}
+	AnomalyApplicationContext = AnomalyRule{"DP-2002", "Missing or wrong application context name"}
+	AnomalyContextID          = AnomalyRule{"DP-2003", "Invalid presentation context ID"}
+	AnomalyAETitle            = AnomalyRule{"DP-2004", "Non-ASCII or overlong AE title"}
+	AnomalyMixedContext       = AnomalyRule{"DP-3001", "P-DATA fragments of one message use different contexts"}
+	AnomalyDuplicateLast      = AnomalyRule{"DP-3002", "Last bit set more than once in one message"}
+	AnomalyCommandField       = AnomalyRule{"DP-3003", "Unknown DIMSE command field"}
+)
+
+// anomalyDetector reports the anomalies of one association. A nil
+// *anomalyDetector reports nothing. Every rule is reported once per
+// association.
+type anomalyDetector struct {
+	label string
+	ip    string
+
+	mu       sync.Mutex
+	reported map[string]bool
+}
+
+func newAnomalyDetector(label string, ip string) *anomalyDetector {
+	return &anomalyDetector{label: label, ip: ip, reported: make(map[string]bool)}
+}
+
+func (ad *anomalyDetector) report(rule AnomalyRule, format string, args ...interface{}) {
+	if ad == nil {
+		return
+	}
+	ad.mu.Lock()
+	seen := ad.reported[rule.ID]
+	ad.reported[rule.ID] = true
+	ad.mu.Unlock()
+	if seen {
+		return
+	}
+	observeAnomaly(rule.ID)
+	logrus.WithFields(logrus.Fields{
+		"Rule":        rule.ID,
+		"Description": rule.Description,
+		"Detail":      fmt.Sprintf(format, args...),
+		"IP":          ad.ip,
+		"ID":          ad.label,
+	}).Warn("Anomaly")
+}
+
+// Inspect the header of a PDU, before its payload is read. maxPDUSize is the
+// size we announced to the peer; ReadPDU refuses twice that.
+func (ad *anomalyDetector) inspectPDUHeader(pduType pdu.Type, length uint32, maxPDUSize int) {
+	if ad == nil {
+		return
+	}
+	switch pduType {
+	case pdu.TypeAAssociateRq, pdu.TypeAAssociateAc, pdu.TypeAAssociateRj, pdu.TypePDataTf,
+		pdu.TypeAReleaseRq, pdu.TypeAReleaseRp, pdu.TypeAAbort:
+	default:
+		ad.report(AnomalyUnknownPDUType, "type 0x%02x", byte(pduType))
+	}
+	if pduType == pdu.TypePDataTf && length > uint32(maxPDUSize) {
+		ad.report(AnomalyPDUOversized, "P-DATA-TF of %d bytes, max %d", length, maxPDUSize)
+	} else if length >= uint32(maxPDUSize)*2 {
+		ad.report(AnomalyPDUOversized, "PDU 0x%02x of %d bytes", byte(pduType), length)
+	}
+	switch pduType {
+	case pdu.TypeAAssociateRj, pdu.TypeAReleaseRq, pdu.TypeAReleaseRp, pdu.TypeAAbort:
+		if length != 4 {
+			ad.report(AnomalyPDULength, "PDU 0x%02x of %d bytes, expected 4", byte(pduType), length)
+		}
+	}
+}
+
+// Inspect the payload of a PDU, before it is decoded.
+func (ad *anomalyDetector) inspectPDU(pduType pdu.Type, payload []byte) {
+	if ad == nil {
+		return
+	}
+	switch pduType {
+	case pdu.TypeAAssociateRq, pdu.TypeAAssociateAc:
+		ad.inspectAAssociate(pduType, payload)
+	case pdu.TypePDataTf:
+		for pos := 0; pos < len(payload); {
+			if len(payload)-pos < 6 {
+				ad.report(AnomalyPDULength, "P-DATA-TF has %d trailing bytes", len(payload)-pos)
+				return
+			}
+			length := binary.BigEndian.Uint32(payload[pos:])
+			if length < 2 || uint64(length) > uint64(len(payload)-pos-4) {
+				ad.report(AnomalyPDULength, "presentation data value of %d bytes at offset %d, %d left", length, pos, len(payload)-pos-4)
+				return
+			}
+			pos += 4 + int(length)
+		}
+	}
+}
+
+// Standard AE titles are printable ASCII without backslashes, padded with
+// spaces.
+func (ad *anomalyDetector) inspectAETitle(name string, field []byte) {
+	for _, c := range strings.TrimRight(string(field), "\x00") {
+		if c < 0x20 || c > 0x7e || c == '\\' {
+			ad.report(AnomalyAETitle, "%s AE title %q", name, field)
+			return
+		}
+	}
+}
+
+// A-ASSOCIATE-RQ and -AC: P3.8 9.3.2 and 9.3.3.
+func (ad *anomalyDetector) inspectAAssociate(pduType pdu.Type, payload []byte) {
+	if len(payload) < 68 {
+		ad.report(AnomalyPDULength, "PDU 0x%02x of %d bytes", byte(pduType), len(payload))
+		return
+	}
+	ad.inspectAETitle("Called", payload[4:20])
+	ad.inspectAETitle("Calling", payload[20:36])
+	for _, c := range payload[36:68] {
+		if c != 0 {
+			// A title longer than 16 bytes runs into the reserved field.
+			ad.report(AnomalyAETitle, "reserved field after the AE titles is not zero: %q", payload[20:68])
+			break
+		}
+	}
+
+	pcType := byte(pdu.ItemTypePresentationContextRequest)
+	if pduType == pdu.TypeAAssociateAc {
+		pcType = byte(pdu.ItemTypePresentationContextResponse)
+	}
+	var order []byte
+	contextIDs := make(map[byte]bool)
+	appContext := ""
+	for pos := 68; pos < len(payload); {
+		itemType, data, next, ok := nextAssociateItem(payload, pos)
+		if !ok {
+			ad.report(AnomalyPDULength, "item 0x%02x at offset %d overflows the PDU", payload[pos], pos)
+			return
+		}
+		pos = next
+		order = append(order, itemType)
+		switch itemType {
+		case byte(pdu.ItemTypeApplicationContext):
+			appContext = strings.TrimRight(string(data), "\x00 ")
+		case pcType:
+			if len(data) < 4 {
+				ad.report(AnomalyPDULength, "presentation context item of %d bytes", len(data))
+				continue
+			}
+			id := data[0]
+			if id%2 != 1 {
+				ad.report(AnomalyContextID, "even presentation context ID %d", id)
+			} else if contextIDs[id] {
+				ad.report(AnomalyContextID, "duplicate presentation context ID %d", id)
+			}
+			contextIDs[id] = true
+			ad.inspectSubItems(data[4:], fmt.Sprintf("presentation context %d", id),
+				func(i int, t byte) bool {
+					if pduType == pdu.TypeAAssociateRq && i == 0 {
+						// The abstract syntax comes first.
+						return t == byte(pdu.ItemTypeAbstractSyntax)
+					}
+					return t == byte(pdu.ItemTypeTransferSyntax)
+				})
+		case byte(pdu.ItemTypeUserInformation):
+			ad.inspectSubItems(data, "user information", func(i int, t byte) bool {
+				// The maximum length comes first.
+				return i != 0 || t == byte(pdu.ItemTypeUserInformationMaximumLength)
+			})
+		}
+	}
+
+	// One application context, the presentation contexts, then the user
+	// information.
+	prev := -1
+	for _, t := range order {
+		rank := 3
+		switch t {
+		case byte(pdu.ItemTypeApplicationContext):
+			rank = 0
+		case pcType:
+			rank = 1
+		case byte(pdu.ItemTypeUserInformation):
+			rank = 2
+		}
+		if rank == 3 || rank < prev || (rank == prev && rank != 1) {
+			ad.report(AnomalyItemOrder, "PDU 0x%02x items: % x", byte(pduType), order)
+			break
+		}
+		prev = rank
+	}
+	if appContext == "" {
+		ad.report(AnomalyApplicationContext, "no application context item")
+	} else if appContext != pdu.DICOMApplicationContextItemName {
+		ad.report(AnomalyApplicationContext, "application context %q", appContext)
+	}
+}
+
+// Check the sub-items in "data". valid reports whether the i-th sub-item may
+// be of type t.
+func (ad *anomalyDetector) inspectSubItems(data []byte, name string, valid func(i int, t byte) bool) {
+	var order []byte
+	for pos, i := 0, 0; pos < len(data); i++ {
+		t, _, next, ok := nextAssociateItem(data, pos)
+		if !ok {
+			ad.report(AnomalyPDULength, "%s: sub-item 0x%02x at offset %d overflows the item", name, data[pos], pos)
+			return
+		}
+		pos = next
+		order = append(order, t)
+		if !valid(i, t) {
+			ad.report(AnomalyItemOrder, "%s sub-items: % x", name, order)
+		}
+	}
+}
+
+// Split the item at data[pos:]: one byte type, one reserved, two bytes length.
+func nextAssociateItem(data []byte, pos int) (itemType byte, value []byte, next int, ok bool) {
+	if len(data)-pos < 4 {
+		return data[pos], nil, 0, false
+	}
+	length := int(binary.BigEndian.Uint16(data[pos+2:]))
+	if length > len(data)-pos-4 {
+		return data[pos], nil, 0, false
+	}
+	return data[pos], data[pos+4 : pos+4+length], pos + 4 + length, true
+}
+
+// Inspect a P-DATA-TF PDU against the negotiated contexts, and the error the
+// CommandAssembler returned for it, if any.
+func (ad *anomalyDetector) inspectPData(cm *contextManager, v *pdu.PDataTf, err error) {
+	if ad == nil {
+		return
+	}
+	for _, item := range v.Items {
+		if _, ok := cm.contextIDToAbstractSyntaxNameMap[item.ContextID]; !ok {
+			ad.report(AnomalyContextID, "P-DATA-TF for unknown presentation context ID %d", item.ContextID)
+		}
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, dimse.ErrMixedContext):
+		ad.report(AnomalyMixedContext, "%v", err)
+	case errors.Is(err, dimse.ErrDuplicateLast):
+		ad.report(AnomalyDuplicateLast, "%v", err)
+	case errors.Is(err, dimse.ErrUnknownCommand):
+		ad.report(AnomalyCommandField, "%v", err)
+	}
+}
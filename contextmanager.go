@@ -33,6 +33,19 @@ type contextManager struct {
 	peerImplementationClassUID string
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
+	// AE titles from the A-ASSOCIATE-RQ pdu, with padding removed.
+	callingAETitle string
+	calledAETitle  string
+
+	// Delays for this association, nil unless it is in the tarpit.
+	tarpit *tarpitSession
+	// Fingerprint of the A-ASSOCIATE-RQ pdu. Provider side only.
+	fingerprint ClientFingerprint
+	// Accepted by the LurePolicy despite a wrong called AE title.
+	postBruteForce bool
+	// The AccessPolicy rule of the calling AE title. Nil if every service
+	// is allowed.
+	access *AccessRule
 
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
@@ -57,9 +70,10 @@ func newContextManager(label string) *contextManager {
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
 // maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
-// receive. maxPDUSize is encoded in one of the items.
+// receive. maxPDUSize is encoded in one of the items. A role selection item
+// proposing the SCP role is added for each of scpRoleUIDs.
 func (m *contextManager) generateAssociateRequest(
-	sopClassUIDs []string, transferSyntaxUIDs []string) []pdu.SubItem {
+	sopClassUIDs []string, transferSyntaxUIDs []string, scpRoleUIDs []string) []pdu.SubItem {
 	items := []pdu.SubItem{
 		&pdu.ApplicationContextItem{
 			Name: pdu.DICOMApplicationContextItemName,
@@ -82,12 +96,15 @@ func (m *contextManager) generateAssociateRequest(
 		m.tmpRequests[contextID] = item
 		contextID += 2 // must be odd.
 	}
-	items = append(items,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{
-				&pdu.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
-				&pdu.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
-				&pdu.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}})
+	userItems := []pdu.SubItem{
+		&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)},
+		&pdu.ImplementationClassUIDSubItem{Name: dicom.GoDICOMImplementationClassUID},
+	}
+	for _, sop := range scpRoleUIDs {
+		userItems = append(userItems, &pdu.RoleSelectionSubItem{SOPClassUID: sop, SCURole: 0, SCPRole: 1})
+	}
+	userItems = append(userItems, &pdu.ImplementationVersionNameSubItem{Name: dicom.GoDICOMImplementationVersionName})
+	items = append(items, &pdu.UserInformationItem{Items: userItems})
 
 	return items
 }
@@ -132,7 +149,9 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 				ContextID: ri.ContextID,
 				Result:    0, // accepted
 				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted)
+			if err := addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted); err != nil {
+				return nil, err
+			}
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -198,7 +217,9 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 			if sopUID == "" {
 				return fmt.Errorf("dicom.onAssociateResponse(%s): The A-ASSOCIATE request lacks the abstract syntax item for tag %v (this shouldn't happen)", m.label, ri.ContextID)
 			}
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, ri.Result)
+			if err := addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, ri.Result); err != nil {
+				return err
+			}
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -216,19 +237,24 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 	return nil
 }
 
-// Add a mapping between a (global) UID and a (per-session) context ID.
+// Add a mapping between a (global) UID and a (per-session) context ID. The
+// values come from the peer: invalid ones are reported as an error, for the
+// caller to abort or reject the association.
 func addContextMapping(
 	m *contextManager,
 	abstractSyntaxUID string,
 	transferSyntaxUID string,
 	contextID byte,
-	result pdu.PresentationContextResult) {
+	result pdu.PresentationContextResult) error {
 
-	doassert(result <= 4, result)
-	doassert(contextID%2 == 1, contextID)
-	if result == 0 {
-		doassert(abstractSyntaxUID != "", abstractSyntaxUID)
-		doassert(transferSyntaxUID != "", transferSyntaxUID)
+	if result > pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported {
+		return fmt.Errorf("dicom.addContextMapping(%s): Invalid result %d for context ID %d", m.label, result, contextID)
+	}
+	if contextID%2 != 1 {
+		return fmt.Errorf("dicom.addContextMapping(%s): Context ID %d is not odd", m.label, contextID)
+	}
+	if result == pdu.PresentationContextAccepted && (abstractSyntaxUID == "" || transferSyntaxUID == "") {
+		return fmt.Errorf("dicom.addContextMapping(%s): Empty abstract or transfer syntax for accepted context ID %d", m.label, contextID)
 	}
 	e := &contextManagerEntry{
 		abstractSyntaxUID: abstractSyntaxUID,
@@ -238,6 +264,7 @@ func addContextMapping(
 	}
 	m.contextIDToAbstractSyntaxNameMap[contextID] = e
 	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = e
+	return nil
 }
 
 func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
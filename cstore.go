@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/grailbio/go-dicom"
-	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/nsmfoo/dicompot/dimse"
 )
@@ -38,39 +37,73 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 	if err != nil {
 		return err
 	}
-	bodyEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
-	for _, elem := range ds.Elements {
-		if elem.Tag.Group == dicomtag.MetadataGroup {
-			continue
-		}
-		dicom.WriteElement(bodyEncoder, elem)
+	data, err := encodeDataSet(ds, context.transferSyntaxUID)
+	if err != nil {
+		return err
 	}
-	if err := bodyEncoder.Error(); err != nil {
+	return sendCStore(upcallCh, downcallCh, cm, messageID, instancePayload{
+		sopClassUID:    sopClassUID,
+		sopInstanceUID: sopInstanceUID,
+		data:           data,
+		size:           int64(len(data)),
+	})
+}
+
+// Ditto, but send the file at "path", from the cache if it has the file.
+func runCStoreFileOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
+	cm *contextManager,
+	messageID dimse.MessageID,
+	cache *PayloadCache,
+	path string) error {
+	payload, err := cache.load(path, func(sopClassUID string) (string, error) {
+		context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
+		if err != nil {
+			return "", err
+		}
+		return context.transferSyntaxUID, nil
+	})
+	if err != nil {
 		return err
 	}
-	downcallCh <- stateEvent{
-		event: evt09,
-		dimsePayload: &stateEventDIMSEPayload{
-			abstractSyntaxName: sopClassUID,
-			command: &dimse.CStoreRq{
-				AffectedSOPClassUID:    sopClassUID,
-				MessageID:              messageID,
-				CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
-				AffectedSOPInstanceUID: sopInstanceUID,
-			},
-			data: bodyEncoder.Bytes(),
+	if payload.file != nil {
+		defer payload.file.Close()
+	}
+	return sendCStore(upcallCh, downcallCh, cm, messageID, payload)
+}
+
+func sendCStore(upcallCh chan upcallEvent, downcallCh chan stateEvent,
+	cm *contextManager,
+	messageID dimse.MessageID,
+	payload instancePayload) error {
+	dimsePayload := &stateEventDIMSEPayload{
+		abstractSyntaxName: payload.sopClassUID,
+		command: &dimse.CStoreRq{
+			AffectedSOPClassUID:    payload.sopClassUID,
+			MessageID:              messageID,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: payload.sopInstanceUID,
 		},
+		data: payload.data,
+	}
+	if payload.data == nil {
+		dimsePayload.dataReader = payload.reader
+		dimsePayload.dataSize = payload.size
+	}
+	downcallCh <- stateEvent{
+		event:        evt09,
+		dimsePayload: dimsePayload,
 	}
 	for {
 		event, ok := <-upcallCh
 		if !ok {
 			return fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
 		}
+		event.data.Close()
 
-		doassert(event.eventType == upcallEventData)
-		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CStoreRsp)
-		doassert(ok)
+		if !ok {
+			return fmt.Errorf("dicom.cstore(%s): Found wrong response for C-STORE: %v", cm.label, event.command)
+		}
 		if resp.Status.Status != 0 {
 			return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
 		}
@@ -0,0 +1,196 @@
+package dimse
+
+// This file implements the data payloads assembled by CommandAssembler: held
+// in memory, or spilled to a temp file past a threshold, and charged to byte
+// budgets until they are closed.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrBudgetExceeded is returned by AddDataPDU when the bytes received go past
+// a ByteBudget.
+var ErrBudgetExceeded = errors.New("DIMSE byte budget exceeded")
+
+// ByteBudget bounds the bytes held by CommandAssemblers and by the Data they
+// returned, until closed. A budget with a parent is charged to the parent
+// too, e.g. the budget of an association to the budget of the process. It is
+// safe for concurrent use.
+type ByteBudget struct {
+	name   string
+	limit  int64 // Zero means no limit.
+	parent *ByteBudget
+
+	mu     sync.Mutex
+	used   int64
+	closed bool
+}
+
+// NewByteBudget creates a budget of "limit" bytes, zero meaning no limit.
+// "name" tells the budget apart in errors.
+func NewByteBudget(name string, limit int64, parent *ByteBudget) *ByteBudget {
+	return &ByteBudget{name: name, limit: limit, parent: parent}
+}
+
+// Used returns the bytes held.
+func (b *ByteBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *ByteBudget) acquire(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if b.limit > 0 && b.used+n > b.limit {
+		b.mu.Unlock()
+		return fmt.Errorf("%w: %s budget of %d bytes", ErrBudgetExceeded, b.name, b.limit)
+	}
+	b.used += n
+	charged := !b.closed
+	b.mu.Unlock()
+	if !charged {
+		return nil
+	}
+	if err := b.parent.acquire(n); err != nil {
+		b.mu.Lock()
+		b.used -= n
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (b *ByteBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	charged := !b.closed
+	b.mu.Unlock()
+	if charged {
+		b.parent.release(n)
+	}
+}
+
+// Close gives the bytes still held back to the parent: the Data not closed
+// yet is no longer charged to it. Closing a budget without a parent has no
+// effect.
+func (b *ByteBudget) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	used := b.used
+	wasClosed := b.closed
+	b.closed = true
+	b.mu.Unlock()
+	if !wasClosed {
+		b.parent.release(used)
+	}
+}
+
+// Data is the data payload of a DIMSE message. It must be closed once read,
+// to remove the temp file and give the bytes back to the budget. A nil *Data
+// is an empty payload.
+type Data struct {
+	data   []byte   // Set if held in memory.
+	file   *os.File // Else, the temp file holding the payload.
+	size   int64
+	budget *ByteBudget
+}
+
+// NewData wraps a payload held in memory.
+func NewData(data []byte) *Data {
+	return &Data{data: data, size: int64(len(data))}
+}
+
+// Size returns the length of the payload.
+func (d *Data) Size() int64 {
+	if d == nil {
+		return 0
+	}
+	return d.size
+}
+
+// Spilled reports whether the payload is in a temp file.
+func (d *Data) Spilled() bool {
+	return d != nil && d.file != nil
+}
+
+// Reader returns a reader of the payload, from the start.
+func (d *Data) Reader() io.Reader {
+	if d == nil {
+		return bytes.NewReader(nil)
+	}
+	if d.file != nil {
+		return io.NewSectionReader(d.file, 0, d.size)
+	}
+	return bytes.NewReader(d.data)
+}
+
+// Bytes returns the payload, read into memory if it was spilled.
+func (d *Data) Bytes() ([]byte, error) {
+	if d == nil {
+		return nil, nil
+	}
+	if d.file == nil {
+		return d.data, nil
+	}
+	b := make([]byte, d.size)
+	if _, err := d.file.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close removes the temp file and gives the bytes back to the budget.
+func (d *Data) Close() error {
+	if d == nil {
+		return nil
+	}
+	var err error
+	if d.file != nil {
+		err = d.file.Close()
+		os.Remove(d.file.Name())
+		d.file = nil
+	}
+	d.data = nil
+	d.budget.release(d.size)
+	d.budget, d.size = nil, 0
+	return err
+}
+
+// Append "b" to the payload, moving it to a temp file in "dir" once it is
+// larger than "threshold" (if positive).
+func (d *Data) write(b []byte, threshold int64, dir string) error {
+	if d.file == nil && threshold > 0 && d.size+int64(len(b)) > threshold {
+		f, err := os.CreateTemp(dir, "dimse-data-*")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(d.data); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		d.file, d.data = f, nil
+	}
+	if d.file != nil {
+		if _, err := d.file.Write(b); err != nil {
+			return err
+		}
+	} else {
+		d.data = append(d.data, b...)
+	}
+	d.size += int64(len(b))
+	return nil
+}
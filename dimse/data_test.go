@@ -0,0 +1,258 @@
+package dimse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+func TestByteBudget(t *testing.T) {
+	type op struct {
+		budget  string // "child" or "parent"
+		acquire int64  // Released if negative
+		wantErr bool
+	}
+	tests := []struct {
+		name        string
+		childLimit  int64
+		parentLimit int64
+		ops         []op
+		child       int64 // Used afterwards
+		parent      int64
+	}{
+		{"unlimited", 0, 0, []op{
+			{"child", 1 << 40, false},
+		}, 1 << 40, 1 << 40},
+		{"child limit", 100, 0, []op{
+			{"child", 60, false},
+			{"child", 41, true},
+			{"child", 40, false},
+		}, 100, 100},
+		{"parent limit", 100, 100, []op{
+			{"parent", 50, false},
+			{"child", 60, true},
+			{"child", 50, false},
+		}, 50, 100},
+		{"release", 100, 100, []op{
+			{"child", 100, false},
+			{"child", -30, false},
+			{"parent", 30, false},
+			{"child", 1, true},
+		}, 70, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent := NewByteBudget("process", test.parentLimit, nil)
+			child := NewByteBudget("association", test.childLimit, parent)
+			for i, op := range test.ops {
+				b := child
+				if op.budget == "parent" {
+					b = parent
+				}
+				if op.acquire < 0 {
+					b.release(-op.acquire)
+					continue
+				}
+				err := b.acquire(op.acquire)
+				if (err != nil) != op.wantErr {
+					t.Errorf("op %d: %s.acquire(%d) = %v, want error %v", i, op.budget, op.acquire, err, op.wantErr)
+				}
+				if err != nil && !errors.Is(err, ErrBudgetExceeded) {
+					t.Errorf("op %d: error %v is not ErrBudgetExceeded", i, err)
+				}
+			}
+			if child.Used() != test.child || parent.Used() != test.parent {
+				t.Errorf("used = %d, %d, want %d, %d", child.Used(), parent.Used(), test.child, test.parent)
+			}
+		})
+	}
+}
+
+func TestByteBudgetClose(t *testing.T) {
+	parent := NewByteBudget("process", 100, nil)
+	child := NewByteBudget("association", 0, parent)
+	if err := child.acquire(60); err != nil {
+		t.Fatal(err)
+	}
+	child.Close()
+	if parent.Used() != 0 {
+		t.Errorf("parent used = %d after Close, want 0", parent.Used())
+	}
+	// The bytes still held are no longer charged to the parent.
+	child.release(60)
+	child.Close()
+	if parent.Used() != 0 || child.Used() != 0 {
+		t.Errorf("used = %d, %d after release, want 0, 0", child.Used(), parent.Used())
+	}
+	if err := child.acquire(200); err != nil {
+		t.Errorf("acquire after Close = %v, want nil", err)
+	}
+	if parent.Used() != 0 {
+		t.Errorf("parent charged after Close")
+	}
+	var nilBudget *ByteBudget
+	if err := nilBudget.acquire(1 << 40); err != nil {
+		t.Errorf("nil budget acquire = %v", err)
+	}
+	nilBudget.release(1)
+	nilBudget.Close()
+}
+
+// The P_DATA_TF PDUs of "msg" and its payload, "fragment" bytes per data
+// fragment.
+func messagePDUs(t *testing.T, contextID byte, msg Message, payload []byte, fragment int) []*pdu.PDataTf {
+	pdus := []*pdu.PDataTf{{Items: []pdu.PresentationDataValueItem{
+		{ContextID: contextID, Command: true, Last: true, Value: encodeMessage(t, msg)},
+	}}}
+	for len(payload) > 0 {
+		n := fragment
+		if n > len(payload) {
+			n = len(payload)
+		}
+		pdus = append(pdus, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+			{ContextID: contextID, Last: n == len(payload), Value: payload[:n]},
+		}})
+		payload = payload[n:]
+	}
+	return pdus
+}
+
+func TestCommandAssembler(t *testing.T) {
+	echo := &CEchoRq{MessageID: 1, CommandDataSetType: CommandDataSetTypeNull}
+	store := &CStoreRq{AffectedSOPClassUID: "1.2.840.10008.5.1.4.1.1.7", MessageID: 3,
+		CommandDataSetType: CommandDataSetTypeNonNull, AffectedSOPInstanceUID: "1.2.3.4.8"}
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	tests := []struct {
+		name      string
+		msg       Message
+		payload   []byte
+		threshold int64
+		limit     int64
+		spilled   bool
+		err       error
+	}{
+		{"no data", echo, nil, 0, 0, false, nil},
+		{"in memory", store, payload, 0, 0, false, nil},
+		{"under the threshold", store, payload, int64(len(payload)), 0, false, nil},
+		{"spilled", store, payload, 100, 0, true, nil},
+		{"within the budget", store, payload, 0, 2 * int64(len(payload)), false, nil},
+		{"over the budget", store, payload, 0, int64(len(payload)), false, ErrBudgetExceeded},
+		{"spilled over the budget", store, payload, 100, int64(len(payload)), false, ErrBudgetExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			budget := NewByteBudget("association", test.limit, nil)
+			a := &CommandAssembler{SpillThreshold: test.threshold, SpillDir: dir, Budget: budget}
+			var (
+				contextID byte
+				msg       Message
+				data      *Data
+				err       error
+			)
+			for _, p := range messagePDUs(t, 3, test.msg, test.payload, 100) {
+				contextID, msg, data, err = a.AddDataPDU(p)
+				if err != nil {
+					break
+				}
+			}
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("AddDataPDU error = %v, want %v", err, test.err)
+				}
+				a.Discard()
+				if budget.Used() != 0 {
+					t.Errorf("budget used = %d after Discard, want 0", budget.Used())
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("%d temp files left after Discard", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contextID != 3 || msg == nil || msg.CommandField() != test.msg.CommandField() {
+				t.Fatalf("AddDataPDU = %d, %v", contextID, msg)
+			}
+			if data.Size() != int64(len(test.payload)) || data.Spilled() != test.spilled {
+				t.Errorf("data of %d bytes, spilled %v, want %d, %v", data.Size(), data.Spilled(), len(test.payload), test.spilled)
+			}
+			if entries, _ := os.ReadDir(dir); (len(entries) == 1) != test.spilled {
+				t.Errorf("%d temp files, spilled %v", len(entries), test.spilled)
+			}
+			if got, _ := io.ReadAll(data.Reader()); !bytes.Equal(got, test.payload) {
+				t.Errorf("Reader() returned %d bytes, want the %d bytes sent", len(got), len(test.payload))
+			}
+			if got, _ := data.Bytes(); !bytes.Equal(got, test.payload) {
+				t.Errorf("Bytes() returned %d bytes, want the %d bytes sent", len(got), len(test.payload))
+			}
+			if budget.Used() != data.Size() {
+				t.Errorf("budget used = %d while the data is held, want %d", budget.Used(), data.Size())
+			}
+			if err := data.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+			if budget.Used() != 0 {
+				t.Errorf("budget used = %d after Close, want 0", budget.Used())
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("%d temp files left after Close", len(entries))
+			}
+		})
+	}
+}
+
+func TestCommandAssemblerErrors(t *testing.T) {
+	echo := encodeMessage(t, &CEchoRq{MessageID: 1, CommandDataSetType: CommandDataSetTypeNonNull})
+	tests := []struct {
+		name  string
+		items []pdu.PresentationDataValueItem
+		err   error
+	}{
+		{"mixed contexts", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Value: echo[:10]},
+			{ContextID: 3, Command: true, Last: true, Value: echo[10:]},
+		}, ErrMixedContext},
+		{"duplicate last command", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: echo},
+			{ContextID: 1, Command: true, Last: true, Value: echo},
+		}, ErrDuplicateLast},
+		{"duplicate last data", []pdu.PresentationDataValueItem{
+			{ContextID: 1, Last: true, Value: []byte{1}},
+			{ContextID: 1, Last: true, Value: []byte{2}},
+		}, ErrDuplicateLast},
+	}
+	for _, test := range tests {
+		budget := NewByteBudget("association", 0, nil)
+		a := &CommandAssembler{Budget: budget}
+		_, _, _, err := a.AddDataPDU(&pdu.PDataTf{Items: test.items})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: AddDataPDU error = %v, want %v", test.name, err, test.err)
+		}
+		a.Discard()
+		if budget.Used() != 0 {
+			t.Errorf("%s: budget used = %d after Discard, want 0", test.name, budget.Used())
+		}
+	}
+}
+
+func TestDataNil(t *testing.T) {
+	var d *Data
+	if d.Size() != 0 || d.Spilled() {
+		t.Errorf("nil Data has size %d, spilled %v", d.Size(), d.Spilled())
+	}
+	if b, err := d.Bytes(); b != nil || err != nil {
+		t.Errorf("nil Data Bytes() = %v, %v", b, err)
+	}
+	if got, _ := io.ReadAll(d.Reader()); len(got) != 0 {
+		t.Errorf("nil Data Reader() returned %d bytes", len(got))
+	}
+	if err := d.Close(); err != nil {
+		t.Errorf("nil Data Close() = %v", err)
+	}
+}
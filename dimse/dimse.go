@@ -4,9 +4,14 @@ package dimse
 //
 // http://dicom.nema.org/medical/dicom/current/output/pdf/part07.pdf
 
+//go:generate sh -c "python3 generate_dimse_messages.py | gofmt > dimse_messages.go"
+
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
 
 	dicom "github.com/grailbio/go-dicom"
@@ -40,6 +45,13 @@ type Status struct {
 	ErrorComment string // Encoded as (0000,0902)
 }
 
+// Errors for malformed DIMSE traffic, wrapped with the details.
+var (
+	ErrUnknownCommand = errors.New("Unknown DIMSE command")
+	ErrMixedContext   = errors.New("Mixed context")
+	ErrDuplicateLast  = errors.New("P_DATA_TF: found >1 chunks with the Last bit set")
+)
+
 // Helper class for extracting values from a list of DicomElement.
 type messageDecoder struct {
 	elems  []*dicom.Element
@@ -117,16 +129,53 @@ func (d *messageDecoder) getUInt16(tag dicomtag.Tag, optional isOptionalElement)
 	return v
 }
 
+// Find an element with "tag", and extract a list of tags from it. Used for
+// AT-typed fields such as AttributeIdentifierList. Errors are reported in d.err.
+func (d *messageDecoder) getTags(tag dicomtag.Tag, optional isOptionalElement) []dicomtag.Tag {
+	e := d.findElement(tag, optional)
+	if e == nil {
+		return nil
+	}
+	tags := make([]dicomtag.Tag, 0, len(e.Value))
+	for _, v := range e.Value {
+		t, ok := v.(dicomtag.Tag)
+		if !ok {
+			d.setError(fmt.Errorf("dimse.getTags: Element %s has non-tag value %v", dicomtag.DebugString(tag), v))
+			return nil
+		}
+		tags = append(tags, t)
+	}
+	return tags
+}
+
 // Encode the given elements. The elements are sorted in ascending tag order.
 func encodeElements(e *dicomio.Encoder, elems []*dicom.Element) {
 	sort.Slice(elems, func(i, j int) bool {
 		return elems[i].Tag.Compare(elems[j].Tag) < 0
 	})
 	for _, elem := range elems {
+		if elem.VR == "AT" {
+			writeTagListElement(e, elem)
+			continue
+		}
 		dicom.WriteElement(e, elem)
 	}
 }
 
+// go-dicom cannot serialize AT values, so tag lists are written by hand. DIMSE
+// commands are always implicit VR little endian, so the layout is
+// <tag><uint32 length><group,element>...
+func writeTagListElement(e *dicomio.Encoder, elem *dicom.Element) {
+	e.WriteUInt16(elem.Tag.Group)
+	e.WriteUInt16(elem.Tag.Element)
+	e.WriteUInt32(uint32(len(elem.Value) * 4))
+	for _, v := range elem.Value {
+		t := v.(dicomtag.Tag)
+		e.WriteUInt16(t.Group)
+		e.WriteUInt16(t.Element)
+	}
+}
+
 // Create a list of elements that represent the dimse status. The list contains
 // multiple elements for non-ok status.
 func newStatusElements(s Status) []*dicom.Element {
@@ -147,6 +196,20 @@ func newElement(tag dicomtag.Tag, v interface{}) *dicom.Element {
 	}
 }
 
+// Create a new AT element holding the given list of tags.
+func newTagListElement(tag dicomtag.Tag, tags ...dicomtag.Tag) *dicom.Element {
+	values := make([]interface{}, len(tags))
+	for i, t := range tags {
+		values[i] = t
+	}
+	return &dicom.Element{
+		Tag:             tag,
+		VR:              "AT",
+		UndefinedLength: false,
+		Value:           values,
+	}
+}
+
 // CommandDataSetTypeNull indicates that the DIMSE message has no data payload,
 // when set in dicom.TagCommandDataSetType. Any other value indicates the
 // existence of a payload.
@@ -187,6 +250,22 @@ const (
 	CMoveMoveDestinationUnknown                         StatusCode = 0xa801
 	CMoveDataSetDoesNotMatchSOPClass                    StatusCode = 0xa900
 
+	// DIMSE-N status codes. P3.7 C.
+	StatusNoSuchAttribute       StatusCode = 0x0105
+	StatusProcessingFailure     StatusCode = 0x0110
+	StatusDuplicateSOPInstance  StatusCode = 0x0111
+	StatusNoSuchEventType       StatusCode = 0x0113
+	StatusNoSuchArgument        StatusCode = 0x0114
+	StatusNoSuchSOPClass        StatusCode = 0x0118
+	StatusClassInstanceConflict StatusCode = 0x0119
+	StatusMissingAttribute      StatusCode = 0x0120
+	StatusMissingAttributeValue StatusCode = 0x0121
+	StatusNoSuchActionType      StatusCode = 0x0123
+	StatusDuplicateInvocation   StatusCode = 0x0210
+	StatusMistypedArgument      StatusCode = 0x0212
+	StatusResourceLimitation    StatusCode = 0x0213
+	StatusNoSuchSOPInstance     StatusCode = 0x0112 // Same value as StatusSOPClassNotSupported.
+
 	// Warning codes.
 	StatusAttributeValueOutOfRange StatusCode = 0x0116
 	StatusAttributeListError       StatusCode = 0x0107
@@ -196,13 +275,32 @@ const (
 // dicom.Elements,
 func ReadMessage(d *dicomio.Decoder) Message {
 	// A DIMSE message is a sequence of Elements, encoded in implici
+	data, err := io.ReadAll(d)
+	if err != nil {
+		d.SetError(err)
+		return nil
+	}
+	v, err := decodeMessage(data)
+	if err != nil {
+		d.SetError(err)
+		return nil
+	}
+	return v
+}
+
+// Like ReadMessage, but the error is returned as is, so that the callers can
+// tell the ErrXxx values apart.
+func decodeMessage(data []byte) (Message, error) {
+	c := lengthChecker{r: bytes.NewReader(data), bo: binary.LittleEndian, implicit: dicomio.ImplicitVR}
+	if _, err := c.check(0, len(data), 0); err != nil {
+		return nil, fmt.Errorf("dimse.ReadMessage: %v", err)
+	}
 	var elems []*dicom.Element
-	d.PushTransferSyntax(binary.LittleEndian, dicomio.ImplicitVR)
-	defer d.PopTransferSyntax()
-	for !d.EOF() {
-		elem := dicom.ReadElement(d, dicom.ReadOptions{})
-		if d.Error() != nil {
-			break
+	ed := dicomio.NewBytesDecoder(data, binary.LittleEndian, dicomio.ImplicitVR)
+	for !ed.EOF() {
+		elem := dicom.ReadElement(ed, dicom.ReadOptions{})
+		if ed.Error() != nil {
+			return nil, ed.Error()
 		}
 		elems = append(elems, elem)
 	}
@@ -215,15 +313,13 @@ func ReadMessage(d *dicomio.Decoder) Message {
 	}
 	commandField := dd.getUInt16(dicomtag.CommandField, requiredElement)
 	if dd.err != nil {
-		d.SetError(dd.err)
-		return nil
+		return nil, dd.err
 	}
 	v := decodeMessageForType(&dd, commandField)
 	if dd.err != nil {
-		d.SetError(dd.err)
-		return nil
+		return nil, dd.err
 	}
-	return v
+	return v, nil
 }
 
 // EncodeMessage serializes the given message. Errors are reported through e.Error()
@@ -245,10 +341,19 @@ func EncodeMessage(e *dicomio.Encoder, v Message) {
 // CommandAssembler is a helper that assembles a DIMSE command message and data
 // payload from a sequence of P_DATA_TF PDUs.
 type CommandAssembler struct {
+	// Data payloads larger than SpillThreshold bytes are written to a temp
+	// file in SpillDir (os.TempDir() if empty) as they arrive. Zero keeps
+	// them in memory.
+	SpillThreshold int64
+	SpillDir       string
+	// Budget is charged for the fragments received, until the command is
+	// decoded and the Data returned is closed. Nil means no limit.
+	Budget *ByteBudget
+
 	contextID      byte
 	commandBytes   []byte
 	command        Message
-	dataBytes      []byte
+	data           *Data
 	readAllCommand bool
 
 	readAllData bool
@@ -256,27 +361,37 @@ type CommandAssembler struct {
 
 // AddDataPDU is to be called for each P_DATA_TF PDU received from the
 // network. If the fragment is marked as the last one, AddDataPDU returns
-// <SOPUID, TransferSyntaxUID, payload, nil>
-func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte, error) {
+// <SOPUID, TransferSyntaxUID, payload, nil>. The payload is nil if the
+// command has no data; the caller must close it otherwise.
+func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, *Data, error) {
 	for _, item := range pdu.Items {
 		if a.contextID == 0 {
 			a.contextID = item.ContextID
 		} else if a.contextID != item.ContextID {
-			return 0, nil, nil, fmt.Errorf("Mixed context: %d %d", a.contextID, item.ContextID)
+			return 0, nil, nil, fmt.Errorf("%w: %d %d", ErrMixedContext, a.contextID, item.ContextID)
+		}
+		if err := a.Budget.acquire(int64(len(item.Value))); err != nil {
+			return 0, nil, nil, err
 		}
 		if item.Command {
 			a.commandBytes = append(a.commandBytes, item.Value...)
 			if item.Last {
 				if a.readAllCommand {
-					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 command chunks with the Last bit set")
+					return 0, nil, nil, fmt.Errorf("%w (command)", ErrDuplicateLast)
 				}
 				a.readAllCommand = true
 			}
 		} else {
-			a.dataBytes = append(a.dataBytes, item.Value...)
+			if a.data == nil {
+				a.data = &Data{budget: a.Budget}
+			}
+			if err := a.data.write(item.Value, a.SpillThreshold, a.SpillDir); err != nil {
+				a.Budget.release(int64(len(item.Value)))
+				return 0, nil, nil, err
+			}
 			if item.Last {
 				if a.readAllData {
-					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 data chunks with the Last bit set")
+					return 0, nil, nil, fmt.Errorf("%w (data)", ErrDuplicateLast)
 				}
 				a.readAllData = true
 			}
@@ -286,20 +401,38 @@ func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte,
 		return 0, nil, nil, nil
 	}
 	if a.command == nil {
-		d := dicomio.NewBytesDecoder(a.commandBytes, nil, dicomio.UnknownVR)
-		a.command = ReadMessage(d)
-		if err := d.Finish(); err != nil {
+		command, err := decodeMessage(a.commandBytes)
+		if err != nil {
 			return 0, nil, nil, err
 		}
+		a.command = command
 	}
 	if a.command.HasData() && !a.readAllData {
 		return 0, nil, nil, nil
 	}
 	contextID := a.contextID
 	command := a.command
-	dataBytes := a.dataBytes
-	*a = CommandAssembler{}
-	return contextID, command, dataBytes, nil
+	data := a.data
+	a.data = nil
+	if !command.HasData() {
+		data.Close()
+		data = nil
+	}
+	a.Discard()
+	return contextID, command, data, nil
+}
+
+// Discard drops the fragments received so far, e.g. when the association
+// ends.
+func (a *CommandAssembler) Discard() {
+	a.Budget.release(int64(len(a.commandBytes)))
+	a.data.Close()
+	a.contextID = 0
+	a.commandBytes = nil
+	a.command = nil
+	a.data = nil
+	a.readAllCommand = false
+	a.readAllData = false
 }
 
 type MessageID = uint16
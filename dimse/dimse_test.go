@@ -0,0 +1,173 @@
+package dimse
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// Messages of a typical association, for the seed corpora.
+func seedMessages() []Message {
+	return []Message{
+		&CEchoRq{MessageID: 1, CommandDataSetType: CommandDataSetTypeNull},
+		&CEchoRsp{MessageIDBeingRespondedTo: 1, CommandDataSetType: CommandDataSetTypeNull, Status: Success},
+		&CFindRq{AffectedSOPClassUID: "1.2.840.10008.5.1.4.1.2.2.1", MessageID: 2, CommandDataSetType: CommandDataSetTypeNonNull},
+		&CStoreRq{AffectedSOPClassUID: "1.2.840.10008.5.1.4.1.1.7", MessageID: 3, CommandDataSetType: CommandDataSetTypeNonNull, AffectedSOPInstanceUID: "1.2.3.4.8"},
+		&CStoreRsp{AffectedSOPClassUID: "1.2.840.10008.5.1.4.1.1.7", MessageIDBeingRespondedTo: 3, CommandDataSetType: CommandDataSetTypeNull, AffectedSOPInstanceUID: "1.2.3.4.8",
+			Status: Status{Status: StatusProcessingFailure, ErrorComment: "failed"}},
+		&NActionRq{RequestedSOPClassUID: "1.2.840.10008.1.20.1", MessageID: 4, CommandDataSetType: CommandDataSetTypeNonNull, RequestedSOPInstanceUID: "1.2.840.10008.1.20.1.1", ActionTypeID: 1},
+	}
+}
+
+func encodeMessage(t testing.TB, v Message) []byte {
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
+	EncodeMessage(e, v)
+	if err := e.Error(); err != nil {
+		t.Fatalf("EncodeMessage(%v): %v", v, err)
+	}
+	return e.Bytes()
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for _, v := range seedMessages() {
+		f.Add(encodeMessage(f, v))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d := dicomio.NewBytesDecoder(b, binary.LittleEndian, dicomio.ImplicitVR)
+		v := ReadMessage(d)
+		if d.Error() != nil {
+			return
+		}
+		// What was read must be written back.
+		e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
+		EncodeMessage(e, v)
+		_ = v.String()
+	})
+}
+
+// The fuzz input of FuzzCommandAssembler is a sequence of fragments: a header
+// byte (bit 0: command, bit 1: last, bit 2: second context), a length byte,
+// then the value.
+func encodeFragments(items []pdu.PresentationDataValueItem) []byte {
+	var b []byte
+	for _, item := range items {
+		var header byte
+		if item.Command {
+			header |= 1
+		}
+		if item.Last {
+			header |= 2
+		}
+		if item.ContextID != 1 {
+			header |= 4
+		}
+		for len(item.Value) > 255 {
+			b = append(b, header&^2, 255)
+			b = append(b, item.Value[:255]...)
+			item.Value = item.Value[255:]
+		}
+		b = append(b, header, byte(len(item.Value)))
+		b = append(b, item.Value...)
+	}
+	return b
+}
+
+func decodeFragments(b []byte) []*pdu.PDataTf {
+	var pdus []*pdu.PDataTf
+	for len(b) >= 2 {
+		header, n := b[0], int(b[1])
+		b = b[2:]
+		if n > len(b) {
+			n = len(b)
+		}
+		item := pdu.PresentationDataValueItem{
+			ContextID: 1,
+			Command:   header&1 != 0,
+			Last:      header&2 != 0,
+			Value:     b[:n],
+		}
+		if header&4 != 0 {
+			item.ContextID = 3
+		}
+		b = b[n:]
+		pdus = append(pdus, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{item}})
+	}
+	return pdus
+}
+
+func FuzzCommandAssembler(f *testing.F) {
+	for _, v := range seedMessages() {
+		command := encodeMessage(f, v)
+		items := []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: command},
+		}
+		if v.HasData() {
+			items = append(items,
+				pdu.PresentationDataValueItem{ContextID: 1, Value: make([]byte, 100)},
+				pdu.PresentationDataValueItem{ContextID: 1, Last: true, Value: make([]byte, 40)})
+		}
+		f.Add(encodeFragments(items))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		budget := NewByteBudget("test", 4096, nil)
+		a := CommandAssembler{SpillThreshold: 64, SpillDir: t.TempDir(), Budget: budget}
+		for _, p := range decodeFragments(b) {
+			_, command, data, err := a.AddDataPDU(p)
+			if err != nil {
+				a.Discard()
+				break
+			}
+			if command == nil {
+				continue
+			}
+			if !command.HasData() && data != nil {
+				t.Fatalf("data returned for %v", command)
+			}
+			n, err := io.Copy(io.Discard, data.Reader())
+			if err != nil || n != data.Size() {
+				t.Fatalf("read %d of %d bytes: %v", n, data.Size(), err)
+			}
+			data.Close()
+		}
+		a.Discard()
+		if used := budget.Used(); used != 0 {
+			t.Fatalf("%d bytes still charged to the budget", used)
+		}
+	})
+}
+
+func TestCheckElementLengthsNesting(t *testing.T) {
+	header := func(group, element uint16, vl uint32) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint16(b, group)
+		binary.LittleEndian.PutUint16(b[2:], element)
+		binary.LittleEndian.PutUint32(b[4:], vl)
+		return b
+	}
+	nest := func(depth int, closed bool) []byte {
+		var b []byte
+		for i := 0; i < depth; i++ {
+			b = append(b, header(0x0008, 0x1199, 0xffffffff)...) // ReferencedSOPSequence
+			b = append(b, header(0xfffe, 0xe000, 0xffffffff)...) // Item
+			if closed {
+				b = append(b, header(0xfffe, 0xe00d, 0)...)
+				b = append(b, header(0xfffe, 0xe0dd, 0)...)
+			}
+		}
+		return b
+	}
+	const implicitLE = "1.2.840.10008.1.2"
+	if err := CheckElementLengths(nest(maxElementDepth/2, false), implicitLE); err != nil {
+		t.Errorf("%d nested sequences: %v", maxElementDepth/2, err)
+	}
+	if err := CheckElementLengths(nest(maxElementDepth, false), implicitLE); err == nil {
+		t.Errorf("%d nested sequences: no error", maxElementDepth)
+	}
+	// Sequences one after the other don't nest.
+	if err := CheckElementLengths(nest(10*maxElementDepth, true), implicitLE); err != nil {
+		t.Errorf("%d sequences: %v", 10*maxElementDepth, err)
+	}
+}
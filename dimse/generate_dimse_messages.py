@@ -0,0 +1,292 @@
+#!/usr/bin/env python3
+
+"""Generates dimse_messages.go. Run as
+
+  python3 generate_dimse_messages.py | gofmt > dimse_messages.go
+
+Message definitions follow P3.7 9.3 (DIMSE-C) and 10.3 (DIMSE-N).
+"""
+
+import sys
+from typing import List, NamedTuple
+
+REQUIRED = 0
+OPTIONAL = 1
+
+Field = NamedTuple('Field', [('name', str), ('type', str), ('required', int)])
+Message = NamedTuple('Message', [('name', str), ('command_field', int), ('fields', List[Field])])
+
+
+def f(name: str, type: str, required: int = REQUIRED) -> Field:
+    return Field(name, type, required)
+
+
+MESSAGES = [
+    Message('CStoreRq', 1, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('Priority', 'uint16'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string'),
+        f('MoveOriginatorApplicationEntityTitle', 'string', OPTIONAL),
+        f('MoveOriginatorMessageID', 'MessageID', OPTIONAL)]),
+    Message('CStoreRsp', 0x8001, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string'),
+        f('Status', 'Status')]),
+    Message('CFindRq', 0x20, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('Priority', 'uint16'),
+        f('CommandDataSetType', 'uint16')]),
+    Message('CFindRsp', 0x8020, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('Status', 'Status')]),
+    Message('CGetRq', 0x10, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('Priority', 'uint16'),
+        f('CommandDataSetType', 'uint16')]),
+    Message('CGetRsp', 0x8010, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('NumberOfRemainingSuboperations', 'uint16', OPTIONAL),
+        f('NumberOfCompletedSuboperations', 'uint16', OPTIONAL),
+        f('NumberOfFailedSuboperations', 'uint16', OPTIONAL),
+        f('NumberOfWarningSuboperations', 'uint16', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('CMoveRq', 0x21, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('Priority', 'uint16'),
+        f('MoveDestination', 'string'),
+        f('CommandDataSetType', 'uint16')]),
+    Message('CMoveRsp', 0x8021, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('NumberOfRemainingSuboperations', 'uint16', OPTIONAL),
+        f('NumberOfCompletedSuboperations', 'uint16', OPTIONAL),
+        f('NumberOfFailedSuboperations', 'uint16', OPTIONAL),
+        f('NumberOfWarningSuboperations', 'uint16', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('CEchoRq', 0x30, [
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16')]),
+    Message('CEchoRsp', 0x8030, [
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('Status', 'Status')]),
+
+    # DIMSE-N. P3.7 10.3.
+    Message('NEventReportRq', 0x100, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string'),
+        f('EventTypeID', 'uint16')]),
+    Message('NEventReportRsp', 0x8100, [
+        f('AffectedSOPClassUID', 'string', OPTIONAL),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL),
+        f('EventTypeID', 'uint16', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('NGetRq', 0x110, [
+        f('RequestedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('RequestedSOPInstanceUID', 'string'),
+        f('AttributeIdentifierList', '[]dicomtag.Tag', OPTIONAL)]),
+    Message('NGetRsp', 0x8110, [
+        f('AffectedSOPClassUID', 'string', OPTIONAL),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('NSetRq', 0x120, [
+        f('RequestedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('RequestedSOPInstanceUID', 'string')]),
+    Message('NSetRsp', 0x8120, [
+        f('AffectedSOPClassUID', 'string', OPTIONAL),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('NActionRq', 0x130, [
+        f('RequestedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('RequestedSOPInstanceUID', 'string'),
+        f('ActionTypeID', 'uint16')]),
+    Message('NActionRsp', 0x8130, [
+        f('AffectedSOPClassUID', 'string', OPTIONAL),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL),
+        f('ActionTypeID', 'uint16', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('NCreateRq', 0x140, [
+        f('AffectedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL)]),
+    Message('NCreateRsp', 0x8140, [
+        f('AffectedSOPClassUID', 'string', OPTIONAL),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL),
+        f('Status', 'Status')]),
+    Message('NDeleteRq', 0x150, [
+        f('RequestedSOPClassUID', 'string'),
+        f('MessageID', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('RequestedSOPInstanceUID', 'string')]),
+    Message('NDeleteRsp', 0x8150, [
+        f('AffectedSOPClassUID', 'string', OPTIONAL),
+        f('MessageIDBeingRespondedTo', 'MessageID'),
+        f('CommandDataSetType', 'uint16'),
+        f('AffectedSOPInstanceUID', 'string', OPTIONAL),
+        f('Status', 'Status')]),
+]
+
+ZERO_VALUES = {
+    'string': '""',
+    'uint16': '0',
+    'MessageID': '0',
+    '[]dicomtag.Tag': 'nil',
+}
+
+GETTERS = {
+    'string': 'getString',
+    'uint16': 'getUInt16',
+    'MessageID': 'getUInt16',
+    '[]dicomtag.Tag': 'getTags',
+}
+
+
+def is_optional_nonempty_check(field: Field) -> str:
+    if field.type == '[]dicomtag.Tag':
+        return 'len(v.%s) > 0' % field.name
+    return 'v.%s != %s' % (field.name, ZERO_VALUES[field.type])
+
+
+def generate_message(out, m: Message):
+    print('type %s struct {' % m.name, file=out)
+    for field in m.fields:
+        print('\t%s %s' % (field.name, field.type), file=out)
+    print('\tExtra []*dicom.Element // Unparsed elements', file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    print('func (v *%s) Encode(e *dicomio.Encoder) {' % m.name, file=out)
+    print('\telems := []*dicom.Element{}', file=out)
+    print('\telems = append(elems, newElement(dicomtag.CommandField, uint16(%d)))' % m.command_field, file=out)
+    for field in m.fields:
+        if field.type == 'Status':
+            print('\telems = append(elems, newStatusElements(v.Status)...)', file=out)
+            continue
+        value = 'v.%s' % field.name
+        if field.type == '[]dicomtag.Tag':
+            value = 'v.%s...' % field.name
+            stmt = 'elems = append(elems, newTagListElement(dicomtag.%s, %s))' % (field.name, value)
+        else:
+            stmt = 'elems = append(elems, newElement(dicomtag.%s, %s))' % (field.name, value)
+        if field.required == OPTIONAL:
+            print('\tif %s {' % is_optional_nonempty_check(field), file=out)
+            print('\t\t%s' % stmt, file=out)
+            print('\t}', file=out)
+        else:
+            print('\t%s' % stmt, file=out)
+    print('\telems = append(elems, v.Extra...)', file=out)
+    print('\tencodeElements(e, elems)', file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    print('func (v *%s) HasData() bool {' % m.name, file=out)
+    print('\treturn v.CommandDataSetType != CommandDataSetTypeNull', file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    print('func (v *%s) CommandField() int {' % m.name, file=out)
+    print('\treturn %d' % m.command_field, file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    names = [field.name for field in m.fields]
+    print('func (v *%s) GetMessageID() MessageID {' % m.name, file=out)
+    if 'MessageID' in names:
+        print('\treturn v.MessageID', file=out)
+    else:
+        print('\treturn v.MessageIDBeingRespondedTo', file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    print('func (v *%s) GetStatus() *Status {' % m.name, file=out)
+    if 'Status' in names:
+        print('\treturn &v.Status', file=out)
+    else:
+        print('\treturn nil', file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    print('func (v *%s) String() string {' % m.name, file=out)
+    fmt_str = ' '.join('%s:%%v' % name for name in names)
+    args = ', '.join('v.%s' % name for name in names)
+    print('\treturn fmt.Sprintf("%s{%s}}", %s)' % (m.name, fmt_str, args), file=out)
+    print('}', file=out)
+    print('', file=out)
+
+    print('func decode%s(d *messageDecoder) *%s {' % (m.name, m.name), file=out)
+    print('\tv := &%s{}' % m.name, file=out)
+    for field in m.fields:
+        if field.type == 'Status':
+            print('\tv.Status = d.getStatus()', file=out)
+            continue
+        required = 'requiredElement' if field.required == REQUIRED else 'optionalElement'
+        print('\tv.%s = d.%s(dicomtag.%s, %s)' % (field.name, GETTERS[field.type], field.name, required), file=out)
+    print('\tv.Extra = d.unparsedElements()', file=out)
+    print('\treturn v', file=out)
+    print('}', file=out)
+    print('', file=out)
+
+
+def main():
+    out = sys.stdout
+    print('package dimse', file=out)
+    print('', file=out)
+    print('// Code generated from generate_dimse_messages.py. DO NOT EDIT.', file=out)
+    print('', file=out)
+    print('import (', file=out)
+    print('\t"fmt"', file=out)
+    print('', file=out)
+    print('\t"github.com/grailbio/go-dicom"', file=out)
+    print('\t"github.com/grailbio/go-dicom/dicomio"', file=out)
+    print('\t"github.com/grailbio/go-dicom/dicomtag"', file=out)
+    print(')', file=out)
+    print('', file=out)
+    for m in MESSAGES:
+        generate_message(out, m)
+    for m in MESSAGES:
+        print('const CommandField%s = %d' % (m.name, m.command_field), file=out)
+    print('', file=out)
+    print('func decodeMessageForType(d *messageDecoder, commandField uint16) Message {', file=out)
+    print('\tswitch commandField {', file=out)
+    for m in MESSAGES:
+        print('\tcase 0x%x:' % m.command_field, file=out)
+        print('\t\treturn decode%s(d)' % m.name, file=out)
+    print('\tdefault:', file=out)
+    print('\t\td.setError(fmt.Errorf("%w 0x%x", ErrUnknownCommand, commandField))', file=out)
+    print('\t\treturn nil', file=out)
+    print('\t}', file=out)
+    print('}', file=out)
+
+
+main()
@@ -0,0 +1,217 @@
+package dimse
+
+// This file checks the value lengths of encoded elements before they are
+// handed to go-dicom. dicom.ReadElement trusts the VL: e.g., it reads an OW
+// element 2 bytes at a time for VL/2 rounds even when the buffer is shorter,
+// so a single bogus element can exhaust the memory.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+const undefinedLength uint32 = 0xffffffff
+
+// Max nesting of sequences and items.
+const maxElementDepth = 64
+
+// CheckElementLengths reports an error if an element in "data", encoded with
+// the given transfer syntax, is truncated or claims more bytes than its
+// enclosing sequence, item or buffer holds.
+func CheckElementLengths(data []byte, transferSyntaxUID string) error {
+	bo, implicit, err := dicomio.ParseTransferSyntaxUID(transferSyntaxUID)
+	if err != nil {
+		return err
+	}
+	c := lengthChecker{r: bytes.NewReader(data), bo: bo, implicit: implicit}
+	_, err = c.check(0, len(data), 0)
+	return err
+}
+
+// CheckFileLengths is CheckElementLengths for a DICOM file: the 128-byte
+// preamble, "DICM", the file meta information in explicit VR little endian,
+// then the dataset in the transfer syntax the meta information names.
+func CheckFileLengths(data []byte) error {
+	return CheckFileLengthsAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// CheckFileLengthsAt is CheckFileLengths for a DICOM file of "size" bytes read
+// from "r", e.g. an *os.File. Only the element headers are read.
+func CheckFileLengthsAt(r io.ReaderAt, size int64) error {
+	magic := make([]byte, 4)
+	if size < 132 {
+		return fmt.Errorf("dimse.CheckFileLengths: DICM magic not found")
+	}
+	if _, err := r.ReadAt(magic, 128); err != nil || string(magic) != "DICM" {
+		return fmt.Errorf("dimse.CheckFileLengths: DICM magic not found")
+	}
+	c := lengthChecker{r: r, bo: binary.LittleEndian, implicit: dicomio.ExplicitVR, metaOnly: true}
+	pos, err := c.check(132, int(size), 0)
+	if err != nil {
+		return err
+	}
+	if c.transferSyntaxUID == "" {
+		return fmt.Errorf("dimse.CheckFileLengths: TransferSyntaxUID not found")
+	}
+	bo, implicit, err := dicomio.ParseTransferSyntaxUID(c.transferSyntaxUID)
+	if err != nil {
+		return fmt.Errorf("dimse.CheckFileLengths: %v", err)
+	}
+	c = lengthChecker{r: r, bo: bo, implicit: implicit}
+	if _, err := c.check(pos, int(size), 0); err != nil {
+		return fmt.Errorf("dimse.CheckFileLengths: %v", err)
+	}
+	return nil
+}
+
+type lengthChecker struct {
+	r        io.ReaderAt
+	buf      [12]byte
+	bo       binary.ByteOrder
+	implicit dicomio.IsImplicitVR
+
+	// Stop at the first element outside group 0002, and remember the
+	// transfer syntax.
+	metaOnly          bool
+	transferSyntaxUID string
+}
+
+// Read "n" bytes at "pos", at most len(c.buf). The caller checks that they
+// are before the end.
+func (c *lengthChecker) read(pos, n int) ([]byte, error) {
+	b := c.buf[:n]
+	if _, err := c.r.ReadAt(b, int64(pos)); err != nil {
+		return nil, fmt.Errorf("read at offset %d: %v", pos, err)
+	}
+	return b, nil
+}
+
+// Check the elements in [pos, end). Returns the position after the last
+// element checked.
+func (c *lengthChecker) check(pos, end int, depth int) (int, error) {
+	if depth > maxElementDepth {
+		return pos, fmt.Errorf("elements nested more than %d deep", maxElementDepth)
+	}
+	// Undefined-length sequences and items open at this level: go-dicom
+	// recurses into them as well.
+	open := 0
+	for pos < end {
+		if end-pos < 8 {
+			return pos, fmt.Errorf("truncated element at offset %d", pos)
+		}
+		h, err := c.read(pos, 8)
+		if err != nil {
+			return pos, err
+		}
+		tag := dicomtag.Tag{Group: c.bo.Uint16(h), Element: c.bo.Uint16(h[2:])}
+		if c.metaOnly && tag.Group != 0x0002 {
+			return pos, nil
+		}
+		headerEnd := pos + 8
+		var vr string
+		var vl uint32
+		if tag.Group == 0xfffe || c.implicit == dicomio.ImplicitVR {
+			vl = c.bo.Uint32(h[4:])
+			if info, err := dicomtag.Find(tag); err == nil {
+				vr = info.VR
+			}
+		} else {
+			vr = string(h[4:6])
+			switch vr {
+			case "NA", "OB", "OD", "OF", "OL", "OW", "SQ", "UN", "UC", "UR", "UT":
+				if end-pos < 12 {
+					return pos, fmt.Errorf("truncated element %v at offset %d", tag, pos)
+				}
+				if h, err = c.read(pos, 12); err != nil {
+					return pos, err
+				}
+				vl = c.bo.Uint32(h[8:])
+				headerEnd = pos + 12
+			default:
+				vl = uint32(c.bo.Uint16(h[6:]))
+				if vl == 0xffff {
+					vl = undefinedLength
+				}
+			}
+		}
+		pos = headerEnd
+		if tag == dicomtag.ItemDelimitationItem || tag == dicomtag.SequenceDelimitationItem {
+			if open > 0 {
+				open--
+			}
+		}
+		if vl == undefinedLength {
+			if tag == dicomtag.PixelData {
+				// Encapsulated fragments are raw bytes, not elements.
+				if pos, err = c.checkFragments(pos, end); err != nil {
+					return pos, err
+				}
+				continue
+			}
+			open++
+			if depth+open > maxElementDepth {
+				return pos, fmt.Errorf("elements nested more than %d deep", maxElementDepth)
+			}
+			// The elements of an undefined-length sequence or item
+			// follow inline, up to a delimitation item.
+			continue
+		}
+		if uint64(vl) > uint64(end-pos) {
+			return pos, fmt.Errorf("element %v at offset %d has length %d, only %d bytes left", tag, headerEnd, vl, end-pos)
+		}
+		if vr == "SQ" || tag == dicomtag.Item {
+			if _, err := c.check(pos, pos+int(vl), depth+open+1); err != nil {
+				return pos, err
+			}
+		}
+		if c.metaOnly && tag == dicomtag.TransferSyntaxUID {
+			if vl > 64 {
+				return pos, fmt.Errorf("TransferSyntaxUID at offset %d has length %d", headerEnd, vl)
+			}
+			value := make([]byte, vl)
+			if _, err := c.r.ReadAt(value, int64(pos)); err != nil {
+				return pos, fmt.Errorf("read at offset %d: %v", pos, err)
+			}
+			c.transferSyntaxUID = trimUID(value)
+		}
+		pos += int(vl)
+	}
+	return pos, nil
+}
+
+// Check the items of encapsulated pixel data, up to the sequence
+// delimitation item.
+func (c *lengthChecker) checkFragments(pos, end int) (int, error) {
+	for pos < end {
+		if end-pos < 8 {
+			return pos, fmt.Errorf("truncated pixel data item at offset %d", pos)
+		}
+		h, err := c.read(pos, 8)
+		if err != nil {
+			return pos, err
+		}
+		tag := dicomtag.Tag{Group: c.bo.Uint16(h), Element: c.bo.Uint16(h[2:])}
+		vl := c.bo.Uint32(h[4:])
+		pos += 8
+		if tag == dicomtag.SequenceDelimitationItem {
+			return pos, nil
+		}
+		if vl == undefinedLength || uint64(vl) > uint64(end-pos) {
+			return pos, fmt.Errorf("pixel data item at offset %d has length %d, only %d bytes left", pos, vl, end-pos)
+		}
+		pos += int(vl)
+	}
+	return pos, nil
+}
+
+func trimUID(b []byte) string {
+	for len(b) > 0 && (b[len(b)-1] == 0 || b[len(b)-1] == ' ') {
+		b = b[:len(b)-1]
+	}
+	return string(b)
+}
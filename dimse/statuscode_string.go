@@ -4,26 +4,39 @@ package dimse
 
 import "fmt"
 
-const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandStatusCancelStatusPending"
+const _StatusCode_name = "StatusSuccessStatusNoSuchAttributeStatusInvalidAttributeValueStatusAttributeListErrorStatusProcessingFailureStatusDuplicateSOPInstanceStatusSOPClassNotSupportedStatusNoSuchEventTypeStatusNoSuchArgumentStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNoSuchSOPClassStatusClassInstanceConflictStatusMissingAttributeStatusMissingAttributeValueStatusNoSuchActionTypeStatusNotAuthorizedStatusDuplicateInvocationStatusUnrecognizedOperationStatusMistypedArgumentStatusResourceLimitationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandStatusCancelStatusPending"
 
 var _StatusCode_map = map[StatusCode]string{
 	0:     _StatusCode_name[0:13],
-	262:   _StatusCode_name[13:40],
-	263:   _StatusCode_name[40:64],
-	274:   _StatusCode_name[64:90],
-	277:   _StatusCode_name[90:116],
-	278:   _StatusCode_name[116:146],
-	279:   _StatusCode_name[146:173],
-	292:   _StatusCode_name[173:192],
-	529:   _StatusCode_name[192:219],
-	42752: _StatusCode_name[219:239],
-	42753: _StatusCode_name[239:290],
-	42754: _StatusCode_name[290:337],
-	43009: _StatusCode_name[337:364],
-	43264: _StatusCode_name[364:397],
-	49152: _StatusCode_name[397:419],
-	65024: _StatusCode_name[419:431],
-	65280: _StatusCode_name[431:444],
+	261:   _StatusCode_name[13:34],
+	262:   _StatusCode_name[34:61],
+	263:   _StatusCode_name[61:85],
+	272:   _StatusCode_name[85:108],
+	273:   _StatusCode_name[108:134],
+	274:   _StatusCode_name[134:160],
+	275:   _StatusCode_name[160:181],
+	276:   _StatusCode_name[181:201],
+	277:   _StatusCode_name[201:227],
+	278:   _StatusCode_name[227:257],
+	279:   _StatusCode_name[257:284],
+	280:   _StatusCode_name[284:304],
+	281:   _StatusCode_name[304:331],
+	288:   _StatusCode_name[331:353],
+	289:   _StatusCode_name[353:380],
+	291:   _StatusCode_name[380:402],
+	292:   _StatusCode_name[402:421],
+	528:   _StatusCode_name[421:446],
+	529:   _StatusCode_name[446:473],
+	530:   _StatusCode_name[473:495],
+	531:   _StatusCode_name[495:519],
+	42752: _StatusCode_name[519:539],
+	42753: _StatusCode_name[539:590],
+	42754: _StatusCode_name[590:637],
+	43009: _StatusCode_name[637:664],
+	43264: _StatusCode_name[664:697],
+	49152: _StatusCode_name[697:719],
+	65024: _StatusCode_name[719:731],
+	65280: _StatusCode_name[731:744],
 }
 
 func (i StatusCode) String() string {
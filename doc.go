@@ -1,5 +1,6 @@
 /*
 This package exports two main classes: ServiceUser for implementing DICOM
-clients, and ServiceProvider for implementing DICOM servers.
+clients, and ServiceProvider for implementing DICOM servers. AssociationPool
+shares ServiceUsers among concurrent clients.
 */
 package dicompot
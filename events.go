@@ -0,0 +1,172 @@
+package dicompot
+
+// This file forwards the events logged by the provider to EventSinks. Every
+// sink gets its own buffer and goroutine, so a slow or unreachable collector
+// only loses its own events and never stalls an association.
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Default number of events buffered per sink.
+const defaultEventBufferSize = 4096
+
+// Event is a log entry of the honeypot, e.g. "Connection from" or "C-FIND
+// Search result".
+type Event struct {
+	Time    time.Time
+	Level   string // "info", "warning", "error", ...
+	Message string
+	// Commonly present fields, copied from Fields. Empty if not set.
+	Protocol string // "DIMSE" or "DICOMweb"
+	IP       string
+	Port     string
+	ID       string // Session label
+	// All the fields of the entry, including the ones above.
+	Fields map[string]interface{}
+}
+
+// EventSink receives events. WriteEvent is called from a single goroutine per
+// sink and may block, e.g., on network I/O.
+type EventSink interface {
+	WriteEvent(e Event) error
+	// Close flushes buffered events and releases the resources of the sink.
+	Close() error
+}
+
+var (
+	metricEventsDropped = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_events_dropped_total",
+		Help: "Events dropped because the buffer of the sink was full.",
+	}, []string{"sink"})
+	metricEventSinkErrors = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_event_sink_errors_total",
+		Help: "Events that a sink failed to write.",
+	}, []string{"sink"})
+)
+
+func newEvent(entry *logrus.Entry) Event {
+	e := Event{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+		Fields:  make(map[string]interface{}, len(entry.Data)),
+	}
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		e.Fields[k] = v
+	}
+	str := func(key string) string {
+		if v, ok := e.Fields[key]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+	e.Protocol = str("Protocol")
+	e.IP = str("IP")
+	e.Port = str("Port")
+	e.ID = str("ID")
+	return e
+}
+
+type eventSinkWorker struct {
+	name string
+	sink EventSink
+	ch   chan Event
+	done chan struct{}
+}
+
+func (w *eventSinkWorker) run() {
+	defer close(w.done)
+	failing := false
+	for e := range w.ch {
+		err := w.sink.WriteEvent(e)
+		if err != nil {
+			metricEventSinkErrors.WithLabelValues(w.name).Inc()
+		}
+		// Logging through logrus would feed the error back into the sinks,
+		// so report only changes of state on the standard logger.
+		if err != nil && !failing {
+			log.Printf("dicom.eventSink: %s: %v", w.name, err)
+		} else if err == nil && failing {
+			log.Printf("dicom.eventSink: %s: recovered", w.name)
+		}
+		failing = err != nil
+	}
+	if err := w.sink.Close(); err != nil {
+		log.Printf("dicom.eventSink: %s: close: %v", w.name, err)
+	}
+}
+
+// eventDispatcher is a logrus hook that copies every entry to the sinks.
+type eventDispatcher struct {
+	mu      sync.RWMutex
+	closed  bool
+	workers []*eventSinkWorker
+}
+
+func newEventDispatcher(sinks []EventSink, bufferSize int) *eventDispatcher {
+	if bufferSize <= 0 {
+		bufferSize = defaultEventBufferSize
+	}
+	d := &eventDispatcher{}
+	for _, sink := range sinks {
+		w := &eventSinkWorker{
+			name: fmt.Sprint(sink),
+			sink: sink,
+			ch:   make(chan Event, bufferSize),
+			done: make(chan struct{}),
+		}
+		d.workers = append(d.workers, w)
+		go w.run()
+	}
+	return d
+}
+
+func (d *eventDispatcher) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (d *eventDispatcher) Fire(entry *logrus.Entry) error {
+	e := newEvent(entry)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return nil
+	}
+	for _, w := range d.workers {
+		select {
+		case w.ch <- e:
+		default:
+			metricEventsDropped.WithLabelValues(w.name).Inc()
+		}
+	}
+	return nil
+}
+
+// Stop accepting events, then wait until the buffered ones are written and
+// the sinks closed.
+func (d *eventDispatcher) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, w := range d.workers {
+		close(w.ch)
+	}
+	d.mu.Unlock()
+	for _, w := range d.workers {
+		<-w.done
+	}
+}
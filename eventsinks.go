@@ -0,0 +1,413 @@
+package dicompot
+
+// This file implements the EventSinks shipped with dicompot: syslog (RFC 5424,
+// optionally carrying CEF or LEEF), NDJSON files and HTTP POST batches.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// SyslogFormat selects the payload of the messages sent by a SyslogSink.
+type SyslogFormat int
+
+const (
+	// RFC 5424 message, the event fields are sent as structured data.
+	SyslogRFC5424 SyslogFormat = iota
+	// ArcSight Common Event Format in the message part.
+	SyslogCEF
+	// IBM QRadar Log Event Extended Format in the message part.
+	SyslogLEEF
+)
+
+func (f SyslogFormat) String() string {
+	switch f {
+	case SyslogCEF:
+		return "cef"
+	case SyslogLEEF:
+		return "leef"
+	default:
+		return "rfc5424"
+	}
+}
+
+const (
+	eventVendor  = "dicompot"
+	eventProduct = "dicompot"
+	eventVersion = "1.0"
+
+	// Facility local0.
+	syslogFacility = 16
+	// Enterprise number in the SD-ID. 32473 is reserved for documentation
+	// (RFC 5612).
+	syslogSDID = "dicompot@32473"
+)
+
+func sortedFields(e Event) []string {
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func eventSeverity(level string) (syslog int, cef int) {
+	switch level {
+	case "panic", "fatal":
+		return 2, 10
+	case "error":
+		return 3, 7
+	case "warning":
+		return 4, 5
+	case "info":
+		return 6, 3
+	default:
+		return 7, 1
+	}
+}
+
+// Keep only the characters that are valid in syslog SD-PARAM names and in
+// CEF/LEEF extension keys.
+func eventKey(k string) string {
+	var b strings.Builder
+	for _, r := range k {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 32 {
+		return b.String()[:32]
+	}
+	return b.String()
+}
+
+// SyslogSink sends events to a syslog collector over UDP, TCP or TLS. Over TCP
+// and TLS, messages are framed by octet counting (RFC 6587, RFC 5425). A
+// broken connection is redialed on the next event.
+type SyslogSink struct {
+	network   string // "udp", "tcp" or "tls"
+	addr      string
+	format    SyslogFormat
+	tlsConfig *tls.Config
+	hostname  string
+	conn      net.Conn
+}
+
+// NewSyslogSink creates a sink for the collector at addr (host:port). network
+// is "udp", "tcp" or "tls". tlsConfig is used only for "tls" and may be nil.
+func NewSyslogSink(network, addr string, format SyslogFormat, tlsConfig *tls.Config) (*SyslogSink, error) {
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("dicom.syslogSink: unsupported network %q", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("dicom.syslogSink: %v", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{
+		network:   network,
+		addr:      addr,
+		format:    format,
+		tlsConfig: tlsConfig,
+		hostname:  hostname,
+	}, nil
+}
+
+func (s *SyslogSink) String() string {
+	return fmt.Sprintf("%s+%s://%s", s.format, s.network, s.addr)
+}
+
+func (s *SyslogSink) dial() error {
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if s.network == "tls" {
+		s.conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	} else {
+		s.conn, err = dialer.Dial(s.network, s.addr)
+	}
+	return err
+}
+
+func (s *SyslogSink) WriteEvent(e Event) error {
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	msg := s.message(e)
+	if s.network != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Format e as an RFC 5424 message.
+func (s *SyslogSink) message(e Event) string {
+	severity, _ := eventSeverity(e.Level)
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ",
+		syslogFacility*8+severity,
+		e.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, eventProduct, os.Getpid())
+	switch s.format {
+	case SyslogCEF:
+		b.WriteString("- ")
+		b.WriteString(formatCEF(e))
+	case SyslogLEEF:
+		b.WriteString("- ")
+		b.WriteString(formatLEEF(e))
+	default:
+		b.WriteString("[" + syslogSDID)
+		escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+		for _, k := range sortedFields(e) {
+			if key := eventKey(k); key != "" {
+				fmt.Fprintf(&b, ` %s="%s"`, key, escape.Replace(fmt.Sprint(e.Fields[k])))
+			}
+		}
+		b.WriteString("] ")
+		b.WriteString(e.Message)
+	}
+	return b.String()
+}
+
+// Format e as a CEF record. The source address goes to the standard src and
+// spt keys, the other fields keep their names.
+func formatCEF(e Event) string {
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	value := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	_, severity := eventSeverity(e.Level)
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|rt=%d",
+		eventVendor, eventProduct, eventVersion,
+		header.Replace(eventID(e.Message)),
+		header.Replace(e.Message), severity, e.Time.UnixNano()/int64(time.Millisecond))
+	for _, k := range sortedFields(e) {
+		key := eventKey(k)
+		switch k {
+		case "IP":
+			key = "src"
+		case "Port":
+			key = "spt"
+		}
+		if key != "" {
+			fmt.Fprintf(&b, " %s=%s", key, value.Replace(fmt.Sprint(e.Fields[k])))
+		}
+	}
+	fmt.Fprintf(&b, " msg=%s", value.Replace(e.Message))
+	return b.String()
+}
+
+// Format e as a LEEF 2.0 record with tab separated attributes.
+func formatLEEF(e Event) string {
+	header := strings.NewReplacer(`|`, ` `)
+	value := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	_, severity := eventSeverity(e.Level)
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:2.0|%s|%s|%s|%s|x09|devTime=%s\tsev=%d",
+		eventVendor, eventProduct, eventVersion,
+		header.Replace(eventID(e.Message)),
+		e.Time.Format("Jan 02 2006 15:04:05.000"), severity)
+	for _, k := range sortedFields(e) {
+		key := eventKey(k)
+		switch k {
+		case "IP":
+			key = "src"
+		case "Port":
+			key = "srcPort"
+		}
+		if key != "" {
+			fmt.Fprintf(&b, "\t%s=%s", key, value.Replace(fmt.Sprint(e.Fields[k])))
+		}
+	}
+	return b.String()
+}
+
+// Event class ID for CEF and LEEF headers, e.g., "ConnectionFrom".
+func eventID(msg string) string {
+	var b strings.Builder
+	for _, word := range strings.Fields(msg) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return eventKey(b.String())
+}
+
+// Flatten e into the JSON object written by the file and HTTP sinks. The
+// layout matches the logrus JSON formatter: time, level, msg and the fields.
+func eventJSON(e Event) map[string]interface{} {
+	obj := make(map[string]interface{}, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		obj[k] = v
+	}
+	obj["time"] = e.Time.Format(time.RFC3339Nano)
+	obj["level"] = e.Level
+	obj["msg"] = e.Message
+	return obj
+}
+
+// FileSink writes events as newline-delimited JSON to a file that is rotated
+// once it reaches the maximum size.
+type FileSink struct {
+	logger *lumberjack.Logger
+}
+
+// NewFileSink creates a sink that writes to path. The file is rotated when it
+// exceeds maxSizeMB megabytes, keeping at most maxBackups old files.
+func NewFileSink(path string, maxSizeMB, maxBackups int) *FileSink {
+	return &FileSink{logger: &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSizeMB,
+		MaxBackups: maxBackups,
+	}}
+}
+
+func (s *FileSink) String() string {
+	return "file://" + s.logger.Filename
+}
+
+func (s *FileSink) WriteEvent(e Event) error {
+	line, err := json.Marshal(eventJSON(e))
+	if err != nil {
+		return err
+	}
+	_, err = s.logger.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.logger.Close()
+}
+
+// HTTPSink POSTs events as a JSON array to a URL, in batches of up to
+// batchSize events. A partial batch is sent after flushInterval.
+type HTTPSink struct {
+	url           string
+	header        http.Header
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+
+	mu    sync.Mutex
+	batch []map[string]interface{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewHTTPSink creates a sink for url. header is added to every request, e.g.,
+// for an Authorization token, and may be nil.
+func NewHTTPSink(url string, header http.Header, batchSize int, flushInterval time.Duration) *HTTPSink {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+	s := &HTTPSink{
+		url:           url,
+		header:        header,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s
+}
+
+func (s *HTTPSink) String() string {
+	return s.url
+}
+
+func (s *HTTPSink) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.Printf("dicom.eventSink: %s: %v", s.url, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *HTTPSink) flush() error {
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("dicom.httpSink: %d events refused: %s", len(batch), resp.Status)
+	}
+	return nil
+}
+
+func (s *HTTPSink) WriteEvent(e Event) error {
+	s.mu.Lock()
+	s.batch = append(s.batch, eventJSON(e))
+	full := len(s.batch) >= s.batchSize
+	s.mu.Unlock()
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.flush()
+}
@@ -0,0 +1,232 @@
+package dicompot
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEventTime = time.Date(2024, 3, 1, 12, 30, 45, 123000000, time.UTC)
+
+func testEvent(level, msg string, fields map[string]interface{}) Event {
+	return Event{Time: testEventTime, Level: level, Message: msg, Fields: fields}
+}
+
+func TestFormatCEF(t *testing.T) {
+	tests := []struct {
+		e    Event
+		want string
+	}{
+		{
+			testEvent("warning", "Connection from", map[string]interface{}{"IP": "10.0.0.1", "Port": "4242", "ID": "7"}),
+			"CEF:0|dicompot|dicompot|1.0|ConnectionFrom|Connection from|5|rt=1709296245123 ID=7 src=10.0.0.1 spt=4242 msg=Connection from",
+		},
+		{
+			testEvent("error", "a|b", map[string]interface{}{"Query": "x=1\ny\\z", "Bad-Key!": 3}),
+			`CEF:0|dicompot|dicompot|1.0|Ab|a\|b|7|rt=1709296245123 BadKey=3 Query=x\=1\ny\\z msg=a|b`,
+		},
+		{
+			testEvent("debug", "", nil),
+			"CEF:0|dicompot|dicompot|1.0|||1|rt=1709296245123 msg=",
+		},
+		{
+			testEvent("fatal", "x", map[string]interface{}{"!!!": "dropped"}),
+			"CEF:0|dicompot|dicompot|1.0|X|x|10|rt=1709296245123 msg=x",
+		},
+	}
+	for _, test := range tests {
+		if got := formatCEF(test.e); got != test.want {
+			t.Errorf("formatCEF(%q)\n got %s\nwant %s", test.e.Message, got, test.want)
+		}
+	}
+}
+
+func TestFormatLEEF(t *testing.T) {
+	tests := []struct {
+		e    Event
+		want string
+	}{
+		{
+			testEvent("warning", "Connection from", map[string]interface{}{"IP": "10.0.0.1", "Port": "4242", "ID": "7"}),
+			"LEEF:2.0|dicompot|dicompot|1.0|ConnectionFrom|x09|devTime=Mar 01 2024 12:30:45.123\tsev=5\tID=7\tsrc=10.0.0.1\tsrcPort=4242",
+		},
+		{
+			testEvent("info", "a|b", map[string]interface{}{"Query": "x\ty\nz"}),
+			"LEEF:2.0|dicompot|dicompot|1.0|Ab|x09|devTime=Mar 01 2024 12:30:45.123\tsev=3\tQuery=x y z",
+		},
+	}
+	for _, test := range tests {
+		if got := formatLEEF(test.e); got != test.want {
+			t.Errorf("formatLEEF(%q)\n got %q\nwant %q", test.e.Message, got, test.want)
+		}
+	}
+}
+
+func TestEventKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"SOPInstance", "SOPInstance"},
+		{"Calling AE", "CallingAE"},
+		{"a=b]c\"d", "abcd"},
+		{"é_1", "_1"},
+		{strings.Repeat("k", 40), strings.Repeat("k", 32)},
+	}
+	for _, test := range tests {
+		if got := eventKey(test.key); got != test.want {
+			t.Errorf("eventKey(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	e := testEvent("warning", "Connection from", map[string]interface{}{"IP": "10.0.0.1", "Note": `a"b]c\d`})
+	pid := strconv.Itoa(os.Getpid())
+	header := "<132>1 2024-03-01T12:30:45.123000Z host dicompot " + pid + " - "
+	tests := []struct {
+		format SyslogFormat
+		want   string
+	}{
+		{SyslogRFC5424, header + `[dicompot@32473 IP="10.0.0.1" Note="a\"b\]c\\d"] Connection from`},
+		{SyslogCEF, header + "- " + formatCEF(e)},
+		{SyslogLEEF, header + "- " + formatLEEF(e)},
+	}
+	for _, test := range tests {
+		s := &SyslogSink{format: test.format, hostname: "host"}
+		if got := s.message(e); got != test.want {
+			t.Errorf("message(%s)\n got %s\nwant %s", test.format, got, test.want)
+		}
+	}
+}
+
+func TestSyslogSinkFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s, err := NewSyslogSink("tcp", ln.Addr().String(), SyslogCEF, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e := testEvent("info", "Received", nil)
+	if err := s.WriteEvent(e); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	n, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := strconv.Atoi(strings.TrimSpace(n))
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := s.message(e); string(msg) != want {
+		t.Errorf("framed message = %q, want %q", msg, want)
+	}
+}
+
+func TestNewSyslogSink(t *testing.T) {
+	tests := []struct {
+		network, addr string
+		ok            bool
+	}{
+		{"udp", "127.0.0.1:514", true},
+		{"tls", "collector:6514", true},
+		{"unix", "/dev/log", false},
+		{"tcp", "collector", false},
+	}
+	for _, test := range tests {
+		_, err := NewSyslogSink(test.network, test.addr, SyslogRFC5424, nil)
+		if (err == nil) != test.ok {
+			t.Errorf("NewSyslogSink(%q, %q) error = %v, want ok %v", test.network, test.addr, err, test.ok)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	s := NewFileSink(path, 1, 1)
+	for _, msg := range []string{"Connection from", "Received"} {
+		if err := s.WriteEvent(testEvent("warning", msg, map[string]interface{}{"ID": "7"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines, want 2", len(lines))
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &obj); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"time":  "2024-03-01T12:30:45.123Z",
+		"level": "warning",
+		"msg":   "Received",
+		"ID":    "7",
+	}
+	for k, v := range want {
+		if obj[k] != v {
+			t.Errorf("%s = %v, want %v", k, obj[k], v)
+		}
+	}
+}
+
+func TestHTTPSinkBatches(t *testing.T) {
+	batches := make(chan []map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer tok" {
+			t.Errorf("Authorization = %q, want Bearer tok", got)
+		}
+		batches <- batch
+	}))
+	defer srv.Close()
+	s := NewHTTPSink(srv.URL, http.Header{"Authorization": {"Bearer tok"}}, 2, time.Hour)
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := s.WriteEvent(testEvent("info", msg, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third event waits for the flush interval or Close.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(batches)
+	var sizes []int
+	for batch := range batches {
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Errorf("batch sizes = %v, want [2 1]", sizes)
+	}
+}
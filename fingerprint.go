@@ -0,0 +1,453 @@
+package dicompot
+
+// This file computes client fingerprints from A-ASSOCIATE-RQ PDUs and matches
+// them against a list of known tools. DICOM toolkits and scanners each build
+// their association requests in their own way: the presentation contexts
+// they propose and in which order, the implementation UID and version, the
+// user information sub-items, even the way they pad the AE titles. Banner
+// grabbers that don't speak DICOM are fingerprinted by the first bytes they
+// send instead.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+// ClientFingerprint identifies the software that sent an A-ASSOCIATE-RQ, or
+// the first bytes of a connection that didn't start with one.
+type ClientFingerprint struct {
+	// Hash of Canonical. Stable across releases, it may be used in
+	// signatures and alerting rules.
+	Hash string
+	// The features of the request the hash is computed from, in a readable
+	// form.
+	Canonical string
+	// Tool named by the first matching FingerprintSignature. Empty if
+	// unknown.
+	Tool string
+
+	implementationClassUID    string
+	implementationVersionName string
+	callingAETitle            string
+	calledAETitle             string
+	abstractSyntaxes          []string
+	probe                     string // Hex. Set for connections without an A-ASSOCIATE-RQ.
+}
+
+// FingerprintSignature maps client fingerprints to a tool. A signature
+// matches a request if its hash is one of Fingerprints, or if the request has
+// all of the attributes the signature sets. A signature that sets no
+// attribute only matches by hash. The A-ASSOCIATE-RQ attributes never match a
+// probe, nor Probe a request.
+type FingerprintSignature struct {
+	Tool         string   `json:"tool"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+
+	// Prefixes of the implementation class UID and version name.
+	ImplementationClassUID    string `json:"implementation_class_uid,omitempty"`
+	ImplementationVersionName string `json:"implementation_version_name,omitempty"`
+	// AE titles, without padding.
+	CallingAETitle string `json:"calling_ae_title,omitempty"`
+	CalledAETitle  string `json:"called_ae_title,omitempty"`
+	// The request proposes no abstract syntax outside this list.
+	AbstractSyntaxes []string `json:"abstract_syntaxes,omitempty"`
+	// Hex prefix of the first bytes sent by a client that doesn't start
+	// with an A-ASSOCIATE-RQ.
+	Probe string `json:"probe,omitempty"`
+	// Domain of the reverse DNS name of the source address, e.g.,
+	// "shodan.io". Only looked up for the signatures that need it.
+	ReverseDNS string `json:"reverse_dns,omitempty"`
+
+	Comment string `json:"comment,omitempty"`
+}
+
+// ParseFingerprintSignatures decodes a signature file: a JSON object with a
+// "signatures" list. Signatures are tried in order.
+func ParseFingerprintSignatures(data []byte) ([]FingerprintSignature, error) {
+	var file struct {
+		Signatures []FingerprintSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("dicom.ParseFingerprintSignatures: %v", err)
+	}
+	for i, sig := range file.Signatures {
+		if sig.Tool == "" {
+			return nil, fmt.Errorf("dicom.ParseFingerprintSignatures: signature %d has no tool", i)
+		}
+	}
+	return file.Signatures, nil
+}
+
+func (sig *FingerprintSignature) hasAssociateAttributes() bool {
+	return sig.ImplementationClassUID != "" || sig.ImplementationVersionName != "" ||
+		sig.CallingAETitle != "" || sig.CalledAETitle != "" || len(sig.AbstractSyntaxes) > 0
+}
+
+func (sig *FingerprintSignature) hasAttributes() bool {
+	return sig.hasAssociateAttributes() || sig.Probe != "" || sig.ReverseDNS != ""
+}
+
+// The reverse DNS name of the source is only asked for once the other
+// attributes match.
+func (sig *FingerprintSignature) match(fp *ClientFingerprint, source *sourceName) bool {
+	for _, hash := range sig.Fingerprints {
+		if strings.EqualFold(hash, fp.Hash) {
+			return true
+		}
+	}
+	if !sig.hasAttributes() {
+		return false
+	}
+	if sig.Probe != "" && (fp.probe == "" || !strings.HasPrefix(fp.probe, strings.ToLower(sig.Probe))) {
+		return false
+	}
+	if sig.hasAssociateAttributes() && fp.probe != "" {
+		return false
+	}
+	if !strings.HasPrefix(fp.implementationClassUID, sig.ImplementationClassUID) ||
+		!strings.HasPrefix(fp.implementationVersionName, sig.ImplementationVersionName) {
+		return false
+	}
+	if (sig.CallingAETitle != "" && sig.CallingAETitle != fp.callingAETitle) ||
+		(sig.CalledAETitle != "" && sig.CalledAETitle != fp.calledAETitle) {
+		return false
+	}
+	if len(sig.AbstractSyntaxes) > 0 {
+		for _, uid := range fp.abstractSyntaxes {
+			if !containsString(sig.AbstractSyntaxes, uid) {
+				return false
+			}
+		}
+	}
+	if sig.ReverseDNS != "" {
+		name := source.get()
+		domain := strings.ToLower(strings.Trim(sig.ReverseDNS, "."))
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The signatures used by a ServiceProvider. They may be replaced while it
+// runs.
+type signatureDB struct {
+	mu         sync.RWMutex
+	signatures []FingerprintSignature
+}
+
+func newSignatureDB(signatures []FingerprintSignature) *signatureDB {
+	return &signatureDB{signatures: signatures}
+}
+
+func (db *signatureDB) set(signatures []FingerprintSignature) {
+	db.mu.Lock()
+	db.signatures = signatures
+	db.mu.Unlock()
+}
+
+// Name the tool of "fp", if a signature matches. "source" may be nil.
+// Nil-safe.
+func (db *signatureDB) identify(fp *ClientFingerprint, source *sourceName) {
+	if db == nil {
+		return
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for i := range db.signatures {
+		if db.signatures[i].match(fp, source) {
+			fp.Tool = db.signatures[i].Tool
+			return
+		}
+	}
+}
+
+// Reports whether a signature needs the reverse DNS name of the source.
+// Nil-safe.
+func (db *signatureDB) needsSourceName() bool {
+	if db == nil {
+		return false
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for i := range db.signatures {
+		if db.signatures[i].ReverseDNS != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Max time spent on the reverse DNS lookup of a source address, and max wait
+// for its result once the fingerprint is ready. The lookup starts when the
+// connection is accepted, so it is usually done by then.
+const (
+	sourceLookupTimeout = 2 * time.Second
+	sourceLookupWait    = 250 * time.Millisecond
+)
+
+// The reverse DNS name of a source address, looked up in the background.
+type sourceName struct {
+	done chan struct{}
+	name string // Lower case, without the final dot. Set before done is closed.
+}
+
+func lookupSourceName(ip string) *sourceName {
+	s := &sourceName{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		ctx, cancel := context.WithTimeout(context.Background(), sourceLookupTimeout)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		if err == nil && len(names) > 0 {
+			s.name = strings.ToLower(strings.TrimSuffix(names[0], "."))
+		}
+	}()
+	return s
+}
+
+// The name, or "" if there is none or it takes too long. Nil-safe.
+func (s *sourceName) get() string {
+	if s == nil {
+		return ""
+	}
+	timer := time.NewTimer(sourceLookupWait)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return s.name
+	case <-timer.C:
+		return ""
+	}
+}
+
+// SetFingerprintSignatures replaces the signatures used to name the clients,
+// e.g., after the signature file was updated. Associations already
+// established keep their tool.
+func (sp *ServiceProvider) SetFingerprintSignatures(signatures []FingerprintSignature) {
+	sp.signatures.set(signatures)
+}
+
+// Compute the fingerprint of an A-ASSOCIATE-RQ. The canonical form has one
+// section per feature, in a fixed order, so the hash only changes when the
+// client does.
+func fingerprintAssociate(v *pdu.AAssociate) ClientFingerprint {
+	fp := ClientFingerprint{
+		callingAETitle: strings.Trim(v.CallingAETitle, " \x00"),
+		calledAETitle:  strings.Trim(v.CalledAETitle, " \x00"),
+	}
+	appContext := "none"
+	var contextIDs []byte
+	var contexts []string
+	maxLength := "none"
+	var userItems []string
+	async := "none"
+	var roles []string
+	for _, item := range v.Items {
+		switch c := item.(type) {
+		case *pdu.ApplicationContextItem:
+			appContext = c.Name
+		case *pdu.PresentationContextItem:
+			contextIDs = append(contextIDs, c.ContextID)
+			var abstractSyntax string
+			var transferSyntaxes []string
+			for _, subItem := range c.Items {
+				switch s := subItem.(type) {
+				case *pdu.AbstractSyntaxSubItem:
+					abstractSyntax = s.Name
+					fp.abstractSyntaxes = append(fp.abstractSyntaxes, s.Name)
+				case *pdu.TransferSyntaxSubItem:
+					transferSyntaxes = append(transferSyntaxes, s.Name)
+				}
+			}
+			contexts = append(contexts, abstractSyntax+":"+strings.Join(transferSyntaxes, ","))
+		case *pdu.UserInformationItem:
+			for _, subItem := range c.Items {
+				switch s := subItem.(type) {
+				case *pdu.UserInformationMaximumLengthItem:
+					userItems = append(userItems, fmt.Sprintf("%02x", pdu.ItemTypeUserInformationMaximumLength))
+					maxLength = fmt.Sprint(s.MaximumLengthReceived)
+				case *pdu.ImplementationClassUIDSubItem:
+					userItems = append(userItems, fmt.Sprintf("%02x", pdu.ItemTypeImplementationClassUID))
+					fp.implementationClassUID = s.Name
+				case *pdu.ImplementationVersionNameSubItem:
+					userItems = append(userItems, fmt.Sprintf("%02x", pdu.ItemTypeImplementationVersionName))
+					fp.implementationVersionName = s.Name
+				case *pdu.AsynchronousOperationsWindowSubItem:
+					userItems = append(userItems, fmt.Sprintf("%02x", pdu.ItemTypeAsynchronousOperationsWindow))
+					async = fmt.Sprintf("%d/%d", s.MaxOpsInvoked, s.MaxOpsPerformed)
+				case *pdu.RoleSelectionSubItem:
+					userItems = append(userItems, fmt.Sprintf("%02x", pdu.ItemTypeRoleSelection))
+					roles = append(roles, fmt.Sprintf("%s:%d/%d", s.SOPClassUID, s.SCURole, s.SCPRole))
+				case *pdu.SubItemUnsupported:
+					// Extended negotiation and user identity: only
+					// their presence is a feature, the contents
+					// depend on the request.
+					userItems = append(userItems, fmt.Sprintf("%02x", s.Type))
+				}
+			}
+		}
+	}
+
+	sections := []string{
+		"fp1",
+		fmt.Sprintf("pv=%d", v.ProtocolVersion),
+		"ac=" + appContext,
+		"ids=" + contextIDPattern(contextIDs),
+		"pc=" + strings.Join(contexts, ";"),
+		"max=" + maxLength,
+		"impl=" + fp.implementationClassUID,
+		"ver=" + fp.implementationVersionName,
+		"ui=" + strings.Join(userItems, "."),
+		"async=" + async,
+		"roles=" + strings.Join(roles, ";"),
+		"called=" + aeTitleShape(v.CalledAETitle),
+		"calling=" + aeTitleShape(v.CallingAETitle),
+	}
+	fp.Canonical = strings.Join(sections, "|")
+	sum := sha256.Sum256([]byte(fp.Canonical))
+	fp.Hash = hex.EncodeToString(sum[:8])
+	return fp
+}
+
+// Max number of bytes of a probe fingerprint.
+const maxProbeBytes = 32
+
+// Compute the fingerprint of the first bytes of a connection that didn't
+// start with an A-ASSOCIATE-RQ.
+func fingerprintProbe(data []byte) ClientFingerprint {
+	if len(data) > maxProbeBytes {
+		data = data[:maxProbeBytes]
+	}
+	fp := ClientFingerprint{probe: hex.EncodeToString(data)}
+	fp.Canonical = "probe1|" + fp.probe
+	sum := sha256.Sum256([]byte(fp.Canonical))
+	fp.Hash = hex.EncodeToString(sum[:8])
+	return fp
+}
+
+// probeRecorder keeps the first bytes read from a connection, for
+// fingerprintProbe.
+type probeRecorder struct {
+	net.Conn
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func (r *probeRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.mu.Lock()
+	if room := maxProbeBytes - len(r.data); room > 0 && n > 0 {
+		if room > n {
+			room = n
+		}
+		r.data = append(r.data, b[:room]...)
+	}
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *probeRecorder) bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.data...)
+}
+
+// Describe the presentation context IDs: "1+2" for 1, 3, 5..., otherwise the
+// list.
+func contextIDPattern(ids []byte) string {
+	if len(ids) == 0 {
+		return "none"
+	}
+	if len(ids) > 1 {
+		step := int(ids[1]) - int(ids[0])
+		arithmetic := step > 0
+		for i := 2; i < len(ids) && arithmetic; i++ {
+			arithmetic = int(ids[i])-int(ids[i-1]) == step
+		}
+		if arithmetic {
+			return fmt.Sprintf("%d+%d", ids[0], step)
+		}
+	}
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = fmt.Sprint(id)
+	}
+	return strings.Join(list, ",")
+}
+
+// Describe the shape of a 16-byte AE title field, not its value: runs of
+// upper case letters (A), lower case letters (a), digits (9) and other
+// characters, after the number of leading spaces (^n) if any, then how the
+// field is padded: spaces (s), NULs (z), mixed (m) or not at all (-). E.g., "ECHOSCU" padded with
+// spaces is "A7/s", "ANY-SCP" is "A3-A3/s".
+func aeTitleShape(field string) string {
+	value := strings.TrimRight(field, " \x00")
+	padding := field[len(value):]
+	var b strings.Builder
+	if trimmed := strings.TrimLeft(value, " "); len(trimmed) < len(value) {
+		fmt.Fprintf(&b, "^%d", len(value)-len(trimmed))
+		value = trimmed
+	}
+	var class byte
+	run := 0
+	flush := func() {
+		if run == 0 {
+			return
+		}
+		b.WriteByte(class)
+		if run > 1 || strings.IndexByte("Aa9", class) >= 0 {
+			fmt.Fprint(&b, run)
+		}
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		next := c
+		switch {
+		case c >= 'A' && c <= 'Z':
+			next = 'A'
+		case c >= 'a' && c <= 'z':
+			next = 'a'
+		case c >= '0' && c <= '9':
+			next = '9'
+		case c < 0x20 || c > 0x7e:
+			next = '?'
+		}
+		if next != class {
+			flush()
+			class, run = next, 0
+		}
+		run++
+	}
+	flush()
+	switch {
+	case padding == "":
+		b.WriteString("/-")
+	case strings.Trim(padding, " ") == "":
+		b.WriteString("/s")
+	case strings.Trim(padding, "\x00") == "":
+		b.WriteString("/z")
+	default:
+		b.WriteString("/m")
+	}
+	return b.String()
+}
@@ -0,0 +1,260 @@
+package dicompot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/nsmfoo/dicompot/pdu"
+)
+
+const (
+	testVerificationSOPClass = "1.2.840.10008.1.1"
+	testCTImageStorage       = "1.2.840.10008.5.1.4.1.1.2"
+	testImplicitVRLE         = "1.2.840.10008.1.2"
+	testExplicitVRLE         = "1.2.840.10008.1.2.1"
+)
+
+func testAssociateRQ(calling, called string, abstractSyntaxes ...string) *pdu.AAssociate {
+	rq := &pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: 1,
+		CalledAETitle:   called,
+		CallingAETitle:  calling,
+		Items:           []pdu.SubItem{&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName}},
+	}
+	for i, uid := range abstractSyntaxes {
+		rq.Items = append(rq.Items, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: byte(2*i + 1),
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: uid},
+				&pdu.TransferSyntaxSubItem{Name: testExplicitVRLE},
+				&pdu.TransferSyntaxSubItem{Name: testImplicitVRLE},
+			},
+		})
+	}
+	rq.Items = append(rq.Items, &pdu.UserInformationItem{Items: []pdu.SubItem{
+		&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+		&pdu.ImplementationClassUIDSubItem{Name: "1.2.276.0.7230010.3.0.3.6.7"},
+		&pdu.ImplementationVersionNameSubItem{Name: "OFFIS_DCMTK_367"},
+	}})
+	return rq
+}
+
+func TestFingerprintAssociate(t *testing.T) {
+	rq := testAssociateRQ("ECHOSCU         ", "ANY-SCP         ", testVerificationSOPClass)
+	fp := fingerprintAssociate(rq)
+	want := "fp1|pv=1|ac=" + pdu.DICOMApplicationContextItemName + "|ids=1|" +
+		"pc=1.2.840.10008.1.1:1.2.840.10008.1.2.1,1.2.840.10008.1.2|max=16384|" +
+		"impl=1.2.276.0.7230010.3.0.3.6.7|ver=OFFIS_DCMTK_367|ui=51.52.55|async=none|roles=|" +
+		"called=A3-A3/s|calling=A7/s"
+	if fp.Canonical != want {
+		t.Errorf("Canonical\n got %s\nwant %s", fp.Canonical, want)
+	}
+	sum := sha256.Sum256([]byte(want))
+	if fp.Hash != hex.EncodeToString(sum[:8]) {
+		t.Errorf("Hash = %s, want the first 8 bytes of the SHA-256 of Canonical", fp.Hash)
+	}
+	if fp.callingAETitle != "ECHOSCU" || fp.calledAETitle != "ANY-SCP" {
+		t.Errorf("AE titles = %q, %q, want ECHOSCU, ANY-SCP", fp.callingAETitle, fp.calledAETitle)
+	}
+
+	// The AE titles only count by their shape.
+	if other := fingerprintAssociate(testAssociateRQ("FINDSCU         ", "ABC-XYZ         ", testVerificationSOPClass)); other.Hash != fp.Hash {
+		t.Errorf("hash changed with AE titles of the same shape")
+	}
+	for name, rq := range map[string]*pdu.AAssociate{
+		"padding":         testAssociateRQ("ECHOSCU\x00\x00\x00\x00\x00\x00\x00\x00\x00", "ANY-SCP         ", testVerificationSOPClass),
+		"contexts":        testAssociateRQ("ECHOSCU         ", "ANY-SCP         ", testVerificationSOPClass, testCTImageStorage),
+		"abstract syntax": testAssociateRQ("ECHOSCU         ", "ANY-SCP         ", testCTImageStorage),
+	} {
+		if other := fingerprintAssociate(rq); other.Hash == fp.Hash {
+			t.Errorf("hash unchanged with different %s", name)
+		}
+	}
+}
+
+func TestFingerprintProbe(t *testing.T) {
+	fp := fingerprintProbe([]byte("GET / HTTP/1.1\r\n"))
+	if fp.probe != "474554202f20485454502f312e310d0a" || fp.Canonical != "probe1|"+fp.probe {
+		t.Errorf("fingerprintProbe = %+v", fp)
+	}
+	long := fingerprintProbe(make([]byte, 2*maxProbeBytes))
+	if len(long.probe) != 2*maxProbeBytes {
+		t.Errorf("probe of %d hex digits, want %d", len(long.probe), 2*maxProbeBytes)
+	}
+}
+
+func TestContextIDPattern(t *testing.T) {
+	tests := []struct {
+		ids  []byte
+		want string
+	}{
+		{nil, "none"},
+		{[]byte{1}, "1"},
+		{[]byte{1, 3, 5, 7}, "1+2"},
+		{[]byte{3, 4}, "3+1"},
+		{[]byte{1, 3, 7}, "1,3,7"},
+		{[]byte{5, 3, 1}, "5,3,1"},
+		{[]byte{1, 1}, "1,1"},
+	}
+	for _, test := range tests {
+		if got := contextIDPattern(test.ids); got != test.want {
+			t.Errorf("contextIDPattern(%v) = %q, want %q", test.ids, got, test.want)
+		}
+	}
+}
+
+func TestAETitleShape(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"ECHOSCU         ", "A7/s"},
+		{"ANY-SCP         ", "A3-A3/s"},
+		{"STORESCU\x00\x00\x00\x00\x00\x00\x00\x00", "A8/z"},
+		{"ab12 \x00 \x00", "a292/m"},
+		{"0123456789ABCDEF", "910A6/-"},
+		{"  PACS          ", "^2A4/s"},
+		{"a..b            ", "a1.2a1/s"},
+		{"X\x01Y            ", "A1?A1/s"},
+		{"                ", "/s"},
+	}
+	for _, test := range tests {
+		if got := aeTitleShape(test.field); got != test.want {
+			t.Errorf("aeTitleShape(%q) = %q, want %q", test.field, got, test.want)
+		}
+	}
+}
+
+// A sourceName already resolved to "name".
+func resolvedSourceName(name string) *sourceName {
+	s := &sourceName{done: make(chan struct{}), name: name}
+	close(s.done)
+	return s
+}
+
+func TestSignatureMatch(t *testing.T) {
+	dcmtk := fingerprintAssociate(testAssociateRQ("ECHOSCU         ", "ANY-SCP         ", testVerificationSOPClass))
+	store := fingerprintAssociate(testAssociateRQ("STORESCU        ", "ANY-SCP         ", testVerificationSOPClass, testCTImageStorage))
+	http := fingerprintProbe([]byte("GET / HTTP/1.1\r\n"))
+	scanner := resolvedSourceName("census1.shodan.io")
+	tests := []struct {
+		name   string
+		sig    FingerprintSignature
+		fp     ClientFingerprint
+		source *sourceName
+		want   bool
+	}{
+		{"hash", FingerprintSignature{Fingerprints: []string{"00", dcmtk.Hash}}, dcmtk, nil, true},
+		{"hash case", FingerprintSignature{Fingerprints: []string{"ABCDEF"}}, ClientFingerprint{Hash: "abcdef"}, nil, true},
+		{"no attributes", FingerprintSignature{Fingerprints: []string{"00"}}, dcmtk, nil, false},
+		{"implementation prefix", FingerprintSignature{ImplementationClassUID: "1.2.276.0.7230010.3"}, dcmtk, nil, true},
+		{"implementation mismatch", FingerprintSignature{ImplementationClassUID: "1.2.826.0.1.3680043"}, dcmtk, nil, false},
+		{"version prefix", FingerprintSignature{ImplementationVersionName: "OFFIS_DCMTK"}, dcmtk, nil, true},
+		{"calling AE", FingerprintSignature{CallingAETitle: "ECHOSCU"}, dcmtk, nil, true},
+		{"calling AE mismatch", FingerprintSignature{CallingAETitle: "ECHOSCU"}, store, nil, false},
+		{"called AE", FingerprintSignature{CalledAETitle: "ANY-SCP"}, dcmtk, nil, true},
+		{"abstract syntaxes subset", FingerprintSignature{AbstractSyntaxes: []string{testVerificationSOPClass, testCTImageStorage}}, dcmtk, nil, true},
+		{"abstract syntax outside", FingerprintSignature{AbstractSyntaxes: []string{testVerificationSOPClass}}, store, nil, false},
+		{"all attributes", FingerprintSignature{ImplementationClassUID: "1.2.276", CallingAETitle: "STORESCU"}, store, nil, true},
+		{"one attribute off", FingerprintSignature{ImplementationClassUID: "1.2.276", CallingAETitle: "ECHOSCU"}, store, nil, false},
+		{"probe", FingerprintSignature{Probe: "474554"}, http, nil, true},
+		{"probe upper case", FingerprintSignature{Probe: "47455420"}, http, nil, true},
+		{"probe mismatch", FingerprintSignature{Probe: "16030"}, http, nil, false},
+		{"probe on a request", FingerprintSignature{Probe: "01"}, dcmtk, nil, false},
+		{"request attributes on a probe", FingerprintSignature{ImplementationClassUID: "1"}, http, nil, false},
+		{"reverse DNS", FingerprintSignature{ReverseDNS: "shodan.io"}, http, scanner, true},
+		{"reverse DNS exact", FingerprintSignature{ReverseDNS: "census1.shodan.io."}, http, scanner, true},
+		{"reverse DNS suffix only", FingerprintSignature{ReverseDNS: "odan.io"}, http, scanner, false},
+		{"reverse DNS unknown", FingerprintSignature{ReverseDNS: "shodan.io"}, http, nil, false},
+		{"reverse DNS and probe", FingerprintSignature{ReverseDNS: "shodan.io", Probe: "1603"}, http, scanner, false},
+	}
+	for _, test := range tests {
+		if got := test.sig.match(&test.fp, test.source); got != test.want {
+			t.Errorf("%s: match = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSignatureDBIdentify(t *testing.T) {
+	db := newSignatureDB([]FingerprintSignature{
+		{Tool: "echoscu", CallingAETitle: "ECHOSCU"},
+		{Tool: "dcmtk", ImplementationClassUID: "1.2.276.0.7230010.3"},
+	})
+	tests := []struct {
+		fp   ClientFingerprint
+		want string
+	}{
+		{fingerprintAssociate(testAssociateRQ("ECHOSCU         ", "ANY-SCP         ", testVerificationSOPClass)), "echoscu"},
+		{fingerprintAssociate(testAssociateRQ("FINDSCU         ", "ANY-SCP         ", testVerificationSOPClass)), "dcmtk"},
+		{fingerprintProbe([]byte("GET /")), ""},
+	}
+	for _, test := range tests {
+		db.identify(&test.fp, nil)
+		if test.fp.Tool != test.want {
+			t.Errorf("identify(%s) = %q, want %q", test.fp.Canonical, test.fp.Tool, test.want)
+		}
+	}
+	if db.needsSourceName() {
+		t.Errorf("needsSourceName() = true without a reverse_dns signature")
+	}
+	db.set([]FingerprintSignature{{Tool: "shodan", ReverseDNS: "shodan.io"}})
+	if !db.needsSourceName() {
+		t.Errorf("needsSourceName() = false with a reverse_dns signature")
+	}
+
+	var nilDB *signatureDB
+	fp := ClientFingerprint{}
+	nilDB.identify(&fp, nil)
+	if nilDB.needsSourceName() || fp.Tool != "" {
+		t.Errorf("nil signatureDB identified %q", fp.Tool)
+	}
+}
+
+func TestParseFingerprintSignatures(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+		ok   bool
+	}{
+		{`{"signatures": []}`, 0, true},
+		{`{"signatures": [{"tool": "a", "probe": "16"}, {"tool": "b", "fingerprints": ["00"]}]}`, 2, true},
+		{`{"signatures": [{"probe": "16"}]}`, 0, false},
+		{`{"signatures": {}}`, 0, false},
+		{`not json`, 0, false},
+	}
+	for _, test := range tests {
+		sigs, err := ParseFingerprintSignatures([]byte(test.data))
+		if (err == nil) != test.ok || len(sigs) != test.want {
+			t.Errorf("ParseFingerprintSignatures(%s) = %d signatures, %v, want %d, ok %v", test.data, len(sigs), err, test.want, test.ok)
+		}
+	}
+}
+
+func TestProbeRecorder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	r := &probeRecorder{Conn: server}
+	data := make([]byte, maxProbeBytes+8)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		client.Write(data[:10])
+		client.Write(data[10:])
+	}()
+	buf := make([]byte, len(data))
+	for n := 0; n < len(data); {
+		m, err := r.Read(buf[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if got := r.bytes(); string(got) != string(data[:maxProbeBytes]) {
+		t.Errorf("bytes() = %x, want %x", got, data[:maxProbeBytes])
+	}
+}
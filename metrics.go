@@ -0,0 +1,187 @@
+package dicompot
+
+// This file defines the Prometheus metrics exported by the ServiceProvider.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricTCPConnections = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "dicompot_tcp_connections_total",
+		Help: "TCP connections accepted by the listener.",
+	})
+	metricConnections = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_connections_total",
+		Help: "Connections by result: accepted or rejected association, or denied by IP.",
+	}, []string{"result"})
+	metricAssociations = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_associations_total",
+		Help: "Accepted associations, by calling AE title.",
+	}, []string{"calling_ae"})
+	metricRejections = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_association_rejections_total",
+		Help: "Rejected association requests, by reason.",
+	}, []string{"reason"})
+	metricCommands = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_dimse_commands_total",
+		Help: "DIMSE requests handled, by command and response status.",
+	}, []string{"command", "status"})
+	metricCFindMatches = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "dicompot_cfind_matches_total",
+		Help: "Matches returned in C-FIND responses.",
+	})
+	metricRetrievedInstances = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_retrieved_instances_total",
+		Help: "Instances sent in C-GET and C-MOVE sub-operations, by command.",
+	}, []string{"command"})
+	metricBytes = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_bytes_total",
+		Help: "Bytes transferred on provider connections, by direction (in or out).",
+	}, []string{"direction"})
+	metricFingerprints = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_client_fingerprints_total",
+		Help: "A-ASSOCIATE-RQ received, by the tool named by the fingerprint signatures, or unknown.",
+	}, []string{"tool"})
+	metricLured = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_lured_associations_total",
+		Help: "Associations accepted by the lure despite a wrong called AE title, by trigger.",
+	}, []string{"trigger"})
+	metricAnomalies = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_anomalies_total",
+		Help: "Protocol anomalies detected, by rule ID.",
+	}, []string{"rule"})
+	metricPayloadCacheRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "dicompot_payload_cache_requests_total",
+		Help: "Files sent by C-GET from the payload cache, by result: hit, miss or stream (too large to cache).",
+	}, []string{"result"})
+	metricPayloadCacheEvictions = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "dicompot_payload_cache_evictions_total",
+		Help: "Files evicted from the payload cache to stay within its budget.",
+	})
+	metricPayloadCacheBytes = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "dicompot_payload_cache_bytes",
+		Help: "Bytes of payloads in the payload cache.",
+	})
+	metricPayloadCacheEntries = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "dicompot_payload_cache_entries",
+		Help: "Files in the payload cache.",
+	})
+	metricAssociationDuration = promauto.With(metricsRegistry).NewHistogram(prometheus.HistogramOpts{
+		Name:    "dicompot_association_duration_seconds",
+		Help:    "Lifetime of provider connections.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	})
+)
+
+// The dicompot_bytes_total counters, resolved once: they are updated on every
+// read and write.
+var (
+	metricBytesIn  = metricBytes.WithLabelValues("in")
+	metricBytesOut = metricBytes.WithLabelValues("out")
+)
+
+// Rejection reasons reported in dicompot_association_rejections_total.
+const (
+	rejectCalledAETitle     = "called_ae_title"
+	rejectCallingAETitle    = "calling_ae_title"
+	rejectProtocolVersion   = "protocol_version"
+	rejectAssociateRequest  = "invalid_associate_request"
+	metricsOtherLabelValue  = "other"
+	maxCallingAETitleLabels = 1000
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics of all
+// ServiceProviders in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// AE titles are chosen by the peer. Only the first maxCallingAETitleLabels
+// distinct titles get their own label value, so a brute force run cannot blow
+// up the number of series.
+var callingAETitleLabels = struct {
+	mu     sync.Mutex
+	values map[string]bool
+}{values: make(map[string]bool)}
+
+func callingAETitleLabel(aeTitle string) string {
+	// Label values must be UTF-8, AE titles are whatever the peer sends.
+	aeTitle = strings.ToValidUTF8(aeTitle, "?")
+	callingAETitleLabels.mu.Lock()
+	defer callingAETitleLabels.mu.Unlock()
+	if !callingAETitleLabels.values[aeTitle] {
+		if len(callingAETitleLabels.values) >= maxCallingAETitleLabels {
+			return metricsOtherLabelValue
+		}
+		callingAETitleLabels.values[aeTitle] = true
+	}
+	return aeTitle
+}
+
+func observeAssociationAccepted(callingAETitle string) {
+	metricConnections.WithLabelValues("accepted").Inc()
+	metricAssociations.WithLabelValues(callingAETitleLabel(callingAETitle)).Inc()
+}
+
+func observeAssociationRejected(reason string) {
+	metricConnections.WithLabelValues("rejected").Inc()
+	metricRejections.WithLabelValues(reason).Inc()
+}
+
+func observeConnectionDenied() {
+	metricConnections.WithLabelValues("denied").Inc()
+}
+
+func observeFingerprint(tool string) {
+	if tool == "" {
+		tool = "unknown"
+	}
+	metricFingerprints.WithLabelValues(strings.ToValidUTF8(tool, "?")).Inc()
+}
+
+func observeLure(trigger string) {
+	metricLured.WithLabelValues(trigger).Inc()
+}
+
+func observeAnomaly(ruleID string) {
+	metricAnomalies.WithLabelValues(ruleID).Inc()
+}
+
+func observeCommand(command string, status dimse.Status) {
+	metricCommands.WithLabelValues(command, status.Status.String()).Inc()
+}
+
+// meteredConn counts the bytes read and written on a provider connection.
+type meteredConn struct {
+	net.Conn
+}
+
+func (c meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	metricBytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	metricBytesOut.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,50 @@
+package dicompot
+
+import (
+	"fmt"
+
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// Send an N-EVENT-REPORT request over the association that "cs" belongs to,
+// and wait for the response. The request uses the presentation context of
+// "cs".
+func runNEventReportOnAssociation(cs *serviceCommandState, report *NEventReport) error {
+	var payload []byte
+	if len(report.Elements) > 0 {
+		var err error
+		payload, err = writeElementsToBytes(report.Elements, cs.context.transferSyntaxUID)
+		if err != nil {
+			return err
+		}
+	}
+	subCs, err := cs.disp.newCommand(cs.cm, cs.context)
+	if err != nil {
+		return err
+	}
+	defer cs.disp.deleteCommand(subCs)
+	dataSetType := dimse.CommandDataSetTypeNull
+	if payload != nil {
+		dataSetType = dimse.CommandDataSetTypeNonNull
+	}
+	subCs.sendMessage(&dimse.NEventReportRq{
+		AffectedSOPClassUID:    report.SOPClassUID,
+		MessageID:              subCs.messageID,
+		CommandDataSetType:     dataSetType,
+		AffectedSOPInstanceUID: report.SOPInstanceUID,
+		EventTypeID:            report.EventTypeID,
+	}, payload)
+	event, ok := <-subCs.upcallCh
+	if !ok {
+		return fmt.Errorf("dicom.neventreport(%s): Connection closed while waiting for N-EVENT-REPORT response", cs.cm.label)
+	}
+	event.data.Close()
+	resp, ok := event.command.(*dimse.NEventReportRsp)
+	if !ok {
+		return fmt.Errorf("dicom.neventreport(%s): Invalid response for N-EVENT-REPORT: %v", cs.cm.label, event.command)
+	}
+	if resp.Status.Status != dimse.StatusSuccess {
+		return fmt.Errorf("dicom.neventreport(%s): failed: %v", cs.cm.label, resp.String())
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package dicompot
+
+// This file implements the cache of the datasets sent by C-GET: the encoded
+// payloads of the files returned without a DataSet by the CGet callback are
+// kept in memory, so that repeated retrieves don't read and encode them again.
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// PayloadCache is a bounded LRU cache of encoded datasets, keyed by file path
+// and transfer syntax. Files whose payload exceeds the budget are streamed
+// from disk instead. A nil *PayloadCache caches nothing.
+type PayloadCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Of *payloadCacheEntry, most recently used first.
+	entries map[string]*list.Element
+}
+
+// The dataset of a file, without its meta information group, ready for
+// C-STORE.
+type instancePayload struct {
+	sopClassUID    string
+	sopInstanceUID string
+	data           []byte    // Set if in memory.
+	reader         io.Reader // Else, "size" bytes read from the file.
+	size           int64
+	file           *os.File // To close once sent, if streamed.
+}
+
+// The payloads of a file, by transfer syntax.
+type payloadCacheEntry struct {
+	path           string
+	modTime        time.Time
+	fileSize       int64 // To tell when the file changed.
+	sopClassUID    string
+	sopInstanceUID string
+	payloads       map[string][]byte
+	size           int64
+}
+
+// NewPayloadCache creates a cache holding up to maxBytes of payloads.
+func NewPayloadCache(maxBytes int64) *PayloadCache {
+	return &PayloadCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Purge empties the cache.
+func (c *PayloadCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.size = 0
+	c.updateMetrics()
+}
+
+// The SOP class and instance of the file cached for "path", if it didn't
+// change since.
+func (c *PayloadCache) instance(path string, info os.FileInfo) (string, string, bool) {
+	if c == nil {
+		return "", "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[path]
+	if !ok {
+		return "", "", false
+	}
+	e := elem.Value.(*payloadCacheEntry)
+	if !e.modTime.Equal(info.ModTime()) || e.fileSize != info.Size() {
+		c.remove(elem)
+		return "", "", false
+	}
+	return e.sopClassUID, e.sopInstanceUID, true
+}
+
+func (c *PayloadCache) get(path string, transferSyntaxUID string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	data, ok := elem.Value.(*payloadCacheEntry).payloads[transferSyntaxUID]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	return data, ok
+}
+
+func (c *PayloadCache) add(path string, info os.FileInfo, transferSyntaxUID string, payload instancePayload) {
+	if c == nil || int64(len(payload.data)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var e *payloadCacheEntry
+	if elem, ok := c.entries[path]; ok {
+		e = elem.Value.(*payloadCacheEntry)
+		if !e.modTime.Equal(info.ModTime()) || e.fileSize != info.Size() || e.sopInstanceUID != payload.sopInstanceUID {
+			c.remove(elem)
+			e = nil
+		} else {
+			c.lru.MoveToFront(elem)
+		}
+	}
+	if e == nil {
+		e = &payloadCacheEntry{
+			path:           path,
+			modTime:        info.ModTime(),
+			fileSize:       info.Size(),
+			sopClassUID:    payload.sopClassUID,
+			sopInstanceUID: payload.sopInstanceUID,
+			payloads:       make(map[string][]byte),
+		}
+		c.entries[path] = c.lru.PushFront(e)
+	}
+	if old, ok := e.payloads[transferSyntaxUID]; ok {
+		delete(e.payloads, transferSyntaxUID)
+		e.size -= int64(len(old))
+		c.size -= int64(len(old))
+	}
+	// An entry must fit on its own: drop its payloads in other transfer
+	// syntaxes to make room.
+	for ts, data := range e.payloads {
+		if e.size+int64(len(payload.data)) <= c.maxBytes {
+			break
+		}
+		delete(e.payloads, ts)
+		e.size -= int64(len(data))
+		c.size -= int64(len(data))
+	}
+	e.payloads[transferSyntaxUID] = payload.data
+	e.size += int64(len(payload.data))
+	c.size += int64(len(payload.data))
+	// The entry just added is at the front and fits.
+	for c.size > c.maxBytes && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+		metricPayloadCacheEvictions.Inc()
+	}
+	c.updateMetrics()
+}
+
+// Must be called with c.mu held.
+func (c *PayloadCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*payloadCacheEntry)
+	delete(c.entries, e.path)
+	c.size -= e.size
+	c.updateMetrics()
+}
+
+// Must be called with c.mu held.
+func (c *PayloadCache) updateMetrics() {
+	metricPayloadCacheBytes.Set(float64(c.size))
+	metricPayloadCacheEntries.Set(float64(len(c.entries)))
+}
+
+// Return the payload of the file at "path", in the transfer syntax that
+// "syntax" gives for its SOP class. The dataset is sent as stored when the
+// file is in that transfer syntax, and re-encoded otherwise. The caller must
+// close payload.file, if set.
+func (c *PayloadCache) load(path string, syntax func(sopClassUID string) (string, error)) (instancePayload, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return instancePayload{}, err
+	}
+	if sopClassUID, sopInstanceUID, ok := c.instance(path, info); ok {
+		transferSyntaxUID, err := syntax(sopClassUID)
+		if err != nil {
+			return instancePayload{}, err
+		}
+		if data, ok := c.get(path, transferSyntaxUID); ok {
+			metricPayloadCacheRequests.WithLabelValues("hit").Inc()
+			return instancePayload{
+				sopClassUID:    sopClassUID,
+				sopInstanceUID: sopInstanceUID,
+				data:           data,
+				size:           int64(len(data)),
+			}, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return instancePayload{}, err
+	}
+	d := dicomio.NewDecoder(f, binary.LittleEndian, dicomio.ExplicitVR)
+	meta := dicom.ParseFileHeader(d)
+	if err := d.Error(); err != nil {
+		f.Close()
+		return instancePayload{}, fmt.Errorf("%s: %v", path, err)
+	}
+	metaString := func(tag dicomtag.Tag) string {
+		for _, elem := range meta {
+			if elem.Tag == tag {
+				s, _ := elem.GetString()
+				return strings.TrimRight(s, " \x00")
+			}
+		}
+		return ""
+	}
+	payload := instancePayload{
+		sopClassUID:    metaString(dicomtag.MediaStorageSOPClassUID),
+		sopInstanceUID: metaString(dicomtag.MediaStorageSOPInstanceUID),
+	}
+	if payload.sopClassUID == "" || payload.sopInstanceUID == "" {
+		f.Close()
+		return instancePayload{}, fmt.Errorf("%s: file meta information lacks the SOP class or instance UID", path)
+	}
+	transferSyntaxUID, err := syntax(payload.sopClassUID)
+	if err != nil {
+		f.Close()
+		return instancePayload{}, err
+	}
+
+	if metaString(dicomtag.TransferSyntaxUID) == transferSyntaxUID {
+		offset := d.BytesRead()
+		payload.size = info.Size() - offset
+		if c == nil || payload.size > c.maxBytes {
+			metricPayloadCacheRequests.WithLabelValues("stream").Inc()
+			payload.reader = io.NewSectionReader(f, offset, payload.size)
+			payload.file = f
+			return payload, nil
+		}
+		payload.data = make([]byte, payload.size)
+		_, err := f.ReadAt(payload.data, offset)
+		f.Close()
+		if err != nil {
+			return instancePayload{}, err
+		}
+	} else {
+		f.Close()
+		ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+		if err != nil {
+			return instancePayload{}, err
+		}
+		if payload.data, err = encodeDataSet(ds, transferSyntaxUID); err != nil {
+			return instancePayload{}, err
+		}
+		payload.size = int64(len(payload.data))
+	}
+	metricPayloadCacheRequests.WithLabelValues("miss").Inc()
+	c.add(path, info, transferSyntaxUID, payload)
+	return payload, nil
+}
+
+// Encode the dataset, without its meta information group.
+func encodeDataSet(ds *dicom.DataSet, transferSyntaxUID string) ([]byte, error) {
+	e := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
+	for _, elem := range ds.Elements {
+		if elem.Tag.Group == dicomtag.MetadataGroup {
+			continue
+		}
+		dicom.WriteElement(e, elem)
+	}
+	if err := e.Error(); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
@@ -0,0 +1,264 @@
+package dicompot
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+type testFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) ModTime() time.Time { return fi.modTime }
+
+var testFileTime = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func testPayload(instance string, size int) instancePayload {
+	return instancePayload{sopClassUID: testCTImageStorage, sopInstanceUID: instance, data: make([]byte, size)}
+}
+
+func TestPayloadCacheAdd(t *testing.T) {
+	info := testFileInfo{size: 1000, modTime: testFileTime}
+	type add struct {
+		path string
+		ts   string
+		size int
+	}
+	type entry struct {
+		path string
+		ts   string
+	}
+	tests := []struct {
+		name    string
+		adds    []add
+		size    int64   // Bytes cached afterwards
+		cached  []entry // Payloads still cached
+		evicted []entry // Payloads gone
+	}{
+		{"fits", []add{
+			{"a", testExplicitVRLE, 40},
+			{"b", testExplicitVRLE, 40},
+		}, 80, []entry{{"a", testExplicitVRLE}, {"b", testExplicitVRLE}}, nil},
+		{"least recently used evicted", []add{
+			{"a", testExplicitVRLE, 40},
+			{"b", testExplicitVRLE, 40},
+			{"c", testExplicitVRLE, 40},
+		}, 80, []entry{{"b", testExplicitVRLE}, {"c", testExplicitVRLE}}, []entry{{"a", testExplicitVRLE}}},
+		{"second syntax of one file", []add{
+			{"a", testExplicitVRLE, 40},
+			{"a", testImplicitVRLE, 40},
+		}, 80, []entry{{"a", testExplicitVRLE}, {"a", testImplicitVRLE}}, nil},
+		{"entry must fit on its own", []add{
+			{"a", testExplicitVRLE, 60},
+			{"a", testImplicitVRLE, 60},
+		}, 60, []entry{{"a", testImplicitVRLE}}, []entry{{"a", testExplicitVRLE}}},
+		{"replaced payload", []add{
+			{"a", testExplicitVRLE, 60},
+			{"a", testExplicitVRLE, 30},
+		}, 30, []entry{{"a", testExplicitVRLE}}, nil},
+		{"too large", []add{
+			{"a", testExplicitVRLE, 40},
+			{"b", testExplicitVRLE, 101},
+		}, 40, []entry{{"a", testExplicitVRLE}}, []entry{{"b", testExplicitVRLE}}},
+		{"exactly the budget", []add{
+			{"a", testExplicitVRLE, 40},
+			{"b", testExplicitVRLE, 100},
+		}, 100, []entry{{"b", testExplicitVRLE}}, []entry{{"a", testExplicitVRLE}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewPayloadCache(100)
+			for _, a := range test.adds {
+				c.add(a.path, info, a.ts, testPayload("1.2.3."+a.path, a.size))
+			}
+			if c.size != test.size {
+				t.Errorf("size = %d, want %d", c.size, test.size)
+			}
+			for _, e := range test.cached {
+				if _, ok := c.get(e.path, e.ts); !ok {
+					t.Errorf("%s in %s not cached", e.path, e.ts)
+				}
+			}
+			for _, e := range test.evicted {
+				if _, ok := c.get(e.path, e.ts); ok {
+					t.Errorf("%s in %s still cached", e.path, e.ts)
+				}
+			}
+		})
+	}
+}
+
+func TestPayloadCacheGetRefreshes(t *testing.T) {
+	info := testFileInfo{size: 1000, modTime: testFileTime}
+	c := NewPayloadCache(100)
+	c.add("a", info, testExplicitVRLE, testPayload("1.2.3.1", 40))
+	c.add("b", info, testExplicitVRLE, testPayload("1.2.3.2", 40))
+	c.get("a", testExplicitVRLE)
+	c.add("c", info, testExplicitVRLE, testPayload("1.2.3.3", 40))
+	if _, ok := c.get("a", testExplicitVRLE); !ok {
+		t.Errorf("recently used a evicted")
+	}
+	if _, ok := c.get("b", testExplicitVRLE); ok {
+		t.Errorf("least recently used b still cached")
+	}
+}
+
+func TestPayloadCacheInstance(t *testing.T) {
+	info := testFileInfo{size: 1000, modTime: testFileTime}
+	tests := []struct {
+		name string
+		info os.FileInfo
+		want bool
+	}{
+		{"unchanged", info, true},
+		{"modified", testFileInfo{size: 1000, modTime: testFileTime.Add(time.Second)}, false},
+		{"resized", testFileInfo{size: 1001, modTime: testFileTime}, false},
+	}
+	for _, test := range tests {
+		c := NewPayloadCache(100)
+		c.add("a", info, testExplicitVRLE, testPayload("1.2.3.1", 40))
+		class, instance, ok := c.instance("a", test.info)
+		if ok != test.want {
+			t.Errorf("%s: instance() ok = %v, want %v", test.name, ok, test.want)
+		}
+		if ok && (class != testCTImageStorage || instance != "1.2.3.1") {
+			t.Errorf("%s: instance() = %s, %s", test.name, class, instance)
+		}
+		if !ok && c.size != 0 {
+			t.Errorf("%s: %d bytes left for a stale entry", test.name, c.size)
+		}
+	}
+}
+
+func TestPayloadCacheNil(t *testing.T) {
+	var c *PayloadCache
+	info := testFileInfo{size: 1000, modTime: testFileTime}
+	c.add("a", info, testExplicitVRLE, testPayload("1.2.3.1", 40))
+	if _, ok := c.get("a", testExplicitVRLE); ok {
+		t.Errorf("nil cache returned a payload")
+	}
+	if _, _, ok := c.instance("a", info); ok {
+		t.Errorf("nil cache returned an instance")
+	}
+	c.Purge()
+}
+
+func TestPayloadCachePurge(t *testing.T) {
+	info := testFileInfo{size: 1000, modTime: testFileTime}
+	c := NewPayloadCache(100)
+	c.add("a", info, testExplicitVRLE, testPayload("1.2.3.1", 40))
+	c.Purge()
+	if _, ok := c.get("a", testExplicitVRLE); ok || c.size != 0 || c.lru.Len() != 0 {
+		t.Errorf("Purge left %d bytes, %d entries", c.size, c.lru.Len())
+	}
+}
+
+// Write a small CT dataset to a file in "ts" and return its path.
+func writeTestFile(t *testing.T, ts string) string {
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, testCTImageStorage),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, "1.2.3.4"),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, ts),
+		dicom.MustNewElement(dicomtag.SOPClassUID, testCTImageStorage),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4"),
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^Jane"),
+	}}
+	path := filepath.Join(t.TempDir(), "ct.dcm")
+	if err := dicom.WriteDataSetToFile(path, ds); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPayloadCacheLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		fileTS   string
+		ts       string
+		streamed bool
+		cached   bool
+	}{
+		{"as stored", 1 << 20, testExplicitVRLE, testExplicitVRLE, false, true},
+		{"re-encoded", 1 << 20, testExplicitVRLE, testImplicitVRLE, false, true},
+		{"over the budget", 16, testExplicitVRLE, testExplicitVRLE, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeTestFile(t, test.fileTS)
+			c := NewPayloadCache(test.maxBytes)
+			syntax := func(string) (string, error) { return test.ts, nil }
+			payload, err := c.load(path, syntax)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload.sopClassUID != testCTImageStorage || payload.sopInstanceUID != "1.2.3.4" {
+				t.Errorf("load = %s, %s", payload.sopClassUID, payload.sopInstanceUID)
+			}
+			data := payload.data
+			if test.streamed {
+				if payload.reader == nil || payload.file == nil {
+					t.Fatalf("payload of %d bytes not streamed", payload.size)
+				}
+				data, _ = io.ReadAll(payload.reader)
+				payload.file.Close()
+			}
+			if int64(len(data)) != payload.size {
+				t.Errorf("%d bytes read, size %d", len(data), payload.size)
+			}
+			if !bytes.Contains(data, []byte("Doe^Jane")) {
+				t.Errorf("payload lacks the patient name")
+			}
+			cached, ok := c.get(path, test.ts)
+			if ok != test.cached {
+				t.Errorf("cached = %v, want %v", ok, test.cached)
+			}
+			if ok && !bytes.Equal(cached, data) {
+				t.Errorf("cached payload differs from the one returned")
+			}
+		})
+	}
+}
+
+func TestPayloadCacheLoadInvalidated(t *testing.T) {
+	path := writeTestFile(t, testExplicitVRLE)
+	c := NewPayloadCache(1 << 20)
+	syntax := func(string) (string, error) { return testExplicitVRLE, nil }
+	if _, err := c.load(path, syntax); err != nil {
+		t.Fatal(err)
+	}
+	// Rewrite the file with another patient, and another mtime.
+	f, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, elem := range f.Elements {
+		if elem.Tag == dicomtag.PatientName {
+			f.Elements[i] = dicom.MustNewElement(dicomtag.PatientName, "Roe^Richard")
+		}
+	}
+	if err := dicom.WriteDataSetToFile(path, f); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := c.load(path, syntax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(payload.data, []byte("Roe^Richard")) {
+		t.Errorf("stale payload returned after the file changed")
+	}
+}
@@ -5,6 +5,7 @@ package pdu
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
@@ -56,6 +57,12 @@ const (
 	ItemTypeAsynchronousOperationsWindow = 0x53
 	ItemTypeRoleSelection                = 0x54
 	ItemTypeImplementationVersionName    = 0x55
+
+	// Decoded as SubItemUnsupported.
+	ItemTypeSOPClassExtendedNegotiation       = 0x56
+	ItemTypeSOPClassCommonExtendedNegotiation = 0x57
+	ItemTypeUserIdentityRequest               = 0x58
+	ItemTypeUserIdentityResponse              = 0x59
 )
 
 func decodeSubItem(d *dicomio.Decoder) SubItem {
@@ -85,6 +92,9 @@ func decodeSubItem(d *dicomio.Decoder) SubItem {
 		return decodeRoleSelectionSubItem(d, length)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeSOPClassExtendedNegotiation, ItemTypeSOPClassCommonExtendedNegotiation,
+		ItemTypeUserIdentityRequest, ItemTypeUserIdentityResponse:
+		return &SubItemUnsupported{Type: itemType, Data: d.ReadBytes(int(length))}
 	default:
 		d.SetError(fmt.Errorf("Unknown item type: 0x%x", itemType))
 		return nil
@@ -363,7 +373,8 @@ func decodePresentationContextItem(d *dicomio.Decoder, itemType byte, length uin
 func (v *PresentationContextItem) Write(e *dicomio.Encoder) {
 	if v.Type != ItemTypePresentationContextRequest &&
 		v.Type != ItemTypePresentationContextResponse {
-		panic(*v)
+		e.SetError(fmt.Errorf("PresentationContextItem has invalid type %v", v.Type))
+		return
 	}
 
 	itemEncoder := dicomio.NewBytesEncoder(binary.BigEndian, dicomio.UnknownVR)
@@ -406,6 +417,10 @@ type PresentationDataValueItem struct {
 func ReadPresentationDataValueItem(d *dicomio.Decoder) PresentationDataValueItem {
 	item := PresentationDataValueItem{}
 	length := d.ReadUInt32()
+	if length < 2 {
+		d.SetError(fmt.Errorf("PresentationDataValueItem: invalid length %d", length))
+		return item
+	}
 	item.ContextID = d.ReadByte()
 	header := d.ReadByte()
 	item.Command = (header&1 != 0)
@@ -449,7 +464,7 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	case *AAbort:
 		pduType = TypeAAbort
 	default:
-		panic(fmt.Sprintf("Unknown PDU %v", pdu))
+		return nil, fmt.Errorf("Unknown PDU %v", pdu)
 	}
 	e := dicomio.NewBytesEncoder(binary.BigEndian, dicomio.UnknownVR)
 	pdu.WritePayload(e)
@@ -465,6 +480,10 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	return append(header[:], payload...), nil
 }
 
+// ErrJunk is returned by ReadPDU when bytes are left after the items of a
+// PDU, i.e. the PDU length is larger than its items.
+var ErrJunk = errors.New("ReadPDU: junk after the PDU items")
+
 // EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
 // possible PDU size, in bytes, accepted by the caller.
 func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
@@ -491,6 +510,9 @@ func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 		&io.LimitedReader{R: in, N: int64(length)},
 		binary.BigEndian,  // PDU is always big endian
 		dicomio.UnknownVR) // irrelevant for PDU parsing
+	// The decoder doesn't know the input size otherwise, and would trust
+	// the length fields of the items.
+	d.PushLimit(int64(length))
 	var pdu PDU
 	switch pduType {
 	case TypeAAssociateRq:
@@ -513,6 +535,10 @@ func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 		return nil, err
 	}
 	if err := d.Finish(); err != nil {
+		if d.Error() == nil {
+			// Finish only fails this way if bytes are left.
+			return nil, ErrJunk
+		}
 		return nil, err
 	}
 	return pdu, nil
@@ -602,7 +628,8 @@ func decodeAAssociate(d *dicomio.Decoder, pduType Type) *AAssociate {
 
 func (pdu *AAssociate) WritePayload(e *dicomio.Encoder) {
 	if pdu.Type == 0 || pdu.CalledAETitle == "" || pdu.CallingAETitle == "" {
-		panic(*pdu)
+		e.SetError(fmt.Errorf("A_ASSOCIATE type and AE titles must not be empty, in %v", pdu.String()))
+		return
 	}
 	e.WriteUInt16(pdu.ProtocolVersion)
 	e.WriteZeros(2) // Reserved
@@ -0,0 +1,104 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// PDUs of a typical association, for the seed corpus.
+func seedPDUs() []PDU {
+	return []PDU{
+		&AAssociate{
+			Type:            TypeAAssociateRq,
+			ProtocolVersion: CurrentProtocolVersion,
+			CalledAETitle:   "ANY-SCP",
+			CallingAETitle:  "FINDSCU",
+			Items: []SubItem{
+				&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+				&PresentationContextItem{
+					Type:      ItemTypePresentationContextRequest,
+					ContextID: 1,
+					Items: []SubItem{
+						&AbstractSyntaxSubItem{Name: "1.2.840.10008.5.1.4.1.2.2.1"},
+						&TransferSyntaxSubItem{Name: "1.2.840.10008.1.2.1"},
+						&TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"},
+					},
+				},
+				&UserInformationItem{
+					Items: []SubItem{
+						&UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+						&ImplementationClassUIDSubItem{Name: "1.2.276.0.7230010.3.0.3.6.4"},
+						&AsynchronousOperationsWindowSubItem{MaxOpsInvoked: 1, MaxOpsPerformed: 1},
+						&RoleSelectionSubItem{SOPClassUID: "1.2.840.10008.5.1.4.1.1.7", SCURole: 1, SCPRole: 1},
+						&ImplementationVersionNameSubItem{Name: "OFFIS_DCMTK_364"},
+					},
+				},
+			},
+		},
+		&AAssociate{
+			Type:            TypeAAssociateAc,
+			ProtocolVersion: CurrentProtocolVersion,
+			CalledAETitle:   "ANY-SCP",
+			CallingAETitle:  "FINDSCU",
+			Items: []SubItem{
+				&ApplicationContextItem{Name: DICOMApplicationContextItemName},
+				&PresentationContextItem{
+					Type:      ItemTypePresentationContextResponse,
+					ContextID: 1,
+					Result:    PresentationContextAccepted,
+					Items:     []SubItem{&TransferSyntaxSubItem{Name: "1.2.840.10008.1.2.1"}},
+				},
+				&UserInformationItem{
+					Items: []SubItem{&UserInformationMaximumLengthItem{MaximumLengthReceived: 16384}},
+				},
+			},
+		},
+		&AAssociateRj{Result: ResultRejectedPermanent, Source: SourceULServiceUser, Reason: RejectReasonCalledAETitleNotRecognized},
+		&PDataTf{Items: []PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: []byte{0, 0, 0, 0, 4, 0, 0, 0, 0x30, 0, 0, 0}},
+			{ContextID: 1, Command: false, Last: false, Value: []byte{8, 0, 0x52, 0, 6, 0, 0, 0, 'S', 'T', 'U', 'D', 'Y', ' '}},
+		}},
+		&AReleaseRq{},
+		&AReleaseRp{},
+		&AAbort{Source: SourceULServiceProviderACSE, Reason: 0},
+	}
+}
+
+func FuzzReadPDU(f *testing.F) {
+	for _, pdu := range seedPDUs() {
+		b, err := EncodePDU(pdu)
+		if err != nil {
+			f.Fatalf("EncodePDU(%v): %v", pdu, err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pdu, err := ReadPDU(bytes.NewReader(b), 1<<16)
+		if err != nil {
+			return
+		}
+		// What was read must be written back.
+		if _, err := EncodePDU(pdu); err != nil {
+			return
+		}
+		_ = pdu.String()
+	})
+}
+
+func TestReadPDUJunk(t *testing.T) {
+	b, err := EncodePDU(&AReleaseRq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPDU(bytes.NewReader(b), 1<<16); err != nil {
+		t.Fatalf("ReadPDU: %v", err)
+	}
+	// The same PDU, claiming 4 more bytes than its items.
+	b = append(b, 1, 2, 3, 4)
+	binary.BigEndian.PutUint32(b[2:], uint32(len(b)-6))
+	if _, err := ReadPDU(bytes.NewReader(b), 1<<16); !errors.Is(err, ErrJunk) {
+		t.Errorf("ReadPDU: got %v, want ErrJunk", err)
+	}
+}
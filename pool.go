@@ -0,0 +1,256 @@
+package dicompot
+
+// This file implements AssociationPool: associations to remote AEs kept open
+// and shared by concurrent clients.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// ErrPoolClosed is returned by AssociationPool.Session once the pool is
+// closed.
+var ErrPoolClosed = errors.New("dicom.associationPool: Pool closed")
+
+// RemoteAE is a peer of an AssociationPool.
+type RemoteAE struct {
+	AETitle string // Called AE title.
+	Address string // "host:port".
+}
+
+// AssociationPoolParams defines parameters for an AssociationPool.
+type AssociationPoolParams struct {
+	// Parameters of the associations. CalledAETitle is ignored, the AE
+	// title of the RemoteAE is used instead.
+	ServiceUserParams
+
+	// Max associations per remote AE. If zero, set to 4.
+	Size int
+
+	// Associations left unused for longer are released instead of reused.
+	// Zero keeps them for as long as the remote AE does.
+	IdleTimeout time.Duration
+}
+
+// AssociationPool keeps up to Size associations per remote AE and hands them
+// out as PoolSessions, one command at a time each, so that CEcho, CFind and
+// CGet run in parallel. Associations that failed or that the remote AE closed
+// are dropped, and a new one is opened for the next Session. It is safe for
+// concurrent use.
+type AssociationPool struct {
+	params AssociationPoolParams
+
+	mu      sync.Mutex
+	closed  bool
+	remotes map[RemoteAE]*poolRemote
+}
+
+// The associations to a remote AE.
+type poolRemote struct {
+	slots chan struct{}       // Holds a token per association handed out or being opened.
+	idle  []pooledAssociation // Guarded by AssociationPool.mu. Most recently used last.
+}
+
+type pooledAssociation struct {
+	su       *ServiceUser
+	lastUsed time.Time
+}
+
+// NewAssociationPool creates an AssociationPool. No association is opened
+// until a Session is asked for.
+func NewAssociationPool(params AssociationPoolParams) (*AssociationPool, error) {
+	if err := validateServiceUserParams(&params.ServiceUserParams); err != nil {
+		return nil, err
+	}
+	if params.Size <= 0 {
+		params.Size = 4
+	}
+	return &AssociationPool{
+		params:  params,
+		remotes: make(map[RemoteAE]*poolRemote),
+	}, nil
+}
+
+// Session hands out an association to "remote": an idle one if any, else a new
+// one once fewer than Size are handed out. If ctx expires first, ctx.Err() is
+// returned. The PoolSession must be closed to give the association back.
+func (p *AssociationPool) Session(ctx context.Context, remote RemoteAE) (*PoolSession, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	r, ok := p.remotes[remote]
+	if !ok {
+		r = &poolRemote{slots: make(chan struct{}, p.params.Size)}
+		p.remotes[remote] = r
+	}
+	p.mu.Unlock()
+
+	select {
+	case r.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		su := p.takeIdle(r)
+		if su == nil {
+			break
+		}
+		if su.active() {
+			return &PoolSession{pool: p, remote: r, su: su}, nil
+		}
+		su.Release()
+	}
+	su, err := p.connect(ctx, remote)
+	if err != nil {
+		<-r.slots
+		return nil, err
+	}
+	return &PoolSession{pool: p, remote: r, su: su}, nil
+}
+
+// The most recently used idle association of "r", or nil. The ones idle for
+// longer than IdleTimeout are released.
+func (p *AssociationPool) takeIdle(r *poolRemote) *ServiceUser {
+	p.mu.Lock()
+	var expired []*ServiceUser
+	if p.params.IdleTimeout > 0 {
+		// Most recently used last: the expired ones come first.
+		now := time.Now()
+		n := 0
+		for n < len(r.idle) && now.Sub(r.idle[n].lastUsed) > p.params.IdleTimeout {
+			expired = append(expired, r.idle[n].su)
+			n++
+		}
+		r.idle = r.idle[n:]
+	}
+	var su *ServiceUser
+	if n := len(r.idle); n > 0 {
+		su = r.idle[n-1].su
+		r.idle = r.idle[:n-1]
+	}
+	p.mu.Unlock()
+	for _, su := range expired {
+		su.Release()
+	}
+	return su
+}
+
+// Open a new association to "remote".
+func (p *AssociationPool) connect(ctx context.Context, remote RemoteAE) (*ServiceUser, error) {
+	params := p.params.ServiceUserParams
+	params.CalledAETitle = remote.AETitle
+	// NewServiceUser rewrites the transfer syntaxes in place.
+	params.SOPClasses = append([]string(nil), params.SOPClasses...)
+	params.TransferSyntaxes = append([]string(nil), params.TransferSyntaxes...)
+	su, err := NewServiceUser(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := su.ConnectContext(ctx, remote.Address); err != nil {
+		su.Release()
+		return nil, err
+	}
+	return su, nil
+}
+
+// Give an association back to the pool, or release it if it failed or the
+// pool is closed.
+func (p *AssociationPool) put(r *poolRemote, su *ServiceUser, failed bool) {
+	p.mu.Lock()
+	keep := !p.closed && !failed && su.active()
+	if keep {
+		r.idle = append(r.idle, pooledAssociation{su: su, lastUsed: time.Now()})
+	}
+	p.mu.Unlock()
+	if !keep {
+		su.Release()
+	}
+	<-r.slots
+}
+
+// Close releases the idle associations. The ones handed out are released when
+// their PoolSession is closed. Session fails with ErrPoolClosed afterwards.
+func (p *AssociationPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	var idle []*ServiceUser
+	for _, r := range p.remotes {
+		for _, a := range r.idle {
+			idle = append(idle, a.su)
+		}
+		r.idle = nil
+	}
+	p.mu.Unlock()
+	for _, su := range idle {
+		su.Release()
+	}
+}
+
+// PoolSession is an association handed out by an AssociationPool. An
+// association on which a command failed is not reused. A PoolSession is meant
+// for one goroutine; it must be closed once done.
+type PoolSession struct {
+	pool   *AssociationPool
+	remote *poolRemote
+	su     *ServiceUser
+
+	mu     sync.Mutex
+	failed bool
+	closed bool
+}
+
+func (s *PoolSession) fail(err error) error {
+	if err != nil {
+		s.mu.Lock()
+		s.failed = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// CEcho is ServiceUser.CEchoContext on the association of the PoolSession.
+func (s *PoolSession) CEcho(ctx context.Context) error {
+	return s.fail(s.su.CEchoContext(ctx))
+}
+
+// CFind is ServiceUser.CFindContext on the association of the PoolSession.
+// All the results must be read before the PoolSession is closed.
+func (s *PoolSession) CFind(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	results := s.su.CFindContext(ctx, qrLevel, filter)
+	ch := make(chan CFindResult, cap(results))
+	go func() {
+		defer close(ch)
+		for r := range results {
+			s.fail(r.Err)
+			ch <- r
+		}
+	}()
+	return ch
+}
+
+// CGet is ServiceUser.CGetContext on the association of the PoolSession.
+func (s *PoolSession) CGet(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	return s.fail(s.su.CGetContext(ctx, qrLevel, filter, cb))
+}
+
+// Close gives the association back to the pool. Calling it again has no
+// effect.
+func (s *PoolSession) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	failed := s.failed
+	s.mu.Unlock()
+	s.pool.put(s.remote, s.su, failed)
+}
@@ -0,0 +1,211 @@
+package dicompot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// Start a ServiceProvider answering C-ECHO to any called AE title on a local
+// port. Returns its address.
+func testEchoProvider(t *testing.T) string {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "DICOMPOT",
+		Enforce: "no",
+		CEcho:   func(ConnectionState) dimse.Status { return dimse.Success },
+	}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sp.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := sp.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return sp.listener.Addr().String()
+}
+
+func testPool(t *testing.T, size int, idleTimeout time.Duration) *AssociationPool {
+	p, err := NewAssociationPool(AssociationPoolParams{
+		ServiceUserParams: ServiceUserParams{
+			CallingAETitle: "SCU",
+			SOPClasses:     []string{testVerificationSOPClass},
+		},
+		Size:        size,
+		IdleTimeout: idleTimeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func poolSession(t *testing.T, p *AssociationPool, remote RemoteAE) *PoolSession {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := p.Session(ctx, remote)
+	if err != nil {
+		t.Fatalf("Session(%v): %v", remote, err)
+	}
+	if err := s.CEcho(ctx); err != nil {
+		t.Fatalf("CEcho: %v", err)
+	}
+	return s
+}
+
+func TestAssociationPoolReuse(t *testing.T) {
+	remote := RemoteAE{AETitle: "DICOMPOT", Address: testEchoProvider(t)}
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		wait        time.Duration // Between Close and the next Session
+		fail        bool          // A command failed on the first session
+		reused      bool
+	}{
+		{"idle", 0, 0, false, true},
+		{"within the idle timeout", time.Minute, 0, false, true},
+		{"past the idle timeout", 10 * time.Millisecond, 50 * time.Millisecond, false, false},
+		{"failed", 0, 0, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := testPool(t, 2, test.idleTimeout)
+			first := poolSession(t, p, remote)
+			if test.fail {
+				first.fail(errors.New("command failed"))
+			}
+			first.Close()
+			time.Sleep(test.wait)
+			second := poolSession(t, p, remote)
+			defer second.Close()
+			if reused := second.su == first.su; reused != test.reused {
+				t.Errorf("association reused = %v, want %v", reused, test.reused)
+			}
+			if !test.reused && first.su.active() {
+				t.Errorf("association not reused but still active")
+			}
+		})
+	}
+}
+
+func TestAssociationPoolSize(t *testing.T) {
+	remote := RemoteAE{AETitle: "DICOMPOT", Address: testEchoProvider(t)}
+	p := testPool(t, 1, 0)
+	first := poolSession(t, p, remote)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Session(ctx, remote); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Session past Size = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Another remote AE has associations of its own.
+	other := poolSession(t, p, RemoteAE{AETitle: "OTHER", Address: remote.Address})
+	other.Close()
+
+	first.Close()
+	first.Close()
+	second := poolSession(t, p, remote)
+	second.Close()
+}
+
+func TestAssociationPoolConcurrent(t *testing.T) {
+	remote := RemoteAE{AETitle: "DICOMPOT", Address: testEchoProvider(t)}
+	p := testPool(t, 2, 0)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		used = make(map[*ServiceUser]bool)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				s, err := p.Session(ctx, remote)
+				if err != nil {
+					cancel()
+					t.Error(err)
+					return
+				}
+				if err := s.CEcho(ctx); err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				used[s.su] = true
+				mu.Unlock()
+				s.Close()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(used) == 0 || len(used) > 2 {
+		t.Errorf("%d associations used, want 1 or 2", len(used))
+	}
+}
+
+func TestAssociationPoolClose(t *testing.T) {
+	remote := RemoteAE{AETitle: "DICOMPOT", Address: testEchoProvider(t)}
+	p := testPool(t, 2, 0)
+	idle := poolSession(t, p, remote)
+	busy := poolSession(t, p, remote)
+	idle.Close()
+
+	p.Close()
+	if idle.su.active() {
+		t.Errorf("idle association still active after Close")
+	}
+	if !busy.su.active() {
+		t.Errorf("association handed out released by Close")
+	}
+	busy.Close()
+	if busy.su.active() {
+		t.Errorf("association given back after Close still active")
+	}
+	if _, err := p.Session(context.Background(), remote); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Session after Close = %v, want %v", err, ErrPoolClosed)
+	}
+}
+
+func TestAssociationPoolConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	p := testPool(t, 1, 0)
+	// The slot of a failed connect is given back: the second try fails the
+	// same way instead of waiting.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := p.Session(ctx, RemoteAE{AETitle: "DICOMPOT", Address: addr})
+		cancel()
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Session %d to a closed port = %v, want a connect error", i, err)
+		}
+	}
+}
+
+func TestNewAssociationPool(t *testing.T) {
+	if _, err := NewAssociationPool(AssociationPoolParams{}); err == nil {
+		t.Errorf("NewAssociationPool without SOP classes succeeded")
+	}
+	p, err := NewAssociationPool(AssociationPoolParams{ServiceUserParams: ServiceUserParams{SOPClasses: []string{testVerificationSOPClass}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.params.Size != 4 {
+		t.Errorf("default Size = %d, want 4", p.params.Size)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// Access policy file, e.g.:
+//
+//	{
+//	  "called_ae_titles": ["RADIANT"],
+//	  "rules": [
+//	    {"calling_ae_title": "WS01", "ips": ["10.1.0.0/16"], "services": ["echo", "query", "retrieve"]},
+//	    {"calling_ae_title": "*", "services": ["echo"]}
+//	  ]
+//	}
+type accessPolicyFile struct {
+	CalledAETitles []string `json:"called_ae_titles"`
+	Rules          []struct {
+		CallingAETitle string   `json:"calling_ae_title"`
+		IPs            []string `json:"ips"`
+		Services       []string `json:"services"`
+	} `json:"rules"`
+}
+
+// Load the access policy from a JSON file.
+func loadAccessPolicy(path string) (*dicompot.AccessPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file accessPolicyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	policy := &dicompot.AccessPolicy{CalledAETitles: file.CalledAETitles}
+	for i, r := range file.Rules {
+		if r.CallingAETitle == "" {
+			return nil, fmt.Errorf("%s: rule %d has no calling_ae_title", path, i)
+		}
+		rule := dicompot.AccessRule{CallingAETitle: r.CallingAETitle}
+		for _, s := range r.IPs {
+			ipNet, err := parseIPNet(s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %v", path, i, err)
+			}
+			rule.IPs = append(rule.IPs, ipNet)
+		}
+		if len(r.Services) == 0 {
+			return nil, fmt.Errorf("%s: rule %d has no services", path, i)
+		}
+		if rule.Services, err = dicompot.ParseAccessServices(r.Services); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %v", path, i, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
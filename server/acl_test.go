@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+func TestLoadAccessPolicy(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		rules int
+		ok    bool
+	}{
+		{"example", `{
+			"called_ae_titles": ["RADIANT"],
+			"rules": [
+				{"calling_ae_title": "WS01", "ips": ["10.1.0.0/16", "192.0.2.7", "2001:db8::1"], "services": ["echo", "query", "retrieve"]},
+				{"calling_ae_title": "*", "services": ["echo"]}
+			]
+		}`, 2, true},
+		{"no rules", `{"called_ae_titles": ["RADIANT"]}`, 0, true},
+		{"no calling AE title", `{"rules": [{"services": ["echo"]}]}`, 0, false},
+		{"no services", `{"rules": [{"calling_ae_title": "WS01"}]}`, 0, false},
+		{"unknown service", `{"rules": [{"calling_ae_title": "WS01", "services": ["print"]}]}`, 0, false},
+		{"bad address", `{"rules": [{"calling_ae_title": "WS01", "ips": ["10.1.0.0/33"], "services": ["echo"]}]}`, 0, false},
+		{"not JSON", `rules: []`, 0, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "acl.json")
+		if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		policy, err := loadAccessPolicy(path)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: loadAccessPolicy error = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if err == nil && len(policy.Rules) != test.rules {
+			t.Errorf("%s: %d rules, want %d", test.name, len(policy.Rules), test.rules)
+		}
+	}
+}
+
+func TestLoadAccessPolicyRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	data := `{"rules": [{"calling_ae_title": "WS01", "ips": ["192.0.2.7", "2001:db8::1"], "services": ["echo", "store"]}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadAccessPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := policy.Rules[0]
+	if rule.CallingAETitle != "WS01" || rule.Services != dicompot.AccessEcho|dicompot.AccessStore {
+		t.Errorf("rule = %+v", rule)
+	}
+	want := []string{"192.0.2.7/32", "2001:db8::1/128"}
+	if len(rule.IPs) != len(want) {
+		t.Fatalf("IPs = %v, want %v", rule.IPs, want)
+	}
+	for i, ipNet := range rule.IPs {
+		if ipNet.String() != want[i] {
+			t.Errorf("IPs[%d] = %s, want %s", i, ipNet, want[i])
+		}
+	}
+}
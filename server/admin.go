@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// Admin HTTP/JSON API. Every request must carry "Authorization: Bearer
+// <token>".
+//
+//	GET    /api/sessions             active associations
+//	GET    /api/sessions/<id>        one association and its command history
+//	POST   /api/sessions/<id>/abort  send A-ABORT and close the connection
+//	GET    /api/denylist             denied IP addresses
+//	POST   /api/denylist/<ip>        deny connections from <ip>
+//	DELETE /api/denylist/<ip>        allow connections from <ip> again
+//	GET    /api/aetitles             AE titles tried, overall and by address
+//	GET    /api/aetitles/wordlist    called AE titles tried, one per line,
+//	                                 most frequent first; ?calling for the
+//	                                 calling AE titles
+//	GET    /api/watermarks?value=<v> sessions a watermark was handed out to
+//	POST   /api/catalog/rescan       reread the picture directory
+type adminServer struct {
+	ss    *server
+	sp    *dicompot.ServiceProvider
+	token string
+}
+
+type adminSession struct {
+	ID             string
+	Start          time.Time
+	RemoteAddr     string
+	CallingAETitle string
+	CalledAETitle  string
+	Commands       int
+	Fingerprint    string         `json:",omitempty"`
+	Tool           string         `json:",omitempty"`
+	PostBruteForce bool           `json:",omitempty"`
+	History        []adminCommand `json:",omitempty"`
+}
+
+type adminCommand struct {
+	Time         time.Time
+	Command      string
+	Status       string
+	ErrorComment string `json:",omitempty"`
+}
+
+func newAdminToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newAdminSession(info dicompot.SessionInfo) adminSession {
+	s := adminSession{
+		ID:             info.ID,
+		Start:          info.Start,
+		CallingAETitle: info.ConnectionState.CallingAETitle,
+		CalledAETitle:  info.ConnectionState.CalledAETitle,
+		Commands:       info.Commands,
+		Fingerprint:    info.Fingerprint.Hash,
+		Tool:           info.Fingerprint.Tool,
+		PostBruteForce: info.ConnectionState.PostBruteForce,
+	}
+	if info.ConnectionState.RemoteAddr != nil {
+		s.RemoteAddr = info.ConnectionState.RemoteAddr.String()
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"Error": msg})
+}
+
+func (as *adminServer) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(as.token)) == 1
+}
+
+func (as *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !as.authorized(r) {
+		logrus.WithFields(logrus.Fields{
+			"IP":   r.RemoteAddr,
+			"Path": r.URL.Path,
+		}).Error("Admin API unauthorized")
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"IP":     r.RemoteAddr,
+		"Method": r.Method,
+		"Path":   r.URL.Path,
+	}).Info("Admin API")
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case parts[0] == "sessions" && len(parts) == 1 && r.Method == http.MethodGet:
+		as.listSessions(w)
+	case parts[0] == "sessions" && len(parts) == 2 && r.Method == http.MethodGet:
+		as.getSession(w, parts[1])
+	case parts[0] == "sessions" && len(parts) == 3 && parts[2] == "abort" && r.Method == http.MethodPost:
+		as.abortSession(w, parts[1])
+	case parts[0] == "denylist" && len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, as.sp.DeniedIPs())
+	case parts[0] == "denylist" && len(parts) == 2 && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		as.updateDenyList(w, r.Method, parts[1])
+	case path == "aetitles" && r.Method == http.MethodGet:
+		as.listAETitles(w)
+	case path == "aetitles/wordlist" && r.Method == http.MethodGet:
+		as.writeWordlist(w, r.URL.Query().Has("calling"))
+	case path == "watermarks" && r.Method == http.MethodGet:
+		as.lookupWatermark(w, r.URL.Query().Get("value"))
+	case path == "catalog/rescan" && r.Method == http.MethodPost:
+		as.rescan(w)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (as *adminServer) listSessions(w http.ResponseWriter) {
+	sessions := []adminSession{}
+	for _, info := range as.sp.Sessions() {
+		sessions = append(sessions, newAdminSession(info))
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (as *adminServer) getSession(w http.ResponseWriter, id string) {
+	history, err := as.sp.SessionHistory(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	for _, info := range as.sp.Sessions() {
+		if info.ID != id {
+			continue
+		}
+		s := newAdminSession(info)
+		s.History = []adminCommand{}
+		for _, c := range history {
+			s.History = append(s.History, adminCommand{
+				Time:         c.Time,
+				Command:      c.Command,
+				Status:       c.Status.Status.String(),
+				ErrorComment: c.Status.ErrorComment,
+			})
+		}
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	writeError(w, http.StatusNotFound, "session finished")
+}
+
+func (as *adminServer) abortSession(w http.ResponseWriter, id string) {
+	if err := as.sp.AbortSession(id); err != nil {
+		code := http.StatusServiceUnavailable
+		if errors.Is(err, dicompot.ErrNoSuchSession) {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"Aborted": id})
+}
+
+func (as *adminServer) updateDenyList(w http.ResponseWriter, method string, value string) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "invalid IP address")
+		return
+	}
+	if method == http.MethodPost {
+		as.sp.DenyIP(ip)
+	} else {
+		as.sp.AllowIP(ip)
+	}
+	logrus.WithFields(logrus.Fields{
+		"IP":     ip.String(),
+		"Denied": method == http.MethodPost,
+	}).Warn("Deny list updated")
+	writeJSON(w, http.StatusOK, as.sp.DeniedIPs())
+}
+
+func (as *adminServer) listAETitles(w http.ResponseWriter) {
+	called, calling := as.sp.AETitles()
+	writeJSON(w, http.StatusOK, struct {
+		Called  []dicompot.AETitleCount
+		Calling []dicompot.AETitleCount
+		Sources []dicompot.AETitleSource
+	}{called, calling, as.sp.AETitleSources()})
+}
+
+func (as *adminServer) writeWordlist(w http.ResponseWriter, calling bool) {
+	titles, callingTitles := as.sp.AETitles()
+	if calling {
+		titles = callingTitles
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, t := range titles {
+		if strings.ContainsAny(t.Title, "\r\n") {
+			// Keep one title per line.
+			fmt.Fprintf(w, "%q\n", t.Title)
+			continue
+		}
+		fmt.Fprintln(w, t.Title)
+	}
+}
+
+func (as *adminServer) lookupWatermark(w http.ResponseWriter, value string) {
+	if as.ss.watermarks == nil {
+		writeError(w, http.StatusNotFound, "watermarking is off")
+		return
+	}
+	entries := as.ss.watermarks.lookup(value)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "unknown watermark")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (as *adminServer) rescan(w http.ResponseWriter) {
+	n, err := as.ss.rescan()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"Images": n})
+}
+
+// Reread the picture directory. Returns the number of images loaded.
+func (ss *server) rescan() (int, error) {
+	datasets, err := listDicomFiles(*dirFlag)
+	if err != nil {
+		return 0, err
+	}
+	ss.mu.Lock()
+	ss.datasets = datasets
+	ss.mu.Unlock()
+	ss.cache.Purge()
+	logrus.WithFields(logrus.Fields{
+		"Images": len(datasets),
+	}).Info("Catalog rescanned")
+	return len(datasets), nil
+}
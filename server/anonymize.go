@@ -0,0 +1,229 @@
+package main
+
+// The "anonymize" command: turn real studies into decoys for -dir.
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+const anonymizeUsage = `Usage: dicompot anonymize -out DIR [flags] FILE|DIR...
+
+De-identify DICOM files with the DICOM PS3.15 Basic Application Level
+Confidentiality Profile, for use as decoys with -dir. Images flagged with
+burned-in annotation are written to the quarantine directory instead.
+
+`
+
+// One line of the report.
+type anonymizeReport struct {
+	File        string
+	Output      string       `json:",omitempty"`
+	Quarantined bool         `json:",omitempty"`
+	Error       string       `json:",omitempty"`
+	Changes     []deidChange `json:",omitempty"`
+}
+
+// Run the anonymize command. Returns the exit status: 0 if every file was
+// de-identified, 1 if not, 2 on usage errors.
+func anonymizeCommand(args []string) int {
+	fs := flag.NewFlagSet("anonymize", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), anonymizeUsage)
+		fs.PrintDefaults()
+	}
+	out := fs.String("out", "", "Directory to write the de-identified files to")
+	quarantine := fs.String("quarantine", "quarantine", "Directory to write the images with burned-in annotation to")
+	unknown := fs.Bool("quarantineunknown", false, "Also quarantine the images that don't tell whether they have burned-in annotation")
+	reportPath := fs.String("report", "anonymize-report.jsonl", "Report of the changed attributes, one JSON line per file")
+	keepDates := fs.Bool("keepdates", false, "Retain longitudinal temporal information: keep the dates, shifted by -dateshift days, and the times")
+	dateShift := fs.Int("dateshift", 0, "Days to shift the dates by with -keepdates, random between 1 and 3 years back if 0")
+	keepUIDs := fs.Bool("keepuids", false, "Retain the UIDs, instead of remapping them")
+	uidKey := fs.String("uidkey", "", "Key of the UID remapping: the same key remaps a UID the same way across runs; random if empty")
+	keepDevice := fs.Bool("keepdevice", false, "Retain the device identity: station name, serial numbers, device UID")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	options := deidOptions{
+		keepDates:  *keepDates,
+		dateShift:  *dateShift,
+		keepUIDs:   *keepUIDs,
+		keepDevice: *keepDevice,
+		uidKey:     []byte(*uidKey),
+	}
+	if options.keepDates && options.dateShift == 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(2*365))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		options.dateShift = -365 - int(n.Int64())
+	}
+	if len(options.uidKey) == 0 {
+		options.uidKey = make([]byte, 32)
+		if _, err := rand.Read(options.uidKey); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	for _, dir := range []string{*out, *quarantine} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	report, err := os.OpenFile(*reportPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer report.Close()
+
+	d := &deidentifier{options: options}
+	var done, quarantined, failed int
+	for _, path := range anonymizeInputs(fs.Args()) {
+		r := anonymizeFile(d, path, *out, *quarantine, *unknown)
+		line, _ := json.Marshal(r)
+		if _, err := report.Write(append(line, '\n')); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		switch {
+		case r.Error != "":
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, r.Error)
+			failed++
+		case r.Quarantined:
+			fmt.Printf("%s: quarantined as %s\n", path, r.Output)
+			quarantined++
+		default:
+			done++
+		}
+	}
+	fmt.Printf("%d files de-identified to %s, %d quarantined to %s, %d failed; report in %s\n",
+		done, *out, quarantined, *quarantine, failed, *reportPath)
+	if options.keepDates {
+		fmt.Printf("Dates shifted by %d days\n", options.dateShift)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// The files given, and the files under the directories given. DICOMDIR files
+// are left out, they would point to the original files.
+func anonymizeInputs(args []string) []string {
+	var paths []string
+	for _, arg := range args {
+		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				return nil
+			}
+			if info.Mode().IsRegular() && filepath.Base(path) != "DICOMDIR" {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
+	return paths
+}
+
+// De-identify one file, and write it to "out", or to "quarantine" if it has
+// burned-in annotation.
+func anonymizeFile(d *deidentifier, path string, out string, quarantine string, quarantineUnknown bool) anonymizeReport {
+	r := anonymizeReport{File: path}
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	burnedIn := ""
+	if elem, err := ds.FindElementByTag(dicomtag.BurnedInAnnotation); err == nil {
+		burnedIn, _ = elem.GetString()
+		burnedIn = strings.TrimSpace(burnedIn)
+	}
+	_, err = ds.FindElementByTag(dicomtag.PixelData)
+	isImage := err == nil
+	r.Quarantined = burnedIn == "YES" || (isImage && burnedIn == "" && quarantineUnknown)
+
+	r.Changes = d.dataset(ds)
+
+	name := ""
+	if elem, err := ds.FindElementByTag(dicomtag.SOPInstanceUID); err == nil {
+		name, _ = elem.GetString()
+	}
+	if name = strings.TrimRight(name, " \x00"); name == "" {
+		name = d.remapUID(path)
+	}
+	dir := out
+	if r.Quarantined {
+		dir = quarantine
+	}
+	r.Output = filepath.Join(dir, name+".dcm")
+	if err := encodeTagValues(ds); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	if err := dicom.WriteDataSetToFile(r.Output, ds); err != nil {
+		r.Error = err.Error()
+		os.Remove(r.Output)
+	}
+	return r
+}
+
+// go-dicom reads AT values as tags but writes them as strings: turn them into
+// strings of the encoded tags, in the byte order of the transfer syntax.
+func encodeTagValues(ds *dicom.DataSet) error {
+	ts, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+	if err != nil {
+		return err
+	}
+	uid, _ := ts.GetString()
+	order, _, err := dicomio.ParseTransferSyntaxUID(strings.TrimRight(uid, " \x00"))
+	if err != nil {
+		return err
+	}
+	var encode func(elems []*dicom.Element)
+	encode = func(elems []*dicom.Element) {
+		for _, elem := range elems {
+			if elem.VR == "AT" {
+				var b []byte
+				for _, v := range elem.Value {
+					if tag, ok := v.(dicomtag.Tag); ok {
+						var t [4]byte
+						order.PutUint16(t[:2], tag.Group)
+						order.PutUint16(t[2:], tag.Element)
+						b = append(b, t[:]...)
+					}
+				}
+				if b != nil {
+					elem.Value = []interface{}{string(b)}
+				}
+				continue
+			}
+			for _, v := range elem.Value {
+				if child, ok := v.(*dicom.Element); ok {
+					encode([]*dicom.Element{child})
+				}
+			}
+		}
+	}
+	encode(ds.Elements)
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/sopclass"
+	"github.com/sirupsen/logrus"
+)
+
+// Storage commitment N-ACTION and N-EVENT-REPORT type IDs. P3.4, J.3.
+const (
+	commitmentActionRequest = 1
+	commitmentEventSuccess  = 1
+	commitmentEventFailures = 2
+)
+
+// Failure reasons reported in the FailedSOPSequence. P3.4, J.3.3.1.
+const (
+	commitmentProcessingFailure  = 0x0110
+	commitmentNoSuchObject       = 0x0112
+	commitmentReferencedConflict = 0x0119
+)
+
+// Reference to one SOP instance in a storage commitment request.
+type commitmentRef struct {
+	sopClassUID    string
+	sopInstanceUID string
+}
+
+// Parse "AE=host:port,..." as given to -remote.
+func parseRemoteAEs(value string) (map[string]string, error) {
+	remotes := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid remote AE %q, expected AE=host:port", entry)
+		}
+		remotes[kv[0]] = kv[1]
+	}
+	return remotes, nil
+}
+
+// Extract the (class, instance) pairs from a ReferencedSOPSequence.
+func commitmentRefs(seq *dicom.Element) []commitmentRef {
+	var refs []commitmentRef
+	for _, item := range sequenceItems(seq) {
+		refs = append(refs, commitmentRef{
+			sopClassUID:    elementString(item, dicomtag.ReferencedSOPClassUID),
+			sopInstanceUID: elementString(item, dicomtag.ReferencedSOPInstanceUID),
+		})
+	}
+	return refs
+}
+
+// Records the instance a peer tried to C-STORE. The upload itself is still
+// refused, but a later commitment request for it is answered accordingly.
+func (ss *server) onCStore(
+	connState dicompot.ConnectionState,
+	sopClassUID string,
+	sopInstanceUID string) dimse.Status {
+	ss.addUpload(sopInstanceUID, sopClassUID)
+	return dimse.Status{Status: dimse.StatusUnrecognizedOperation}
+}
+
+// Max number of SOP instances remembered in ss.uploads.
+const maxUploads = 100000
+
+// Remember an instance a peer tried to store.
+func (ss *server) addUpload(sopInstanceUID string, sopClassUID string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.uploads[sopInstanceUID]; !ok && len(ss.uploads) >= maxUploads {
+		// Evict an arbitrary entry, the map must stay bounded.
+		for k := range ss.uploads {
+			delete(ss.uploads, k)
+			break
+		}
+	}
+	ss.uploads[sopInstanceUID] = sopClassUID
+}
+
+// Decide whether the instance can be committed. Returns 0 on success,
+// otherwise the failure reason.
+func (ss *server) commitmentStatus(ref commitmentRef) uint16 {
+	if ref.sopInstanceUID == "" {
+		return commitmentProcessingFailure
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, ds := range ss.datasets {
+		elem, err := ds.FindElementByTag(dicomtag.SOPInstanceUID)
+		if err != nil {
+			continue
+		}
+		if uid, _ := elem.GetString(); uid != ref.sopInstanceUID {
+			continue
+		}
+		if elem, err := ds.FindElementByTag(dicomtag.SOPClassUID); err == nil && ref.sopClassUID != "" {
+			if uid, _ := elem.GetString(); uid != ref.sopClassUID {
+				return commitmentReferencedConflict
+			}
+		}
+		return 0
+	}
+	if _, ok := ss.uploads[ref.sopInstanceUID]; ok {
+		// We never keep what they send us.
+		return commitmentProcessingFailure
+	}
+	return commitmentNoSuchObject
+}
+
+// Storage Commitment Push Model SCP. The request is answered right away and
+// the result is reported through N-EVENT-REPORT, either on the same
+// association or, with "-commit new", on a new association to the requestor.
+func (ss *server) onStorageCommitment(
+	connState dicompot.ConnectionState,
+	msg dimse.Message,
+	elems []*dicom.Element,
+	sessionID string) dicompot.NServiceResult {
+	rq, ok := msg.(*dimse.NActionRq)
+	if !ok {
+		return dicompot.NServiceResult{Status: dimse.Status{Status: dimse.StatusUnrecognizedOperation}}
+	}
+	if rq.ActionTypeID != commitmentActionRequest {
+		return dicompot.NServiceResult{Status: dimse.Status{Status: dimse.StatusNoSuchActionType}}
+	}
+	transactionUID := elementString(elems, dicomtag.TransactionUID)
+	seq, err := dicom.FindElementByTag(elems, dicomtag.ReferencedSOPSequence)
+	if transactionUID == "" || err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Transaction": transactionUID,
+			"ID":          sessionID,
+		}).Warn("Storage commitment request without references")
+		return dicompot.NServiceResult{Status: dimse.Status{Status: dimse.StatusMissingAttribute}}
+	}
+
+	var committed, failed []interface{}
+	for _, ref := range commitmentRefs(seq) {
+		reason := ss.commitmentStatus(ref)
+		logrus.WithFields(logrus.Fields{
+			"Transaction": transactionUID,
+			"SOPClass":    ref.sopClassUID,
+			"SOPInstance": ref.sopInstanceUID,
+			"Committed":   reason == 0,
+			"ID":          sessionID,
+		}).Warn("Storage commitment request")
+		values := []interface{}{
+			dicom.MustNewElement(dicomtag.ReferencedSOPClassUID, ref.sopClassUID),
+			dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUID, ref.sopInstanceUID),
+		}
+		if reason == 0 {
+			values = append(values, dicom.MustNewElement(dicomtag.RetrieveAETitle, *aeFlag))
+			committed = append(committed, dicom.MustNewElement(dicomtag.Item, values...))
+		} else {
+			values = append(values, dicom.MustNewElement(dicomtag.FailureReason, reason))
+			failed = append(failed, dicom.MustNewElement(dicomtag.Item, values...))
+		}
+	}
+
+	report := &dicompot.NEventReport{
+		SOPClassUID:    sopclass.StorageCommitmentPushModel,
+		SOPInstanceUID: sopclass.StorageCommitmentPushModelInstance,
+		EventTypeID:    commitmentEventSuccess,
+		Elements: []*dicom.Element{
+			dicom.MustNewElement(dicomtag.TransactionUID, transactionUID),
+		},
+	}
+	if len(committed) > 0 {
+		report.Elements = append(report.Elements, dicom.MustNewElement(dicomtag.ReferencedSOPSequence, committed...))
+	}
+	if len(failed) > 0 {
+		report.EventTypeID = commitmentEventFailures
+		report.Elements = append(report.Elements, dicom.MustNewElement(dicomtag.FailedSOPSequence, failed...))
+	}
+
+	result := dicompot.NServiceResult{Status: dimse.Success}
+	if addr, ok := ss.remoteAEs[connState.CallingAETitle]; ok && *commitFlag == "new" {
+		go ss.sendCommitmentReport(connState.CallingAETitle, addr, report, sessionID)
+	} else {
+		result.EventReport = report
+	}
+	return result
+}
+
+// Time given to deliver a storage commitment result on a new association,
+// connecting included.
+const commitmentReportTimeout = 30 * time.Second
+
+// Deliver a storage commitment result on a new association to the requestor.
+// The server sends the N-EVENT-REPORT, so it proposes the SCP role. P3.4, J.3.3.
+func (ss *server) sendCommitmentReport(aeTitle string, addr string, report *dicompot.NEventReport, sessionID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), commitmentReportTimeout)
+	defer cancel()
+	su, err := dicompot.NewServiceUser(dicompot.ServiceUserParams{
+		CalledAETitle:     aeTitle,
+		CallingAETitle:    *aeFlag,
+		SOPClasses:        sopclass.StorageCommitmentClasses,
+		SCPRoleSOPClasses: []string{sopclass.StorageCommitmentPushModel},
+	})
+	if err == nil {
+		defer su.Release()
+		err = su.ConnectContext(ctx, addr)
+		if err == nil {
+			err = su.NEventReportContext(ctx, *report)
+		}
+	}
+	fields := logrus.Fields{
+		"Command": "N-EVENT-REPORT",
+		"Event":   report.EventTypeID,
+		"Remote":  aeTitle + "@" + addr,
+		"ID":      sessionID,
+	}
+	if err != nil {
+		fields["Error"] = err
+		logrus.WithFields(fields).Warn("Storage commitment report failed")
+		return
+	}
+	logrus.WithFields(fields).Info("Sent")
+}
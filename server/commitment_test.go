@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+const (
+	testCTImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	testMRImageStorage = "1.2.840.10008.5.1.4.1.1.4"
+)
+
+func testCommitmentServer() *server {
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.SOPClassUID, testCTImageStorage),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4"),
+	}}
+	return &server{
+		mu:       &sync.Mutex{},
+		datasets: map[string]*dicom.DataSet{"ct.dcm": ds},
+		uploads:  map[string]string{"1.2.3.5": testCTImageStorage},
+	}
+}
+
+func TestCommitmentStatus(t *testing.T) {
+	ss := testCommitmentServer()
+	tests := []struct {
+		name string
+		ref  commitmentRef
+		want uint16
+	}{
+		{"served", commitmentRef{testCTImageStorage, "1.2.3.4"}, 0},
+		{"served without class", commitmentRef{"", "1.2.3.4"}, 0},
+		{"class conflict", commitmentRef{testMRImageStorage, "1.2.3.4"}, commitmentReferencedConflict},
+		{"uploaded", commitmentRef{testCTImageStorage, "1.2.3.5"}, commitmentProcessingFailure},
+		{"unknown", commitmentRef{testCTImageStorage, "1.2.3.6"}, commitmentNoSuchObject},
+		{"no instance", commitmentRef{testCTImageStorage, ""}, commitmentProcessingFailure},
+	}
+	for _, test := range tests {
+		if got := ss.commitmentStatus(test.ref); got != test.want {
+			t.Errorf("%s: commitmentStatus(%v) = %#04x, want %#04x", test.name, test.ref, got, test.want)
+		}
+	}
+}
+
+func TestAddUploadBounded(t *testing.T) {
+	ss := &server{mu: &sync.Mutex{}, uploads: make(map[string]string)}
+	for i := 0; i < maxUploads; i++ {
+		ss.uploads["1.2.4."+strconv.Itoa(i)] = testCTImageStorage
+	}
+	ss.addUpload("1.2.3.5", testCTImageStorage)
+	if len(ss.uploads) != maxUploads {
+		t.Errorf("len(uploads) = %d, want %d", len(ss.uploads), maxUploads)
+	}
+	if ss.commitmentStatus(commitmentRef{testCTImageStorage, "1.2.3.5"}) != commitmentProcessingFailure {
+		t.Errorf("upload 1.2.3.5 not remembered")
+	}
+	// Storing the same instance again must not evict anything.
+	ss.addUpload("1.2.3.5", testMRImageStorage)
+	if len(ss.uploads) != maxUploads {
+		t.Errorf("len(uploads) = %d after re-upload, want %d", len(ss.uploads), maxUploads)
+	}
+}
+
+func TestParseRemoteAEs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"PACS=10.0.0.1:104", map[string]string{"PACS": "10.0.0.1:104"}, false},
+		{" A=h:1 , B=h:2,", map[string]string{"A": "h:1", "B": "h:2"}, false},
+		{"PACS", nil, true},
+		{"=h:1", nil, true},
+		{"PACS=", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseRemoteAEs(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseRemoteAEs(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("parseRemoteAEs(%q) = %v, want %v", test.value, got, test.want)
+			continue
+		}
+		for k, v := range test.want {
+			if got[k] != v {
+				t.Errorf("parseRemoteAEs(%q) = %v, want %v", test.value, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+// De-identification of datasets with the DICOM PS3.15 Basic Application Level
+// Confidentiality Profile (Annex E), and its Retain Longitudinal Temporal
+// Information with Modified Dates, Retain UIDs and Retain Device Identity
+// options.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// Actions of the profile, PS3.15 Table E.1-1. Where the table leaves a choice
+// (X/Z, X/D, Z/D, X/Z/D), the most restrictive one allowed is used.
+const (
+	deidRemove = 'X' // Remove the attribute.
+	deidZero   = 'Z' // Replace with a zero length value.
+	deidDummy  = 'D' // Replace with a dummy value.
+	deidUID    = 'U' // Replace with a consistently remapped UID.
+
+	// Shift the date, with the Retain Longitudinal Temporal Information
+	// option.
+	deidShift = 'S'
+)
+
+// The attributes of PS3.15 Table E.1-1 and their action. Attributes not
+// listed are kept; UIDs nested in the kept sequences are remapped.
+var basicProfile = map[dicomtag.Tag]byte{
+	{Group: 0x0002, Element: 0x0003}: deidUID,    // MediaStorageSOPInstanceUID
+	{Group: 0x0004, Element: 0x1511}: deidUID,    // ReferencedSOPInstanceUIDInFile
+	{Group: 0x0008, Element: 0x0012}: deidRemove, // InstanceCreationDate
+	{Group: 0x0008, Element: 0x0013}: deidRemove, // InstanceCreationTime
+	{Group: 0x0008, Element: 0x0014}: deidUID,    // InstanceCreatorUID
+	{Group: 0x0008, Element: 0x0015}: deidRemove, // InstanceCoercionDateTime
+	{Group: 0x0008, Element: 0x0018}: deidUID,    // SOPInstanceUID
+	{Group: 0x0008, Element: 0x0020}: deidZero,   // StudyDate
+	{Group: 0x0008, Element: 0x0021}: deidRemove, // SeriesDate
+	{Group: 0x0008, Element: 0x0022}: deidRemove, // AcquisitionDate
+	{Group: 0x0008, Element: 0x0023}: deidZero,   // ContentDate
+	{Group: 0x0008, Element: 0x0024}: deidRemove, // OverlayDate
+	{Group: 0x0008, Element: 0x0025}: deidRemove, // CurveDate
+	{Group: 0x0008, Element: 0x002a}: deidRemove, // AcquisitionDateTime
+	{Group: 0x0008, Element: 0x0030}: deidZero,   // StudyTime
+	{Group: 0x0008, Element: 0x0031}: deidRemove, // SeriesTime
+	{Group: 0x0008, Element: 0x0032}: deidRemove, // AcquisitionTime
+	{Group: 0x0008, Element: 0x0033}: deidZero,   // ContentTime
+	{Group: 0x0008, Element: 0x0034}: deidRemove, // OverlayTime
+	{Group: 0x0008, Element: 0x0035}: deidRemove, // CurveTime
+	{Group: 0x0008, Element: 0x0050}: deidZero,   // AccessionNumber
+	{Group: 0x0008, Element: 0x0058}: deidUID,    // FailedSOPInstanceUIDList
+	{Group: 0x0008, Element: 0x0080}: deidRemove, // InstitutionName
+	{Group: 0x0008, Element: 0x0081}: deidRemove, // InstitutionAddress
+	{Group: 0x0008, Element: 0x0082}: deidRemove, // InstitutionCodeSequence
+	{Group: 0x0008, Element: 0x0090}: deidZero,   // ReferringPhysicianName
+	{Group: 0x0008, Element: 0x0092}: deidRemove, // ReferringPhysicianAddress
+	{Group: 0x0008, Element: 0x0094}: deidRemove, // ReferringPhysicianTelephoneNumbers
+	{Group: 0x0008, Element: 0x0096}: deidRemove, // ReferringPhysicianIdentificationSequence
+	{Group: 0x0008, Element: 0x010d}: deidUID,    // ContextGroupExtensionCreatorUID
+	{Group: 0x0008, Element: 0x0201}: deidRemove, // TimezoneOffsetFromUTC
+	{Group: 0x0008, Element: 0x1010}: deidRemove, // StationName
+	{Group: 0x0008, Element: 0x1030}: deidRemove, // StudyDescription
+	{Group: 0x0008, Element: 0x103e}: deidRemove, // SeriesDescription
+	{Group: 0x0008, Element: 0x1040}: deidRemove, // InstitutionalDepartmentName
+	{Group: 0x0008, Element: 0x1048}: deidRemove, // PhysiciansOfRecord
+	{Group: 0x0008, Element: 0x1049}: deidRemove, // PhysiciansOfRecordIdentificationSequence
+	{Group: 0x0008, Element: 0x1050}: deidRemove, // PerformingPhysicianName
+	{Group: 0x0008, Element: 0x1052}: deidRemove, // PerformingPhysicianIdentificationSequence
+	{Group: 0x0008, Element: 0x1060}: deidRemove, // NameOfPhysiciansReadingStudy
+	{Group: 0x0008, Element: 0x1062}: deidRemove, // PhysiciansReadingStudyIdentificationSequence
+	{Group: 0x0008, Element: 0x1070}: deidRemove, // OperatorsName
+	{Group: 0x0008, Element: 0x1072}: deidRemove, // OperatorIdentificationSequence
+	{Group: 0x0008, Element: 0x1080}: deidRemove, // AdmittingDiagnosesDescription
+	{Group: 0x0008, Element: 0x1084}: deidRemove, // AdmittingDiagnosesCodeSequence
+	{Group: 0x0008, Element: 0x1110}: deidRemove, // ReferencedStudySequence
+	{Group: 0x0008, Element: 0x1111}: deidRemove, // ReferencedPerformedProcedureStepSequence
+	{Group: 0x0008, Element: 0x1120}: deidRemove, // ReferencedPatientSequence
+	{Group: 0x0008, Element: 0x1155}: deidUID,    // ReferencedSOPInstanceUID
+	{Group: 0x0008, Element: 0x1195}: deidUID,    // TransactionUID
+	{Group: 0x0008, Element: 0x2111}: deidRemove, // DerivationDescription
+	{Group: 0x0008, Element: 0x3010}: deidUID,    // IrradiationEventUID
+	{Group: 0x0008, Element: 0x4000}: deidRemove, // IdentifyingComments
+	{Group: 0x0008, Element: 0x9123}: deidUID,    // CreatorVersionUID
+	{Group: 0x0010, Element: 0x0010}: deidZero,   // PatientName
+	{Group: 0x0010, Element: 0x0020}: deidZero,   // PatientID
+	{Group: 0x0010, Element: 0x0021}: deidRemove, // IssuerOfPatientID
+	{Group: 0x0010, Element: 0x0030}: deidZero,   // PatientBirthDate
+	{Group: 0x0010, Element: 0x0032}: deidRemove, // PatientBirthTime
+	{Group: 0x0010, Element: 0x0040}: deidZero,   // PatientSex
+	{Group: 0x0010, Element: 0x0050}: deidRemove, // PatientInsurancePlanCodeSequence
+	{Group: 0x0010, Element: 0x0101}: deidRemove, // PatientPrimaryLanguageCodeSequence
+	{Group: 0x0010, Element: 0x0102}: deidRemove, // PatientPrimaryLanguageModifierCodeSequence
+	{Group: 0x0010, Element: 0x1000}: deidRemove, // OtherPatientIDs
+	{Group: 0x0010, Element: 0x1001}: deidRemove, // OtherPatientNames
+	{Group: 0x0010, Element: 0x1002}: deidRemove, // OtherPatientIDsSequence
+	{Group: 0x0010, Element: 0x1005}: deidRemove, // PatientBirthName
+	{Group: 0x0010, Element: 0x1010}: deidRemove, // PatientAge
+	{Group: 0x0010, Element: 0x1020}: deidRemove, // PatientSize
+	{Group: 0x0010, Element: 0x1030}: deidRemove, // PatientWeight
+	{Group: 0x0010, Element: 0x1040}: deidRemove, // PatientAddress
+	{Group: 0x0010, Element: 0x1050}: deidRemove, // InsurancePlanIdentification
+	{Group: 0x0010, Element: 0x1060}: deidRemove, // PatientMotherBirthName
+	{Group: 0x0010, Element: 0x1080}: deidRemove, // MilitaryRank
+	{Group: 0x0010, Element: 0x1081}: deidRemove, // BranchOfService
+	{Group: 0x0010, Element: 0x1090}: deidRemove, // MedicalRecordLocator
+	{Group: 0x0010, Element: 0x1100}: deidRemove, // ReferencedPatientPhotoSequence
+	{Group: 0x0010, Element: 0x2000}: deidRemove, // MedicalAlerts
+	{Group: 0x0010, Element: 0x2110}: deidRemove, // Allergies
+	{Group: 0x0010, Element: 0x2150}: deidRemove, // CountryOfResidence
+	{Group: 0x0010, Element: 0x2152}: deidRemove, // RegionOfResidence
+	{Group: 0x0010, Element: 0x2154}: deidRemove, // PatientTelephoneNumbers
+	{Group: 0x0010, Element: 0x2155}: deidRemove, // PatientTelecomInformation
+	{Group: 0x0010, Element: 0x2160}: deidRemove, // EthnicGroup
+	{Group: 0x0010, Element: 0x2180}: deidRemove, // Occupation
+	{Group: 0x0010, Element: 0x21a0}: deidRemove, // SmokingStatus
+	{Group: 0x0010, Element: 0x21b0}: deidRemove, // AdditionalPatientHistory
+	{Group: 0x0010, Element: 0x21c0}: deidRemove, // PregnancyStatus
+	{Group: 0x0010, Element: 0x21d0}: deidRemove, // LastMenstrualDate
+	{Group: 0x0010, Element: 0x21f0}: deidRemove, // PatientReligiousPreference
+	{Group: 0x0010, Element: 0x2203}: deidRemove, // PatientSexNeutered
+	{Group: 0x0010, Element: 0x2297}: deidRemove, // ResponsiblePerson
+	{Group: 0x0010, Element: 0x2299}: deidRemove, // ResponsibleOrganization
+	{Group: 0x0010, Element: 0x4000}: deidRemove, // PatientComments
+	{Group: 0x0018, Element: 0x0010}: deidZero,   // ContrastBolusAgent
+	{Group: 0x0018, Element: 0x1000}: deidZero,   // DeviceSerialNumber
+	{Group: 0x0018, Element: 0x1002}: deidUID,    // DeviceUID
+	{Group: 0x0018, Element: 0x1004}: deidRemove, // PlateID
+	{Group: 0x0018, Element: 0x1005}: deidRemove, // GeneratorID
+	{Group: 0x0018, Element: 0x1007}: deidRemove, // CassetteID
+	{Group: 0x0018, Element: 0x1008}: deidRemove, // GantryID
+	{Group: 0x0018, Element: 0x1012}: deidRemove, // DateOfSecondaryCapture
+	{Group: 0x0018, Element: 0x1014}: deidRemove, // TimeOfSecondaryCapture
+	{Group: 0x0018, Element: 0x1030}: deidRemove, // ProtocolName
+	{Group: 0x0018, Element: 0x1200}: deidRemove, // DateOfLastCalibration
+	{Group: 0x0018, Element: 0x1201}: deidRemove, // TimeOfLastCalibration
+	{Group: 0x0018, Element: 0x1400}: deidRemove, // AcquisitionDeviceProcessingDescription
+	{Group: 0x0018, Element: 0x4000}: deidRemove, // AcquisitionComments
+	{Group: 0x0018, Element: 0x700a}: deidRemove, // DetectorID
+	{Group: 0x0018, Element: 0x9424}: deidRemove, // AcquisitionProtocolDescription
+	{Group: 0x0018, Element: 0x9516}: deidRemove, // StartAcquisitionDateTime
+	{Group: 0x0018, Element: 0x9517}: deidRemove, // EndAcquisitionDateTime
+	{Group: 0x0018, Element: 0xa003}: deidRemove, // ContributionDescription
+	{Group: 0x0020, Element: 0x000d}: deidUID,    // StudyInstanceUID
+	{Group: 0x0020, Element: 0x000e}: deidUID,    // SeriesInstanceUID
+	{Group: 0x0020, Element: 0x0010}: deidZero,   // StudyID
+	{Group: 0x0020, Element: 0x0052}: deidUID,    // FrameOfReferenceUID
+	{Group: 0x0020, Element: 0x0200}: deidUID,    // SynchronizationFrameOfReferenceUID
+	{Group: 0x0020, Element: 0x4000}: deidRemove, // ImageComments
+	{Group: 0x0020, Element: 0x9158}: deidRemove, // FrameComments
+	{Group: 0x0020, Element: 0x9161}: deidUID,    // ConcatenationUID
+	{Group: 0x0020, Element: 0x9164}: deidUID,    // DimensionOrganizationUID
+	{Group: 0x0028, Element: 0x1199}: deidUID,    // PaletteColorLookupTableUID
+	{Group: 0x0028, Element: 0x1214}: deidUID,    // LargePaletteColorLookupTableUID
+	{Group: 0x0028, Element: 0x4000}: deidRemove, // ImagePresentationComments
+	{Group: 0x0032, Element: 0x0012}: deidRemove, // StudyIDIssuer
+	{Group: 0x0032, Element: 0x1020}: deidRemove, // ScheduledStudyLocation
+	{Group: 0x0032, Element: 0x1021}: deidRemove, // ScheduledStudyLocationAETitle
+	{Group: 0x0032, Element: 0x1030}: deidRemove, // ReasonForStudy
+	{Group: 0x0032, Element: 0x1032}: deidRemove, // RequestingPhysician
+	{Group: 0x0032, Element: 0x1033}: deidRemove, // RequestingService
+	{Group: 0x0032, Element: 0x1060}: deidRemove, // RequestedProcedureDescription
+	{Group: 0x0032, Element: 0x1070}: deidRemove, // RequestedContrastAgent
+	{Group: 0x0032, Element: 0x4000}: deidRemove, // StudyComments
+	{Group: 0x0038, Element: 0x0010}: deidRemove, // AdmissionID
+	{Group: 0x0038, Element: 0x0011}: deidRemove, // IssuerOfAdmissionID
+	{Group: 0x0038, Element: 0x001e}: deidRemove, // ScheduledPatientInstitutionResidence
+	{Group: 0x0038, Element: 0x0020}: deidRemove, // AdmittingDate
+	{Group: 0x0038, Element: 0x0021}: deidRemove, // AdmittingTime
+	{Group: 0x0038, Element: 0x0040}: deidRemove, // DischargeDiagnosisDescription
+	{Group: 0x0038, Element: 0x0050}: deidRemove, // SpecialNeeds
+	{Group: 0x0038, Element: 0x0060}: deidRemove, // ServiceEpisodeID
+	{Group: 0x0038, Element: 0x0061}: deidRemove, // IssuerOfServiceEpisodeID
+	{Group: 0x0038, Element: 0x0062}: deidRemove, // ServiceEpisodeDescription
+	{Group: 0x0038, Element: 0x0300}: deidRemove, // CurrentPatientLocation
+	{Group: 0x0038, Element: 0x0400}: deidRemove, // PatientInstitutionResidence
+	{Group: 0x0038, Element: 0x0500}: deidRemove, // PatientState
+	{Group: 0x0038, Element: 0x4000}: deidRemove, // VisitComments
+	{Group: 0x0040, Element: 0x0001}: deidRemove, // ScheduledStationAETitle
+	{Group: 0x0040, Element: 0x0002}: deidRemove, // ScheduledProcedureStepStartDate
+	{Group: 0x0040, Element: 0x0003}: deidRemove, // ScheduledProcedureStepStartTime
+	{Group: 0x0040, Element: 0x0004}: deidRemove, // ScheduledProcedureStepEndDate
+	{Group: 0x0040, Element: 0x0005}: deidRemove, // ScheduledProcedureStepEndTime
+	{Group: 0x0040, Element: 0x0006}: deidRemove, // ScheduledPerformingPhysicianName
+	{Group: 0x0040, Element: 0x0007}: deidRemove, // ScheduledProcedureStepDescription
+	{Group: 0x0040, Element: 0x000b}: deidRemove, // ScheduledPerformingPhysicianIdentificationSequence
+	{Group: 0x0040, Element: 0x0010}: deidRemove, // ScheduledStationName
+	{Group: 0x0040, Element: 0x0011}: deidRemove, // ScheduledProcedureStepLocation
+	{Group: 0x0040, Element: 0x0012}: deidRemove, // PreMedication
+	{Group: 0x0040, Element: 0x0241}: deidRemove, // PerformedStationAETitle
+	{Group: 0x0040, Element: 0x0242}: deidRemove, // PerformedStationName
+	{Group: 0x0040, Element: 0x0243}: deidRemove, // PerformedLocation
+	{Group: 0x0040, Element: 0x0244}: deidRemove, // PerformedProcedureStepStartDate
+	{Group: 0x0040, Element: 0x0245}: deidRemove, // PerformedProcedureStepStartTime
+	{Group: 0x0040, Element: 0x0250}: deidRemove, // PerformedProcedureStepEndDate
+	{Group: 0x0040, Element: 0x0251}: deidRemove, // PerformedProcedureStepEndTime
+	{Group: 0x0040, Element: 0x0253}: deidRemove, // PerformedProcedureStepID
+	{Group: 0x0040, Element: 0x0254}: deidRemove, // PerformedProcedureStepDescription
+	{Group: 0x0040, Element: 0x0275}: deidRemove, // RequestAttributesSequence
+	{Group: 0x0040, Element: 0x0280}: deidRemove, // CommentsOnThePerformedProcedureStep
+	{Group: 0x0040, Element: 0x0555}: deidRemove, // AcquisitionContextSequence
+	{Group: 0x0040, Element: 0x1001}: deidRemove, // RequestedProcedureID
+	{Group: 0x0040, Element: 0x1004}: deidRemove, // PatientTransportArrangements
+	{Group: 0x0040, Element: 0x1005}: deidRemove, // RequestedProcedureLocation
+	{Group: 0x0040, Element: 0x1011}: deidRemove, // IntendedRecipientsOfResultsIdentificationSequence
+	{Group: 0x0040, Element: 0x1101}: deidRemove, // PersonIdentificationCodeSequence
+	{Group: 0x0040, Element: 0x1102}: deidRemove, // PersonAddress
+	{Group: 0x0040, Element: 0x1103}: deidRemove, // PersonTelephoneNumbers
+	{Group: 0x0040, Element: 0x1400}: deidRemove, // RequestedProcedureComments
+	{Group: 0x0040, Element: 0x2001}: deidRemove, // ReasonForImagingServiceRequest
+	{Group: 0x0040, Element: 0x2016}: deidZero,   // PlacerOrderNumberImagingServiceRequest
+	{Group: 0x0040, Element: 0x2017}: deidZero,   // FillerOrderNumberImagingServiceRequest
+	{Group: 0x0040, Element: 0x2400}: deidRemove, // ImagingServiceRequestComments
+	{Group: 0x0040, Element: 0x3001}: deidRemove, // ConfidentialityConstraintOnPatientDataDescription
+	{Group: 0x0040, Element: 0x4023}: deidUID,    // ReferencedGeneralPurposeScheduledProcedureStepTransactionUID
+	{Group: 0x0040, Element: 0x4025}: deidRemove, // ScheduledStationNameCodeSequence
+	{Group: 0x0040, Element: 0x4027}: deidRemove, // ScheduledStationGeographicLocationCodeSequence
+	{Group: 0x0040, Element: 0x4028}: deidRemove, // PerformedStationNameCodeSequence
+	{Group: 0x0040, Element: 0x4030}: deidRemove, // PerformedStationGeographicLocationCodeSequence
+	{Group: 0x0040, Element: 0x4034}: deidRemove, // ScheduledHumanPerformersSequence
+	{Group: 0x0040, Element: 0x4035}: deidRemove, // ActualHumanPerformersSequence
+	{Group: 0x0040, Element: 0x4036}: deidRemove, // HumanPerformerOrganization
+	{Group: 0x0040, Element: 0x4037}: deidRemove, // HumanPerformerName
+	{Group: 0x0040, Element: 0xa027}: deidRemove, // VerifyingOrganization
+	{Group: 0x0040, Element: 0xa030}: deidDummy,  // VerificationDateTime
+	{Group: 0x0040, Element: 0xa073}: deidRemove, // VerifyingObserverSequence
+	{Group: 0x0040, Element: 0xa075}: deidDummy,  // VerifyingObserverName
+	{Group: 0x0040, Element: 0xa078}: deidRemove, // AuthorObserverSequence
+	{Group: 0x0040, Element: 0xa07a}: deidRemove, // ParticipantSequence
+	{Group: 0x0040, Element: 0xa07c}: deidRemove, // CustodialOrganizationSequence
+	{Group: 0x0040, Element: 0xa088}: deidZero,   // VerifyingObserverIdentificationCodeSequence
+	{Group: 0x0040, Element: 0xa123}: deidDummy,  // PersonName
+	{Group: 0x0040, Element: 0xa124}: deidUID,    // UID
+	{Group: 0x0040, Element: 0xa171}: deidUID,    // ObservationUID
+	{Group: 0x0040, Element: 0xa730}: deidRemove, // ContentSequence
+	{Group: 0x0040, Element: 0xdb0c}: deidUID,    // TemplateExtensionOrganizationUID
+	{Group: 0x0040, Element: 0xdb0d}: deidUID,    // TemplateExtensionCreatorUID
+	{Group: 0x0050, Element: 0x0020}: deidRemove, // DeviceDescription
+	{Group: 0x0070, Element: 0x0001}: deidRemove, // GraphicAnnotationSequence
+	{Group: 0x0070, Element: 0x0084}: deidZero,   // ContentCreatorName
+	{Group: 0x0070, Element: 0x0086}: deidRemove, // ContentCreatorIdentificationCodeSequence
+	{Group: 0x0070, Element: 0x031a}: deidUID,    // FiducialUID
+	{Group: 0x0088, Element: 0x0140}: deidUID,    // StorageMediaFileSetUID
+	{Group: 0x0088, Element: 0x0200}: deidRemove, // IconImageSequence
+	{Group: 0x0088, Element: 0x0904}: deidRemove, // TopicTitle
+	{Group: 0x0088, Element: 0x0906}: deidRemove, // TopicSubject
+	{Group: 0x0088, Element: 0x0910}: deidRemove, // TopicAuthor
+	{Group: 0x0088, Element: 0x0912}: deidRemove, // TopicKeywords
+	{Group: 0x0400, Element: 0x0100}: deidRemove, // DigitalSignatureUID
+	{Group: 0x0400, Element: 0x0402}: deidRemove, // ReferencedDigitalSignatureSequence
+	{Group: 0x0400, Element: 0x0403}: deidRemove, // ReferencedSOPInstanceMACSequence
+	{Group: 0x0400, Element: 0x0404}: deidRemove, // MAC
+	{Group: 0x0400, Element: 0x0561}: deidRemove, // OriginalAttributesSequence
+	{Group: 0x2030, Element: 0x0020}: deidRemove, // TextString
+	{Group: 0x3006, Element: 0x0024}: deidUID,    // ReferencedFrameOfReferenceUID
+	{Group: 0x3006, Element: 0x00c2}: deidUID,    // RelatedFrameOfReferenceUID
+	{Group: 0x300a, Element: 0x0013}: deidUID,    // DoseReferenceUID
+	{Group: 0x300a, Element: 0x0016}: deidRemove, // DoseReferenceDescription
+	{Group: 0x300e, Element: 0x0008}: deidRemove, // ReviewerName
+	{Group: 0x4000, Element: 0x0010}: deidRemove, // Arbitrary
+	{Group: 0x4000, Element: 0x4000}: deidRemove, // TextComments
+	{Group: 0x4008, Element: 0x0042}: deidRemove, // ResultsIDIssuer
+	{Group: 0x4008, Element: 0x0102}: deidRemove, // InterpretationRecorder
+	{Group: 0x4008, Element: 0x010a}: deidRemove, // InterpretationTranscriber
+	{Group: 0x4008, Element: 0x010b}: deidRemove, // InterpretationText
+	{Group: 0x4008, Element: 0x010c}: deidRemove, // InterpretationAuthor
+	{Group: 0x4008, Element: 0x0111}: deidRemove, // InterpretationApproverSequence
+	{Group: 0x4008, Element: 0x0114}: deidRemove, // PhysicianApprovingInterpretation
+	{Group: 0x4008, Element: 0x0115}: deidRemove, // InterpretationDiagnosisDescription
+	{Group: 0x4008, Element: 0x0118}: deidRemove, // ResultsDistributionListSequence
+	{Group: 0x4008, Element: 0x0119}: deidRemove, // DistributionName
+	{Group: 0x4008, Element: 0x011a}: deidRemove, // DistributionAddress
+	{Group: 0x4008, Element: 0x0202}: deidRemove, // InterpretationIDIssuer
+	{Group: 0x4008, Element: 0x0300}: deidRemove, // Impressions
+	{Group: 0x4008, Element: 0x4000}: deidRemove, // ResultsComments
+	{Group: 0xfffa, Element: 0xfffa}: deidRemove, // DigitalSignaturesSequence
+	{Group: 0xfffc, Element: 0xfffc}: deidRemove, // DataSetTrailingPadding
+}
+
+// The attributes kept by the Retain Device Identity option, PS3.15 E.3.6.
+var deviceIdentity = map[dicomtag.Tag]bool{
+	{Group: 0x0008, Element: 0x1010}: true, // StationName
+	{Group: 0x0018, Element: 0x1000}: true, // DeviceSerialNumber
+	{Group: 0x0018, Element: 0x1002}: true, // DeviceUID
+	{Group: 0x0018, Element: 0x1004}: true, // PlateID
+	{Group: 0x0018, Element: 0x1005}: true, // GeneratorID
+	{Group: 0x0018, Element: 0x1007}: true, // CassetteID
+	{Group: 0x0018, Element: 0x1008}: true, // GantryID
+	{Group: 0x0018, Element: 0x700a}: true, // DetectorID
+	{Group: 0x0050, Element: 0x0020}: true, // DeviceDescription
+}
+
+// Options of the profile.
+type deidOptions struct {
+	keepDates  bool // Retain Longitudinal Temporal Information, dates shifted by dateShift days.
+	dateShift  int
+	keepUIDs   bool   // Retain UIDs.
+	keepDevice bool   // Retain Device Identity.
+	uidKey     []byte // Seeds the UID remapping.
+}
+
+// A change made to an attribute, for the report.
+type deidChange struct {
+	Attribute string // Path of the attribute, through the sequences.
+	Action    string // removed, emptied, replaced, remapped, shifted, added.
+	Value     string `json:",omitempty"` // The new value.
+}
+
+type deidentifier struct {
+	options deidOptions
+	changes []deidChange
+}
+
+// Remap a UID: the same UID maps to the same new one for the same key. The
+// new UIDs are UUID derived (2.25), PS3.5 B.2.
+func (d *deidentifier) remapUID(uid string) string {
+	h := sha256.Sum256(append(append([]byte(nil), d.options.uidKey...), uid...))
+	h[6] = h[6]&0x0f | 0x40
+	h[8] = h[8]&0x3f | 0x80
+	return "2.25." + new(big.Int).SetBytes(h[:16]).String()
+}
+
+// Shift a DA or DT value by the date shift. Returns "" if the value can't be
+// parsed.
+func (d *deidentifier) shiftDate(value string) string {
+	if len(value) < 8 {
+		return ""
+	}
+	t, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return ""
+	}
+	return t.AddDate(0, 0, d.options.dateShift).Format("20060102") + value[8:]
+}
+
+func deidDummyValue(vr string) (interface{}, bool) {
+	switch vr {
+	case "PN", "LO", "SH", "CS", "LT", "ST", "UT", "UC":
+		return "ANONYMOUS", true
+	case "DA":
+		return "19000101", true
+	case "TM":
+		return "000000", true
+	case "DT":
+		return "19000101000000", true
+	}
+	return nil, false
+}
+
+// The action for an attribute, the options applied. 0 to keep it.
+func (d *deidentifier) action(elem *dicom.Element) byte {
+	tag := elem.Tag
+	switch {
+	case tag.Group%2 == 1:
+		// Private attributes.
+		return deidRemove
+	case tag.Element == 0x0000 && tag.Group != dicomtag.MetadataGroup:
+		// Group lengths, wrong once attributes are removed.
+		return deidRemove
+	case tag.Group&0xff00 == 0x5000:
+		// Curves.
+		return deidRemove
+	case tag.Group&0xff00 == 0x6000 && (tag.Element == 0x3000 || tag.Element == 0x4000):
+		// Overlay data and comments.
+		return deidRemove
+	}
+	action := basicProfile[tag]
+	switch {
+	case action == 0:
+	case d.options.keepDevice && deviceIdentity[tag]:
+		return 0
+	case d.options.keepUIDs && action == deidUID:
+		return 0
+	case d.options.keepDates && (elem.VR == "DA" || elem.VR == "DT"):
+		return deidShift
+	case d.options.keepDates && elem.VR == "TM":
+		return 0
+	}
+	return action
+}
+
+// Return the de-identified copy of "elems". "path" is the path of the
+// enclosing sequence item, for the report.
+func (d *deidentifier) elements(elems []*dicom.Element, path string) []*dicom.Element {
+	out := make([]*dicom.Element, 0, len(elems))
+	for _, elem := range elems {
+		name := path + dicomtag.DebugString(elem.Tag)
+		change := func(action string, value string) {
+			d.changes = append(d.changes, deidChange{Attribute: name, Action: action, Value: value})
+		}
+		replace := func(values []interface{}) *dicom.Element {
+			return &dicom.Element{Tag: elem.Tag, VR: elem.VR, UndefinedLength: elem.UndefinedLength, Value: values}
+		}
+
+		switch d.action(elem) {
+		case deidRemove:
+			change("removed", "")
+			continue
+		case deidZero:
+			if len(elem.Value) > 0 {
+				change("emptied", "")
+				elem = replace(nil)
+			}
+		case deidDummy:
+			if v, ok := deidDummyValue(elem.VR); ok {
+				change("replaced", fmt.Sprint(v))
+				elem = replace([]interface{}{v})
+			} else {
+				change("removed", "")
+				continue
+			}
+		case deidUID:
+			var values []interface{}
+			var uids []string
+			for _, v := range elem.Value {
+				if s, ok := v.(string); ok && strings.TrimRight(s, " \x00") != "" {
+					s = d.remapUID(strings.TrimRight(s, " \x00"))
+					values = append(values, s)
+					uids = append(uids, s)
+				}
+			}
+			if len(uids) > 0 {
+				change("remapped", strings.Join(uids, "\\"))
+				elem = replace(values)
+			}
+		case deidShift:
+			var values []interface{}
+			var dates []string
+			for _, v := range elem.Value {
+				if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
+					if s = d.shiftDate(strings.TrimSpace(s)); s != "" {
+						values = append(values, s)
+						dates = append(dates, s)
+					}
+				}
+			}
+			if len(values) > 0 {
+				change("shifted", strings.Join(dates, "\\"))
+				elem = replace(values)
+			} else if len(elem.Value) > 0 {
+				change("emptied", "")
+				elem = replace(nil)
+			}
+		default:
+			if elem.VR == "SQ" {
+				elem = d.sequence(elem, name)
+			}
+		}
+		out = append(out, elem)
+	}
+	return out
+}
+
+// De-identify the items of a sequence that is kept.
+func (d *deidentifier) sequence(elem *dicom.Element, name string) *dicom.Element {
+	sq := &dicom.Element{Tag: elem.Tag, VR: elem.VR, UndefinedLength: elem.UndefinedLength}
+	for i, v := range elem.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok {
+			sq.Value = append(sq.Value, v)
+			continue
+		}
+		var children []*dicom.Element
+		for _, c := range item.Value {
+			if child, ok := c.(*dicom.Element); ok {
+				children = append(children, child)
+			}
+		}
+		var values []interface{}
+		for _, child := range d.elements(children, fmt.Sprintf("%s[%d]/", name, i)) {
+			values = append(values, child)
+		}
+		sq.Value = append(sq.Value, &dicom.Element{Tag: item.Tag, VR: item.VR, UndefinedLength: item.UndefinedLength, Value: values})
+	}
+	return sq
+}
+
+// The code and meaning of the profile and the options applied, PS3.16
+// CID 7050.
+func (d *deidentifier) methods() [][2]string {
+	methods := [][2]string{{"113100", "Basic Application Confidentiality Profile"}}
+	if d.options.keepDates {
+		methods = append(methods, [2]string{"113107", "Retain Longitudinal Temporal Information Modified Dates Option"})
+	}
+	if d.options.keepDevice {
+		methods = append(methods, [2]string{"113109", "Retain Device Identity Option"})
+	}
+	if d.options.keepUIDs {
+		methods = append(methods, [2]string{"113110", "Retain UIDs Option"})
+	}
+	return methods
+}
+
+// De-identify the dataset. Returns the changes made.
+func (d *deidentifier) dataset(ds *dicom.DataSet) []deidChange {
+	d.changes = nil
+	ds.Elements = d.elements(ds.Elements, "")
+
+	methods := d.methods()
+	var names, codes []interface{}
+	for _, m := range methods {
+		names = append(names, m[1])
+		codes = append(codes, &dicom.Element{Tag: dicomtag.Item, Value: []interface{}{
+			dicom.MustNewElement(dicomtag.CodeValue, m[0]),
+			dicom.MustNewElement(dicomtag.CodingSchemeDesignator, "DCM"),
+			dicom.MustNewElement(dicomtag.CodeMeaning, m[1]),
+		}})
+	}
+	temporal := "REMOVED"
+	if d.options.keepDates {
+		temporal = "MODIFIED"
+	}
+	for _, elem := range []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientIdentityRemoved, "YES"),
+		dicom.MustNewElement(dicomtag.DeidentificationMethod, names...),
+		{Tag: dicomtag.DeidentificationMethodCodeSequence, VR: "SQ", Value: codes},
+		dicom.MustNewElement(dicomtag.LongitudinalTemporalInformationModified, temporal),
+	} {
+		ds.Elements = setElement(ds.Elements, elem)
+		value := ""
+		if elem.VR != "SQ" {
+			values, _ := elem.GetStrings()
+			value = strings.Join(values, "\\")
+		}
+		d.changes = append(d.changes, deidChange{Attribute: dicomtag.DebugString(elem.Tag), Action: "added", Value: value})
+	}
+	return d.changes
+}
+
+// Replace the element with the same tag as "elem", or insert it in tag order.
+func setElement(elems []*dicom.Element, elem *dicom.Element) []*dicom.Element {
+	for i, e := range elems {
+		switch e.Tag.Compare(elem.Tag) {
+		case 0:
+			elems[i] = elem
+			return elems
+		case 1:
+			return append(elems[:i], append([]*dicom.Element{elem}, elems[i:]...)...)
+		}
+	}
+	return append(elems, elem)
+}
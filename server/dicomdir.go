@@ -0,0 +1,208 @@
+package main
+
+// DICOMDIR media layouts: the directory records of the DICOMDIR tell which
+// files make up the file-set and where they are, in nested directories and
+// without a .dcm extension.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/sirupsen/logrus"
+)
+
+// A directory record referencing a file, with the patient, study and series
+// records it is under.
+type dicomDirEntry struct {
+	fileID            string // Referenced File ID, components separated by "\".
+	path              string // The referenced file, "" if not found.
+	err               error  // Why the file was not found.
+	patientID         string
+	studyInstanceUID  string
+	seriesInstanceUID string
+	sopClassUID       string
+	sopInstanceUID    string
+	transferSyntaxUID string
+}
+
+// The file named DICOMDIR in "dir", or "".
+func findDicomDir(dir string) string {
+	for _, name := range []string{"DICOMDIR", "dicomdir"} {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// Read the directory records of the DICOMDIR at "path" that reference a
+// file. The records are taken in the order they are stored, which is the
+// order of the hierarchy for the DICOMDIR writers around: an IMAGE record is
+// under the last PATIENT, STUDY and SERIES records before it.
+func readDicomDir(path string) ([]dicomDirEntry, error) {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
+	if err != nil {
+		return nil, err
+	}
+	seq, err := ds.FindElementByTag(dicomtag.DirectoryRecordSequence)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Dir(path)
+	var entries []dicomDirEntry
+	var patientID, studyUID, seriesUID string
+	for _, v := range seq.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok {
+			continue
+		}
+		record := make(map[dicomtag.Tag]*dicom.Element)
+		for _, child := range item.Value {
+			if elem, ok := child.(*dicom.Element); ok {
+				record[elem.Tag] = elem
+			}
+		}
+		if elem, ok := record[dicomtag.RecordInUseFlag]; ok {
+			if flag, err := elem.GetUInt16(); err == nil && flag == 0 {
+				continue
+			}
+		}
+		switch recordString(record, dicomtag.DirectoryRecordType) {
+		case "PATIENT":
+			patientID = recordString(record, dicomtag.PatientID)
+			studyUID, seriesUID = "", ""
+		case "STUDY":
+			studyUID = recordString(record, dicomtag.StudyInstanceUID)
+			seriesUID = ""
+		case "SERIES":
+			seriesUID = recordString(record, dicomtag.SeriesInstanceUID)
+		}
+		elem, ok := record[dicomtag.ReferencedFileID]
+		if !ok {
+			continue
+		}
+		components, err := elem.GetStrings()
+		if err != nil || len(components) == 0 {
+			continue
+		}
+		for i, c := range components {
+			components[i] = strings.TrimSpace(c)
+		}
+		e := dicomDirEntry{
+			fileID:            strings.Join(components, "\\"),
+			patientID:         patientID,
+			studyInstanceUID:  studyUID,
+			seriesInstanceUID: seriesUID,
+			sopClassUID:       recordString(record, dicomtag.ReferencedSOPClassUIDInFile),
+			sopInstanceUID:    recordString(record, dicomtag.ReferencedSOPInstanceUIDInFile),
+			transferSyntaxUID: recordString(record, dicomtag.ReferencedTransferSyntaxUIDInFile),
+		}
+		e.path, e.err = resolveFileID(root, components)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func recordString(record map[dicomtag.Tag]*dicom.Element, tag dicomtag.Tag) string {
+	elem, ok := record[tag]
+	if !ok {
+		return ""
+	}
+	s, err := elem.GetString()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(s, " \x00")
+}
+
+// The path of the file with the Referenced File ID "components" under
+// "root". File IDs are in capitals, the components are matched regardless of
+// case, for media copied to case-sensitive file systems.
+func resolveFileID(root string, components []string) (string, error) {
+	path := root
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, `/\`) {
+			return "", fmt.Errorf("invalid file ID component %q", c)
+		}
+		if _, err := os.Lstat(filepath.Join(path, c)); err == nil {
+			path = filepath.Join(path, c)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return "", err
+		}
+		found := false
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), c) {
+				path = filepath.Join(path, entry.Name())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("%s: %s not found", path, c)
+		}
+	}
+	return path, nil
+}
+
+// Whether the file at "path" starts with the 128 byte preamble and the
+// "DICM" prefix of DICOM files.
+func hasDicomPreamble(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var b [132]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		return false
+	}
+	return bytes.Equal(b[128:], []byte("DICM"))
+}
+
+// The differences between the directory record and the file it references.
+func (e *dicomDirEntry) check(ds *dicom.DataSet) []string {
+	var problems []string
+	for _, c := range []struct {
+		name   string
+		record string
+		tag    dicomtag.Tag
+	}{
+		{"Patient ID", e.patientID, dicomtag.PatientID},
+		{"Study Instance UID", e.studyInstanceUID, dicomtag.StudyInstanceUID},
+		{"Series Instance UID", e.seriesInstanceUID, dicomtag.SeriesInstanceUID},
+		{"SOP Class UID", e.sopClassUID, dicomtag.SOPClassUID},
+		{"SOP Instance UID", e.sopInstanceUID, dicomtag.SOPInstanceUID},
+		{"Transfer Syntax UID", e.transferSyntaxUID, dicomtag.TransferSyntaxUID},
+	} {
+		if c.record == "" {
+			continue
+		}
+		file := ""
+		if elem, err := ds.FindElementByTag(c.tag); err == nil {
+			file, _ = elem.GetString()
+			file = strings.TrimRight(file, " \x00")
+		}
+		if file != c.record {
+			problems = append(problems, fmt.Sprintf("%s %q in the DICOMDIR, %q in the file", c.name, c.record, file))
+		}
+	}
+	return problems
+}
+
+func reportDicomDir(dicomdir string, fileID string, problem string) {
+	logrus.WithFields(logrus.Fields{
+		"DICOMDIR": dicomdir,
+		"File":     fileID,
+		"Problem":  problem,
+	}).Warn("DICOMDIR inconsistency")
+}
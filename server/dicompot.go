@@ -1,18 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/mattn/go-colorable"
 	"github.com/nsmfoo/dicompot"
 	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/sopclass"
 	"github.com/sirupsen/logrus"
 	"github.com/snowzach/rotatefilehook"
 )
@@ -22,8 +33,62 @@ var (
 	ipFlag   = flag.String("ip", "127.0.0.1", "IP address to listen to")
 	enFlag   = flag.String("enforce", "no", "Enforce AE title check")
 	aeFlag   = flag.String("ae", "radiant", "AE title of this server")
+	aclFlag  = flag.String("acl", "", "Access policy (JSON): called AE titles, calling AE titles by address range and service")
 	dirFlag  = flag.String("dir", ".", "Picture directory")
 	logFlag  = flag.String("log", "dicompot.log", "logfile")
+	mwlFlag  = flag.String("mwl", "", "Modality worklist schedule (JSON), generated if empty")
+
+	commitFlag = flag.String("commit", "same", "Storage commitment reports: same or new association")
+	remoteFlag = flag.String("remote", "", "Remote AEs for new associations (AE=host:port,...)")
+	printFlag  = flag.String("print", "print", "Directory to save received print jobs in")
+
+	printSizeFlag  = flag.Int("printsize", 1024, "Stop saving print images once the -print directory holds this much, in MiB; 0 for no limit")
+	printFilesFlag = flag.Int("printfiles", 10000, "Stop saving print images once the -print directory holds this many files; 0 for no limit")
+
+	metricsFlag = flag.String("metrics", "", "Serve Prometheus metrics on this address, e.g. :9100")
+
+	adminFlag      = flag.String("admin", "", "Serve the admin API on this address, e.g. 127.0.0.1:8080")
+	adminTokenFlag = flag.String("admintoken", "", "Bearer token for the admin API, generated if empty")
+
+	webFlag       = flag.String("web", "", "Serve DICOMweb (QIDO-RS, WADO-RS, STOW-RS) on this address, e.g. :8042")
+	stowFlag      = flag.String("stow", "stow", "Directory to save STOW-RS uploads in")
+	stowSizeFlag  = flag.Int("stowsize", 1024, "Stop saving STOW-RS uploads once the -stow directory holds this much, in MiB; 0 for no limit")
+	stowFilesFlag = flag.Int("stowfiles", 10000, "Stop saving STOW-RS uploads once the -stow directory holds this many files; 0 for no limit")
+
+	watermarkFlag   = flag.String("watermark", "", "Watermark the datasets returned to each session with UIDs under this root, off if empty")
+	watermarkDBFlag = flag.String("watermarkdb", "watermarks.jsonl", "Lookup table of the watermarks handed out")
+
+	pixelKeyFlag      = flag.String("pixelkey", "", "Add a pattern carrying the session ID to the pixel data sent by C-GET and C-MOVE, seeded with this key; off if empty")
+	pixelStrengthFlag = flag.Int("pixelstrength", 2, "Amplitude of the pixel data pattern, in stored pixel values")
+	canaryFlag        = flag.String("canary", "", "Burn this text into the images sent by C-GET and C-MOVE, {session} and {token} are replaced; off if empty")
+
+	cacheFlag = flag.Int("cache", 256, "Memory for the files sent by C-GET, in MiB; larger files are streamed from disk. 0 streams every file")
+
+	spillFlag       = flag.Int("spill", 16, "Write received datasets larger than this to temp files, in MiB; 0 keeps them in memory")
+	spillDirFlag    = flag.String("spilldir", "", "Directory for the temp files of -spill, the system temp directory if empty")
+	maxAssocFlag    = flag.Int("maxassoc", 1024, "Abort associations holding more received data than this, in MiB; 0 for no limit")
+	maxInFlightFlag = flag.Int("maxinflight", 4096, "Abort associations once all of them hold more received data than this, in MiB; 0 for no limit")
+
+	artimFlag       = flag.Duration("artim", 10*time.Second, "ARTIM timer: wait for A-ASSOCIATE-RQ after connect and for close after abort or release")
+	idleFlag        = flag.Duration("idle", 5*time.Minute, "Abort associations idle for this long, 0 for no limit")
+	readTimeoutFlag = flag.Duration("readtimeout", 30*time.Second, "Abort associations when one PDU takes longer to arrive, 0 for no limit")
+
+	tarpitScoreFlag   = flag.Int("tarpitscore", 10, "Behavior score that puts a source in the tarpit, 0 to disable scoring")
+	tarpitIPsFlag     = flag.String("tarpitips", "", "Always tarpit these source addresses or ranges (CIDR,...)")
+	tarpitAEsFlag     = flag.String("tarpitaes", "", "Always tarpit these calling AE titles (AE,...)")
+	tarpitDelayFlag   = flag.Duration("tarpitdelay", 5*time.Second, "Association response delay in the tarpit, doubled for repeat offenders")
+	tarpitFindFlag    = flag.Duration("tarpitfind", time.Second, "Delay of each C-FIND match in the tarpit")
+	tarpitDribbleFlag = flag.Duration("tarpitdribble", 0, "Send PDUs in the tarpit one byte at a time, with this pause")
+	tarpitMaxFlag     = flag.Duration("tarpitmax", time.Minute, "Max delay in the tarpit")
+
+	graceFlag = flag.Duration("grace", 10*time.Second, "Time given to active associations to finish on SIGINT/SIGTERM")
+
+	lureFlag    = flag.Int("lure", 0, "With -enforce, accept clients after this many rejected called AE titles, 0 to disable")
+	lureAEsFlag = flag.String("lureaes", "", "With -enforce, accept these called AE titles too (AE,...)")
+
+	signaturesFlag = flag.String("signatures", "", "Client fingerprint signatures (JSON), reloaded on SIGHUP; the bundled ones if empty")
+
+	sinkFlag = flag.String("sink", "", "Event sinks, comma separated: syslog+udp://host:514, cef+tcp://..., leef+tls://..., file:///path, https://...")
 )
 
 func logInit() {
@@ -57,6 +122,32 @@ type server struct {
 
 	// Set of dicom files the server manages. Keys are file paths.
 	datasets map[string]*dicom.DataSet
+
+	// Scheduled procedure steps served to Modality Worklist queries.
+	worklist *worklist
+
+	// Performed procedure steps reported through MPPS.
+	mpps *mppsStore
+
+	// Film sessions, film boxes and image boxes of print jobs.
+	print *printStore
+
+	// SOP instances peers tried to C-STORE or STOW. Keys are SOP instance
+	// UIDs, values are SOP class UIDs. See addUpload.
+	uploads map[string]string
+
+	// Remote AEs that receive storage commitment reports on a new
+	// association. Keys are AE titles, values are host:ports.
+	remoteAEs map[string]string
+
+	// Rewrites the datasets returned to each session. Nil if watermarking
+	// is off.
+	watermarks *watermarker
+	// Marks the pixel data sent by C-GET and C-MOVE. Nil if off.
+	pixels *pixelMarker
+
+	// The files sent by C-GET, when they are sent unchanged. Nil if off.
+	cache *dicompot.PayloadCache
 }
 
 // Represents a match.
@@ -68,6 +159,9 @@ type filterMatch struct {
 // "filters" are matching conditions specified in C-{FIND,GET,MOVE}. This
 // function returns the list of datasets and their elements that match filters.
 func (ss *server) findMatchingFiles(filters []*dicom.Element) ([]filterMatch, error) {
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("query has no attributes")
+	}
 
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
@@ -98,9 +192,6 @@ func (ss *server) findMatchingFiles(filters []*dicom.Element) ([]filterMatch, er
 			}
 		}
 		if allMatched {
-			if len(match.elems) == 0 {
-				panic(match)
-			}
 			matches = append(matches, match)
 		}
 	}
@@ -108,14 +199,61 @@ func (ss *server) findMatchingFiles(filters []*dicom.Element) ([]filterMatch, er
 	return matches, nil
 }
 
+// Returns the elements of each item in sequence element "seq".
+func sequenceItems(seq *dicom.Element) [][]*dicom.Element {
+	var items [][]*dicom.Element
+	for _, v := range seq.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok || item.Tag != dicomtag.Item {
+			continue
+		}
+		var elems []*dicom.Element
+		for _, iv := range item.Value {
+			if elem, ok := iv.(*dicom.Element); ok {
+				elems = append(elems, elem)
+			}
+		}
+		items = append(items, elems)
+	}
+	return items
+}
+
+// Returns the string value of "tag" in "elems", or "" if absent.
+func elementString(elems []*dicom.Element, tag dicomtag.Tag) string {
+	elem, err := dicom.FindElementByTag(elems, tag)
+	if err != nil {
+		return ""
+	}
+	value, _ := elem.GetString()
+	return strings.TrimSpace(value)
+}
+
+// Returns the IP address of the peer.
+func connStateIP(connState dicompot.ConnectionState) string {
+	if connState.RemoteAddr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(connState.RemoteAddr.String())
+	if err != nil {
+		return connState.RemoteAddr.String()
+	}
+	return host
+}
+
+// Allocates a SOP instance UID for objects created on behalf of a peer.
+func newInstanceUID() string {
+	return fmt.Sprintf("2.25.%d%d", rand.Int63(), rand.Intn(1000))
+}
+
 func (ss *server) onCFind(
+	connState dicompot.ConnectionState,
 	transferSyntaxUID string,
 	sopClassUID string,
 	filters []*dicom.Element,
 	sessionID string,
 	ch chan dicompot.CFindResult) {
 
-	matches, err := ss.findMatchingFiles(filters)
+	matches, err := ss.findMatchingFiles(ss.watermarks.unmark(filters, sessionID))
 
 	logrus.WithFields(logrus.Fields{
 		"Matches": len(matches),
@@ -126,20 +264,21 @@ func (ss *server) onCFind(
 		ch <- dicompot.CFindResult{Err: err}
 	} else {
 		for _, match := range matches {
-			ch <- dicompot.CFindResult{Elements: match.elems}
+			ch <- dicompot.CFindResult{Elements: ss.watermarks.mark(match.elems, sessionID, connStateIP(connState), false)}
 		}
 	}
 	close(ch)
 }
 
 func (ss *server) onCMoveOrCGet(
+	connState dicompot.ConnectionState,
 	transferSyntaxUID string,
 	sopClassUID string,
 	filters []*dicom.Element,
 	sessionID string,
 	ch chan dicompot.CMoveResult) {
 
-	matches, err := ss.findMatchingFiles(filters)
+	matches, err := ss.findMatchingFiles(ss.watermarks.unmark(filters, sessionID))
 
 	logrus.WithFields(logrus.Fields{
 		"Matches": len(matches),
@@ -150,14 +289,27 @@ func (ss *server) onCMoveOrCGet(
 		ch <- dicompot.CMoveResult{Err: err}
 	} else {
 		for i, match := range matches {
-			ds, err := dicom.ReadDataSetFromFile(match.path, dicom.ReadOptions{})
 			resp := dicompot.CMoveResult{
 				Remaining: len(matches) - i - 1,
 				Path:      match.path,
 			}
+			if ss.watermarks == nil && ss.pixels == nil {
+				// Sent as is: leave the reading to the payload cache.
+				ch <- resp
+				continue
+			}
+			ds, err := dicom.ReadDataSetFromFile(match.path, dicom.ReadOptions{})
 			if err != nil {
 				resp.Err = err
 			} else {
+				ds.Elements = ss.watermarks.mark(ds.Elements, sessionID, connStateIP(connState), true)
+				if err := ss.pixels.mark(ds, sessionID, connStateIP(connState)); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"Path":  match.path,
+						"Error": err,
+						"ID":    sessionID,
+					}).Debug("Pixel data not marked")
+				}
 				resp.DataSet = ds
 			}
 			ch <- resp
@@ -166,19 +318,51 @@ func (ss *server) onCMoveOrCGet(
 	close(ch)
 }
 
-// Find DICOM files in or under "dir" and read its attributes.
+// Find DICOM files in or under "dir" and read its attributes. Files are found
+// through the DICOMDIRs, by the .dcm extension or by the DICM prefix; the
+// differences between a DICOMDIR and the files it references are logged.
 func listDicomFiles(dir string) (map[string]*dicom.DataSet, error) {
 	datasets := make(map[string]*dicom.DataSet)
-	readFile := func(path string) {
-		if _, ok := datasets[path]; ok {
-			return
+	readFile := func(path string) *dicom.DataSet {
+		if ds, ok := datasets[path]; ok {
+			return ds
 		}
 		ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
 		if err != nil {
 			log.Printf("%s: failed to parse dicom file: %v", path, err)
-			return
+			return nil
 		}
 		datasets[path] = ds
+		return ds
+	}
+
+	// The files referenced by the DICOMDIRs found, and the directories
+	// holding them.
+	referenced := make(map[string]bool)
+	var dicomDirs []string
+	readDir := func(dicomdir string) {
+		entries, err := readDicomDir(dicomdir)
+		if err != nil {
+			log.Printf("%s: failed to parse DICOMDIR: %v", dicomdir, err)
+			return
+		}
+		dicomDirs = append(dicomDirs, dicomdir)
+		for i := range entries {
+			e := &entries[i]
+			if e.path == "" {
+				reportDicomDir(dicomdir, e.fileID, fmt.Sprintf("referenced file not found: %v", e.err))
+				continue
+			}
+			referenced[e.path] = true
+			ds := readFile(e.path)
+			if ds == nil {
+				reportDicomDir(dicomdir, e.fileID, "referenced file not readable")
+				continue
+			}
+			for _, problem := range e.check(ds) {
+				reportDicomDir(dicomdir, e.fileID, problem)
+			}
+		}
 	}
 
 	walkCallback := func(path string, info os.FileInfo, err error) error {
@@ -187,24 +371,27 @@ func listDicomFiles(dir string) (map[string]*dicom.DataSet, error) {
 			return nil
 		}
 		if (info.Mode() & os.ModeDir) != 0 {
-			// If a directory contains file "DICOMDIR", all the files in the directory are DICOM files.
-			if _, err := os.Stat(filepath.Join(path, "DICOMDIR")); err != nil {
-				return nil
-			}
-			subpaths, err := filepath.Glob(path + "/*")
-			if err != nil {
-				log.Printf("%v: glob: %v", path, err)
-				return nil
-			}
-			for _, subpath := range subpaths {
-				if !strings.HasSuffix(subpath, "DICOMDIR") {
-					readFile(subpath)
-				}
+			// Read the DICOMDIR before the files of the directory,
+			// which may sort before it.
+			if dicomdir := findDicomDir(path); dicomdir != "" {
+				readDir(dicomdir)
 			}
 			return nil
 		}
-		if strings.HasSuffix(path, ".dcm") {
-			readFile(path)
+		if !info.Mode().IsRegular() || strings.EqualFold(info.Name(), "DICOMDIR") || referenced[path] {
+			return nil
+		}
+		if !strings.HasSuffix(path, ".dcm") && !hasDicomPreamble(path) {
+			return nil
+		}
+		if readFile(path) == nil {
+			return nil
+		}
+		for _, dicomdir := range dicomDirs {
+			if rel, err := filepath.Rel(filepath.Dir(dicomdir), path); err == nil && !strings.HasPrefix(rel, "..") {
+				reportDicomDir(dicomdir, rel, "file not referenced by the DICOMDIR")
+				break
+			}
 		}
 		return nil
 	}
@@ -232,6 +419,14 @@ func canonicalizeHostIp(IpAdr string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(verifyCommand(os.Args[2:]))
+		case "anonymize":
+			os.Exit(anonymizeCommand(os.Args[2:]))
+		}
+	}
 
 	flag.Parse()
 	logInit()
@@ -251,41 +446,255 @@ func main() {
 	`)
 
 	log.Printf("-| Loaded %d images", len(datasets))
+
+	wl := generateWorklist(25)
+	if *mwlFlag != "" {
+		wl, err = loadWorklist(*mwlFlag)
+		if err != nil {
+			log.Fatalf("-| Failed to load worklist: %v", err)
+		}
+	}
+	log.Printf("-| Worklist: %d requested procedures", len(wl.entries))
+
+	remoteAEs, err := parseRemoteAEs(*remoteFlag)
+	if err != nil {
+		log.Fatalf("-| %v", err)
+	}
+
+	printQuota, err := newDirQuota(*printFlag, int64(*printSizeFlag)<<20, *printFilesFlag)
+	if err != nil {
+		log.Fatalf("-| Print directory: %v", err)
+	}
+
 	ss := server{
-		mu:       &sync.Mutex{},
-		datasets: datasets,
+		mu:        &sync.Mutex{},
+		datasets:  datasets,
+		worklist:  wl,
+		mpps:      newMPPSStore(),
+		print:     newPrintStore(*printFlag, printQuota),
+		uploads:   make(map[string]string),
+		remoteAEs: remoteAEs,
 	}
+	if *watermarkFlag != "" {
+		ss.watermarks, err = newWatermarker(*watermarkFlag, *watermarkDBFlag)
+		if err != nil {
+			log.Fatalf("-| Watermarks: %v", err)
+		}
+		log.Printf("-| Watermarks: %s, lookup table %s", *watermarkFlag, *watermarkDBFlag)
+	}
+	if *pixelKeyFlag != "" || *canaryFlag != "" {
+		if err := validateCanary(*canaryFlag); err != nil {
+			log.Fatalf("-| Canary: %v", err)
+		}
+		ss.pixels = &pixelMarker{canary: *canaryFlag, watermarks: ss.watermarks}
+		if *pixelKeyFlag != "" {
+			ss.pixels.key, ss.pixels.strength = *pixelKeyFlag, *pixelStrengthFlag
+		}
+		log.Printf("-| Pixel data marks: pattern %t, canary %q", ss.pixels.strength > 0, *canaryFlag)
+	}
+	if *cacheFlag > 0 {
+		ss.cache = dicompot.NewPayloadCache(int64(*cacheFlag) << 20)
+		log.Printf("-| C-GET cache: %d MiB", *cacheFlag)
+	}
+	log.Printf("-| Received data: spill past %d MiB, at most %d MiB per association, %d MiB in all",
+		*spillFlag, *maxAssocFlag, *maxInFlightFlag)
 	log.Printf("-| Listening on: %s", hostAddress)
 
 	params := dicompot.ServiceProviderParams{
 		AETitle: *aeFlag,
 		Enforce: *enFlag,
 
+		PayloadCache: ss.cache,
+
+		SpillThreshold:      int64(*spillFlag) << 20,
+		SpillDir:            *spillDirFlag,
+		MaxAssociationBytes: int64(*maxAssocFlag) << 20,
+		MaxInFlightBytes:    int64(*maxInFlightFlag) << 20,
+
+		ARTIMTimeout: *artimFlag,
+		IdleTimeout:  *idleFlag,
+		ReadTimeout:  *readTimeoutFlag,
+
 		CEcho: func(connState dicompot.ConnectionState) dimse.Status {
 			return dimse.Success
 		},
 		CFind: func(connState dicompot.ConnectionState, transferSyntaxUID string, sopClassUID string,
 			filter []*dicom.Element, sessionID string, ch chan dicompot.CFindResult) {
-			ss.onCFind(transferSyntaxUID, sopClassUID, filter, sessionID, ch)
+			if sopClassUID == dicomuid.ModalityWorklistInformationFind {
+				ss.onWorklistFind(connState, filter, sessionID, ch)
+				return
+			}
+			ss.onCFind(connState, transferSyntaxUID, sopClassUID, filter, sessionID, ch)
 		},
 		CMove: func(connState dicompot.ConnectionState, transferSyntaxUID string, sopClassUID string,
 			filter []*dicom.Element, sessionID string, ch chan dicompot.CMoveResult) {
-			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, sessionID, ch)
+			ss.onCMoveOrCGet(connState, transferSyntaxUID, sopClassUID, filter, sessionID, ch)
 		},
 		CGet: func(connState dicompot.ConnectionState, transferSyntaxUID string, sopClassUID string,
 			filter []*dicom.Element, sessionID string, ch chan dicompot.CMoveResult) {
-			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, sessionID, ch)
+			ss.onCMoveOrCGet(connState, transferSyntaxUID, sopClassUID, filter, sessionID, ch)
+		},
+		CStore: func(connState dicompot.ConnectionState, transferSyntaxUID string, sopClassUID string,
+			sopInstanceUID string, data io.Reader, size int64) dimse.Status {
+			return ss.onCStore(connState, sopClassUID, sopInstanceUID)
+		},
+		NServices: map[string]dicompot.NServiceCallback{
+			sopclass.StorageCommitmentPushModel: func(connState dicompot.ConnectionState, transferSyntaxUID string,
+				msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+				return ss.onStorageCommitment(connState, msg, elems, sessionID)
+			},
+			sopclass.ModalityPerformedProcedureStep: func(connState dicompot.ConnectionState, transferSyntaxUID string,
+				msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+				return ss.onMPPS(msg, elems, sessionID)
+			},
 		},
 	}
 
+	for uid, cb := range ss.printServices() {
+		params.NServices[uid] = cb
+	}
+
+	params.Tarpit, err = tarpitPolicy()
+	if err != nil {
+		log.Fatalf("-| Tarpit: %v", err)
+	}
+
+	params.Lure = lurePolicy()
+
+	if *aclFlag != "" {
+		params.Access, err = loadAccessPolicy(*aclFlag)
+		if err != nil {
+			log.Fatalf("-| Access policy: %v", err)
+		}
+		log.Printf("-| Access policy: %d rules", len(params.Access.Rules))
+	}
+
+	params.FingerprintSignatures, err = loadSignatures()
+	if err != nil {
+		log.Fatalf("-| Fingerprint signatures: %v", err)
+	}
+	log.Printf("-| Fingerprint signatures: %d", len(params.FingerprintSignatures))
+
+	if *sinkFlag != "" {
+		params.EventSinks, err = parseEventSinks(*sinkFlag)
+		if err != nil {
+			log.Fatalf("-| Event sinks: %v", err)
+		}
+		for _, sink := range params.EventSinks {
+			log.Printf("-| Event sink: %v", sink)
+		}
+	}
+
 	log.Printf("-| Local AE Title: %s", params.AETitle)
 	log.Printf("-| Attacker log: %s", *logFlag)
 
+	var httpServers []*http.Server
+	if *metricsFlag != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", dicompot.MetricsHandler())
+		httpServers = append(httpServers, serveHTTP("Metrics", *metricsFlag, mux))
+		log.Printf("-| Metrics: %s/metrics", *metricsFlag)
+	}
+
+	if *webFlag != "" {
+		mux := http.NewServeMux()
+		quota, err := newDirQuota(*stowFlag, int64(*stowSizeFlag)<<20, *stowFilesFlag)
+		if err != nil {
+			log.Fatalf("-| STOW-RS directory: %v", err)
+		}
+		mux.Handle(dicomwebPrefix+"/", &dicomweb{ss: &ss, stowDir: *stowFlag, quota: quota})
+		httpServers = append(httpServers, serveHTTP("DICOMweb", *webFlag, mux))
+		log.Printf("-| DICOMweb: %s%s", *webFlag, dicomwebPrefix)
+	}
+
 	sp, err := dicompot.NewServiceProvider(params, hostAddress)
 
 	if err != nil {
 		panic(err)
 	}
 
-	sp.Run()
+	if *adminFlag != "" {
+		as := &adminServer{ss: &ss, sp: sp, token: *adminTokenFlag}
+		if as.token == "" {
+			as.token, err = newAdminToken()
+			if err != nil {
+				log.Fatalf("-| Admin token: %v", err)
+			}
+			log.Printf("-| Admin token: %s", as.token)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/api/", as)
+		httpServers = append(httpServers, serveHTTP("Admin", *adminFlag, mux))
+		log.Printf("-| Admin API: %s/api/", *adminFlag)
+	}
+
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			signatures, err := loadSignatures()
+			if err != nil {
+				log.Printf("-| Fingerprint signatures not reloaded: %v", err)
+				continue
+			}
+			sp.SetFingerprintSignatures(signatures)
+			log.Printf("-| Fingerprint signatures reloaded: %d", len(signatures))
+		}
+	}()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Printf("-| %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *graceFlag)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, srv := range httpServers {
+			wg.Add(1)
+			go func(srv *http.Server) {
+				defer wg.Done()
+				if err := srv.Shutdown(ctx); err != nil {
+					srv.Close()
+				}
+			}(srv)
+		}
+		if err := sp.Shutdown(ctx); err != nil {
+			log.Printf("-| Shutdown: %v", err)
+		}
+		wg.Wait()
+		close(shutdownDone)
+	}()
+
+	if err := sp.Run(); err != dicompot.ErrServiceProviderClosed {
+		log.Fatalf("-| Listener: %v", err)
+	}
+	<-shutdownDone
+}
+
+// Timeouts of the HTTP listeners. A STOW-RS upload must arrive within the read
+// timeout.
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 5 * time.Minute
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// Serve "handler" on "addr" in the background. The process exits if the
+// listener fails; signal handling shuts the server down.
+func serveHTTP(name string, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("-| %s listener: %v", name, err)
+		}
+	}()
+	return srv
 }
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+// DICOMweb front-end (PS3.18) serving the same catalog as the DIMSE side.
+// QIDO-RS and WADO-RS requests are answered from ss.datasets, STOW-RS uploads
+// are saved to the -stow directory.
+
+const (
+	dicomwebPrefix = "/dicom-web"
+
+	// Max size of a STOW-RS request body.
+	maxStowSize = 256 << 20
+
+	// Max number of results of a QIDO-RS search.
+	maxQidoResults = 1000
+)
+
+var dicomwebRequestSeq int64
+
+type dicomweb struct {
+	ss      *server
+	stowDir string
+	quota   *dirQuota
+}
+
+// Search level of a QIDO-RS request, with the attributes returned by default.
+type qidoLevel struct {
+	name string
+	uid  dicomtag.Tag // Attribute that identifies a result
+	keys []dicomtag.Tag
+}
+
+var (
+	qidoStudy = qidoLevel{"STUDY", dicomtag.StudyInstanceUID, []dicomtag.Tag{
+		dicomtag.StudyInstanceUID, dicomtag.StudyDate, dicomtag.StudyTime, dicomtag.AccessionNumber,
+		dicomtag.PatientName, dicomtag.PatientID, dicomtag.PatientBirthDate, dicomtag.PatientSex,
+		dicomtag.StudyID, dicomtag.StudyDescription, dicomtag.ReferringPhysicianName,
+	}}
+	qidoSeries = qidoLevel{"SERIES", dicomtag.SeriesInstanceUID, []dicomtag.Tag{
+		dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.Modality,
+		dicomtag.SeriesNumber, dicomtag.SeriesDescription,
+	}}
+	qidoInstance = qidoLevel{"IMAGE", dicomtag.SOPInstanceUID, []dicomtag.Tag{
+		dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.SOPClassUID,
+		dicomtag.SOPInstanceUID, dicomtag.InstanceNumber, dicomtag.Rows, dicomtag.Columns,
+	}}
+)
+
+// Resolve a QIDO-RS query key, either a keyword or eight hex digits.
+func dicomwebTag(key string) (dicomtag.Tag, bool) {
+	if len(key) == 8 {
+		if v, err := strconv.ParseUint(key, 16, 32); err == nil {
+			return dicomtag.Tag{Group: uint16(v >> 16), Element: uint16(v)}, true
+		}
+	}
+	info, err := dicomtag.FindByName(key)
+	if err != nil {
+		return dicomtag.Tag{}, false
+	}
+	return info.Tag, true
+}
+
+// Key of "tag" in a DICOM JSON object.
+func dicomJSONKey(tag dicomtag.Tag) string {
+	return fmt.Sprintf("%04X%04X", tag.Group, tag.Element)
+}
+
+// Encode elements in the DICOM JSON model. PS3.18, F.2. Bulk data, group
+// lengths and file meta elements are left out.
+func dicomJSON(elems []*dicom.Element) map[string]interface{} {
+	obj := make(map[string]interface{})
+	for _, elem := range elems {
+		if elem.Tag.Group == 0x0002 || elem.Tag.Element == 0x0000 || elem.Tag == dicomtag.PixelData {
+			continue
+		}
+		attr := map[string]interface{}{"vr": elem.VR}
+		var values []interface{}
+		switch elem.VR {
+		case "SQ":
+			for _, item := range sequenceItems(elem) {
+				values = append(values, dicomJSON(item))
+			}
+		case "OB", "OW", "OF", "OD", "OL", "UN":
+			if len(elem.Value) == 1 {
+				if b, ok := elem.Value[0].([]byte); ok && len(b) <= 1024 {
+					attr["InlineBinary"] = base64.StdEncoding.EncodeToString(b)
+				}
+			}
+		default:
+			for _, v := range elem.Value {
+				switch x := v.(type) {
+				case string:
+					x = strings.TrimSpace(x)
+					switch elem.VR {
+					case "PN":
+						values = append(values, map[string]string{"Alphabetic": x})
+					case "IS":
+						if n, err := strconv.ParseInt(x, 10, 64); err == nil {
+							values = append(values, n)
+						} else {
+							values = append(values, x)
+						}
+					case "DS":
+						if f, err := strconv.ParseFloat(x, 64); err == nil {
+							values = append(values, f)
+						} else {
+							values = append(values, x)
+						}
+					default:
+						values = append(values, x)
+					}
+				case dicomtag.Tag:
+					values = append(values, dicomJSONKey(x))
+				default:
+					values = append(values, x)
+				}
+			}
+		}
+		if len(values) > 0 {
+			attr["Value"] = values
+		}
+		obj[dicomJSONKey(elem.Tag)] = attr
+	}
+	return obj
+}
+
+func writeDICOMJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/dicom+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Log the request, including any credentials offered.
+func logDicomwebRequest(r *http.Request, sessionID string) {
+	host, port, _ := net.SplitHostPort(r.RemoteAddr)
+	logrus.WithFields(logrus.Fields{
+		"Protocol": "DICOMweb",
+		"IP":       host,
+		"Port":     port,
+		"ID":       sessionID,
+	}).Warn("Connection from")
+
+	headers := make(map[string]string)
+	for name, values := range r.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	encoded, _ := json.Marshal(headers)
+	logrus.WithFields(logrus.Fields{
+		"Protocol":  "DICOMweb",
+		"Method":    r.Method,
+		"Path":      r.URL.Path,
+		"Query":     r.URL.RawQuery,
+		"UserAgent": r.UserAgent(),
+		"Headers":   string(encoded),
+		"ID":        sessionID,
+	}).Info("Received")
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return
+	}
+	fields := logrus.Fields{"Protocol": "DICOMweb", "ID": sessionID}
+	if user, password, ok := r.BasicAuth(); ok {
+		fields["Scheme"] = "Basic"
+		fields["Username"] = user
+		fields["Password"] = password
+	} else {
+		scheme := strings.SplitN(auth, " ", 2)
+		fields["Scheme"] = scheme[0]
+		if len(scheme) == 2 {
+			fields["Credentials"] = scheme[1]
+		}
+	}
+	logrus.WithFields(fields).Warn("Authentication attempt")
+}
+
+func (dw *dicomweb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sessionID := fmt.Sprintf("%d", time.Now().UnixNano()+atomic.AddInt64(&dicomwebRequestSeq, 1))
+	logDicomwebRequest(r, sessionID)
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, dicomwebPrefix), "/")
+	parts := strings.Split(path, "/")
+	n := len(parts)
+	uids := map[dicomtag.Tag]string{}
+	for i, tag := range []dicomtag.Tag{dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.SOPInstanceUID} {
+		if 2*i+1 < n {
+			uids[tag] = parts[2*i+1]
+		}
+	}
+	isMetadata := parts[n-1] == "metadata"
+	if isMetadata {
+		n--
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		isQido := !isMetadata
+		switch {
+		case isQido && n == 1 && parts[0] == "studies":
+			dw.qido(w, r, qidoStudy, uids, sessionID)
+		case isQido && (n == 1 && parts[0] == "series" || n == 3 && parts[0] == "studies" && parts[2] == "series"):
+			dw.qido(w, r, qidoSeries, uids, sessionID)
+		case isQido && (n == 1 && parts[0] == "instances" ||
+			n == 3 && parts[0] == "studies" && parts[2] == "instances" ||
+			n == 5 && parts[0] == "studies" && parts[2] == "series" && parts[4] == "instances"):
+			dw.qido(w, r, qidoInstance, uids, sessionID)
+		case parts[0] == "studies" && (n == 2 || n == 4 && parts[2] == "series" ||
+			n == 6 && parts[2] == "series" && parts[4] == "instances"):
+			dw.wado(w, uids, isMetadata, sessionID)
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	case http.MethodPost:
+		if parts[0] == "studies" && n <= 2 && !isMetadata {
+			dw.stow(w, r, uids[dicomtag.StudyInstanceUID], sessionID)
+			return
+		}
+		http.Error(w, "Not Found", http.StatusNotFound)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// QIDO-RS search. PS3.18, 10.6.
+func (dw *dicomweb) qido(w http.ResponseWriter, r *http.Request, level qidoLevel, uids map[dicomtag.Tag]string, sessionID string) {
+	query := r.URL.Query()
+	values := make(map[dicomtag.Tag]string)
+	for _, tag := range level.keys {
+		values[tag] = ""
+	}
+	for tag, uid := range uids {
+		values[tag] = uid
+	}
+	limit, offset := maxQidoResults, 0
+	for key, vs := range query {
+		switch strings.ToLower(key) {
+		case "limit":
+			if v, err := strconv.Atoi(vs[0]); err == nil && v > 0 && v < limit {
+				limit = v
+			}
+			continue
+		case "offset":
+			if v, err := strconv.Atoi(vs[0]); err == nil && v > 0 {
+				offset = v
+			}
+			continue
+		case "fuzzymatching":
+			continue
+		case "includefield":
+			for _, field := range strings.Split(strings.Join(vs, ","), ",") {
+				if tag, ok := dicomwebTag(field); ok {
+					if _, ok := values[tag]; !ok {
+						values[tag] = ""
+					}
+				}
+			}
+			continue
+		}
+		tag, ok := dicomwebTag(key)
+		if !ok {
+			continue
+		}
+		if tag == dicomtag.ModalitiesInStudy {
+			tag = dicomtag.Modality
+		}
+		values[tag] = vs[0]
+	}
+	if level.name == "STUDY" {
+		if _, ok := values[dicomtag.Modality]; !ok {
+			values[dicomtag.Modality] = ""
+		}
+	}
+
+	var filters []*dicom.Element
+	for tag, value := range values {
+		info, err := dicomtag.Find(tag)
+		if err != nil {
+			continue
+		}
+		if kind := dicomtag.GetVRKind(tag, info.VR); value != "" && kind != dicomtag.VRStringList && kind != dicomtag.VRDate {
+			// Only string attributes can be matched, others are just returned.
+			continue
+		}
+		var elem *dicom.Element
+		if value == "" {
+			elem, err = dicom.NewElement(tag)
+		} else {
+			elem, err = dicom.NewElement(tag, value)
+		}
+		if err == nil {
+			filters = append(filters, elem)
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Tag.Compare(filters[j].Tag) < 0 })
+
+	matches, err := dw.ss.findMatchingFiles(filters)
+	logrus.WithFields(logrus.Fields{
+		"Protocol": "DICOMweb",
+		"Level":    level.name,
+		"Query":    r.URL.RawQuery,
+		"Matches":  len(matches),
+		"ID":       sessionID,
+	}).Warn("QIDO-RS Search result")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Collapse instance matches into one result per study or series.
+	type result struct {
+		elems      []*dicom.Element
+		modalities map[string]bool
+		instances  int
+	}
+	var order []string
+	results := make(map[string]*result)
+	for _, match := range matches {
+		key := elementString(match.elems, level.uid)
+		res, ok := results[key]
+		if !ok {
+			res = &result{elems: match.elems, modalities: make(map[string]bool)}
+			results[key] = res
+			order = append(order, key)
+		}
+		res.instances++
+		if modality := elementString(match.elems, dicomtag.Modality); modality != "" {
+			res.modalities[modality] = true
+		}
+	}
+	sort.Strings(order)
+
+	objs := []map[string]interface{}{}
+	for i, key := range order {
+		if i < offset {
+			continue
+		}
+		if len(objs) >= limit {
+			break
+		}
+		res := results[key]
+		obj := dicomJSON(res.elems)
+		if level.name == "STUDY" {
+			delete(obj, dicomJSONKey(dicomtag.Modality))
+			var modalities []interface{}
+			for modality := range res.modalities {
+				modalities = append(modalities, modality)
+			}
+			obj[dicomJSONKey(dicomtag.ModalitiesInStudy)] = map[string]interface{}{"vr": "CS", "Value": modalities}
+			obj[dicomJSONKey(dicomtag.NumberOfStudyRelatedInstances)] = map[string]interface{}{"vr": "IS", "Value": []interface{}{res.instances}}
+		}
+		objs = append(objs, obj)
+	}
+	if len(objs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeDICOMJSON(w, http.StatusOK, objs)
+}
+
+// WADO-RS retrieval of a study, series or instance, either the DICOM files
+// or their metadata. PS3.18, 10.4.
+func (dw *dicomweb) wado(w http.ResponseWriter, uids map[dicomtag.Tag]string, isMetadata bool, sessionID string) {
+	var filters []*dicom.Element
+	for _, tag := range []dicomtag.Tag{dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.SOPInstanceUID} {
+		if uid, ok := uids[tag]; ok {
+			filters = append(filters, dicom.MustNewElement(tag, uid))
+		} else {
+			filters = append(filters, dicom.MustNewElement(tag))
+		}
+	}
+	matches, err := dw.ss.findMatchingFiles(filters)
+	logrus.WithFields(logrus.Fields{
+		"Protocol": "DICOMweb",
+		"Study":    uids[dicomtag.StudyInstanceUID],
+		"Series":   uids[dicomtag.SeriesInstanceUID],
+		"Instance": uids[dicomtag.SOPInstanceUID],
+		"Metadata": isMetadata,
+		"Matches":  len(matches),
+		"ID":       sessionID,
+	}).Warn("WADO-RS Retrieve")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(matches) == 0 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].path < matches[j].path })
+
+	if isMetadata {
+		objs := []map[string]interface{}{}
+		dw.ss.mu.Lock()
+		for _, match := range matches {
+			if ds, ok := dw.ss.datasets[match.path]; ok {
+				objs = append(objs, dicomJSON(ds.Elements))
+			}
+		}
+		dw.ss.mu.Unlock()
+		writeDICOMJSON(w, http.StatusOK, objs)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", fmt.Sprintf(`multipart/related; type="application/dicom"; boundary=%s`, mw.Boundary()))
+	w.WriteHeader(http.StatusOK)
+	for _, match := range matches {
+		if err := writeFilePart(mw, match.path); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"Protocol": "DICOMweb",
+				"Path":     match.path,
+				"Error":    err,
+				"ID":       sessionID,
+			}).Error("WADO-RS Retrieve")
+			if _, ok := err.(*os.PathError); !ok {
+				// The client is gone.
+				return
+			}
+		}
+	}
+	mw.Close()
+}
+
+// Copy the file at "path" to a new application/dicom part. Files are streamed,
+// not read in memory.
+func writeFilePart(mw *multipart.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/dicom"}})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// The -stow directory is full.
+var errStowQuota = errors.New("STOW-RS directory full")
+
+// Reading a STOW-RS part failed, the rest of the request can't be read either.
+var errStowRead = errors.New("STOW-RS read")
+
+// Writes to a file, reserving room in the quota as the bytes arrive.
+type quotaWriter struct {
+	w       io.Writer
+	quota   *dirQuota
+	written int64 // Bytes reserved
+	err     error
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if !qw.quota.grow(int64(len(p))) {
+		qw.err = errStowQuota
+		return 0, qw.err
+	}
+	qw.written += int64(len(p))
+	n, err := qw.w.Write(p)
+	qw.err = err
+	return n, err
+}
+
+// Save a STOW-RS part in "path" through a temp file, reserving quota as it is
+// read. Returns the size read. The error is errStowQuota if the part doesn't
+// fit, wraps errStowRead if it couldn't be read, and is otherwise the reason
+// it couldn't be saved.
+func (dw *dicomweb) savePart(path string, part io.Reader) (int64, error) {
+	if !dw.quota.reserve(0) {
+		return 0, errStowQuota
+	}
+	f, err := os.CreateTemp(dw.stowDir, ".stow-*")
+	if err != nil {
+		dw.quota.release(0)
+		return 0, err
+	}
+	qw := &quotaWriter{w: f, quota: dw.quota}
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = io.Copy(qw, io.LimitReader(part, maxStowSize))
+		if err != nil && qw.err == nil {
+			err = fmt.Errorf("%w: %v", errStowRead, err)
+		}
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		dw.quota.release(qw.written)
+	}
+	return qw.written, err
+}
+
+// Read the attributes of a saved DICOM file, up to the pixel data.
+func readStowFile(path string, size int64) (*dicom.DataSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := dimse.CheckFileLengthsAt(f, size); err != nil {
+		return nil, err
+	}
+	return dicom.ReadDataSet(bufio.NewReader(f), dicom.ReadOptions{DropPixelData: true})
+}
+
+// STOW-RS. Every part of the request is saved, DICOM parts are parsed for the
+// log and the response. PS3.18, 10.5.
+func (dw *dicomweb) stow(w http.ResponseWriter, r *http.Request, studyUID string, sessionID string) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := os.MkdirAll(dw.stowDir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reader := multipart.NewReader(http.MaxBytesReader(w, r.Body, maxStowSize), params["boundary"])
+
+	var stored, failed []interface{}
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"Protocol": "DICOMweb", "Error": err, "ID": sessionID}).Error("STOW-RS upload")
+			break
+		}
+		contentType := part.Header.Get("Content-Type")
+		ext := ".bin"
+		if strings.HasPrefix(contentType, "application/dicom") && !strings.Contains(contentType, "json") {
+			ext = ".dcm"
+		}
+		path := filepath.Join(dw.stowDir, fmt.Sprintf("%s-%d%s", sessionID, i, ext))
+		size, err := dw.savePart(path, part)
+		fields := logrus.Fields{
+			"Protocol":    "DICOMweb",
+			"ContentType": contentType,
+			"Size":        size,
+			"ID":          sessionID,
+		}
+		if errors.Is(err, errStowQuota) {
+			logrus.WithFields(fields).Warn("STOW-RS quota exceeded")
+			failed = append(failed, map[string]interface{}{
+				dicomJSONKey(dicomtag.FailureReason): map[string]interface{}{"vr": "US", "Value": []interface{}{0xA700}},
+			})
+			break
+		}
+		if errors.Is(err, errStowRead) {
+			fields["Error"] = err
+			logrus.WithFields(fields).Error("STOW-RS upload")
+			break
+		}
+		if err != nil {
+			// The part was read but couldn't be saved.
+			fields["Error"] = err
+			logrus.WithFields(fields).Error("STOW-RS upload")
+			failed = append(failed, map[string]interface{}{
+				dicomJSONKey(dicomtag.FailureReason): map[string]interface{}{"vr": "US", "Value": []interface{}{0x0110}},
+			})
+			continue
+		}
+		fields["Path"] = path
+
+		if ext != ".dcm" {
+			logrus.WithFields(fields).Warn("STOW-RS upload")
+			continue
+		}
+		ds, err := readStowFile(path, size)
+		if err != nil {
+			fields["Error"] = err
+			logrus.WithFields(fields).Warn("STOW-RS upload")
+			failed = append(failed, map[string]interface{}{
+				dicomJSONKey(dicomtag.FailureReason): map[string]interface{}{"vr": "US", "Value": []interface{}{0xC000}},
+			})
+			continue
+		}
+		sopClassUID := elementString(ds.Elements, dicomtag.SOPClassUID)
+		sopInstanceUID := elementString(ds.Elements, dicomtag.SOPInstanceUID)
+		fields["SOPClass"] = sopClassUID
+		fields["SOPInstance"] = sopInstanceUID
+		fields["Study"] = elementString(ds.Elements, dicomtag.StudyInstanceUID)
+		fields["PatientName"] = elementString(ds.Elements, dicomtag.PatientName)
+		logrus.WithFields(fields).Warn("STOW-RS upload")
+
+		ref := map[string]interface{}{
+			dicomJSONKey(dicomtag.ReferencedSOPClassUID):    map[string]interface{}{"vr": "UI", "Value": []interface{}{sopClassUID}},
+			dicomJSONKey(dicomtag.ReferencedSOPInstanceUID): map[string]interface{}{"vr": "UI", "Value": []interface{}{sopInstanceUID}},
+		}
+		if studyUID != "" && fields["Study"] != studyUID {
+			ref[dicomJSONKey(dicomtag.FailureReason)] = map[string]interface{}{"vr": "US", "Value": []interface{}{0xA900}}
+			failed = append(failed, ref)
+			continue
+		}
+		dw.ss.addUpload(sopInstanceUID, sopClassUID)
+		stored = append(stored, ref)
+	}
+
+	resp := map[string]interface{}{}
+	if len(stored) > 0 {
+		resp[dicomJSONKey(dicomtag.ReferencedSOPSequence)] = map[string]interface{}{"vr": "SQ", "Value": stored}
+	}
+	if len(failed) > 0 {
+		resp[dicomJSONKey(dicomtag.FailedSOPSequence)] = map[string]interface{}{"vr": "SQ", "Value": failed}
+	}
+	code := http.StatusOK
+	switch {
+	case len(stored) == 0:
+		code = http.StatusConflict
+	case len(failed) > 0:
+		code = http.StatusAccepted
+	}
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(resp)
+	w.Header().Set("Content-Type", "application/dicom+json")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
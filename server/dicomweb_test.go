@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+func testDataSet(study, series, instance string) *dicom.DataSet {
+	return &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, testCTImageStorage),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, instance),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, "1.2.840.10008.1.2.1"),
+		dicom.MustNewElement(dicomtag.SOPClassUID, testCTImageStorage),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, instance),
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^Jane"),
+		dicom.MustNewElement(dicomtag.PatientID, "1234567"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, study),
+		dicom.MustNewElement(dicomtag.SeriesInstanceUID, series),
+		dicom.MustNewElement(dicomtag.Modality, "CT"),
+	}}
+}
+
+func testDicomweb(t *testing.T, maxBytes int64) *dicomweb {
+	dir := t.TempDir()
+	datasets := make(map[string]*dicom.DataSet)
+	for _, uids := range [][3]string{
+		{"1.1", "1.1.1", "1.1.1.1"},
+		{"1.1", "1.1.1", "1.1.1.2"},
+		{"1.1", "1.1.2", "1.1.2.1"},
+		{"1.2", "1.2.1", "1.2.1.1"},
+	} {
+		path := filepath.Join(dir, uids[2]+".dcm")
+		ds := testDataSet(uids[0], uids[1], uids[2])
+		if err := dicom.WriteDataSetToFile(path, ds); err != nil {
+			t.Fatal(err)
+		}
+		datasets[path] = ds
+	}
+	stowDir := filepath.Join(dir, "stow")
+	quota, err := newDirQuota(stowDir, maxBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &server{mu: &sync.Mutex{}, datasets: datasets, uploads: make(map[string]string)}
+	return &dicomweb{ss: ss, stowDir: stowDir, quota: quota}
+}
+
+func TestDicomwebRoutes(t *testing.T) {
+	dw := testDicomweb(t, 0)
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		count  int // Number of JSON results, -1 if not JSON
+	}{
+		{"GET", "/dicom-web/studies", 200, 2},
+		{"GET", "/dicom-web/studies?PatientID=1234567", 200, 2},
+		{"GET", "/dicom-web/studies?PatientID=7654321", 204, -1},
+		{"GET", "/dicom-web/studies?limit=1", 200, 1},
+		{"GET", "/dicom-web/studies?offset=1", 200, 1},
+		{"GET", "/dicom-web/studies/1.1/series", 200, 2},
+		{"GET", "/dicom-web/series", 200, 3},
+		{"GET", "/dicom-web/instances", 200, 4},
+		{"GET", "/dicom-web/studies/1.1/instances", 200, 3},
+		{"GET", "/dicom-web/studies/1.1/series/1.1.1/instances", 200, 2},
+		{"GET", "/dicom-web/studies/1.1/metadata", 200, 3},
+		{"GET", "/dicom-web/studies/1.1/series/1.1.2/metadata", 200, 1},
+		{"GET", "/dicom-web/studies/1.1/series/1.1.1/instances/1.1.1.2/metadata", 200, 1},
+		{"GET", "/dicom-web/studies/9.9/metadata", 404, -1},
+		{"GET", "/dicom-web/studies/1.2", 200, -1},
+		{"GET", "/dicom-web/patients", 404, -1},
+		{"GET", "/dicom-web/studies/1.1/frames", 404, -1},
+		{"POST", "/dicom-web/studies/1.1/series", 404, -1},
+		{"DELETE", "/dicom-web/studies", 405, -1},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		dw.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("%s %s: code = %d, want %d", test.method, test.path, w.Code, test.code)
+			continue
+		}
+		if test.count < 0 {
+			continue
+		}
+		var objs []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &objs); err != nil {
+			t.Errorf("%s %s: %v", test.method, test.path, err)
+			continue
+		}
+		if len(objs) != test.count {
+			t.Errorf("%s %s: %d results, want %d", test.method, test.path, len(objs), test.count)
+		}
+	}
+}
+
+func TestWadoInstance(t *testing.T) {
+	dw := testDicomweb(t, 0)
+	w := httptest.NewRecorder()
+	dw.ServeHTTP(w, httptest.NewRequest("GET", "/dicom-web/studies/1.1/series/1.1.1/instances/1.1.1.2", nil))
+	if w.Code != 200 {
+		t.Fatalf("code = %d, want 200", w.Code)
+	}
+	_, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	var parts int
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds, err := dicom.ReadDataSet(part, dicom.ReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := elementString(ds.Elements, dicomtag.SOPInstanceUID); got != "1.1.1.2" {
+			t.Errorf("SOPInstanceUID = %q, want 1.1.1.2", got)
+		}
+		parts++
+	}
+	if parts != 1 {
+		t.Errorf("%d parts, want 1", parts)
+	}
+}
+
+func TestDicomJSON(t *testing.T) {
+	obj := dicomJSON([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, "1.2.840.10008.1.2.1"),
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^Jane "),
+		dicom.MustNewElement(dicomtag.InstanceNumber, "12"),
+		dicom.MustNewElement(dicomtag.SliceThickness, "2.5"),
+		dicom.MustNewElement(dicomtag.Modality, "CT"),
+	})
+	want := `{"00180050":{"Value":[2.5],"vr":"DS"},"00200013":{"Value":[12],"vr":"IS"},` +
+		`"00080060":{"Value":["CT"],"vr":"CS"},"00100010":{"Value":[{"Alphabetic":"Doe^Jane"}],"vr":"PN"}}`
+	got, _ := json.Marshal(obj)
+	var gotObj, wantObj interface{}
+	json.Unmarshal(got, &gotObj)
+	json.Unmarshal([]byte(want), &wantObj)
+	if !reflect.DeepEqual(gotObj, wantObj) {
+		t.Errorf("dicomJSON = %s, want %s", got, want)
+	}
+}
+
+func TestDicomwebTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		want dicomtag.Tag
+		ok   bool
+	}{
+		{"PatientID", dicomtag.PatientID, true},
+		{"00100020", dicomtag.PatientID, true},
+		{"0010002g", dicomtag.Tag{}, false},
+		{"NoSuchKeyword", dicomtag.Tag{}, false},
+	}
+	for _, test := range tests {
+		got, ok := dicomwebTag(test.key)
+		if got != test.want || ok != test.ok {
+			t.Errorf("dicomwebTag(%q) = %v, %v, want %v, %v", test.key, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// Body of a STOW-RS request with one part per entry of "parts".
+func stowBody(t *testing.T, parts []stowPart) (string, *bytes.Buffer) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {p.contentType}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(p.data)
+	}
+	mw.Close()
+	return `multipart/related; type="application/dicom"; boundary=` + mw.Boundary(), &buf
+}
+
+type stowPart struct {
+	contentType string
+	data        []byte
+}
+
+func dicomPart(t *testing.T, study, instance string) stowPart {
+	var buf bytes.Buffer
+	if err := dicom.WriteDataSet(&buf, testDataSet(study, study+".1", instance)); err != nil {
+		t.Fatal(err)
+	}
+	return stowPart{"application/dicom", buf.Bytes()}
+}
+
+func TestStow(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		path     string
+		parts    func(t *testing.T) []stowPart
+		code     int
+		stored   int
+		failed   []float64 // FailureReasons
+		files    int       // Files left in the -stow directory
+	}{
+		{"stored", 0, "/dicom-web/studies", func(t *testing.T) []stowPart {
+			return []stowPart{dicomPart(t, "2.1", "2.1.1.1"), dicomPart(t, "2.2", "2.2.1.1")}
+		}, 200, 2, nil, 2},
+		{"other part", 0, "/dicom-web/studies", func(t *testing.T) []stowPart {
+			return []stowPart{dicomPart(t, "2.1", "2.1.1.1"), {"application/octet-stream", []byte("hello")}}
+		}, 200, 1, nil, 2},
+		{"study mismatch", 0, "/dicom-web/studies/2.1", func(t *testing.T) []stowPart {
+			return []stowPart{dicomPart(t, "2.1", "2.1.1.1"), dicomPart(t, "2.2", "2.2.1.1")}
+		}, 202, 1, []float64{0xA900}, 2},
+		{"not DICOM", 0, "/dicom-web/studies", func(t *testing.T) []stowPart {
+			return []stowPart{{"application/dicom", []byte("hello")}}
+		}, 409, 0, []float64{0xC000}, 1},
+		{"quota", 1000, "/dicom-web/studies", func(t *testing.T) []stowPart {
+			return []stowPart{dicomPart(t, "2.1", "2.1.1.1"), {"application/dicom", make([]byte, 2000)}, dicomPart(t, "2.2", "2.2.1.1")}
+		}, 202, 1, []float64{0xA700}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dw := testDicomweb(t, test.maxBytes)
+			contentType, body := stowBody(t, test.parts(t))
+			r := httptest.NewRequest("POST", test.path, body)
+			r.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			dw.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("code = %d, want %d", w.Code, test.code)
+			}
+			var resp map[string]struct {
+				Value []map[string]struct {
+					Value []interface{}
+				}
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(resp[dicomJSONKey(dicomtag.ReferencedSOPSequence)].Value); got != test.stored {
+				t.Errorf("%d stored, want %d", got, test.stored)
+			}
+			var failed []float64
+			for _, item := range resp[dicomJSONKey(dicomtag.FailedSOPSequence)].Value {
+				failed = append(failed, item[dicomJSONKey(dicomtag.FailureReason)].Value[0].(float64))
+			}
+			if len(failed) != len(test.failed) {
+				t.Errorf("failures %v, want %v", failed, test.failed)
+			}
+			for i := range failed {
+				if i < len(test.failed) && failed[i] != test.failed[i] {
+					t.Errorf("failures %v, want %v", failed, test.failed)
+					break
+				}
+			}
+			entries, _ := os.ReadDir(dw.stowDir)
+			if len(entries) != test.files {
+				t.Errorf("%d files in the stow directory, want %d", len(entries), test.files)
+			}
+			if len(dw.ss.uploads) != test.stored {
+				t.Errorf("%d uploads remembered, want %d", len(dw.ss.uploads), test.stored)
+			}
+		})
+	}
+}
+
+func TestStowUnsupportedMediaType(t *testing.T) {
+	dw := testDicomweb(t, 0)
+	r := httptest.NewRequest("POST", "/dicom-web/studies", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	dw.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("code = %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestSavePart(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		part     io.Reader
+		err      error
+		size     int64
+	}{
+		{"saved", 0, strings.NewReader("hello"), nil, 5},
+		{"quota", 3, strings.NewReader("hello"), errStowQuota, 0},
+		{"read error", 0, io.MultiReader(strings.NewReader("he"), errReader{}), errStowRead, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			quota, _ := newDirQuota(dir, test.maxBytes, 0)
+			dw := &dicomweb{stowDir: dir, quota: quota}
+			path := filepath.Join(dir, "part.bin")
+			_, err := dw.savePart(path, test.part)
+			if !errors.Is(err, test.err) && err != test.err {
+				t.Fatalf("savePart: err = %v, want %v", err, test.err)
+			}
+			entries, _ := os.ReadDir(dir)
+			if test.err != nil {
+				if len(entries) != 0 {
+					t.Errorf("%d files left after a failed save", len(entries))
+				}
+			} else if info, err := os.Stat(path); err != nil || info.Size() != test.size || info.Mode().Perm() != 0644 {
+				t.Errorf("Stat(%s) = %v, %v, want %d bytes, 0644", path, info, err, test.size)
+			}
+			if quota.bytes != test.size || quota.files != len(entries) {
+				t.Errorf("quota = %d bytes, %d files, want %d, %d", quota.bytes, quota.files, test.size, len(entries))
+			}
+		})
+	}
+}
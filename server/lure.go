@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// Build the lure policy from the -lure* flags. Nil if the lure is off.
+func lurePolicy() *dicompot.LurePolicy {
+	policy := &dicompot.LurePolicy{AfterFailures: *lureFlag}
+	for _, ae := range strings.Split(*lureAEsFlag, ",") {
+		if ae = strings.TrimSpace(ae); ae != "" {
+			policy.WeakAETitles = append(policy.WeakAETitles, ae)
+		}
+	}
+	if policy.AfterFailures <= 0 && len(policy.WeakAETitles) == 0 {
+		return nil
+	}
+	return policy
+}
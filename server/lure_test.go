@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestLurePolicy(t *testing.T) {
+	defer func(after int, aes string) { *lureFlag, *lureAEsFlag = after, aes }(*lureFlag, *lureAEsFlag)
+	tests := []struct {
+		after   int
+		aes     string
+		wantNil bool
+		wantAEs []string
+	}{
+		{0, "", true, nil},
+		{0, " , ", true, nil},
+		{3, "", false, nil},
+		{0, "PACS, ANY-SCP,", false, []string{"PACS", "ANY-SCP"}},
+	}
+	for _, test := range tests {
+		*lureFlag, *lureAEsFlag = test.after, test.aes
+		policy := lurePolicy()
+		if (policy == nil) != test.wantNil {
+			t.Errorf("lurePolicy(%d, %q) = %v, want nil %v", test.after, test.aes, policy, test.wantNil)
+			continue
+		}
+		if policy == nil {
+			continue
+		}
+		if policy.AfterFailures != test.after || len(policy.WeakAETitles) != len(test.wantAEs) {
+			t.Errorf("lurePolicy(%d, %q) = %+v", test.after, test.aes, policy)
+			continue
+		}
+		for i, ae := range test.wantAEs {
+			if policy.WeakAETitles[i] != ae {
+				t.Errorf("lurePolicy(%d, %q) = %+v, want titles %v", test.after, test.aes, policy, test.wantAEs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+// Values of PerformedProcedureStepStatus. P3.3, C.4.14.
+const (
+	mppsInProgress   = "IN PROGRESS"
+	mppsCompleted    = "COMPLETED"
+	mppsDiscontinued = "DISCONTINUED"
+)
+
+// Upper bound of procedure steps held at once. Past it, the oldest finished
+// step is dropped to make room; if every step is still in progress, N-CREATE
+// is refused.
+const maxMPPSInstances = 10000
+
+// Upper bound of the attributes of one procedure step, N-SET can add more.
+const maxMPPSAttrs = 1000
+
+// A performed procedure step created by a peer through N-CREATE.
+type mppsInstance struct {
+	status    string
+	sessionID string // Session that created the instance
+	attrs     map[dicomtag.Tag]*dicom.Element
+}
+
+// Procedure steps known to the server, keyed by SOP instance UID.
+type mppsStore struct {
+	instances map[string]*mppsInstance
+	finished  []string // COMPLETED or DISCONTINUED steps, oldest first
+}
+
+func newMPPSStore() *mppsStore {
+	return &mppsStore{instances: make(map[string]*mppsInstance)}
+}
+
+// Requires ss.mu. Make room for a new step, dropping the oldest finished step
+// if the store is full. Reports false if every step is still in progress.
+func (ms *mppsStore) makeRoom() bool {
+	if len(ms.instances) < maxMPPSInstances {
+		return true
+	}
+	if len(ms.finished) == 0 {
+		return false
+	}
+	delete(ms.instances, ms.finished[0])
+	ms.finished = ms.finished[1:]
+	return true
+}
+
+func mppsStatusValue(elems []*dicom.Element) (string, bool) {
+	elem, err := dicom.FindElementByTag(elems, dicomtag.PerformedProcedureStepStatus)
+	if err != nil {
+		return "", false
+	}
+	value, _ := elem.GetString()
+	return strings.TrimSpace(value), true
+}
+
+// Human readable form of an element value, for logging.
+func attributeValue(elem *dicom.Element) string {
+	var values []string
+	for _, v := range elem.Value {
+		if b, ok := v.([]byte); ok {
+			values = append(values, fmt.Sprintf("<%d bytes>", len(b)))
+			continue
+		}
+		values = append(values, fmt.Sprint(v))
+	}
+	return strings.Join(values, "\\")
+}
+
+// Log every attribute in "elems", descending into sequences. Nested
+// attributes are named "Sequence>Attribute".
+func logAttributes(msg string, prefix string, elems []*dicom.Element, fields logrus.Fields) {
+	for _, elem := range elems {
+		name := elem.Tag.String()
+		if info, err := dicomtag.Find(elem.Tag); err == nil {
+			name = info.Name
+		}
+		if prefix != "" {
+			name = prefix + ">" + name
+		}
+		if elem.VR == "SQ" {
+			for _, item := range sequenceItems(elem) {
+				logAttributes(msg, name, item, fields)
+			}
+			continue
+		}
+		logrus.WithFields(fields).WithFields(logrus.Fields{
+			"Tag":       elem.Tag.String(),
+			"Attribute": name,
+			"Value":     attributeValue(elem),
+		}).Warn(msg)
+	}
+}
+
+// Set "elems" in the step. Reports false, changing nothing, if that would
+// exceed maxMPPSAttrs.
+func (instance *mppsInstance) set(elems []*dicom.Element) bool {
+	added := 0
+	for _, elem := range elems {
+		if _, ok := instance.attrs[elem.Tag]; !ok {
+			added++
+		}
+	}
+	if len(instance.attrs)+added > maxMPPSAttrs {
+		return false
+	}
+	for _, elem := range elems {
+		instance.attrs[elem.Tag] = elem
+	}
+	return true
+}
+
+func mppsFailure(code dimse.StatusCode, comment string) dicompot.NServiceResult {
+	return dicompot.NServiceResult{Status: dimse.Status{Status: code, ErrorComment: comment}}
+}
+
+// N-CREATE starts a procedure step, which must be IN PROGRESS. P3.4, F.7.2.1.
+func (ss *server) onMPPSCreate(rq *dimse.NCreateRq, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	uid := rq.AffectedSOPInstanceUID
+	if uid == "" {
+		uid = newInstanceUID()
+	}
+	fields := logrus.Fields{"Command": "N-CREATE", "SOPInstance": uid, "ID": sessionID}
+	logAttributes("MPPS attribute", "", elems, fields)
+
+	status, ok := mppsStatusValue(elems)
+	if !ok {
+		return mppsFailure(dimse.StatusMissingAttribute, "PerformedProcedureStepStatus missing")
+	}
+	if status != mppsInProgress {
+		return mppsFailure(dimse.StatusInvalidAttributeValue, "PerformedProcedureStepStatus must be IN PROGRESS")
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.mpps.instances[uid]; ok {
+		return mppsFailure(dimse.StatusDuplicateSOPInstance, "")
+	}
+	instance := &mppsInstance{status: status, sessionID: sessionID, attrs: make(map[dicomtag.Tag]*dicom.Element)}
+	if !instance.set(elems) || !ss.mpps.makeRoom() {
+		logrus.WithFields(fields).Warn("MPPS refused, out of resources")
+		return mppsFailure(dimse.StatusResourceLimitation, "")
+	}
+	ss.mpps.instances[uid] = instance
+	logrus.WithFields(fields).WithFields(logrus.Fields{
+		"Status": status,
+	}).Warn("MPPS created")
+	return dicompot.NServiceResult{Status: dimse.Success, SOPInstanceUID: uid}
+}
+
+// N-SET updates a procedure step. Once COMPLETED or DISCONTINUED, a step can
+// no longer be changed. P3.4, F.7.2.2.
+func (ss *server) onMPPSSet(rq *dimse.NSetRq, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	uid := rq.RequestedSOPInstanceUID
+	fields := logrus.Fields{"Command": "N-SET", "SOPInstance": uid, "ID": sessionID}
+	logAttributes("MPPS attribute", "", elems, fields)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	instance, ok := ss.mpps.instances[uid]
+	if !ok {
+		return mppsFailure(dimse.StatusNoSuchSOPInstance, "")
+	}
+	if instance.status != mppsInProgress {
+		logrus.WithFields(fields).WithFields(logrus.Fields{
+			"Status": instance.status,
+		}).Warn("MPPS update refused")
+		return mppsFailure(dimse.StatusProcessingFailure, "Performed Procedure Step Object may no longer be updated")
+	}
+	status, ok := mppsStatusValue(elems)
+	if !ok {
+		status = instance.status
+	}
+	switch status {
+	case mppsInProgress, mppsCompleted, mppsDiscontinued:
+	default:
+		return mppsFailure(dimse.StatusInvalidAttributeValue, "Invalid PerformedProcedureStepStatus "+status)
+	}
+	if !instance.set(elems) {
+		logrus.WithFields(fields).Warn("MPPS refused, out of resources")
+		return mppsFailure(dimse.StatusResourceLimitation, "")
+	}
+	if status != instance.status {
+		logrus.WithFields(fields).WithFields(logrus.Fields{
+			"From":    instance.status,
+			"To":      status,
+			"Creator": instance.sessionID,
+		}).Warn("MPPS state change")
+		instance.status = status
+		if status != mppsInProgress {
+			ss.mpps.finished = append(ss.mpps.finished, uid)
+		}
+	}
+	return dicompot.NServiceResult{Status: dimse.Success}
+}
+
+// MPPS SCP. Only N-CREATE and N-SET are defined for the SOP class.
+func (ss *server) onMPPS(msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	switch rq := msg.(type) {
+	case *dimse.NCreateRq:
+		return ss.onMPPSCreate(rq, elems, sessionID)
+	case *dimse.NSetRq:
+		return ss.onMPPSSet(rq, elems, sessionID)
+	}
+	return mppsFailure(dimse.StatusUnrecognizedOperation, "")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+func testMPPSServer() *server {
+	return &server{mu: &sync.Mutex{}, mpps: newMPPSStore()}
+}
+
+func mppsElems(status string, extra ...*dicom.Element) []*dicom.Element {
+	var elems []*dicom.Element
+	if status != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.PerformedProcedureStepStatus, status))
+	}
+	return append(elems, extra...)
+}
+
+func TestMPPS(t *testing.T) {
+	type op struct {
+		create bool // N-CREATE if set, N-SET otherwise
+		uid    string
+		elems  []*dicom.Element
+		want   dimse.StatusCode
+		status string // Status of uid afterwards, "" if unknown
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{"complete", []op{
+			{true, "1.1", mppsElems(mppsInProgress), dimse.StatusSuccess, mppsInProgress},
+			{false, "1.1", mppsElems("", dicom.MustNewElement(dicomtag.InstitutionName, "X")), dimse.StatusSuccess, mppsInProgress},
+			{false, "1.1", mppsElems(mppsCompleted), dimse.StatusSuccess, mppsCompleted},
+			{false, "1.1", mppsElems(mppsInProgress), dimse.StatusProcessingFailure, mppsCompleted},
+		}},
+		{"discontinue", []op{
+			{true, "1.1", mppsElems(mppsInProgress), dimse.StatusSuccess, mppsInProgress},
+			{false, "1.1", mppsElems(mppsDiscontinued), dimse.StatusSuccess, mppsDiscontinued},
+			{false, "1.1", mppsElems(""), dimse.StatusProcessingFailure, mppsDiscontinued},
+		}},
+		{"duplicate", []op{
+			{true, "1.1", mppsElems(mppsInProgress), dimse.StatusSuccess, mppsInProgress},
+			{true, "1.1", mppsElems(mppsInProgress), dimse.StatusDuplicateSOPInstance, mppsInProgress},
+		}},
+		{"create not in progress", []op{
+			{true, "1.1", mppsElems(mppsCompleted), dimse.StatusInvalidAttributeValue, ""},
+			{true, "1.2", mppsElems(""), dimse.StatusMissingAttribute, ""},
+		}},
+		{"invalid status", []op{
+			{true, "1.1", mppsElems(mppsInProgress), dimse.StatusSuccess, mppsInProgress},
+			{false, "1.1", mppsElems("DONE"), dimse.StatusInvalidAttributeValue, mppsInProgress},
+		}},
+		{"unknown instance", []op{
+			{false, "1.1", mppsElems(mppsCompleted), dimse.StatusNoSuchSOPInstance, ""},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ss := testMPPSServer()
+			for i, op := range test.ops {
+				var got dimse.StatusCode
+				if op.create {
+					got = ss.onMPPSCreate(&dimse.NCreateRq{AffectedSOPInstanceUID: op.uid}, op.elems, "s").Status.Status
+				} else {
+					got = ss.onMPPSSet(&dimse.NSetRq{RequestedSOPInstanceUID: op.uid}, op.elems, "s").Status.Status
+				}
+				if got != op.want {
+					t.Errorf("op %d: status = %#04x, want %#04x", i, got, op.want)
+				}
+				status := ""
+				if instance, ok := ss.mpps.instances[op.uid]; ok {
+					status = instance.status
+				}
+				if status != op.status {
+					t.Errorf("op %d: instance status = %q, want %q", i, status, op.status)
+				}
+			}
+		})
+	}
+}
+
+func TestMPPSCreateWithoutUID(t *testing.T) {
+	ss := testMPPSServer()
+	res := ss.onMPPSCreate(&dimse.NCreateRq{}, mppsElems(mppsInProgress), "s")
+	if res.Status.Status != dimse.StatusSuccess || res.SOPInstanceUID == "" {
+		t.Fatalf("onMPPSCreate = %v, want success with a new UID", res)
+	}
+	if _, ok := ss.mpps.instances[res.SOPInstanceUID]; !ok {
+		t.Errorf("instance %s not stored", res.SOPInstanceUID)
+	}
+}
+
+func TestMPPSBounded(t *testing.T) {
+	ss := testMPPSServer()
+	for i := 0; i < maxMPPSInstances; i++ {
+		uid := "1." + strconv.Itoa(i)
+		if res := ss.onMPPSCreate(&dimse.NCreateRq{AffectedSOPInstanceUID: uid}, mppsElems(mppsInProgress), "s"); res.Status.Status != dimse.StatusSuccess {
+			t.Fatalf("create %s: status = %#04x", uid, res.Status.Status)
+		}
+	}
+	// Full of steps in progress, nothing can be dropped.
+	if got := ss.onMPPSCreate(&dimse.NCreateRq{AffectedSOPInstanceUID: "2.0"}, mppsElems(mppsInProgress), "s").Status.Status; got != dimse.StatusResourceLimitation {
+		t.Errorf("create past the limit: status = %#04x, want %#04x", got, dimse.StatusResourceLimitation)
+	}
+	for _, uid := range []string{"1.7", "1.3"} {
+		ss.onMPPSSet(&dimse.NSetRq{RequestedSOPInstanceUID: uid}, mppsElems(mppsCompleted), "s")
+	}
+	// The oldest finished step makes room.
+	if got := ss.onMPPSCreate(&dimse.NCreateRq{AffectedSOPInstanceUID: "2.0"}, mppsElems(mppsInProgress), "s").Status.Status; got != dimse.StatusSuccess {
+		t.Errorf("create after completion: status = %#04x, want success", got)
+	}
+	if _, ok := ss.mpps.instances["1.7"]; ok {
+		t.Errorf("oldest finished step 1.7 still stored")
+	}
+	if _, ok := ss.mpps.instances["1.3"]; !ok {
+		t.Errorf("finished step 1.3 dropped")
+	}
+	if len(ss.mpps.instances) != maxMPPSInstances {
+		t.Errorf("len(instances) = %d, want %d", len(ss.mpps.instances), maxMPPSInstances)
+	}
+}
+
+func TestMPPSInstanceSet(t *testing.T) {
+	instance := &mppsInstance{attrs: make(map[dicomtag.Tag]*dicom.Element)}
+	for i := 0; i < maxMPPSAttrs; i++ {
+		tag := dicomtag.Tag{Group: 0x0011, Element: uint16(i)}
+		instance.attrs[tag] = &dicom.Element{Tag: tag}
+	}
+	// Replacing an attribute is fine, adding one is not.
+	if !instance.set([]*dicom.Element{{Tag: dicomtag.Tag{Group: 0x0011, Element: 0}}}) {
+		t.Errorf("set of an existing attribute refused")
+	}
+	if instance.set([]*dicom.Element{{Tag: dicomtag.Tag{Group: 0x0013, Element: 0}}}) {
+		t.Errorf("set past maxMPPSAttrs accepted")
+	}
+	if len(instance.attrs) != maxMPPSAttrs {
+		t.Errorf("len(attrs) = %d, want %d", len(instance.attrs), maxMPPSAttrs)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+// Pixel data watermarks: a low amplitude pattern carrying the session ID,
+// spread over the uncompressed pixel data of the images sent by C-GET and
+// C-MOVE, and an optional canary text burned into the images.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// The pattern carries the 64 bit session ID and a 16 bit check.
+const pixelMarkBits = 80
+
+type pixelMarker struct {
+	key        string       // Seeds the pattern, the verifier needs the same.
+	strength   int          // Amplitude of the pattern in stored values, 0 for none.
+	canary     string       // Burned in text, empty for none.
+	watermarks *watermarker // Records the canaries handed out. Nil if off.
+}
+
+// An uncompressed image, possibly multi-frame.
+type pixelImage struct {
+	rows, cols, samples, frames int
+	bytesPerSample              int
+	bitsStored                  int
+	signed                      bool
+	monochrome1                 bool
+	order                       binary.ByteOrder
+	data                        []byte
+}
+
+func imageAttr(ds *dicom.DataSet, tag dicomtag.Tag, def int) (int, error) {
+	elem, err := ds.FindElementByTag(tag)
+	if err != nil {
+		if def < 0 {
+			return 0, fmt.Errorf("no %s", dicomtag.DebugString(tag))
+		}
+		return def, nil
+	}
+	v, err := elem.GetUInt16()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", dicomtag.DebugString(tag), err)
+	}
+	return int(v), nil
+}
+
+// Describe the pixel data of "ds". Returns an error for compressed pixel data
+// and the layouts not handled.
+func readPixelImage(ds *dicom.DataSet) (*pixelImage, *dicom.Element, error) {
+	elem, err := ds.FindElementByTag(dicomtag.PixelData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no pixel data")
+	}
+	info, ok := elem.Value[0].(dicom.PixelDataInfo)
+	if !ok || elem.UndefinedLength || len(info.Frames) != 1 {
+		return nil, nil, fmt.Errorf("compressed pixel data")
+	}
+	im := &pixelImage{data: info.Frames[0]}
+	ts, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no transfer syntax")
+	}
+	uid, _ := ts.GetString()
+	if im.order, _, err = dicomio.ParseTransferSyntaxUID(strings.TrimRight(uid, " \x00")); err != nil {
+		return nil, nil, err
+	}
+
+	var bitsAllocated, highBit, representation, planar int
+	for _, a := range []struct {
+		tag dicomtag.Tag
+		v   *int
+		def int
+	}{
+		{dicomtag.Rows, &im.rows, -1},
+		{dicomtag.Columns, &im.cols, -1},
+		{dicomtag.SamplesPerPixel, &im.samples, 1},
+		{dicomtag.BitsAllocated, &bitsAllocated, -1},
+		{dicomtag.BitsStored, &im.bitsStored, -1},
+		{dicomtag.HighBit, &highBit, -1},
+		{dicomtag.PixelRepresentation, &representation, 0},
+		{dicomtag.PlanarConfiguration, &planar, 0},
+	} {
+		if *a.v, err = imageAttr(ds, a.tag, a.def); err != nil {
+			return nil, nil, err
+		}
+	}
+	switch {
+	case bitsAllocated != 8 && bitsAllocated != 16:
+		return nil, nil, fmt.Errorf("%d bits allocated", bitsAllocated)
+	case im.bitsStored < 2 || im.bitsStored > bitsAllocated || highBit != im.bitsStored-1:
+		return nil, nil, fmt.Errorf("%d bits stored, high bit %d", im.bitsStored, highBit)
+	case im.samples != 1 && (im.samples != 3 || planar != 0):
+		return nil, nil, fmt.Errorf("%d samples per pixel, planar configuration %d", im.samples, planar)
+	}
+	im.bytesPerSample = bitsAllocated / 8
+	im.signed = representation == 1
+	if pi, err := ds.FindElementByTag(dicomtag.PhotometricInterpretation); err == nil {
+		s, _ := pi.GetString()
+		im.monochrome1 = strings.TrimSpace(s) == "MONOCHROME1"
+	}
+	im.frames = 1
+	if nf, err := ds.FindElementByTag(dicomtag.NumberOfFrames); err == nil {
+		s, _ := nf.GetString()
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && n > 0 {
+			im.frames = n
+		}
+	}
+	if im.rows < 3 || im.cols < 3 || len(im.data) < im.frames*im.frameSize() {
+		return nil, nil, fmt.Errorf("%dx%d pixels, %d frames in %d bytes", im.cols, im.rows, im.frames, len(im.data))
+	}
+	return im, elem, nil
+}
+
+// Number of bytes of a frame.
+func (im *pixelImage) frameSize() int {
+	return im.rows * im.cols * im.samples * im.bytesPerSample
+}
+
+// Range of the stored values.
+func (im *pixelImage) limits() (int, int) {
+	if im.signed {
+		return -1 << (im.bitsStored - 1), 1<<(im.bitsStored-1) - 1
+	}
+	return 0, 1<<im.bitsStored - 1
+}
+
+func (im *pixelImage) raw(off int) int {
+	if im.bytesPerSample == 1 {
+		return int(im.data[off])
+	}
+	return int(im.order.Uint16(im.data[off:]))
+}
+
+// Value of sample "i" of frame "frame".
+func (im *pixelImage) get(frame, i int) int {
+	v := im.raw(frame*im.frameSize()+i*im.bytesPerSample) & (1<<im.bitsStored - 1)
+	if im.signed && v&(1<<(im.bitsStored-1)) != 0 {
+		v -= 1 << im.bitsStored
+	}
+	return v
+}
+
+// Set sample "i" of frame "frame", clamped to the range of the stored
+// values. The bits above the stored ones are kept.
+func (im *pixelImage) set(frame, i, v int) {
+	min, max := im.limits()
+	if v < min {
+		v = min
+	} else if v > max {
+		v = max
+	}
+	mask := 1<<im.bitsStored - 1
+	off := frame*im.frameSize() + i*im.bytesPerSample
+	raw := im.raw(off)&^mask | v&mask
+	if im.bytesPerSample == 1 {
+		im.data[off] = byte(raw)
+	} else {
+		im.order.PutUint16(im.data[off:], uint16(raw))
+	}
+}
+
+func pixelMarkSeed(key string) uint64 {
+	h := sha256.Sum256([]byte("pixelmark\x00" + key))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// The payload bit carried by sample "i" of a frame, and the sign of the
+// pattern there.
+func pixelMarkChip(seed uint64, i int) (int, int) {
+	r := splitmix64(seed ^ uint64(i))
+	if r>>63 == 1 {
+		return int(r % pixelMarkBits), -1
+	}
+	return int(r % pixelMarkBits), 1
+}
+
+func pixelMarkPayload(session uint64) [pixelMarkBits]bool {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], session)
+	check := crc32.ChecksumIEEE(b[:])
+	var payload [pixelMarkBits]bool
+	for i := 0; i < 64; i++ {
+		payload[i] = session>>(63-i)&1 == 1
+	}
+	for i := 0; i < 16; i++ {
+		payload[64+i] = check>>(15-i)&1 == 1
+	}
+	return payload
+}
+
+// Add the pattern of "session" to every frame.
+func embedPixelMark(im *pixelImage, key string, session uint64, strength int) {
+	seed := pixelMarkSeed(key)
+	payload := pixelMarkPayload(session)
+	n := im.rows * im.cols * im.samples
+	for i := 0; i < n; i++ {
+		bit, chip := pixelMarkChip(seed, i)
+		if !payload[bit] {
+			chip = -chip
+		}
+		for f := 0; f < im.frames; f++ {
+			im.set(f, i, im.get(f, i)+strength*chip)
+		}
+	}
+}
+
+// Recover the session ID from the pattern. Without the original image, the
+// pattern is told from the image by a high-pass filter, and only the sign of
+// the residue counts, so that edges don't drown it. "margin" is the lowest
+// z-score of the payload bits: close to 0 for an image without the pattern,
+// above 3 for a clean detection.
+func detectPixelMark(im *pixelImage, original *pixelImage, key string) (session uint64, margin float64, err error) {
+	if original != nil && (original.rows != im.rows || original.cols != im.cols || original.samples != im.samples) {
+		return 0, 0, fmt.Errorf("original is %dx%d, image %dx%d", original.cols, original.rows, im.cols, im.rows)
+	}
+	seed := pixelMarkSeed(key)
+	var corr, count [pixelMarkBits]float64
+	row := im.cols * im.samples
+	for y := 1; y < im.rows-1; y++ {
+		for x := im.samples; x < row-im.samples; x++ {
+			i := y*row + x
+			bit, chip := pixelMarkChip(seed, i)
+			for f := 0; f < im.frames; f++ {
+				var h int
+				if original != nil {
+					h = im.get(f, i) - original.get(f%original.frames, i)
+				} else {
+					h = 4*im.get(f, i) - im.get(f, i-im.samples) - im.get(f, i+im.samples) - im.get(f, i-row) - im.get(f, i+row)
+				}
+				if h > 0 {
+					corr[bit] += float64(chip)
+				} else if h < 0 {
+					corr[bit] -= float64(chip)
+				} else {
+					continue
+				}
+				count[bit]++
+			}
+		}
+	}
+	var payload [pixelMarkBits]bool
+	margin = math.Inf(1)
+	for b := range corr {
+		if count[b] == 0 {
+			return 0, 0, fmt.Errorf("no pattern")
+		}
+		payload[b] = corr[b] > 0
+		margin = math.Min(margin, math.Abs(corr[b])/math.Sqrt(count[b]))
+	}
+	for i := 0; i < 64; i++ {
+		if payload[i] {
+			session |= 1 << (63 - i)
+		}
+	}
+	if pixelMarkPayload(session) != payload {
+		return 0, margin, fmt.Errorf("no pattern, or damaged")
+	}
+	return session, margin, nil
+}
+
+// The canary text of a session: {session} and {token} are replaced by the
+// session ID and token.
+func (p *pixelMarker) canaryText(session string) string {
+	return strings.NewReplacer("{session}", session, "{token}", sessionToken(session)).Replace(p.canary)
+}
+
+// Mark the pixel data of "ds" for the session. The pixel data is copied, not
+// modified in place.
+func (p *pixelMarker) mark(ds *dicom.DataSet, session string, ip string) error {
+	if p == nil {
+		return nil
+	}
+	id, err := strconv.ParseUint(session, 10, 64)
+	if err != nil {
+		return fmt.Errorf("session ID %q is not a number", session)
+	}
+	im, elem, err := readPixelImage(ds)
+	if err != nil {
+		return err
+	}
+	im.data = append([]byte(nil), im.data...)
+	if p.canary != "" {
+		text := p.canaryText(session)
+		if burnText(im, text) && p.watermarks != nil {
+			p.watermarks.record(watermarkEntry{Value: text, Attribute: "Canary", Session: session, IP: ip, Time: time.Now()})
+		}
+	}
+	if p.strength > 0 {
+		embedPixelMark(im, p.key, id, p.strength)
+	}
+	marked := &dicom.Element{
+		Tag:   elem.Tag,
+		VR:    elem.VR,
+		Value: []interface{}{dicom.PixelDataInfo{Frames: [][]byte{im.data}}},
+	}
+	for i, e := range ds.Elements {
+		if e == elem {
+			ds.Elements[i] = marked
+		}
+	}
+	return nil
+}
+
+// 5x7 glyphs, one byte per row, for the characters of canary texts. Lower
+// case letters are drawn in upper case.
+var canaryFont = map[rune][7]byte{
+	' ': {},
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'A': {0x0e, 0x11, 0x11, 0x11, 0x1f, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	'?': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	'=': {0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00},
+	'&': {0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d},
+	'%': {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'#': {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+	'+': {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+	'@': {0x0e, 0x11, 0x01, 0x0d, 0x15, 0x15, 0x0e},
+}
+
+// Check that the canary text can be drawn.
+func validateCanary(text string) error {
+	text = strings.NewReplacer("{session}", "", "{token}", "").Replace(text)
+	for _, c := range strings.ToUpper(text) {
+		if _, ok := canaryFont[c]; !ok {
+			return fmt.Errorf("character %q can't be drawn", c)
+		}
+	}
+	return nil
+}
+
+// Burn "text" into the bottom left corner of every frame, in the brightest
+// value on the darkest, wrapped to the width of the image. Returns false if
+// the image is too small.
+func burnText(im *pixelImage, text string) bool {
+	scale := im.cols / 256
+	if scale < 1 {
+		scale = 1
+	}
+	const cellWidth, cellHeight = 6, 9
+	perLine := (im.cols - 4*scale) / (cellWidth * scale)
+	if perLine < 1 {
+		return false
+	}
+	var lines [][]rune
+	longest := 0
+	for runes := []rune(strings.ToUpper(text)); len(runes) > 0; {
+		n := perLine
+		if n > len(runes) {
+			n = len(runes)
+		}
+		lines = append(lines, runes[:n])
+		runes = runes[n:]
+		if n > longest {
+			longest = n
+		}
+	}
+	width := cellWidth*scale*longest + scale
+	height := cellHeight * scale * len(lines)
+	x0, y0 := 2*scale, im.rows-2*scale-height
+	if y0 < 0 {
+		return false
+	}
+	ink, background := im.limits()
+	if !im.monochrome1 {
+		ink, background = background, ink
+	}
+	for f := 0; f < im.frames; f++ {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := background
+				line, row, col := y/(cellHeight*scale), (y%(cellHeight*scale))/scale-1, (x/scale-1)%cellWidth
+				char := (x/scale - 1) / cellWidth
+				if row >= 0 && row < 7 && col >= 0 && col < 5 && x >= scale && char < len(lines[line]) {
+					if canaryFont[lines[line][char]][row]&(0x10>>col) != 0 {
+						v = ink
+					}
+				}
+				for s := 0; s < im.samples; s++ {
+					im.set(f, ((y0+y)*im.cols+x0+x)*im.samples+s, v)
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/nsmfoo/dicompot/sopclass"
+	"github.com/sirupsen/logrus"
+)
+
+// N-ACTION type ID of the film session and film box "print" action. P3.4, H.4.
+const printActionPrint = 1
+
+// Upper bound of image boxes in one film box. Real printers stop well below.
+const maxImageBoxes = 100
+
+// Upper bound of film sessions, film boxes and image boxes held at once.
+// Peers that don't N-DELETE what they create would otherwise fill the memory.
+const maxPrintObjects = 100000
+
+// Upper bound of the attributes of one film session, N-SET can add more.
+const maxFilmSessionAttrs = 1000
+
+// The -print directory is full.
+var errPrintQuota = errors.New("print directory full")
+
+type filmSession struct {
+	sessionID string // Session that created the film session
+	attrs     []*dicom.Element
+	filmBoxes []string
+}
+
+type filmBox struct {
+	filmSession string
+	imageBoxes  []string
+}
+
+type imageBox struct {
+	filmBox  string
+	position uint16
+	path     string // Where the image was saved, empty until N-SET
+	size     int64
+}
+
+// Print objects created by peers, keyed by SOP instance UID.
+type printStore struct {
+	dir      string // Directory to save print images in
+	quota    *dirQuota
+	sessions map[string]*filmSession
+	boxes    map[string]*filmBox
+	images   map[string]*imageBox
+}
+
+func newPrintStore(dir string, quota *dirQuota) *printStore {
+	return &printStore{
+		dir:      dir,
+		quota:    quota,
+		sessions: make(map[string]*filmSession),
+		boxes:    make(map[string]*filmBox),
+		images:   make(map[string]*imageBox),
+	}
+}
+
+// Number of image boxes of an ImageDisplayFormat such as "STANDARD\2,3" or
+// "ROW\2,1". Returns 0 if the format is unsupported. P3.3, C.13.8.
+func imageBoxCount(format string) int {
+	parts := strings.SplitN(format, "\\", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	var nums []int
+	for _, s := range strings.Split(parts[1], ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 || n > maxImageBoxes {
+			return 0
+		}
+		nums = append(nums, n)
+	}
+	count := 0
+	switch strings.ToUpper(strings.TrimSpace(parts[0])) {
+	case "STANDARD":
+		if len(nums) == 2 {
+			count = nums[0] * nums[1]
+		}
+	case "ROW", "COL":
+		for _, n := range nums {
+			count += n
+		}
+	}
+	if count > maxImageBoxes {
+		return 0
+	}
+	return count
+}
+
+// Requires ss.mu. Reports whether "n" more print objects fit.
+func (ps *printStore) room(n int) bool {
+	return len(ps.sessions)+len(ps.boxes)+len(ps.images)+n <= maxPrintObjects
+}
+
+// Requires ss.mu. Set "elems" in the film session, replacing attributes it
+// already has. Reports false if that would exceed maxFilmSessionAttrs.
+func (fs *filmSession) set(elems []*dicom.Element) bool {
+	attrs := append([]*dicom.Element(nil), fs.attrs...)
+	for _, elem := range elems {
+		replaced := false
+		for i, attr := range attrs {
+			if attr.Tag == elem.Tag {
+				attrs[i] = elem
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			attrs = append(attrs, elem)
+		}
+	}
+	if len(attrs) > maxFilmSessionAttrs {
+		return false
+	}
+	fs.attrs = attrs
+	return true
+}
+
+func printFailure(code dimse.StatusCode, comment string) dicompot.NServiceResult {
+	return dicompot.NServiceResult{Status: dimse.Status{Status: code, ErrorComment: comment}}
+}
+
+// Encode 8 or 16 bit grayscale pixels as a binary PGM file.
+func encodePGM(rows, cols, bitsAllocated, bitsStored int, pixels []byte) ([]byte, error) {
+	bytesPerPixel := bitsAllocated / 8
+	if rows <= 0 || cols <= 0 || (bitsAllocated != 8 && bitsAllocated != 16) {
+		return nil, fmt.Errorf("unsupported image %dx%d, %d bits allocated", cols, rows, bitsAllocated)
+	}
+	size := rows * cols * bytesPerPixel
+	if len(pixels) < size {
+		return nil, fmt.Errorf("pixel data too short, %d < %d", len(pixels), size)
+	}
+	if bitsStored <= 0 || bitsStored > bitsAllocated {
+		bitsStored = bitsAllocated
+	}
+	out := make([]byte, size)
+	copy(out, pixels)
+	if bytesPerPixel == 2 {
+		// PGM is big endian, DICOM print images are little endian.
+		for i := 0; i < size; i += 2 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+	}
+	header := fmt.Sprintf("P5\n%d %d\n%d\n", cols, rows, (1<<uint(bitsStored))-1)
+	return append([]byte(header), out...), nil
+}
+
+// Returns the US value of "tag" in "elems", or 0 if absent.
+func elementUInt16(elems []*dicom.Element, tag dicomtag.Tag) int {
+	elem, err := dicom.FindElementByTag(elems, tag)
+	if err != nil {
+		return 0
+	}
+	v, err := elem.GetUInt16()
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// Encode the image in a BasicGrayscaleImageSequence item as PGM.
+func encodeImage(item []*dicom.Element) ([]byte, error) {
+	elem, err := dicom.FindElementByTag(item, dicomtag.PixelData)
+	if err != nil || len(elem.Value) == 0 {
+		return nil, fmt.Errorf("no pixel data")
+	}
+	var pixels []byte
+	switch v := elem.Value[0].(type) {
+	case dicom.PixelDataInfo:
+		for _, frame := range v.Frames {
+			pixels = append(pixels, frame...)
+		}
+	case []byte:
+		pixels = v
+	}
+	return encodePGM(
+		elementUInt16(item, dicomtag.Rows), elementUInt16(item, dicomtag.Columns),
+		elementUInt16(item, dicomtag.BitsAllocated), elementUInt16(item, dicomtag.BitsStored), pixels)
+}
+
+// Save an encoded image in the print directory. Returns errPrintQuota if the
+// directory is full.
+func (ps *printStore) saveImage(name string, data []byte) (string, error) {
+	if !ps.quota.reserve(int64(len(data))) {
+		return "", errPrintQuota
+	}
+	path := filepath.Join(ps.dir, name+".pgm")
+	err := os.MkdirAll(ps.dir, 0755)
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		ps.quota.release(int64(len(data)))
+		return "", err
+	}
+	return path, nil
+}
+
+func (ss *server) onFilmSession(connState dicompot.ConnectionState, msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	ps := ss.print
+	switch rq := msg.(type) {
+	case *dimse.NCreateRq:
+		uid := rq.AffectedSOPInstanceUID
+		if uid == "" {
+			uid = newInstanceUID()
+		}
+		logAttributes("Print attribute", "", elems, logrus.Fields{"Command": "N-CREATE", "SOPInstance": uid, "ID": sessionID})
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if _, ok := ps.sessions[uid]; ok {
+			return printFailure(dimse.StatusDuplicateSOPInstance, "")
+		}
+		fs := &filmSession{sessionID: sessionID}
+		if !ps.room(1) || !fs.set(elems) {
+			return printFailure(dimse.StatusResourceLimitation, "")
+		}
+		ps.sessions[uid] = fs
+		return dicompot.NServiceResult{Status: dimse.Success, SOPInstanceUID: uid}
+	case *dimse.NSetRq:
+		logAttributes("Print attribute", "", elems, logrus.Fields{"Command": "N-SET", "SOPInstance": rq.RequestedSOPInstanceUID, "ID": sessionID})
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		fs, ok := ps.sessions[rq.RequestedSOPInstanceUID]
+		if !ok {
+			return printFailure(dimse.StatusNoSuchSOPInstance, "")
+		}
+		if !fs.set(elems) {
+			return printFailure(dimse.StatusResourceLimitation, "")
+		}
+		return dicompot.NServiceResult{Status: dimse.Success}
+	case *dimse.NActionRq:
+		if rq.ActionTypeID != printActionPrint {
+			return printFailure(dimse.StatusNoSuchActionType, "")
+		}
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		fs, ok := ps.sessions[rq.RequestedSOPInstanceUID]
+		if !ok {
+			return printFailure(dimse.StatusNoSuchSOPInstance, "")
+		}
+		ss.logPrintJob(connState, rq.RequestedSOPInstanceUID, fs.filmBoxes, sessionID)
+		return dicompot.NServiceResult{Status: dimse.Success}
+	case *dimse.NDeleteRq:
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		fs, ok := ps.sessions[rq.RequestedSOPInstanceUID]
+		if !ok {
+			return printFailure(dimse.StatusNoSuchSOPInstance, "")
+		}
+		for _, boxUID := range fs.filmBoxes {
+			ps.deleteFilmBox(boxUID)
+		}
+		delete(ps.sessions, rq.RequestedSOPInstanceUID)
+		return dicompot.NServiceResult{Status: dimse.Success}
+	}
+	return printFailure(dimse.StatusUnrecognizedOperation, "")
+}
+
+// Requires ss.mu.
+func (ps *printStore) deleteFilmBox(uid string) {
+	if fb, ok := ps.boxes[uid]; ok {
+		for _, imageUID := range fb.imageBoxes {
+			delete(ps.images, imageUID)
+		}
+		delete(ps.boxes, uid)
+	}
+}
+
+func (ss *server) onFilmBox(connState dicompot.ConnectionState, msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	ps := ss.print
+	switch rq := msg.(type) {
+	case *dimse.NCreateRq:
+		uid := rq.AffectedSOPInstanceUID
+		if uid == "" {
+			uid = newInstanceUID()
+		}
+		logAttributes("Print attribute", "", elems, logrus.Fields{"Command": "N-CREATE", "SOPInstance": uid, "ID": sessionID})
+
+		var sessionUID string
+		if seq, err := dicom.FindElementByTag(elems, dicomtag.ReferencedFilmSessionSequence); err == nil {
+			if items := sequenceItems(seq); len(items) > 0 {
+				sessionUID = elementString(items[0], dicomtag.ReferencedSOPInstanceUID)
+			}
+		}
+		if sessionUID == "" {
+			return printFailure(dimse.StatusMissingAttribute, "ReferencedFilmSessionSequence missing")
+		}
+		elem, err := dicom.FindElementByTag(elems, dicomtag.ImageDisplayFormat)
+		if err != nil {
+			return printFailure(dimse.StatusMissingAttribute, "ImageDisplayFormat missing")
+		}
+		format, _ := elem.GetStrings()
+		count := imageBoxCount(strings.Join(format, "\\"))
+		if count == 0 {
+			return printFailure(dimse.StatusInvalidAttributeValue, "Unsupported ImageDisplayFormat")
+		}
+
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		fs, ok := ps.sessions[sessionUID]
+		if !ok {
+			return printFailure(dimse.StatusInvalidAttributeValue, "No such film session")
+		}
+		if _, ok := ps.boxes[uid]; ok {
+			return printFailure(dimse.StatusDuplicateSOPInstance, "")
+		}
+		if !ps.room(1 + count) {
+			return printFailure(dimse.StatusResourceLimitation, "")
+		}
+		fb := &filmBox{filmSession: sessionUID}
+		var refs []interface{}
+		for i := 1; i <= count; i++ {
+			imageUID := newInstanceUID()
+			ps.images[imageUID] = &imageBox{filmBox: uid, position: uint16(i)}
+			fb.imageBoxes = append(fb.imageBoxes, imageUID)
+			refs = append(refs, dicom.MustNewElement(dicomtag.Item,
+				dicom.MustNewElement(dicomtag.ReferencedSOPClassUID, sopclass.BasicGrayscaleImageBox),
+				dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUID, imageUID)))
+		}
+		ps.boxes[uid] = fb
+		fs.filmBoxes = append(fs.filmBoxes, uid)
+		return dicompot.NServiceResult{
+			Status:         dimse.Success,
+			SOPInstanceUID: uid,
+			Elements:       append(elems, dicom.MustNewElement(dicomtag.ReferencedImageBoxSequence, refs...)),
+		}
+	case *dimse.NSetRq:
+		logAttributes("Print attribute", "", elems, logrus.Fields{"Command": "N-SET", "SOPInstance": rq.RequestedSOPInstanceUID, "ID": sessionID})
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if _, ok := ps.boxes[rq.RequestedSOPInstanceUID]; !ok {
+			return printFailure(dimse.StatusNoSuchSOPInstance, "")
+		}
+		return dicompot.NServiceResult{Status: dimse.Success}
+	case *dimse.NActionRq:
+		if rq.ActionTypeID != printActionPrint {
+			return printFailure(dimse.StatusNoSuchActionType, "")
+		}
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		fb, ok := ps.boxes[rq.RequestedSOPInstanceUID]
+		if !ok {
+			return printFailure(dimse.StatusNoSuchSOPInstance, "")
+		}
+		ss.logPrintJob(connState, fb.filmSession, []string{rq.RequestedSOPInstanceUID}, sessionID)
+		return dicompot.NServiceResult{Status: dimse.Success}
+	case *dimse.NDeleteRq:
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		fb, ok := ps.boxes[rq.RequestedSOPInstanceUID]
+		if !ok {
+			return printFailure(dimse.StatusNoSuchSOPInstance, "")
+		}
+		if fs, ok := ps.sessions[fb.filmSession]; ok {
+			for i, boxUID := range fs.filmBoxes {
+				if boxUID == rq.RequestedSOPInstanceUID {
+					fs.filmBoxes = append(fs.filmBoxes[:i], fs.filmBoxes[i+1:]...)
+					break
+				}
+			}
+		}
+		ps.deleteFilmBox(rq.RequestedSOPInstanceUID)
+		return dicompot.NServiceResult{Status: dimse.Success}
+	}
+	return printFailure(dimse.StatusUnrecognizedOperation, "")
+}
+
+// Image boxes are created along with their film box and filled in by N-SET.
+func (ss *server) onImageBox(connState dicompot.ConnectionState, msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	ps := ss.print
+	rq, ok := msg.(*dimse.NSetRq)
+	if !ok {
+		return printFailure(dimse.StatusUnrecognizedOperation, "")
+	}
+	uid := rq.RequestedSOPInstanceUID
+	ss.mu.Lock()
+	ib, ok := ps.images[uid]
+	ss.mu.Unlock()
+	if !ok {
+		return printFailure(dimse.StatusNoSuchSOPInstance, "")
+	}
+	seq, err := dicom.FindElementByTag(elems, dicomtag.BasicGrayscaleImageSequence)
+	if err != nil {
+		return printFailure(dimse.StatusMissingAttribute, "BasicGrayscaleImageSequence missing")
+	}
+	items := sequenceItems(seq)
+	if len(items) != 1 {
+		return printFailure(dimse.StatusInvalidAttributeValue, "BasicGrayscaleImageSequence must have one item")
+	}
+	data, err := encodeImage(items[0])
+	status := dimse.StatusInvalidAttributeValue
+	var path string
+	if err == nil {
+		path, err = ps.saveImage(sessionID+"-"+uid, data)
+		status = dimse.StatusProcessingFailure
+		if errors.Is(err, errPrintQuota) {
+			status = dimse.StatusResourceLimitation
+		}
+	}
+	fields := logrus.Fields{
+		"Command":     "N-SET",
+		"SOPInstance": uid,
+		"FilmBox":     ib.filmBox,
+		"Position":    ib.position,
+		"Rows":        elementUInt16(items[0], dicomtag.Rows),
+		"Columns":     elementUInt16(items[0], dicomtag.Columns),
+		"Photometric": elementString(items[0], dicomtag.PhotometricInterpretation),
+		"ID":          sessionID,
+	}
+	if err != nil {
+		fields["Error"] = err
+		logrus.WithFields(fields).Warn("Print image")
+		return printFailure(status, err.Error())
+	}
+	fields["Path"] = path
+	logrus.WithFields(fields).Warn("Print image")
+
+	ss.mu.Lock()
+	if ib.path == path {
+		// The image box was set before, its file was overwritten.
+		ps.quota.release(ib.size)
+	}
+	ib.path = path
+	ib.size = int64(len(data))
+	ss.mu.Unlock()
+	return dicompot.NServiceResult{Status: dimse.Success}
+}
+
+// The printer is always happy to take more jobs.
+func (ss *server) onPrinter(connState dicompot.ConnectionState, msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+	rq, ok := msg.(*dimse.NGetRq)
+	if !ok {
+		return printFailure(dimse.StatusUnrecognizedOperation, "")
+	}
+	if rq.RequestedSOPInstanceUID != sopclass.PrinterInstance {
+		return printFailure(dimse.StatusNoSuchSOPInstance, "")
+	}
+	attrs := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.Manufacturer, "AGFA"),
+		dicom.MustNewElement(dicomtag.DeviceSerialNumber, "5302A71"),
+		dicom.MustNewElement(dicomtag.ManufacturerModelName, "DRYSTAR 5302"),
+		dicom.MustNewElement(dicomtag.SoftwareVersions, "3.1.4"),
+		dicom.MustNewElement(dicomtag.PrinterStatus, "NORMAL"),
+		dicom.MustNewElement(dicomtag.PrinterStatusInfo, "NORMAL"),
+		dicom.MustNewElement(dicomtag.PrinterName, *aeFlag),
+	}
+	logrus.WithFields(logrus.Fields{
+		"Command":    "N-GET",
+		"Attributes": fmt.Sprint(rq.AttributeIdentifierList),
+		"ID":         sessionID,
+	}).Warn("Printer status query")
+	if len(rq.AttributeIdentifierList) == 0 {
+		return dicompot.NServiceResult{Status: dimse.Success, Elements: attrs}
+	}
+	var selected []*dicom.Element
+	for _, tag := range rq.AttributeIdentifierList {
+		if elem, err := dicom.FindElementByTag(attrs, tag); err == nil {
+			selected = append(selected, elem)
+		}
+	}
+	return dicompot.NServiceResult{Status: dimse.Success, Elements: selected}
+}
+
+// Requires ss.mu.
+func (ss *server) logPrintJob(connState dicompot.ConnectionState, sessionUID string, boxUIDs []string, sessionID string) {
+	ps := ss.print
+	var files []string
+	for _, boxUID := range boxUIDs {
+		if fb, ok := ps.boxes[boxUID]; ok {
+			for _, imageUID := range fb.imageBoxes {
+				if ib := ps.images[imageUID]; ib != nil && ib.path != "" {
+					files = append(files, ib.path)
+				}
+			}
+		}
+	}
+	fields := logrus.Fields{
+		"FilmSession":    sessionUID,
+		"FilmBoxes":      len(boxUIDs),
+		"Images":         len(files),
+		"Files":          strings.Join(files, ","),
+		"CallingAETitle": connState.CallingAETitle,
+		"ID":             sessionID,
+	}
+	if fs, ok := ps.sessions[sessionUID]; ok {
+		fields["NumberOfCopies"] = elementString(fs.attrs, dicomtag.NumberOfCopies)
+		fields["MediumType"] = elementString(fs.attrs, dicomtag.MediumType)
+		fields["FilmDestination"] = elementString(fs.attrs, dicomtag.FilmDestination)
+	}
+	logrus.WithFields(fields).Warn("Print job")
+}
+
+// DIMSE-N handlers of the Basic Grayscale Print Management Meta SOP class.
+func (ss *server) printServices() map[string]dicompot.NServiceCallback {
+	adapt := func(cb func(dicompot.ConnectionState, dimse.Message, []*dicom.Element, string) dicompot.NServiceResult) dicompot.NServiceCallback {
+		return func(connState dicompot.ConnectionState, transferSyntaxUID string,
+			msg dimse.Message, elems []*dicom.Element, sessionID string) dicompot.NServiceResult {
+			return cb(connState, msg, elems, sessionID)
+		}
+	}
+	return map[string]dicompot.NServiceCallback{
+		sopclass.BasicFilmSession:       adapt(ss.onFilmSession),
+		sopclass.BasicFilmBox:           adapt(ss.onFilmBox),
+		sopclass.BasicGrayscaleImageBox: adapt(ss.onImageBox),
+		sopclass.Printer:                adapt(ss.onPrinter),
+	}
+}
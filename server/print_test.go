@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+func TestImageBoxCount(t *testing.T) {
+	tests := []struct {
+		format string
+		want   int
+	}{
+		{"STANDARD\\1,1", 1},
+		{"STANDARD\\2,3", 6},
+		{"standard\\ 2 , 3 ", 6},
+		{"ROW\\2,1", 3},
+		{"COL\\1,2,3", 6},
+		{"STANDARD\\10,10", 100},
+		{"STANDARD\\11,10", 0},
+		{"ROW\\100,1", 0},
+		{"STANDARD\\2", 0},
+		{"STANDARD\\0,1", 0},
+		{"STANDARD\\-1,2", 0},
+		{"SLIDE", 0},
+		{"SUPERSLIDE\\1,1", 0},
+		{"", 0},
+	}
+	for _, test := range tests {
+		if got := imageBoxCount(test.format); got != test.want {
+			t.Errorf("imageBoxCount(%q) = %d, want %d", test.format, got, test.want)
+		}
+	}
+}
+
+func TestEncodePGM(t *testing.T) {
+	tests := []struct {
+		name                                  string
+		rows, cols, bitsAllocated, bitsStored int
+		pixels                                []byte
+		want                                  []byte // nil if an error is expected
+	}{
+		{"8 bit", 1, 2, 8, 8, []byte{1, 2}, []byte("P5\n2 1\n255\n\x01\x02")},
+		{"16 bit swapped", 1, 1, 16, 12, []byte{0x34, 0x12}, []byte("P5\n1 1\n4095\n\x12\x34")},
+		{"bits stored defaulted", 1, 1, 8, 0, []byte{7}, []byte("P5\n1 1\n255\n\x07")},
+		{"trailing pixels dropped", 1, 1, 8, 8, []byte{7, 8}, []byte("P5\n1 1\n255\n\x07")},
+		{"short", 2, 2, 8, 8, []byte{1, 2, 3}, nil},
+		{"no rows", 0, 2, 8, 8, nil, nil},
+		{"12 bits allocated", 1, 1, 12, 12, []byte{1, 2}, nil},
+	}
+	for _, test := range tests {
+		got, err := encodePGM(test.rows, test.cols, test.bitsAllocated, test.bitsStored, test.pixels)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: encodePGM = %q, want error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: encodePGM = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestFilmSessionSet(t *testing.T) {
+	fs := &filmSession{}
+	if !fs.set([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.InstitutionName, "A"),
+		dicom.MustNewElement(dicomtag.PatientID, "1"),
+	}) {
+		t.Fatalf("set refused")
+	}
+	if !fs.set([]*dicom.Element{dicom.MustNewElement(dicomtag.InstitutionName, "B")}) {
+		t.Fatalf("set refused")
+	}
+	if len(fs.attrs) != 2 || elementString(fs.attrs, dicomtag.InstitutionName) != "B" {
+		t.Errorf("attrs after replace = %v, want 2 with InstitutionName B", fs.attrs)
+	}
+
+	var elems []*dicom.Element
+	for i := 0; i < maxFilmSessionAttrs; i++ {
+		elems = append(elems, &dicom.Element{Tag: dicomtag.Tag{Group: 0x0011, Element: uint16(i)}})
+	}
+	if fs.set(elems) {
+		t.Errorf("set past maxFilmSessionAttrs accepted")
+	}
+	if len(fs.attrs) != 2 {
+		t.Errorf("len(attrs) = %d after refused set, want 2", len(fs.attrs))
+	}
+}
+
+func TestPrintStoreRoom(t *testing.T) {
+	ps := newPrintStore("", nil)
+	for i := 0; i < maxPrintObjects-1; i++ {
+		ps.images[strconv.Itoa(i)] = &imageBox{}
+	}
+	if !ps.room(1) {
+		t.Errorf("room(1) = false with %d objects", len(ps.images))
+	}
+	if ps.room(2) {
+		t.Errorf("room(2) = true with %d objects", len(ps.images))
+	}
+}
+
+func TestSaveImageQuota(t *testing.T) {
+	dir := t.TempDir()
+	quota, err := newDirQuota(dir, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := newPrintStore(dir, quota)
+	path, err := ps.saveImage("a", make([]byte, 8))
+	if err != nil {
+		t.Fatalf("saveImage: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || len(data) != 8 {
+		t.Errorf("ReadFile(%s) = %d bytes, %v, want 8 bytes", path, len(data), err)
+	}
+	if _, err := ps.saveImage("b", make([]byte, 3)); !errors.Is(err, errPrintQuota) {
+		t.Errorf("saveImage past the quota: err = %v, want %v", err, errPrintQuota)
+	}
+	if _, err := os.Stat(dir + "/b.pgm"); !os.IsNotExist(err) {
+		t.Errorf("b.pgm written past the quota")
+	}
+	if _, err := ps.saveImage("c", make([]byte, 2)); err != nil {
+		t.Errorf("saveImage within the quota: %v", err)
+	}
+}
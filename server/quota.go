@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// Room left in a directory that peers write files to, such as -stow or
+// -print. Files already in the directory count too.
+type dirQuota struct {
+	maxBytes int64 // Zero for no limit.
+	maxFiles int   // Zero for no limit.
+
+	mu    sync.Mutex
+	bytes int64
+	files int
+}
+
+func newDirQuota(dir string, maxBytes int64, maxFiles int) (*dirQuota, error) {
+	q := &dirQuota{maxBytes: maxBytes, maxFiles: maxFiles}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		q.bytes += info.Size()
+		q.files++
+	}
+	return q, nil
+}
+
+// Reserve room for a file of "size" bytes. Reports false if it doesn't fit.
+func (q *dirQuota) reserve(size int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes > 0 && q.bytes+size > q.maxBytes || q.maxFiles > 0 && q.files >= q.maxFiles {
+		return false
+	}
+	q.bytes += size
+	q.files++
+	return true
+}
+
+// Reserve "n" more bytes for a file reserved before, as it is written.
+// Reports false if they don't fit.
+func (q *dirQuota) grow(n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes > 0 && q.bytes+n > q.maxBytes {
+		return false
+	}
+	q.bytes += n
+	return true
+}
+
+// Give back the room of a file that couldn't be written.
+func (q *dirQuota) release(size int64) {
+	q.mu.Lock()
+	q.bytes -= size
+	q.files--
+	q.mu.Unlock()
+}
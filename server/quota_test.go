@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirQuota(t *testing.T) {
+	type op struct {
+		name string // reserve, grow or release
+		size int64
+		want bool
+	}
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxFiles int
+		ops      []op
+	}{
+		{"unlimited", 0, 0, []op{
+			{"reserve", 1 << 40, true},
+			{"grow", 1 << 40, true},
+			{"reserve", 1, true},
+		}},
+		{"bytes", 100, 0, []op{
+			{"reserve", 60, true},
+			{"reserve", 50, false},
+			{"reserve", 40, true},
+			{"grow", 1, false},
+			{"release", 40, true},
+			{"grow", 10, true},
+			{"reserve", 31, false},
+			{"reserve", 30, true},
+		}},
+		{"files", 0, 2, []op{
+			{"reserve", 0, true},
+			{"reserve", 0, true},
+			{"reserve", 0, false},
+			{"grow", 100, true},
+			{"release", 0, true},
+			{"reserve", 0, true},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := newDirQuota(filepath.Join(t.TempDir(), "missing"), test.maxBytes, test.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, op := range test.ops {
+				got := true
+				switch op.name {
+				case "reserve":
+					got = q.reserve(op.size)
+				case "grow":
+					got = q.grow(op.size)
+				case "release":
+					q.release(op.size)
+				}
+				if got != op.want {
+					t.Errorf("op %d: %s(%d) = %v, want %v", i, op.name, op.size, got, op.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDirQuotaCountsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, 30), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	q, err := newDirQuota(dir, 100, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.bytes != 60 || q.files != 2 {
+		t.Errorf("newDirQuota: bytes = %d, files = %d, want 60, 2", q.bytes, q.files)
+	}
+	if q.reserve(41) {
+		t.Errorf("reserve(41) = true with 60 of 100 bytes used")
+	}
+	if !q.reserve(40) {
+		t.Errorf("reserve(40) = false with 60 of 100 bytes used")
+	}
+	if q.reserve(0) {
+		t.Errorf("reserve(0) = true with 3 of 3 files used")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// Signatures shipped with the binary, used unless -signatures names a file.
+//
+//go:embed signatures.json
+var bundledSignatures []byte
+
+// Load the client fingerprint signatures from the -signatures file, or the
+// bundled ones.
+func loadSignatures() ([]dicompot.FingerprintSignature, error) {
+	if *signaturesFlag == "" {
+		return dicompot.ParseFingerprintSignatures(bundledSignatures)
+	}
+	data, err := os.ReadFile(*signaturesFlag)
+	if err != nil {
+		return nil, err
+	}
+	signatures, err := dicompot.ParseFingerprintSignatures(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", *signaturesFlag, err)
+	}
+	return signatures, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+func TestBundledSignatures(t *testing.T) {
+	signatures, err := dicompot.ParseFingerprintSignatures(bundledSignatures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) == 0 {
+		t.Fatalf("no bundled signatures")
+	}
+}
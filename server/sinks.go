@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// Parse the -sink flag, a comma separated list of event sink URLs:
+//
+//	syslog+udp://host:514    RFC 5424 syslog over UDP, TCP or TLS
+//	cef+tcp://host:514       CEF over syslog
+//	leef+tls://host:6514     LEEF over syslog
+//	file:///var/log/dp.json  newline-delimited JSON, rotated at 10 MB
+//	https://host/ingest      JSON array POSTed in batches
+func parseEventSinks(spec string) ([]dicompot.EventSink, error) {
+	var sinks []dicompot.EventSink
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		scheme := strings.SplitN(u.Scheme, "+", 2)
+		switch {
+		case u.Scheme == "file":
+			sinks = append(sinks, dicompot.NewFileSink(u.Path, 10, 3))
+		case u.Scheme == "http" || u.Scheme == "https":
+			var header http.Header
+			if u.User != nil {
+				// Credentials in the URL become a Basic Authorization header.
+				req := &http.Request{Header: make(http.Header)}
+				password, _ := u.User.Password()
+				req.SetBasicAuth(u.User.Username(), password)
+				header = req.Header
+				u.User = nil
+			}
+			sinks = append(sinks, dicompot.NewHTTPSink(u.String(), header, 100, 0))
+		case len(scheme) == 2:
+			var format dicompot.SyslogFormat
+			switch scheme[0] {
+			case "syslog":
+				format = dicompot.SyslogRFC5424
+			case "cef":
+				format = dicompot.SyslogCEF
+			case "leef":
+				format = dicompot.SyslogLEEF
+			default:
+				return nil, fmt.Errorf("unknown event sink format %q", scheme[0])
+			}
+			sink, err := dicompot.NewSyslogSink(scheme[1], u.Host, format, nil)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		default:
+			return nil, fmt.Errorf("unknown event sink %q", s)
+		}
+	}
+	return sinks, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nsmfoo/dicompot"
+)
+
+// Build the tarpit policy from the -tarpit* flags.
+func tarpitPolicy() (*dicompot.TarpitPolicy, error) {
+	policy := &dicompot.TarpitPolicy{
+		ScoreThreshold:  *tarpitScoreFlag,
+		AssociateDelay:  *tarpitDelayFlag,
+		CFindDelay:      *tarpitFindFlag,
+		DribbleInterval: *tarpitDribbleFlag,
+		MaxDelay:        *tarpitMaxFlag,
+	}
+	for _, s := range strings.Split(*tarpitIPsFlag, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ipNet, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		policy.IPs = append(policy.IPs, ipNet)
+	}
+	for _, ae := range strings.Split(*tarpitAEsFlag, ",") {
+		if ae = strings.TrimSpace(ae); ae != "" {
+			policy.CallingAETitles = append(policy.CallingAETitles, ae)
+		}
+	}
+	return policy, nil
+}
+
+// Parse an address range in CIDR notation, or a single address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	return ipNet, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+// The "verify" command: tell which session a leaked file was served to.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+const verifyUsage = `Usage: dicompot verify [flags] FILE...
+
+Recover the session a file served by dicompot was watermarked for: from the
+pattern in the pixel data, the private token and, with -watermarkdb, the
+watermarked attributes.
+
+`
+
+// Run the verify command. Returns the exit status: 0 if a session was found
+// in every file, 1 if not, 2 on usage errors.
+func verifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), verifyUsage)
+		fs.PrintDefaults()
+	}
+	key := fs.String("pixelkey", "", "Key of the pixel data pattern, as given to the server")
+	original := fs.String("original", "", "Original of the file in the picture directory, for a non-blind detection")
+	db := fs.String("watermarkdb", "", "Lookup table of the watermarks handed out")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var orig *pixelImage
+	if *original != "" {
+		ds, err := dicom.ReadDataSetFromFile(*original, dicom.ReadOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *original, err)
+			return 2
+		}
+		if orig, _, err = readPixelImage(ds); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *original, err)
+			return 2
+		}
+	}
+	var watermarks *watermarker
+	if *db != "" {
+		var err error
+		if watermarks, err = readWatermarks(*db); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		if !verifyFile(path, *key, orig, watermarks) {
+			status = 1
+		}
+	}
+	return status
+}
+
+// Print what tells the session "path" was served to. Returns whether a
+// session was found.
+func verifyFile(path string, key string, original *pixelImage, watermarks *watermarker) bool {
+	fmt.Printf("%s:\n", path)
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		fmt.Printf("  %v\n", err)
+		return false
+	}
+	found := false
+
+	if im, _, err := readPixelImage(ds); err != nil {
+		fmt.Printf("  pixel data: %v\n", err)
+	} else if session, margin, err := detectPixelMark(im, original, key); err != nil {
+		fmt.Printf("  pixel data: %v (margin %.1f)\n", err, margin)
+	} else {
+		fmt.Printf("  pixel data: session %d (margin %.1f)\n", session, margin)
+		found = true
+	}
+
+	var values [][2]string // Attribute and value.
+	if token := findSessionToken(ds); token != "" {
+		fmt.Printf("  private token: %s\n", token)
+		values = append(values, [2]string{"private token", token})
+	}
+	if watermarks == nil {
+		return found
+	}
+	for _, tag := range append(append([]dicomtag.Tag(nil), watermarkUIDTags...), dicomtag.AccessionNumber, dicomtag.InstitutionName) {
+		if elem, err := ds.FindElementByTag(tag); err == nil {
+			if v, err := elem.GetString(); err == nil && strings.TrimSpace(v) != "" {
+				values = append(values, [2]string{dicomtag.DebugString(tag), strings.TrimRight(v, " \x00")})
+			}
+		}
+	}
+	for _, v := range values {
+		for _, e := range watermarks.lookup(v[1]) {
+			fmt.Printf("  %s %s: session %s, %s, %s\n", v[0], v[1], e.Session, e.IP, e.Time.Format("2006-01-02 15:04:05"))
+			found = true
+		}
+	}
+	return found
+}
+
+// The session token of the private block added by the watermarker, or "".
+func findSessionToken(ds *dicom.DataSet) string {
+	for _, elem := range ds.Elements {
+		if elem.Tag.Group%2 == 0 || elem.Tag.Element != watermarkPrivateCreator {
+			continue
+		}
+		if creator, err := elem.GetString(); err != nil || strings.TrimSpace(creator) != watermarkPrivateCreatorName {
+			continue
+		}
+		token, err := ds.FindElementByTag(dicomtag.Tag{Group: elem.Tag.Group, Element: watermarkPrivateToken})
+		if err != nil {
+			continue
+		}
+		if s, err := token.GetString(); err == nil {
+			return strings.TrimSpace(s)
+		}
+	}
+	return ""
+}
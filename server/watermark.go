@@ -0,0 +1,356 @@
+package main
+
+// Honeytoken watermarks: the datasets returned by C-FIND, C-GET and C-MOVE
+// are rewritten with values derived from the session ID, so that decoy data
+// found in a leak can be traced back to the session that retrieved it.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/sirupsen/logrus"
+)
+
+// The private block holding the session token in retrieved datasets: the
+// creator is at (gggg,0010) and the token at (gggg,1010), gggg being the
+// first odd group from 0009 the dataset doesn't use.
+const (
+	watermarkPrivateCreatorName = "HOSP_PACS_01"
+	watermarkPrivateCreator     = 0x0010
+	watermarkPrivateToken       = 0x1010
+)
+
+// UIDs are rewritten the same way in every attribute, so that the
+// references between studies, series and instances hold.
+var watermarkUIDTags = []dicomtag.Tag{
+	dicomtag.StudyInstanceUID,
+	dicomtag.SeriesInstanceUID,
+	dicomtag.SOPInstanceUID,
+	dicomtag.MediaStorageSOPInstanceUID,
+}
+
+// A watermark handed out to a session.
+type watermarkEntry struct {
+	Value     string
+	Attribute string
+	Original  string `json:",omitempty"`
+	Session   string
+	IP        string
+	Time      time.Time
+}
+
+type watermarker struct {
+	root string // UID root of the rewritten UIDs.
+
+	mu      sync.Mutex
+	byValue map[string][]watermarkEntry
+	file    *os.File // The lookup table, one JSON entry per line.
+}
+
+// Create a watermarker and load the lookup table from "path".
+func newWatermarker(root string, path string) (*watermarker, error) {
+	root = strings.TrimSuffix(root, ".")
+	// The UIDs get one more component of up to 20 digits.
+	if len(root) > 43 {
+		return nil, fmt.Errorf("UID root %q longer than 43 characters", root)
+	}
+	for _, c := range strings.Split(root, ".") {
+		if c == "" || strings.Trim(c, "0123456789") != "" || (len(c) > 1 && c[0] == '0') {
+			return nil, fmt.Errorf("invalid UID root %q", root)
+		}
+	}
+	w := &watermarker{root: root, byValue: make(map[string][]watermarkEntry)}
+	var err error
+	if w.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	if err := w.load(w.file, path); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Load the lookup table at "path" for lookups only.
+func readWatermarks(path string) (*watermarker, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := &watermarker{byValue: make(map[string][]watermarkEntry)}
+	if err := w.load(f, path); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *watermarker) load(r io.Reader, path string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e watermarkEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		w.index(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Must be called with w.mu held.
+func (w *watermarker) index(e watermarkEntry) bool {
+	for _, old := range w.byValue[e.Value] {
+		if old.Session == e.Session {
+			return false
+		}
+	}
+	w.byValue[e.Value] = append(w.byValue[e.Value], e)
+	return true
+}
+
+// Remember a watermark, in memory and in the lookup table file.
+func (w *watermarker) record(e watermarkEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.index(e) {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Error": err,
+			"ID":    e.Session,
+		}).Error("Watermark not saved")
+	}
+}
+
+// Sessions the watermark "value" was handed out to.
+func (w *watermarker) lookup(value string) []watermarkEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]watermarkEntry(nil), w.byValue[strings.TrimSpace(value)]...)
+}
+
+func watermarkHash(session string, kind string, value string) [32]byte {
+	return sha256.Sum256([]byte(session + "\x00" + kind + "\x00" + value))
+}
+
+func (w *watermarker) uid(session string, original string) string {
+	h := watermarkHash(session, "uid", original)
+	n := binary.BigEndian.Uint64(h[:8])
+	if n == 0 {
+		n = 1
+	}
+	return fmt.Sprintf("%s.%d", w.root, n)
+}
+
+// Keep the shape of the accession number, replace the digits.
+func accessionWatermark(session string, original string) string {
+	h := watermarkHash(session, "accession", original)
+	b := []byte(original)
+	j := 0
+	for i, c := range b {
+		if c >= '0' && c <= '9' {
+			b[i] = '0' + h[j%len(h)]%10
+			j++
+		}
+	}
+	if j == 0 {
+		// No digits to replace: add some, within the 16 characters of SH.
+		suffix := fmt.Sprintf("%d", binary.BigEndian.Uint32(h[:4])%1000000)
+		if len(b)+len(suffix) > 16 {
+			b = b[:16-len(suffix)]
+		}
+		b = append(b, suffix...)
+	}
+	return string(b)
+}
+
+// Spellings of an institution name that pass for data entry variations. The
+// name itself is not one of them.
+func institutionVariants(name string) []string {
+	variants := []string{name + ".", strings.ToUpper(name), "The " + name}
+	for _, r := range [][2]string{
+		{"Hospital", "Hosp."}, {"Medical Center", "Med. Ctr."}, {"Center", "Centre"},
+		{" and ", " & "}, {" & ", " and "}, {"Saint ", "St. "}, {"St. ", "Saint "},
+	} {
+		if v := strings.Replace(name, r[0], r[1], 1); v != name {
+			variants = append(variants, v)
+		}
+	}
+	var unique []string
+	seen := make(map[string]bool)
+	for _, v := range variants {
+		if v != name && len(v) <= 64 && !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// Session token stored in the private element.
+func sessionToken(session string) string {
+	h := watermarkHash(session, "token", "")
+	return strings.ToUpper(hex.EncodeToString(h[:8]))
+}
+
+// Return a copy of "elems" with the watermarks of the session. Elements are
+// replaced, never modified: they may be shared with the catalog. If
+// "private" is set, the session token is added in a private element.
+func (w *watermarker) mark(elems []*dicom.Element, session string, ip string, private bool) []*dicom.Element {
+	if w == nil {
+		return elems
+	}
+	now := time.Now()
+	marked := make([]*dicom.Element, 0, len(elems)+2)
+	for _, elem := range elems {
+		value, err := elem.GetString()
+		value = strings.TrimRight(value, " \x00")
+		if err != nil || value == "" {
+			marked = append(marked, elem)
+			continue
+		}
+		watermark := ""
+		switch {
+		case isWatermarkUIDTag(elem.Tag):
+			watermark = w.uid(session, value)
+		case elem.Tag == dicomtag.AccessionNumber:
+			watermark = accessionWatermark(session, value)
+		case elem.Tag == dicomtag.InstitutionName:
+			if variants := institutionVariants(value); len(variants) > 0 {
+				h := watermarkHash(session, "institution", value)
+				watermark = variants[int(h[0])%len(variants)]
+			}
+		}
+		if watermark == "" {
+			marked = append(marked, elem)
+			continue
+		}
+		e := watermarkEntry{
+			Value:     watermark,
+			Attribute: dicomtag.DebugString(elem.Tag),
+			Session:   session,
+			IP:        ip,
+			Time:      now,
+		}
+		if elem.Tag != dicomtag.InstitutionName {
+			// Queries with the watermark are answered as if they
+			// had the original value.
+			e.Original = value
+		}
+		w.record(e)
+		marked = append(marked, &dicom.Element{Tag: elem.Tag, VR: elem.VR, Value: []interface{}{watermark}})
+	}
+	if private {
+		marked = w.addToken(marked, session, ip, now)
+	}
+	return marked
+}
+
+// Insert the private creator and token elements, in tag order, in a group of
+// their own: adding them to a group in use would invalidate its length.
+// Datasets with no free private group are left alone.
+func (w *watermarker) addToken(elems []*dicom.Element, session string, ip string, now time.Time) []*dicom.Element {
+	used := make(map[uint16]bool)
+	for _, elem := range elems {
+		used[elem.Tag.Group] = true
+	}
+	group := uint16(0x0009)
+	for used[group] {
+		if group += 2; group > 0x00ff {
+			return elems
+		}
+	}
+	pos := len(elems)
+	for i, elem := range elems {
+		if elem.Tag.Group > group {
+			pos = i
+			break
+		}
+	}
+	token := sessionToken(session)
+	tokenTag := dicomtag.Tag{Group: group, Element: watermarkPrivateToken}
+	w.record(watermarkEntry{Value: token, Attribute: dicomtag.DebugString(tokenTag), Session: session, IP: ip, Time: now})
+	private := []*dicom.Element{
+		{Tag: dicomtag.Tag{Group: group, Element: watermarkPrivateCreator}, VR: "LO", Value: []interface{}{watermarkPrivateCreatorName}},
+		{Tag: tokenTag, VR: "LO", Value: []interface{}{token}},
+	}
+	return append(elems[:pos:pos], append(private, elems[pos:]...)...)
+}
+
+func isWatermarkUIDTag(tag dicomtag.Tag) bool {
+	for _, t := range watermarkUIDTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a copy of the query filters with the watermarks replaced by the
+// original values, so that follow-up queries with the values we returned
+// match the catalog.
+func (w *watermarker) unmark(filters []*dicom.Element, session string) []*dicom.Element {
+	if w == nil {
+		return filters
+	}
+	unmarked := make([]*dicom.Element, 0, len(filters))
+	for _, elem := range filters {
+		if !isWatermarkUIDTag(elem.Tag) && elem.Tag != dicomtag.AccessionNumber {
+			unmarked = append(unmarked, elem)
+			continue
+		}
+		changed := false
+		var values []interface{}
+		for _, v := range elem.Value {
+			s, ok := v.(string)
+			if !ok {
+				values = append(values, v)
+				continue
+			}
+			// UID lists are backslash separated.
+			parts := strings.Split(s, "\\")
+			for i, p := range parts {
+				p = strings.TrimRight(p, " \x00")
+				for _, e := range w.lookup(p) {
+					if e.Original == "" {
+						continue
+					}
+					if e.Session != session {
+						logrus.WithFields(logrus.Fields{
+							"Value":  p,
+							"Origin": e.Session,
+							"IP":     e.IP,
+							"ID":     session,
+						}).Warn("Watermark reused")
+					}
+					parts[i] = e.Original
+					changed = true
+					break
+				}
+			}
+			values = append(values, strings.Join(parts, "\\"))
+		}
+		if changed {
+			elem = &dicom.Element{Tag: elem.Tag, VR: elem.VR, Value: values}
+		}
+		unmarked = append(unmarked, elem)
+	}
+	return unmarked
+}
@@ -0,0 +1,379 @@
+package main
+
+// Modality Worklist (MWL) C-FIND emulation. P3.4 K.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/nsmfoo/dicompot"
+	"github.com/sirupsen/logrus"
+)
+
+// One Scheduled Procedure Step. Dates are stored as an offset from today so
+// the schedule never goes stale.
+type worklistStep struct {
+	StationAETitle          string
+	StationName             string
+	Modality                string
+	DayOffset               int    // Days relative to the date of the query.
+	StartTime               string // HHMMSS
+	Description             string
+	ID                      string
+	PerformingPhysicianName string
+	Location                string
+	Status                  string
+}
+
+// One Requested Procedure and the steps scheduled for it.
+type worklistEntry struct {
+	PatientName                   string
+	PatientID                     string
+	PatientBirthDate              string
+	PatientSex                    string
+	AccessionNumber               string
+	StudyInstanceUID              string
+	ReferringPhysicianName        string
+	RequestedProcedureID          string
+	RequestedProcedureDescription string
+	RequestedProcedurePriority    string
+	Steps                         []worklistStep `json:"ScheduledProcedureSteps"`
+}
+
+type worklist struct {
+	entries []worklistEntry
+}
+
+// Load a worklist from a JSON file holding a list of worklistEntry.
+func loadWorklist(path string) (*worklist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []worklistEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range entries {
+		for j := range entries[i].Steps {
+			if entries[i].Steps[j].Status == "" {
+				entries[i].Steps[j].Status = "SCHEDULED"
+			}
+		}
+	}
+	return &worklist{entries: entries}, nil
+}
+
+// Procedures a radiology department typically schedules, per modality.
+var worklistProcedures = []struct {
+	modality     string
+	stations     []string
+	descriptions []string
+}{
+	{"CT", []string{"CT01", "CT02", "CT_SOMATOM"}, []string{
+		"CT HEAD W/O CONTRAST",
+		"CT CHEST W/ CONTRAST",
+		"CT ABDOMEN PELVIS W/ CONTRAST",
+		"CTA CHEST PULMONARY EMBOLISM",
+		"CT LUMBAR SPINE W/O CONTRAST"}},
+	{"MR", []string{"MR01", "MR_AVANTO"}, []string{
+		"MRI BRAIN W/ AND W/O CONTRAST",
+		"MRI KNEE LEFT W/O CONTRAST",
+		"MRI LUMBAR SPINE W/O CONTRAST",
+		"MRI SHOULDER RIGHT W/O CONTRAST",
+		"MRA HEAD W/O CONTRAST"}},
+	{"US", []string{"US01", "US_LOGIQ"}, []string{
+		"US ABDOMEN COMPLETE",
+		"US PELVIS TRANSVAGINAL",
+		"US THYROID",
+		"US CAROTID DOPPLER BILATERAL"}},
+	{"CR", []string{"CR01", "XR_ROOM1"}, []string{
+		"XR CHEST 2 VIEWS",
+		"XR KNEE 3 VIEWS RIGHT",
+		"XR HAND 3 VIEWS LEFT"}},
+	{"MG", []string{"MG01"}, []string{
+		"MAMMO SCREENING BILATERAL W/ CAD",
+		"MAMMO DIAGNOSTIC LEFT"}},
+	{"NM", []string{"NM01"}, []string{
+		"NM BONE SCAN WHOLE BODY",
+		"NM MYOCARDIAL PERFUSION SPECT"}},
+}
+
+var (
+	worklistFamilyNames = []string{"Andersson", "Johansson", "Karlsson", "Nilsson", "Smith", "Brown",
+		"Garcia", "Miller", "Davis", "Wilson", "Taylor", "Moore", "Jackson", "Lee", "Walker"}
+	worklistGivenNames = []string{"Anna", "Erik", "Maria", "Lars", "James", "Linda", "Robert",
+		"Susan", "Michael", "Karin", "David", "Sara", "John", "Emma", "Peter"}
+	worklistPhysicians = []string{"Lindqvist^Helena^^Dr", "Hughes^Thomas^^Dr", "Berg^Johan^^Dr",
+		"Patel^Anita^^Dr", "Olsen^Mark^^Dr"}
+	worklistPriorities = []string{"ROUTINE", "ROUTINE", "ROUTINE", "HIGH", "STAT"}
+)
+
+// Generate a plausible schedule of "n" requested procedures spread over
+// yesterday, today and the next few days.
+func generateWorklist(n int) *worklist {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pick := func(list []string) string { return list[rnd.Intn(len(list))] }
+	wl := &worklist{}
+	for i := 0; i < n; i++ {
+		proc := worklistProcedures[rnd.Intn(len(worklistProcedures))]
+		description := pick(proc.descriptions)
+		birth := time.Now().AddDate(-18-rnd.Intn(70), -rnd.Intn(12), -rnd.Intn(28))
+		sex := "F"
+		if proc.modality != "MG" && rnd.Intn(2) == 0 {
+			sex = "M"
+		}
+		// Steps are scheduled in 15 minute slots during office hours.
+		minutes := 7*60 + 15*rnd.Intn(40)
+		wl.entries = append(wl.entries, worklistEntry{
+			PatientName:                   pick(worklistFamilyNames) + "^" + pick(worklistGivenNames),
+			PatientID:                     fmt.Sprintf("%07d", 1000000+rnd.Intn(9000000)),
+			PatientBirthDate:              birth.Format("20060102"),
+			PatientSex:                    sex,
+			AccessionNumber:               fmt.Sprintf("A%09d", rnd.Intn(1000000000)),
+			StudyInstanceUID:              fmt.Sprintf("2.25.%d%d", rnd.Int63(), rnd.Intn(1000)),
+			ReferringPhysicianName:        pick(worklistPhysicians),
+			RequestedProcedureID:          fmt.Sprintf("RP%06d", rnd.Intn(1000000)),
+			RequestedProcedureDescription: description,
+			RequestedProcedurePriority:    pick(worklistPriorities),
+			Steps: []worklistStep{{
+				StationAETitle:          pick(proc.stations),
+				StationName:             proc.modality + "-ROOM",
+				Modality:                proc.modality,
+				DayOffset:               rnd.Intn(5) - 1,
+				StartTime:               fmt.Sprintf("%02d%02d00", minutes/60, minutes%60),
+				Description:             description,
+				ID:                      fmt.Sprintf("SPS%06d", rnd.Intn(1000000)),
+				PerformingPhysicianName: pick(worklistPhysicians),
+				Location:                "RADIOLOGY",
+				Status:                  "SCHEDULED",
+			}},
+		})
+	}
+	return wl
+}
+
+// Render the step as the items of a ScheduledProcedureStepSequence item.
+func (s *worklistStep) elements(today time.Time) []*dicom.Element {
+	return []*dicom.Element{
+		dicom.MustNewElement(dicomtag.Modality, s.Modality),
+		dicom.MustNewElement(dicomtag.ScheduledStationAETitle, s.StationAETitle),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, today.AddDate(0, 0, s.DayOffset).Format("20060102")),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartTime, s.StartTime),
+		dicom.MustNewElement(dicomtag.ScheduledPerformingPhysicianName, s.PerformingPhysicianName),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepDescription, s.Description),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, s.ID),
+		dicom.MustNewElement(dicomtag.ScheduledStationName, s.StationName),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepLocation, s.Location),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepStatus, s.Status),
+	}
+}
+
+func (e *worklistEntry) elements() []*dicom.Element {
+	return []*dicom.Element{
+		dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 100"),
+		dicom.MustNewElement(dicomtag.AccessionNumber, e.AccessionNumber),
+		dicom.MustNewElement(dicomtag.ReferringPhysicianName, e.ReferringPhysicianName),
+		dicom.MustNewElement(dicomtag.PatientName, e.PatientName),
+		dicom.MustNewElement(dicomtag.PatientID, e.PatientID),
+		dicom.MustNewElement(dicomtag.PatientBirthDate, e.PatientBirthDate),
+		dicom.MustNewElement(dicomtag.PatientSex, e.PatientSex),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, e.StudyInstanceUID),
+		dicom.MustNewElement(dicomtag.RequestedProcedureDescription, e.RequestedProcedureDescription),
+		dicom.MustNewElement(dicomtag.RequestedProcedureID, e.RequestedProcedureID),
+		dicom.MustNewElement(dicomtag.RequestedProcedurePriority, e.RequestedProcedurePriority),
+	}
+}
+
+// Return the string value of a filter, or "" for universal matching.
+func worklistFilterValue(f *dicom.Element) string {
+	if len(f.Value) == 0 {
+		return ""
+	}
+	s, ok := f.Value[0].(string)
+	if !ok {
+		return ""
+	}
+	s = strings.TrimSpace(s)
+	if strings.Trim(s, "*") == "" {
+		return ""
+	}
+	return s
+}
+
+// Check a single attribute against a filter. Supports the wildcard and range
+// matching MWL SCUs use. P3.4 C.2.2.2.
+func worklistMatchValue(f *dicom.Element, value string) bool {
+	pattern := worklistFilterValue(f)
+	if pattern == "" {
+		return true
+	}
+	if (f.VR == "DA" || f.VR == "TM") && strings.Contains(pattern, "-") {
+		r := strings.SplitN(pattern, "-", 2)
+		// Both ends are inclusive. TM values of different precision compare
+		// correctly once the value is cut to the filter's length.
+		if r[0] != "" && value < r[0] {
+			return false
+		}
+		if r[1] != "" && len(value) > len(r[1]) {
+			value = value[:len(r[1])]
+		}
+		return r[1] == "" || value <= r[1]
+	}
+	if strings.ContainsAny(pattern, "*?") {
+		re := "^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(pattern)) + "$"
+		if f.VR == "PN" {
+			// Person names match regardless of case, as below.
+			re = "(?i)" + re
+		}
+		ok, err := regexp.MatchString(re, value)
+		return err == nil && ok
+	}
+	if f.VR == "PN" {
+		return strings.EqualFold(pattern, value)
+	}
+	return pattern == value
+}
+
+// Match "filters" against "elems" and return the elements to send back, one
+// per filter. Returns false if any filter fails to match.
+func worklistMatch(filters []*dicom.Element, elems []*dicom.Element) ([]*dicom.Element, bool) {
+	var resp []*dicom.Element
+	for _, f := range filters {
+		if f.Tag.Group == dicomtag.MetadataGroup || f.Tag.Group == 0 {
+			continue
+		}
+		elem, err := dicom.FindElementByTag(elems, f.Tag)
+		if err != nil {
+			// Unknown attribute; matches only when universal and is returned empty.
+			if worklistFilterValue(f) != "" {
+				return nil, false
+			}
+			empty, err := dicom.NewElement(f.Tag)
+			if err != nil {
+				continue
+			}
+			resp = append(resp, empty)
+			continue
+		}
+		value, _ := elem.GetString()
+		if !worklistMatchValue(f, value) {
+			return nil, false
+		}
+		resp = append(resp, elem)
+	}
+	return resp, true
+}
+
+// Items of the ScheduledProcedureStepSequence filter, if any.
+func worklistStepFilters(filters []*dicom.Element) (*dicom.Element, []*dicom.Element) {
+	for _, f := range filters {
+		if f.Tag != dicomtag.ScheduledProcedureStepSequence {
+			continue
+		}
+		for _, v := range f.Value {
+			if item, ok := v.(*dicom.Element); ok && item.Tag == dicomtag.Item {
+				var subFilters []*dicom.Element
+				for _, sv := range item.Value {
+					if sub, ok := sv.(*dicom.Element); ok {
+						subFilters = append(subFilters, sub)
+					}
+				}
+				return f, subFilters
+			}
+		}
+		return f, nil
+	}
+	return nil, nil
+}
+
+// Log the station AE titles and modalities the SCU asked for. These tell us
+// which devices the attacker is trying to impersonate.
+func logWorklistQuery(stepFilters []*dicom.Element, sessionID string) {
+	for _, f := range stepFilters {
+		value := worklistFilterValue(f)
+		if value == "" {
+			continue
+		}
+		switch f.Tag {
+		case dicomtag.ScheduledStationAETitle:
+			logrus.WithFields(logrus.Fields{
+				"StationAETitle": value,
+				"ID":             sessionID,
+			}).Warn("MWL station query")
+		case dicomtag.Modality:
+			logrus.WithFields(logrus.Fields{
+				"Modality": value,
+				"ID":       sessionID,
+			}).Warn("MWL modality query")
+		}
+	}
+}
+
+// Answer a Modality Worklist C-FIND. Every matching scheduled procedure step is
+// returned as a separate response, as real worklist SCPs do.
+func (wl *worklist) find(filters []*dicom.Element, sessionID string) [][]*dicom.Element {
+	seqFilter, stepFilters := worklistStepFilters(filters)
+	logWorklistQuery(stepFilters, sessionID)
+
+	var topFilters []*dicom.Element
+	for _, f := range filters {
+		if f != seqFilter {
+			topFilters = append(topFilters, f)
+		}
+	}
+	today := time.Now()
+	var results [][]*dicom.Element
+	for i := range wl.entries {
+		entry := &wl.entries[i]
+		top, ok := worklistMatch(topFilters, entry.elements())
+		if !ok {
+			continue
+		}
+		for j := range entry.Steps {
+			stepElems := entry.Steps[j].elements(today)
+			var item []*dicom.Element
+			if len(stepFilters) == 0 {
+				item = stepElems
+			} else if item, ok = worklistMatch(stepFilters, stepElems); !ok {
+				continue
+			}
+			result := append([]*dicom.Element{}, top...)
+			if seqFilter != nil {
+				values := make([]interface{}, len(item))
+				for k, e := range item {
+					values[k] = e
+				}
+				result = append(result, dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+					dicom.MustNewElement(dicomtag.Item, values...)))
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func (ss *server) onWorklistFind(
+	connState dicompot.ConnectionState,
+	filters []*dicom.Element,
+	sessionID string,
+	ch chan dicompot.CFindResult) {
+	results := ss.worklist.find(ss.watermarks.unmark(filters, sessionID), sessionID)
+
+	logrus.WithFields(logrus.Fields{
+		"Matches": len(results),
+		"ID":      sessionID,
+	}).Warn("MWL Search result")
+
+	for _, elems := range results {
+		ch <- dicompot.CFindResult{Elements: ss.watermarks.mark(elems, sessionID, connStateIP(connState), false)}
+	}
+	close(ch)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+func TestWorklistMatchValue(t *testing.T) {
+	tests := []struct {
+		tag    dicomtag.Tag
+		filter string
+		value  string
+		want   bool
+	}{
+		// Universal matching.
+		{dicomtag.PatientID, "", "1234567", true},
+		{dicomtag.PatientID, "*", "1234567", true},
+		{dicomtag.PatientID, "  ", "1234567", true},
+		// Single value matching.
+		{dicomtag.PatientID, "1234567", "1234567", true},
+		{dicomtag.PatientID, "1234568", "1234567", false},
+		{dicomtag.Modality, "ct", "CT", false},
+		{dicomtag.PatientName, "smith^john", "Smith^John", true},
+		// Wildcards.
+		{dicomtag.PatientName, "Smi*", "Smith^John", true},
+		{dicomtag.PatientName, "*John", "Smith^John", true},
+		{dicomtag.PatientName, "Sm?th*", "Smith^John", true},
+		{dicomtag.PatientName, "Jo*", "Smith^John", false},
+		{dicomtag.PatientName, "smi*", "Smith^John", true},
+		{dicomtag.AccessionNumber, "a*", "A000000001", false},
+		{dicomtag.AccessionNumber, "A1.3*", "A1.34", true},
+		{dicomtag.AccessionNumber, "A1.3*", "A1x34", false},
+		// Date ranges, both ends inclusive.
+		{dicomtag.ScheduledProcedureStepStartDate, "20240101-20240131", "20240115", true},
+		{dicomtag.ScheduledProcedureStepStartDate, "20240101-20240131", "20240101", true},
+		{dicomtag.ScheduledProcedureStepStartDate, "20240101-20240131", "20240131", true},
+		{dicomtag.ScheduledProcedureStepStartDate, "20240101-20240131", "20240201", false},
+		{dicomtag.ScheduledProcedureStepStartDate, "20240101-", "20991231", true},
+		{dicomtag.ScheduledProcedureStepStartDate, "20240101-", "20231231", false},
+		{dicomtag.ScheduledProcedureStepStartDate, "-20240101", "20231231", true},
+		{dicomtag.ScheduledProcedureStepStartDate, "-20240101", "20240102", false},
+		// Time ranges of a different precision than the value.
+		{dicomtag.ScheduledProcedureStepStartTime, "0800-1200", "113000", true},
+		{dicomtag.ScheduledProcedureStepStartTime, "0800-1200", "120059", true},
+		{dicomtag.ScheduledProcedureStepStartTime, "0800-1200", "121500", false},
+		{dicomtag.ScheduledProcedureStepStartTime, "0800-1200", "074500", false},
+		// A dash is only a range in dates and times.
+		{dicomtag.PatientID, "1-2", "1-2", true},
+		{dicomtag.PatientID, "1-2", "15", false},
+	}
+	for _, test := range tests {
+		f := dicom.MustNewElement(test.tag, test.filter)
+		if got := worklistMatchValue(f, test.value); got != test.want {
+			t.Errorf("worklistMatchValue(%v %q, %q) = %v, want %v",
+				dicomtag.DebugString(test.tag), test.filter, test.value, got, test.want)
+		}
+	}
+}
+
+func testWorklist() *worklist {
+	return &worklist{entries: []worklistEntry{
+		{
+			PatientName:      "Andersson^Anna",
+			PatientID:        "1000001",
+			AccessionNumber:  "A000000001",
+			StudyInstanceUID: "2.25.1",
+			Steps: []worklistStep{
+				{StationAETitle: "CT01", Modality: "CT", DayOffset: 0, StartTime: "083000", ID: "SPS1", Status: "SCHEDULED"},
+				{StationAETitle: "CT02", Modality: "CT", DayOffset: 1, StartTime: "140000", ID: "SPS2", Status: "SCHEDULED"},
+			},
+		},
+		{
+			PatientName:      "Smith^John",
+			PatientID:        "1000002",
+			AccessionNumber:  "A000000002",
+			StudyInstanceUID: "2.25.2",
+			Steps: []worklistStep{
+				{StationAETitle: "MR01", Modality: "MR", DayOffset: -1, StartTime: "100000", ID: "SPS3", Status: "SCHEDULED"},
+			},
+		},
+	}}
+}
+
+func stepFilter(elems ...*dicom.Element) *dicom.Element {
+	values := []interface{}{}
+	for _, e := range elems {
+		values = append(values, e)
+	}
+	return dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, dicom.MustNewElement(dicomtag.Item, values...))
+}
+
+func TestWorklistFind(t *testing.T) {
+	today := time.Now().Format("20060102")
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("20060102")
+	tests := []struct {
+		name    string
+		filters []*dicom.Element
+		want    []string // ScheduledProcedureStepIDs, in order
+	}{
+		{"universal", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.PatientName, ""),
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS1", "SPS2", "SPS3"}},
+		{"patient name wildcard", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.PatientName, "SMITH*"),
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS3"}},
+		{"modality", []*dicom.Element{
+			stepFilter(dicom.MustNewElement(dicomtag.Modality, "CT"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS1", "SPS2"}},
+		{"station AE title", []*dicom.Element{
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledStationAETitle, "CT02"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS2"}},
+		{"today", []*dicom.Element{
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, today),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS1"}},
+		{"date range", []*dicom.Element{
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, today+"-"+tomorrow),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS1", "SPS2"}},
+		{"time range", []*dicom.Element{
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartTime, "0900-1200"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, []string{"SPS3"}},
+		{"unknown attribute with a value", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.InstitutionName, "X"),
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, nil},
+		{"no match", []*dicom.Element{
+			dicom.MustNewElement(dicomtag.AccessionNumber, "B*"),
+			stepFilter(dicom.MustNewElement(dicomtag.ScheduledProcedureStepID, "")),
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, result := range testWorklist().find(test.filters, "test") {
+				seq, err := dicom.FindElementByTag(result, dicomtag.ScheduledProcedureStepSequence)
+				if err != nil {
+					t.Fatalf("result without ScheduledProcedureStepSequence: %v", result)
+				}
+				items := sequenceItems(seq)
+				if len(items) != 1 {
+					t.Fatalf("got %d ScheduledProcedureStepSequence items, want 1", len(items))
+				}
+				got = append(got, elementString(items[0], dicomtag.ScheduledProcedureStepID))
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got steps %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("got steps %v, want %v", got, test.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+// Only the attributes asked for are returned, unknown ones empty.
+func TestWorklistFindReturnKeys(t *testing.T) {
+	results := testWorklist().find([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientID, "1000002"),
+		dicom.MustNewElement(dicomtag.PatientName, ""),
+		dicom.MustNewElement(dicomtag.InstitutionName, ""),
+	}, "test")
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	result := results[0]
+	if len(result) != 3 {
+		t.Errorf("got %d attributes, want 3: %v", len(result), result)
+	}
+	if got := elementString(result, dicomtag.PatientName); got != "Smith^John" {
+		t.Errorf("PatientName = %q, want Smith^John", got)
+	}
+	if got := elementString(result, dicomtag.InstitutionName); got != "" {
+		t.Errorf("InstitutionName = %q, want empty", got)
+	}
+	if _, err := dicom.FindElementByTag(result, dicomtag.StudyInstanceUID); err == nil {
+		t.Errorf("StudyInstanceUID returned without being asked for")
+	}
+}
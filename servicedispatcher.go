@@ -3,8 +3,10 @@ package dicompot
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
 )
 
 // serviceDispatcher multiplexes statemachine upcall events to DIMSE commands.
@@ -25,9 +27,18 @@ type serviceDispatcher struct {
 	// The last message ID used in newCommand(). Used to avoid creating duplicate
 	// IDs.
 	lastMessageID dimse.MessageID
+
+	// Set by close. Guarded by mu.
+	closed bool
+	// Closed by close.
+	done chan struct{}
+
+	// Session record of a provider association, for the command history.
+	// Nil for ServiceUser and for connections served outside of Run.
+	session *providerSession
 }
 
-type serviceCallback func(msg dimse.Message, data []byte, cs *serviceCommandState)
+type serviceCallback func(msg dimse.Message, data *dimse.Data, cs *serviceCommandState)
 
 // Per-DIMSE-command state.
 type serviceCommandState struct {
@@ -38,6 +49,10 @@ type serviceCommandState struct {
 
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
+
+	// Set for requests from the peer. Their callbacks don't read upcallCh.
+	// Only touched by handleEvent.
+	remote bool
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
@@ -45,6 +60,8 @@ func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 	if s := cmd.GetStatus(); s != nil && s.Status != dimse.StatusSuccess && s.Status != dimse.StatusPending {
 	} else {
 	}
+	// Don't queue PDUs faster than the tarpit dribbles them.
+	cs.cm.tarpit.waitWritten(cs.disp.done)
 	payload := &stateEventDIMSEPayload{
 		abstractSyntaxName: cs.context.abstractSyntaxUID,
 		command:            cmd,
@@ -83,6 +100,9 @@ func (disp *serviceDispatcher) newCommand(
 	cm *contextManager, context contextManagerEntry) (*serviceCommandState, error) {
 	disp.mu.Lock()
 	defer disp.mu.Unlock()
+	if disp.closed {
+		return nil, fmt.Errorf("dicom.serviceDispatcher(%s): Connection closed", disp.label)
+	}
 
 	for msgID := disp.lastMessageID + 1; msgID != disp.lastMessageID; msgID++ {
 		if _, ok := disp.activeCommands[msgID]; ok {
@@ -105,11 +125,16 @@ func (disp *serviceDispatcher) newCommand(
 
 func (disp *serviceDispatcher) deleteCommand(cs *serviceCommandState) {
 	disp.mu.Lock()
-	if _, ok := disp.activeCommands[cs.messageID]; !ok {
-		panic(fmt.Sprintf("cs %+v", cs))
+	defer disp.mu.Unlock()
+	if disp.activeCommands[cs.messageID] != cs {
+		// Already gone, e.g. the peer reused the message ID.
+		logrus.WithFields(logrus.Fields{
+			"MessageID": cs.messageID,
+			"ID":        disp.label,
+		}).Warn("Unknown command")
+		return
 	}
 	delete(disp.activeCommands, cs.messageID)
-	disp.mu.Unlock()
 }
 
 func (disp *serviceDispatcher) registerCallback(commandField int, cb serviceCallback) {
@@ -128,37 +153,90 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	if event.eventType == upcallEventHandshakeCompleted {
 		return
 	}
-	doassert(event.eventType == upcallEventData)
-	doassert(event.command != nil)
+	if event.eventType != upcallEventData || event.command == nil {
+		event.data.Close()
+		disp.downcallCh <- stateEvent{event: evt19, pdu: nil,
+			err: fmt.Errorf("dicom.serviceDispatcher(%s): Unexpected event %v", disp.label, event.eventType)}
+		return
+	}
 	context, err := event.cm.lookupByContextID(event.contextID)
 	if err != nil {
+		event.data.Close()
 		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
 		return
 	}
 	messageID := event.command.GetMessageID()
 	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
 	if found {
-		dc.upcallCh <- event
+		if !dc.remote {
+			dc.upcallCh <- event
+			return
+		}
+		select {
+		case dc.upcallCh <- event:
+		default:
+			// Nobody reads the command: the peer keeps reusing the
+			// message ID of a request in progress.
+			event.data.Close()
+			disp.downcallCh <- stateEvent{event: evt19, pdu: nil,
+				err: fmt.Errorf("dicom.serviceDispatcher(%s): Too many messages for message ID %d", disp.label, messageID)}
+		}
 		return
 	}
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
 	disp.mu.Unlock()
+	if cb == nil {
+		// A response to nothing, or a request nobody serves.
+		event.data.Close()
+		disp.deleteCommand(dc)
+		disp.downcallCh <- stateEvent{event: evt19, pdu: nil,
+			err: fmt.Errorf("dicom.serviceDispatcher(%s): Unexpected DIMSE message %v", disp.label, event.command)}
+		return
+	}
+	dc.remote = true
 	go func() {
 		cb(event.command, event.data, dc)
+		event.data.Close()
 		disp.deleteCommand(dc)
 	}()
 }
 
-// Must be called exactly once to shut down the dispatcher.
+// Reports whether no DIMSE command is in progress.
+func (disp *serviceDispatcher) idle() bool {
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	return len(disp.activeCommands) == 0
+}
+
+// Shut down the dispatcher. Calls after the first have no effect.
 func (disp *serviceDispatcher) close() {
 	disp.mu.Lock()
+	if disp.closed {
+		disp.mu.Unlock()
+		return
+	}
+	disp.closed = true
+	close(disp.done)
 	for _, cs := range disp.activeCommands {
 		close(cs.upcallCh)
 	}
 	disp.mu.Unlock()
 }
 
+// Wait for "d", or until the association is over. Reports whether the whole
+// delay elapsed.
+func (disp *serviceDispatcher) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-disp.done:
+		return false
+	}
+}
+
 func newServiceDispatcher(label string) *serviceDispatcher {
 	return &serviceDispatcher{
 		label:          label,
@@ -166,5 +244,6 @@ func newServiceDispatcher(label string) *serviceDispatcher {
 		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
 		callbacks:      make(map[int]serviceCallback),
 		lastMessageID:  123,
+		done:           make(chan struct{}),
 	}
 }
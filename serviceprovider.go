@@ -3,9 +3,15 @@
 package dicompot
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	dicom "github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
@@ -17,14 +23,14 @@ import (
 type CMoveResult struct {
 	Remaining int // Number of files remaining to be sent. Set -1 if unknown.
 	Err       error
-	Path      string         // Path name of the DICOM file being copied. Used only for reporting errors.
-	DataSet   *dicom.DataSet // Contents of the file.
+	Path      string         // Path name of the DICOM file being copied.
+	DataSet   *dicom.DataSet // Contents of the file. If nil, C-GET sends the file at Path, through the PayloadCache.
 }
 
 func handleCStore(
 	cb CStoreCallback,
 	connState ConnectionState,
-	c *dimse.CStoreRq, data []byte,
+	c *dimse.CStoreRq, data *dimse.Data,
 	cs *serviceCommandState) {
 	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
 
@@ -34,7 +40,8 @@ func handleCStore(
 			cs.context.transferSyntaxUID,
 			c.AffectedSOPClassUID,
 			c.AffectedSOPInstanceUID,
-			data)
+			data.Reader(),
+			data.Size())
 	}
 	resp := &dimse.CStoreRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -44,6 +51,7 @@ func handleCStore(
 		Status:                    status,
 	}
 	cs.sendMessage(resp, nil)
+	recordCommand(cs, "C-STORE", status)
 
 	logrus.WithFields(logrus.Fields{
 		"Type": "We don't like that",
@@ -57,23 +65,23 @@ func handleCFind(
 	c *dimse.CFindRq, data []byte,
 	cs *serviceCommandState) {
 
-	if params.CFind == nil {
+	sendError := func(comment string) {
+		status := dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: comment}
 		cs.sendMessage(&dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
 			CommandDataSetType:        dimse.CommandDataSetTypeNull,
-			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for C-FIND"},
+			Status:                    status,
 		}, nil)
+		recordCommand(cs, "C-FIND", status)
+	}
+	if params.CFind == nil {
+		sendError("No callback found for C-FIND")
 		return
 	}
 	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
 	if err != nil {
-		cs.sendMessage(&dimse.CFindRsp{
-			AffectedSOPClassUID:       c.AffectedSOPClassUID,
-			MessageIDBeingRespondedTo: c.MessageID,
-			CommandDataSetType:        dimse.CommandDataSetTypeNull,
-			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: err.Error()},
-		}, nil)
+		sendError(err.Error())
 		return
 	}
 
@@ -102,12 +110,19 @@ func handleCFind(
 			break
 		}
 
+		if delay := cs.cm.tarpit.cFindDelay(); delay > 0 && !cs.disp.sleep(delay) {
+			// The association is over.
+			for range responseCh {
+			}
+			return
+		}
 		cs.sendMessage(&dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
 			CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
 			Status:                    dimse.Status{Status: dimse.StatusPending},
 		}, payload)
+		metricCFindMatches.Inc()
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -120,6 +135,7 @@ func handleCFind(
 		MessageIDBeingRespondedTo: c.MessageID,
 		CommandDataSetType:        dimse.CommandDataSetTypeNull,
 		Status:                    status}, nil)
+	recordCommand(cs, "C-FIND", status)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -136,26 +152,23 @@ func handleCMove(
 		"ID":      cs.cm.label,
 	}).Info("Received")
 
-	sendError := func(err error) {
+	sendError := func(comment string) {
+		status := dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: comment}
 		cs.sendMessage(&dimse.CMoveRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
 			CommandDataSetType:        dimse.CommandDataSetTypeNull,
-			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: err.Error()},
+			Status:                    status,
 		}, nil)
+		recordCommand(cs, "C-MOVE", status)
 	}
 	if params.CMove == nil {
-		cs.sendMessage(&dimse.CMoveRsp{
-			AffectedSOPClassUID:       c.AffectedSOPClassUID,
-			MessageIDBeingRespondedTo: c.MessageID,
-			CommandDataSetType:        dimse.CommandDataSetTypeNull,
-			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for C-MOVE"},
-		}, nil)
+		sendError("No callback found for C-MOVE")
 		return
 	}
 	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
 	if err != nil {
-		sendError(err)
+		sendError(err.Error())
 		return
 	}
 	var sessionID string = cs.cm.label
@@ -191,6 +204,7 @@ func handleCMove(
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
 		Status:                         status}, nil)
+	recordCommand(cs, "C-MOVE", status)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -201,27 +215,24 @@ func handleCGet(
 	connState ConnectionState,
 
 	c *dimse.CGetRq, data []byte, cs *serviceCommandState) {
-	sendError := func(err error) {
+	sendError := func(comment string) {
+		status := dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: comment}
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
 			CommandDataSetType:        dimse.CommandDataSetTypeNull,
-			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: err.Error()},
+			Status:                    status,
 		}, nil)
+		recordCommand(cs, "C-GET", status)
 	}
 
 	if params.CGet == nil {
-		cs.sendMessage(&dimse.CGetRsp{
-			AffectedSOPClassUID:       c.AffectedSOPClassUID,
-			MessageIDBeingRespondedTo: c.MessageID,
-			CommandDataSetType:        dimse.CommandDataSetTypeNull,
-			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for C-GET"},
-		}, nil)
+		sendError("No callback found for C-GET")
 		return
 	}
 	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
 	if err != nil {
-		sendError(err)
+		sendError(err.Error())
 		return
 	}
 
@@ -249,11 +260,16 @@ func handleCGet(
 			break
 		}
 
-		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		if resp.DataSet != nil {
+			err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		} else {
+			err = runCStoreFileOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, params.PayloadCache, resp.Path)
+		}
 		if err != nil {
 			numFailures++
 		} else {
 			numSuccesses++
+			metricRetrievedInstances.WithLabelValues("C-GET").Inc()
 		}
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
@@ -273,6 +289,7 @@ func handleCGet(
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
 		Status:                         status}, nil)
+	recordCommand(cs, "C-GET", status)
 
 	logrus.WithFields(logrus.Fields{
 		"Command": "C-GET",
@@ -285,6 +302,189 @@ func handleCGet(
 	}
 }
 
+// Wrap a callback of a request whose data is read into memory: everything
+// but C-STORE. The association is aborted if the data can't be read.
+func withDataBytes(cb func(msg dimse.Message, data []byte, cs *serviceCommandState)) serviceCallback {
+	return func(msg dimse.Message, data *dimse.Data, cs *serviceCommandState) {
+		b, err := data.Bytes()
+		if err != nil {
+			cs.disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+			return
+		}
+		cb(msg, b, cs)
+	}
+}
+
+// Name of a DIMSE-N request, for logging.
+func nServiceCommandName(msg dimse.Message) string {
+	switch msg.(type) {
+	case *dimse.NEventReportRq:
+		return "N-EVENT-REPORT"
+	case *dimse.NGetRq:
+		return "N-GET"
+	case *dimse.NSetRq:
+		return "N-SET"
+	case *dimse.NActionRq:
+		return "N-ACTION"
+	case *dimse.NCreateRq:
+		return "N-CREATE"
+	case *dimse.NDeleteRq:
+		return "N-DELETE"
+	}
+	return fmt.Sprintf("0x%x", msg.CommandField())
+}
+
+// Build the response message for a DIMSE-N request.
+func newNServiceResponse(msg dimse.Message, sopClassUID, sopInstanceUID string, status dimse.Status, hasData bool) (dimse.Message, error) {
+	dataSetType := dimse.CommandDataSetTypeNull
+	if hasData {
+		dataSetType = dimse.CommandDataSetTypeNonNull
+	}
+	switch c := msg.(type) {
+	case *dimse.NEventReportRq:
+		return &dimse.NEventReportRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			EventTypeID:               c.EventTypeID,
+			Status:                    status,
+		}, nil
+	case *dimse.NGetRq:
+		return &dimse.NGetRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}, nil
+	case *dimse.NSetRq:
+		return &dimse.NSetRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}, nil
+	case *dimse.NActionRq:
+		return &dimse.NActionRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			ActionTypeID:              c.ActionTypeID,
+			Status:                    status,
+		}, nil
+	case *dimse.NCreateRq:
+		return &dimse.NCreateRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}, nil
+	case *dimse.NDeleteRq:
+		return &dimse.NDeleteRsp{
+			AffectedSOPClassUID:       sopClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dataSetType,
+			AffectedSOPInstanceUID:    sopInstanceUID,
+			Status:                    status,
+		}, nil
+	}
+	return nil, fmt.Errorf("dicom.newNServiceResponse: not a DIMSE-N request: %v", msg)
+}
+
+// Extract the SOP class and instance UIDs a DIMSE-N request refers to.
+func nServiceTarget(msg dimse.Message) (sopClassUID, sopInstanceUID string) {
+	switch c := msg.(type) {
+	case *dimse.NEventReportRq:
+		return c.AffectedSOPClassUID, c.AffectedSOPInstanceUID
+	case *dimse.NGetRq:
+		return c.RequestedSOPClassUID, c.RequestedSOPInstanceUID
+	case *dimse.NSetRq:
+		return c.RequestedSOPClassUID, c.RequestedSOPInstanceUID
+	case *dimse.NActionRq:
+		return c.RequestedSOPClassUID, c.RequestedSOPInstanceUID
+	case *dimse.NCreateRq:
+		return c.AffectedSOPClassUID, c.AffectedSOPInstanceUID
+	case *dimse.NDeleteRq:
+		return c.RequestedSOPClassUID, c.RequestedSOPInstanceUID
+	}
+	return "", ""
+}
+
+func handleNService(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	msg dimse.Message, data []byte,
+	cs *serviceCommandState) {
+	sopClassUID, sopInstanceUID := nServiceTarget(msg)
+
+	logrus.WithFields(logrus.Fields{
+		"Command":  nServiceCommandName(msg),
+		"SOPClass": sopClassUID,
+		"ID":       cs.cm.label,
+	}).Info("Received")
+
+	// The dispatcher only routes DIMSE-N requests here; anything else is
+	// a protocol error, and aborts the association.
+	if _, err := newNServiceResponse(msg, sopClassUID, sopInstanceUID, dimse.Success, false); err != nil {
+		cs.disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+		return
+	}
+	sendResponse := func(status dimse.Status, payload []byte) {
+		rsp, err := newNServiceResponse(msg, sopClassUID, sopInstanceUID, status, payload != nil)
+		if err != nil {
+			cs.disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+			return
+		}
+		cs.sendMessage(rsp, payload)
+		recordCommand(cs, nServiceCommandName(msg), status)
+	}
+	sendStatus := func(status dimse.Status) {
+		sendResponse(status, nil)
+	}
+	cb := params.NServices[sopClassUID]
+	if cb == nil {
+		sendStatus(dimse.Status{Status: dimse.StatusNoSuchSOPClass, ErrorComment: "No callback found for " + nServiceCommandName(msg)})
+		return
+	}
+	var elems []*dicom.Element
+	if len(data) > 0 {
+		var err error
+		elems, err = decodeElementsInBytes(data, cs.context.transferSyntaxUID)
+		if err != nil {
+			sendStatus(dimse.Status{Status: dimse.StatusProcessingFailure, ErrorComment: err.Error()})
+			return
+		}
+	}
+	result := cb(connState, cs.context.transferSyntaxUID, msg, elems, cs.cm.label)
+	if result.SOPInstanceUID != "" {
+		sopInstanceUID = result.SOPInstanceUID
+	}
+	var payload []byte
+	if len(result.Elements) > 0 {
+		var err error
+		payload, err = writeElementsToBytes(result.Elements, cs.context.transferSyntaxUID)
+		if err != nil {
+			sendStatus(dimse.Status{Status: dimse.StatusProcessingFailure, ErrorComment: err.Error()})
+			return
+		}
+	}
+	sendResponse(result.Status, payload)
+
+	if result.EventReport != nil {
+		err := runNEventReportOnAssociation(cs, result.EventReport)
+		logrus.WithFields(logrus.Fields{
+			"Command": "N-EVENT-REPORT",
+			"Event":   result.EventReport.EventTypeID,
+			"Error":   err,
+			"ID":      cs.cm.label,
+		}).Info("Sent")
+	}
+}
+
 func handleCEcho(
 	params ServiceProviderParams,
 	connState ConnectionState,
@@ -307,6 +507,7 @@ func handleCEcho(
 	}).Info("Received")
 
 	cs.sendMessage(resp, nil)
+	recordCommand(cs, "C-ECHO", status)
 }
 
 // ServiceProviderParams defines parameters for ServiceProvider.
@@ -317,6 +518,10 @@ type ServiceProviderParams struct {
 	// Enforce AETitle, default accept any
 	Enforce string
 
+	// Access binds calling AE titles to source addresses and services. Nil
+	// allows any client to use all services.
+	Access *AccessPolicy
+
 	// Names of remote AEs and their host:ports. Used only by C-MOVE. This
 	// map should be nonempty iff the server supports CMove.
 	RemoteAEs map[string]string
@@ -339,17 +544,70 @@ type ServiceProviderParams struct {
 
 	// If CStoreCallback=nil, a C-STORE call will produce an error response.
 	CStore CStoreCallback
+
+	// NServices maps a SOP class UID to the handler for DIMSE-N requests
+	// (N-EVENT-REPORT, N-GET, N-SET, N-ACTION, N-CREATE, N-DELETE) on that
+	// class. A request for a class without a handler produces a
+	// StatusNoSuchSOPClass response.
+	NServices map[string]NServiceCallback
+
+	// EventSinks receive every event logged by the process, in addition to
+	// the logrus output. Each sink buffers up to EventBufferSize events
+	// (default 4096); further events are dropped while it is behind.
+	EventSinks      []EventSink
+	EventBufferSize int
+
+	// ARTIMTimeout is the duration of the ARTIM timer, which limits the wait
+	// for an A-ASSOCIATE-RQ after connect and for the peer to close the
+	// connection after an A-ABORT or A-RELEASE-RP. Default: 10s.
+	ARTIMTimeout time.Duration
+	// IdleTimeout aborts an association after this long without a PDU from
+	// the peer. Zero means no limit.
+	IdleTimeout time.Duration
+	// ReadTimeout aborts an association when a PDU takes longer than this to
+	// arrive once its first byte was received. Zero means no limit.
+	ReadTimeout time.Duration
+
+	// Tarpit slows down the clients selected by the policy. Nil disables
+	// the tarpit.
+	Tarpit *TarpitPolicy
+
+	// FingerprintSignatures name the tools behind the client fingerprints
+	// logged for each association. See ParseFingerprintSignatures.
+	FingerprintSignatures []FingerprintSignature
+
+	// Lure accepts some of the associations Enforce would reject. Nil
+	// disables the lure.
+	Lure *LurePolicy
+
+	// PayloadCache keeps the files sent by C-GET for the CMoveResults
+	// without a DataSet. Nil streams every file from disk.
+	PayloadCache *PayloadCache
+
+	// Data payloads received past SpillThreshold bytes are written to
+	// temp files in SpillDir (os.TempDir() if empty) instead of held in
+	// memory. Zero keeps them in memory.
+	SpillThreshold int64
+	SpillDir       string
+	// Max bytes of data held for one association and for all of them, in
+	// memory or temp files, until the callbacks return. An association
+	// going past either is aborted. Zero means no limit.
+	MaxAssociationBytes int64
+	MaxInFlightBytes    int64
 }
 
 // DefaultMaxPDUSize is the the PDU size advertized.
 const DefaultMaxPDUSize = 4 << 20
 
+// CStoreCallback implements a C-STORE handler. "data" reads the "size" bytes
+// of the dataset; it is only valid until the callback returns.
 type CStoreCallback func(
 	conn ConnectionState,
 	transferSyntaxUID string,
 	sopClassUID string,
 	sopInstanceUID string,
-	data []byte) dimse.Status
+	data io.Reader,
+	size int64) dimse.Status
 
 // CFindCallback implements a C-FIND handler
 type CFindCallback func(
@@ -369,8 +627,51 @@ type CMoveCallback func(
 	sessionID string,
 	ch chan CMoveResult)
 
+// NServiceResult is returned by an NServiceCallback.
+type NServiceResult struct {
+	Status dimse.Status
+	// SOPInstanceUID is reported as the AffectedSOPInstanceUID of the
+	// response. If empty, the instance UID of the request is used. N-CREATE
+	// handlers set it when the requestor leaves the UID to the provider.
+	SOPInstanceUID string
+	// Elements is the optional dataset sent along with the response.
+	Elements []*dicom.Element
+	// EventReport, if set, is sent to the requestor as an N-EVENT-REPORT
+	// request on the same association once the response is out.
+	EventReport *NEventReport
+}
+
+// NEventReport is an N-EVENT-REPORT request issued by the provider, e.g. the
+// result of a Storage Commitment request.
+type NEventReport struct {
+	SOPClassUID    string
+	SOPInstanceUID string
+	EventTypeID    uint16
+	Elements       []*dicom.Element
+}
+
+// NServiceCallback implements a DIMSE-N handler for one SOP class. "msg" is
+// one of dimse.N{EventReport,Get,Set,Action,Create,Delete}Rq, and "elems" is
+// the decoded dataset that came with it (nil if none).
+type NServiceCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	msg dimse.Message,
+	elems []*dicom.Element,
+	sessionID string) NServiceResult
+
 // ConnectionState informs session state to callbacks.
 type ConnectionState struct {
+	// RemoteAddr is the network address of the peer.
+	RemoteAddr net.Addr
+
+	// AE titles proposed by the peer in A-ASSOCIATE-RQ.
+	CallingAETitle string
+	CalledAETitle  string
+
+	// PostBruteForce is set if the association was accepted by the
+	// LurePolicy, despite a wrong called AE title.
+	PostBruteForce bool
 }
 
 // CEchoCallback implements C-ECHO callback.
@@ -382,8 +683,24 @@ type ServiceProvider struct {
 	listener net.Listener
 	// Label is a unique string used in log messages to identify this provider.
 	label string
+
+	mu        sync.Mutex
+	sessions  map[string]*providerSession // Active associations, keyed by ID.
+	deniedIPs map[string]bool             // Connections from these are closed right away.
+
+	events     *eventDispatcher  // nil if there are no EventSinks.
+	tarpit     *tarpit           // nil if there is no TarpitPolicy.
+	inFlight   *dimse.ByteBudget // Data held by all the associations.
+	signatures *signatureDB
+	aeTitles   *aeTitleTracker // AE titles tried by clients.
+
+	closing bool           // Set by Shutdown and Close, guarded by mu.
+	conns   sync.WaitGroup // Connections being served by Run.
 }
 
+// ErrServiceProviderClosed is returned by Run after Shutdown or Close.
+var ErrServiceProviderClosed = errors.New("dicom.serviceProvider: closed")
+
 func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
 	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
 	for _, elem := range elems {
@@ -395,7 +712,11 @@ func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]b
 	return dataEncoder.Bytes(), nil
 }
 
-func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
+// Like readElementsInBytes, but without the C-FIND search logging.
+func decodeElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
+	if err := dimse.CheckElementLengths(data, transferSyntaxUID); err != nil {
+		return nil, err
+	}
 	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
 	var elems []*dicom.Element
 	for !decoder.EOF() {
@@ -403,19 +724,35 @@ func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Elemen
 		if decoder.Error() != nil {
 			break
 		}
+		elems = append(elems, elem)
+	}
+	if decoder.Error() != nil {
+		return nil, decoder.Error()
+	}
+	return elems, nil
+}
 
-		re := regexp.MustCompile(`\[([^\[\]]*)\]`)
-		searchTerm := re.FindAllString(elem.String(), -1)
+// Matches the bracketed parts of dicom.Element.String(): the keyword and the
+// values.
+var searchTermRegexp = regexp.MustCompile(`\[([^\[\]]*)\]`)
 
-		searchTerm[0] = strings.Trim(searchTerm[0], "[")
-		searchTerm[0] = strings.Trim(searchTerm[0], "]")
-		searchTerm[1] = strings.Trim(searchTerm[1], "[")
-		searchTerm[1] = strings.Trim(searchTerm[1], "]")
+func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
+	if err := dimse.CheckElementLengths(data, transferSyntaxUID); err != nil {
+		return nil, err
+	}
+	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
+	var elems []*dicom.Element
+	for !decoder.EOF() {
+		elem := dicom.ReadElement(decoder, dicom.ReadOptions{})
+		if decoder.Error() != nil {
+			break
+		}
 
-		if searchTerm[1] != "" && searchTerm[1] != "ISO_IR 100" && searchTerm[1] != "STUDY" {
+		searchTerm := searchTermRegexp.FindAllStringSubmatch(elem.String(), 2)
+		if len(searchTerm) == 2 && searchTerm[1][1] != "" && searchTerm[1][1] != "ISO_IR 100" && searchTerm[1][1] != "STUDY" {
 			logrus.WithFields(logrus.Fields{
-				"Type": searchTerm[0],
-				"Term": searchTerm[1],
+				"Type": searchTerm[0][1],
+				"Term": searchTerm[1][1],
 				"ID":   attackID,
 			}).Info("C-FIND Search")
 		}
@@ -431,8 +768,13 @@ func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Elemen
 // NewServiceProvider creates a new DICOM server object.
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
 	sp := &ServiceProvider{
-		params: params,
-		label:  newUID(),
+		params:     params,
+		label:      newUID(),
+		sessions:   make(map[string]*providerSession),
+		deniedIPs:  make(map[string]bool),
+		signatures: newSignatureDB(params.FingerprintSignatures),
+		aeTitles:   newAETitleTracker(params.Lure),
+		inFlight:   dimse.NewByteBudget("in-flight", params.MaxInFlightBytes, nil),
 	}
 
 	var err error
@@ -441,17 +783,43 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	if err != nil {
 		return nil, err
 	}
+	if params.Tarpit != nil {
+		sp.tarpit = newTarpit(*params.Tarpit)
+	}
+	if len(params.EventSinks) > 0 {
+		sp.events = newEventDispatcher(params.EventSinks, params.EventBufferSize)
+		logrus.AddHook(sp.events)
+	}
 	return sp, nil
 }
 
-func getConnState(conn net.Conn) (cs ConnectionState) {
-	return
+func getConnState(conn net.Conn, cm *contextManager) ConnectionState {
+	if cm == nil {
+		return ConnectionState{RemoteAddr: conn.RemoteAddr()}
+	}
+	return ConnectionState{
+		RemoteAddr:     conn.RemoteAddr(),
+		CallingAETitle: cm.callingAETitle,
+		CalledAETitle:  cm.calledAETitle,
+		PostBruteForce: cm.postBruteForce,
+	}
 }
 
 var attackID string
 
 // RunProviderForConn starts threads for running a DICOM server on "conn".
+// params.Tarpit applies to the connection alone: its IPs and CallingAETitles
+// are honored, but scores and repeat offenses are only kept across the
+// connections of a ServiceProvider.
 func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
+	runProviderForConn(conn, params, nil)
+}
+
+// Serve "conn". If "sp" is non-nil, the session is registered with it while
+// active.
+func runProviderForConn(conn net.Conn, params ServiceProviderParams, sp *ServiceProvider) {
+	start := time.Now()
+	conn = meteredConn{conn}
 
 	var clientAETitle = params.AETitle
 	var enforce = params.Enforce
@@ -463,38 +831,99 @@ func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 
 	attackID = label
 
+	if sp != nil {
+		disp.session = &providerSession{
+			id:     label,
+			conn:   conn,
+			start:  start,
+			disp:   disp,
+			tarpit: sp.tarpit,
+		}
+		sp.addSession(disp.session)
+		defer sp.removeSession(label)
+	}
+
 	RemoteAddress := conn.RemoteAddr()
 	IPPort := strings.Split(RemoteAddress.String(), ":")
 	logrus.WithFields(logrus.Fields{
-		"IP":   IPPort[0],
-		"Port": IPPort[1],
-		"ID":   label,
+		"Protocol": "DIMSE",
+		"IP":       IPPort[0],
+		"Port":     IPPort[1],
+		"ID":       label,
 	}).Warn("Connection from")
 
 	disp.registerCallback(dimse.CommandFieldCStoreRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCStore(params.CStore, getConnState(conn), msg.(*dimse.CStoreRq), data, cs)
-		})
+		withAccessCheck(func(msg dimse.Message, data *dimse.Data, cs *serviceCommandState) {
+			handleCStore(params.CStore, getConnState(conn, cs.cm), msg.(*dimse.CStoreRq), data, cs)
+		}))
 	disp.registerCallback(dimse.CommandFieldCFindRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCFind(params, getConnState(conn), msg.(*dimse.CFindRq), data, cs)
-		})
+		withAccessCheck(withDataBytes(func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleCFind(params, getConnState(conn, cs.cm), msg.(*dimse.CFindRq), data, cs)
+		})))
 
 	disp.registerCallback(dimse.CommandFieldCMoveRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCMove(params, getConnState(conn), msg.(*dimse.CMoveRq), data, cs)
-		})
+		withAccessCheck(withDataBytes(func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleCMove(params, getConnState(conn, cs.cm), msg.(*dimse.CMoveRq), data, cs)
+		})))
 	disp.registerCallback(dimse.CommandFieldCGetRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCGet(params, getConnState(conn), msg.(*dimse.CGetRq), data, cs)
-		})
+		withAccessCheck(withDataBytes(func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleCGet(params, getConnState(conn, cs.cm), msg.(*dimse.CGetRq), data, cs)
+		})))
 	disp.registerCallback(dimse.CommandFieldCEchoRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCEcho(params, getConnState(conn), msg.(*dimse.CEchoRq), data, cs)
-		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label, clientAETitle, enforce)
+		withAccessCheck(withDataBytes(func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleCEcho(params, getConnState(conn, cs.cm), msg.(*dimse.CEchoRq), data, cs)
+		})))
+	for _, commandField := range []int{
+		dimse.CommandFieldNEventReportRq,
+		dimse.CommandFieldNGetRq,
+		dimse.CommandFieldNSetRq,
+		dimse.CommandFieldNActionRq,
+		dimse.CommandFieldNCreateRq,
+		dimse.CommandFieldNDeleteRq,
+	} {
+		disp.registerCallback(commandField,
+			withAccessCheck(withDataBytes(func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+				handleNService(params, getConnState(conn, cs.cm), msg, data, cs)
+			})))
+	}
+	timeouts := stateMachineTimeouts{
+		artim: params.ARTIMTimeout,
+		idle:  params.IdleTimeout,
+		read:  params.ReadTimeout,
+	}
+	var tp *tarpit
+	var sigs *signatureDB
+	var aeTitles *aeTitleTracker
+	var inFlight *dimse.ByteBudget
+	if sp != nil {
+		tp = sp.tarpit
+		sigs = sp.signatures
+		aeTitles = sp.aeTitles
+		inFlight = sp.inFlight
+	} else {
+		if params.Tarpit != nil {
+			tp = newTarpit(*params.Tarpit)
+		}
+		if len(params.FingerprintSignatures) > 0 {
+			sigs = newSignatureDB(params.FingerprintSignatures)
+		}
+		if params.Lure != nil {
+			aeTitles = newAETitleTracker(params.Lure)
+		}
+	}
+	budget := dimse.NewByteBudget("association", params.MaxAssociationBytes, inFlight)
+	defer budget.Close()
+	assembler := dimse.CommandAssembler{
+		SpillThreshold: params.SpillThreshold,
+		SpillDir:       params.SpillDir,
+		Budget:         budget,
+	}
+	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label, clientAETitle, enforce, params.Access, timeouts, tp, sigs, aeTitles, assembler)
 
 	for event := range upcallCh {
+		if event.eventType == upcallEventHandshakeCompleted && disp.session != nil {
+			disp.session.setContextManager(event.cm)
+		}
 		disp.handleEvent(event)
 	}
 
@@ -503,23 +932,173 @@ func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 		"ID":     label,
 	}).Warn("Connection")
 	disp.close()
+	metricAssociationDuration.Observe(time.Since(start).Seconds())
 }
 
 // Run listens to incoming connections,
-func (sp *ServiceProvider) Run() {
-
+func (sp *ServiceProvider) Run() error {
+	var delay time.Duration // Backoff after failed Accept calls.
 	for {
 		conn, err := sp.listener.Accept()
 		if err != nil {
+			if sp.isClosing() {
+				return ErrServiceProviderClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// Typically out of file descriptors. Retry after a while.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logrus.WithFields(logrus.Fields{
+				"Error": err,
+				"Retry": delay,
+			}).Error("Accept")
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		metricTCPConnections.Inc()
+		if sp.isDenied(conn.RemoteAddr()) {
+			logrus.WithFields(logrus.Fields{
+				"Protocol": "DIMSE",
+				"IP":       conn.RemoteAddr().String(),
+				"Status":   "Denied",
+			}).Warn("Connection from")
+			observeConnectionDenied()
+			conn.Close()
 			continue
 		}
+		sp.mu.Lock()
+		if sp.closing {
+			sp.mu.Unlock()
+			conn.Close()
+			return ErrServiceProviderClosed
+		}
+		sp.conns.Add(1)
+		sp.mu.Unlock()
 		go func() {
-
-			RunProviderForConn(conn, sp.params)
+			defer sp.conns.Done()
+			runProviderForConn(conn, sp.params, sp)
 		}()
 	}
 }
 
+func (sp *ServiceProvider) isClosing() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.closing
+}
+
+// Stop accepting connections. Returns false if already stopped.
+func (sp *ServiceProvider) stopListening() (bool, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.closing {
+		return false, nil
+	}
+	sp.closing = true
+	return true, sp.listener.Close()
+}
+
+// Shutdown stops accepting connections and releases the active
+// associations: each one gets an A-RELEASE-RQ once its DIMSE commands have
+// completed. Connections still waiting for an A-ASSOCIATE-RQ are closed. When
+// all associations are gone, the buffered events are flushed to the
+// EventSinks. If ctx expires first, the remaining associations are aborted
+// and ctx.Err() is returned. Run returns ErrServiceProviderClosed.
+func (sp *ServiceProvider) Shutdown(ctx context.Context) error {
+	first, err := sp.stopListening()
+	if first {
+		logrus.WithFields(logrus.Fields{
+			"Sessions": len(sp.activeSessions()),
+		}).Warn("Shutdown")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sp.conns.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		sp.releaseIdleSessions()
+		select {
+		case <-done:
+			sp.closeEvents()
+			return err
+		case <-ctx.Done():
+			sp.abortSessions()
+			sp.closeEvents()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops accepting connections and aborts the active associations
+// without waiting for their commands. Buffered events are flushed to the
+// EventSinks.
+func (sp *ServiceProvider) Close() error {
+	_, err := sp.stopListening()
+	sp.abortSessions()
+	sp.closeEvents()
+	return err
+}
+
+func (sp *ServiceProvider) releaseIdleSessions() {
+	for _, s := range sp.activeSessions() {
+		s.mu.Lock()
+		if s.released || s.cm != nil && !s.disp.idle() {
+			s.mu.Unlock()
+			continue
+		}
+		s.released = true
+		event := evt15
+		if s.cm != nil {
+			event = evt11
+		}
+		s.mu.Unlock()
+		go func(s *providerSession) {
+			if err := s.signal(event); err != nil {
+				// Try again on the next call, unless the session is gone.
+				s.mu.Lock()
+				s.released = false
+				s.mu.Unlock()
+			}
+		}(s)
+	}
+}
+
+func (sp *ServiceProvider) abortSessions() {
+	var wg sync.WaitGroup
+	for _, s := range sp.activeSessions() {
+		wg.Add(1)
+		go func(s *providerSession) {
+			defer wg.Done()
+			fields := logrus.Fields{
+				"Status": "Aborted by shutdown",
+				"ID":     s.id,
+			}
+			if err := s.signal(evt15); err != nil {
+				fields["Error"] = err
+			}
+			logrus.WithFields(fields).Warn("Connection")
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (sp *ServiceProvider) closeEvents() {
+	if sp.events != nil {
+		sp.events.close()
+	}
+}
+
 // ListenAddr returns the TCP address that the server is listening on
 func (sp *ServiceProvider) ListenAddr() net.Addr {
 
@@ -0,0 +1,41 @@
+package dicompot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nsmfoo/dicompot/dimse"
+)
+
+// The client releases the association while Shutdown releases it too: both
+// A-RELEASE-RQs cross on the wire.
+func TestShutdownReleaseCollision(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		sp, err := NewServiceProvider(ServiceProviderParams{
+			AETitle: "DICOMPOT",
+			CEcho:   func(ConnectionState) dimse.Status { return dimse.Success },
+		}, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sp.Run()
+		su, err := NewServiceUser(ServiceUserParams{CalledAETitle: "DICOMPOT", SOPClasses: []string{testVerificationSOPClass}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := su.Connect(sp.listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		if err := su.CEcho(); err != nil {
+			t.Fatal(err)
+		}
+		su.Release()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = sp.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	}
+}
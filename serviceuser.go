@@ -5,8 +5,8 @@ package dicompot
 //go:generate stringer -type QRLevel
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"sync"
 
@@ -26,9 +26,10 @@ const (
 )
 
 // ServiceUser encapsulates implements the client side of DICOM network protocol.
-// The ServiceUser class is thread compatible. That is, you cannot call C*
-// methods - say CStore and CFind requests - concurrently from two goroutines.
-// You must wait for CStore to finish before issuing CFind.
+// The ServiceUser class is thread safe. The association runs one command at a
+// time, as no asynchronous operations are negotiated: C* methods called
+// concurrently from two goroutines wait for each other. Use an
+// AssociationPool to run commands in parallel.
 type ServiceUser struct {
 	label    string // For  logging
 	upcallCh chan upcallEvent
@@ -37,10 +38,14 @@ type ServiceUser struct {
 	cond *sync.Cond // Broadcast when status changes.
 	disp *serviceDispatcher
 
+	// Holds a token while a command runs.
+	commandCh chan struct{}
+
 	// Following fields are guarded by mu.
-	status serviceUserStatus
-	cm     *contextManager // Set only after the handshake completes.
-	// activeCommands map[uint16]*userCommandState // List of commands running
+	status     serviceUserStatus
+	connecting bool            // Set by Connect or SetConn.
+	released   bool            // Set by Release.
+	cm         *contextManager // Set only after the handshake completes.
 }
 
 // ServiceUserParams defines parameters for a ServiceUser.
@@ -60,6 +65,11 @@ type ServiceUserParams struct {
 	// Otherwise, you'll need to re-encode the data w/ the given transfer
 	// syntax yourself.
 	TransferSyntaxes []string
+
+	// SOP classes, among SOPClasses, for which the client proposes to take
+	// the SCP role, e.g. to send the N-EVENT-REPORT of Storage Commitment
+	// on a new association. P3.7, D.3.3.4.
+	SCPRoleSOPClasses []string
 }
 
 func validateServiceUserParams(params *ServiceUserParams) error {
@@ -96,27 +106,25 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 	mu := &sync.Mutex{}
 	label := newUID()
 	su := &ServiceUser{
-		label:    label,
-		upcallCh: make(chan upcallEvent, 128),
-		disp:     newServiceDispatcher(label),
-		mu:       mu,
-		cond:     sync.NewCond(mu),
-		status:   serviceUserInitial,
+		label:     label,
+		upcallCh:  make(chan upcallEvent, 128),
+		disp:      newServiceDispatcher(label),
+		mu:        mu,
+		cond:      sync.NewCond(mu),
+		commandCh: make(chan struct{}, 1),
+		status:    serviceUserInitial,
 	}
 	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label)
 	go func() {
 		for event := range su.upcallCh {
 			if event.eventType == upcallEventHandshakeCompleted {
 				su.mu.Lock()
-				doassert(su.cm == nil)
 				su.status = serviceUserAssociationActive
 				su.cond.Broadcast()
 				su.cm = event.cm
-				doassert(su.cm != nil)
 				su.mu.Unlock()
 				continue
 			}
-			doassert(event.eventType == upcallEventData)
 			su.disp.handleEvent(event)
 		}
 		su.disp.close()
@@ -128,10 +136,30 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 	return su, nil
 }
 
-func (su *ServiceUser) waitUntilReady() error {
+// Wait for the association handshake. If ctx expires first, the association is
+// aborted.
+func (su *ServiceUser) waitUntilReadyContext(ctx context.Context) error {
 	su.mu.Lock()
 	defer su.mu.Unlock()
+	if su.status <= serviceUserInitial && ctx.Done() != nil {
+		// sync.Cond can't select on ctx, wake up the waiter instead.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				su.mu.Lock()
+				su.cond.Broadcast()
+				su.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
 	for su.status <= serviceUserInitial {
+		if err := ctx.Err(); err != nil {
+			su.abort()
+			return err
+		}
 		su.cond.Wait()
 	}
 	if su.status != serviceUserAssociationActive {
@@ -140,36 +168,129 @@ func (su *ServiceUser) waitUntilReady() error {
 	return nil
 }
 
-// Connect connects to the server at the given "host:port". Either Connect or
-// SetConn must be before calling CStore, etc.
-func (su *ServiceUser) Connect(serverAddr string) {
-	if su.status != serviceUserInitial {
-		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", su.status))
+// Wait for the command in progress to finish. The caller must call
+// unlockCommand once done. If ctx expires first, ctx.Err() is returned; the
+// association is left alone, as the command in progress is not ours.
+func (su *ServiceUser) lockCommand(ctx context.Context) error {
+	select {
+	case su.commandCh <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	conn, err := net.Dial("tcp", serverAddr)
+}
+
+func (su *ServiceUser) unlockCommand() {
+	<-su.commandCh
+}
+
+// Wait for the association handshake, then for the command in progress.
+func (su *ServiceUser) startCommand(ctx context.Context) error {
+	if err := su.waitUntilReadyContext(ctx); err != nil {
+		return err
+	}
+	return su.lockCommand(ctx)
+}
+
+// Reports whether the association is established and not released yet.
+func (su *ServiceUser) active() bool {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.status == serviceUserAssociationActive && !su.released
+}
+
+// Send an A-ABORT and let the state machine close the connection. Called when
+// a context expires. The goroutines started by NewServiceUser exit once the
+// state machine is done.
+func (su *ServiceUser) abort() {
+	select {
+	case su.disp.downcallCh <- stateEvent{event: evt15}:
+	default:
+	}
+}
+
+// Connect connects to the server at the given "host:port" and waits until the
+// association is established. Either Connect or SetConn must be before
+// calling CStore, etc.
+func (su *ServiceUser) Connect(serverAddr string) error {
+	return su.ConnectContext(context.Background(), serverAddr)
+}
+
+// ConnectContext connects to the server at the given "host:port" and waits
+// until the association is established. If ctx expires first, the connection
+// is aborted and ctx.Err() returned.
+func (su *ServiceUser) ConnectContext(ctx context.Context, serverAddr string) error {
+	if err := su.dial(ctx, serverAddr); err != nil {
+		return err
+	}
+	return su.waitUntilReadyContext(ctx)
+}
+
+// Claim the connection of the ServiceUser. Fails if Connect or SetConn was
+// called before.
+func (su *ServiceUser) claimConn() error {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.status != serviceUserInitial || su.connecting || su.released {
+		return fmt.Errorf("dicom.serviceUser: Connect called with wrong state: %v", su.status)
+	}
+	su.connecting = true
+	return nil
+}
+
+func (su *ServiceUser) dial(ctx context.Context, serverAddr string) error {
+	if err := su.claimConn(); err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr)
 	if err != nil {
-		// REMOVE
-		log.Print(err)
 		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
-	} else {
-		su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+		return err
+	}
+	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+	return nil
+}
+
+// Wait for the next event of the command. If ctx expires first, the
+// association is aborted.
+func (su *ServiceUser) nextEvent(ctx context.Context, cs *serviceCommandState) (upcallEvent, bool, error) {
+	select {
+	case event, ok := <-cs.upcallCh:
+		return event, ok, nil
+	case <-ctx.Done():
+		su.abort()
+		return upcallEvent{}, false, ctx.Err()
 	}
 }
 
 // SetConn instructs ServiceUser to use the given network connection to talk to
 // the server. Either Connect or SetConn must be before calling CStore, etc.
-func (su *ServiceUser) SetConn(conn net.Conn) {
-	doassert(su.status == serviceUserInitial)
+// The ServiceUser owns conn afterwards. If Connect or SetConn was called
+// before, conn is closed and an error returned.
+func (su *ServiceUser) SetConn(conn net.Conn) error {
+	if err := su.claimConn(); err != nil {
+		conn.Close()
+		return err
+	}
 	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+	return nil
 }
 
 // CEcho send a C-ECHO request to the remote AE and waits for a
 // response. Returns nil iff the remote AE responds ok.
 func (su *ServiceUser) CEcho() error {
-	err := su.waitUntilReady()
+	return su.CEchoContext(context.Background())
+}
+
+// CEchoContext is CEcho with a deadline on the association and the response.
+// If ctx expires, the association is aborted and ctx.Err() returned.
+func (su *ServiceUser) CEchoContext(ctx context.Context) error {
+	err := su.startCommand(ctx)
 	if err != nil {
 		return err
 	}
+	defer su.unlockCommand()
 	context, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
 	if err != nil {
 		return err
@@ -183,10 +304,14 @@ func (su *ServiceUser) CEcho() error {
 		&dimse.CEchoRq{MessageID: cs.messageID,
 			CommandDataSetType: dimse.CommandDataSetTypeNull,
 		}, nil)
-	event, ok := <-cs.upcallCh
+	event, ok, err := su.nextEvent(ctx, cs)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return fmt.Errorf("Failed to receive C-ECHO response")
 	}
+	event.data.Close()
 	resp, ok := event.command.(*dimse.CEchoRsp)
 	if !ok {
 		return fmt.Errorf("Invalid response for C-ECHO: %v", event.command)
@@ -197,6 +322,65 @@ func (su *ServiceUser) CEcho() error {
 	return err
 }
 
+// NEventReport sends an N-EVENT-REPORT request to the remote AE and waits for
+// the response. Returns nil iff the remote AE responds ok.
+func (su *ServiceUser) NEventReport(report NEventReport) error {
+	return su.NEventReportContext(context.Background(), report)
+}
+
+// NEventReportContext is NEventReport with a deadline on the association and
+// the response. If ctx expires, the association is aborted and ctx.Err()
+// returned.
+func (su *ServiceUser) NEventReportContext(ctx context.Context, report NEventReport) error {
+	err := su.startCommand(ctx)
+	if err != nil {
+		return err
+	}
+	defer su.unlockCommand()
+	context, err := su.cm.lookupByAbstractSyntaxUID(report.SOPClassUID)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	dataSetType := dimse.CommandDataSetTypeNull
+	if len(report.Elements) > 0 {
+		payload, err = writeElementsToBytes(report.Elements, context.transferSyntaxUID)
+		if err != nil {
+			return err
+		}
+		dataSetType = dimse.CommandDataSetTypeNonNull
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return err
+	}
+	defer su.disp.deleteCommand(cs)
+	cs.sendMessage(
+		&dimse.NEventReportRq{
+			AffectedSOPClassUID:    report.SOPClassUID,
+			MessageID:              cs.messageID,
+			CommandDataSetType:     dataSetType,
+			AffectedSOPInstanceUID: report.SOPInstanceUID,
+			EventTypeID:            report.EventTypeID,
+		}, payload)
+	event, ok, err := su.nextEvent(ctx, cs)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Failed to receive N-EVENT-REPORT response")
+	}
+	event.data.Close()
+	resp, ok := event.command.(*dimse.NEventReportRsp)
+	if !ok {
+		return fmt.Errorf("Invalid response for N-EVENT-REPORT: %v", event.command)
+	}
+	if resp.Status.Status != dimse.StatusSuccess {
+		err = fmt.Errorf("Non-OK status in N-EVENT-REPORT response: %+v", resp.Status)
+	}
+	return err
+}
+
 // QRLevel is used to specify the element hierarchy assumed during C-FIND,
 // C-GET, and C-MOVE. P3.4, C.3.
 // http://dicom.nema.org/Dicom/2013/output/chtml/part04/sect_C.3.html
@@ -286,10 +470,18 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 
 // CFind issues a C-FIND request. Returns a channel that streams sequence of
 // either an error or a dataset found. The caller MUST read all responses from
-// the channel before issuing any other DIMSE command (C-FIND, C-STORE, etc).
+// the channel: other DIMSE commands (C-FIND, C-GET, etc) wait until the C-FIND
+// is done.
 func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.CFindContext(context.Background(), qrLevel, filter)
+}
+
+// CFindContext is CFind with a deadline on the association and the
+// responses. If ctx expires, the association is aborted and the last result
+// carries ctx.Err().
+func (su *ServiceUser) CFindContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
 	ch := make(chan CFindResult, 128)
-	err := su.waitUntilReady()
+	err := su.startCommand(ctx)
 	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
@@ -297,18 +489,21 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 	}
 	context, payload, err := encodeQRPayload(qrOpCFind, qrLevel, filter, su.cm)
 	if err != nil {
+		su.unlockCommand()
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
+		su.unlockCommand()
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
 	go func() {
 		defer close(ch)
+		defer su.unlockCommand()
 		defer su.disp.deleteCommand(cs)
 		cs.sendMessage(
 			&dimse.CFindRq{
@@ -318,29 +513,36 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 			},
 			payload)
 		for {
-			event, ok := <-cs.upcallCh
+			event, ok, err := su.nextEvent(ctx, cs)
+			if err != nil {
+				ch <- CFindResult{Err: err}
+				break
+			}
 			if !ok {
-				su.status = serviceUserClosed
 				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
 				break
 			}
-			doassert(event.eventType == upcallEventData)
-			doassert(event.command != nil)
 			resp, ok := event.command.(*dimse.CFindRsp)
 			if !ok {
 				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
 				break
 			}
-			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
+			if resp.Status.Status != dimse.StatusPending && resp.Status.Status != dimse.StatusSuccess {
+				ch <- CFindResult{Err: fmt.Errorf("Received C-FIND error: %+v", resp)}
+				break
+			}
+			var elems []*dicom.Element
+			data, err := event.data.Bytes()
+			event.data.Close()
+			if err == nil {
+				elems, err = readElementsInBytes(data, context.transferSyntaxUID)
+			}
 			if err != nil {
 				ch <- CFindResult{Err: err}
 			} else {
 				ch <- CFindResult{Elements: elems}
 			}
 			if resp.Status.Status != dimse.StatusPending {
-				if resp.Status.Status != 0 {
-					panic(resp)
-				}
 				break
 			}
 		}
@@ -353,11 +555,18 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 // stably written
 func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
-	err := su.waitUntilReady()
+	return su.CGetContext(context.Background(), qrLevel, filter, cb)
+}
 
+// CGetContext is CGet with a deadline on the association and the responses.
+// If ctx expires, the association is aborted and ctx.Err() returned.
+func (su *ServiceUser) CGetContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	err := su.startCommand(ctx)
 	if err != nil {
 		return err
 	}
+	defer su.unlockCommand()
 	context, payload, err := encodeQRPayload(qrOpCGet, qrLevel, filter, su.cm)
 	if err != nil {
 		return err
@@ -368,13 +577,24 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	}
 	defer su.disp.deleteCommand(cs)
 
-	handleCStore := func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+	handleCStore := func(msg dimse.Message, data *dimse.Data, cs *serviceCommandState) {
 		c := msg.(*dimse.CStoreRq)
+		b, err := data.Bytes()
+		if err != nil {
+			cs.sendMessage(&dimse.CStoreRsp{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+				Status:                    dimse.Status{Status: dimse.StatusProcessingFailure, ErrorComment: err.Error()},
+			}, nil)
+			return
+		}
 		status := cb(
 			context.transferSyntaxUID,
 			c.AffectedSOPClassUID,
 			c.AffectedSOPInstanceUID,
-			data)
+			b)
 		resp := &dimse.CStoreRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -394,13 +614,14 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 		},
 		payload)
 	for {
-		event, ok := <-cs.upcallCh
+		event, ok, err := su.nextEvent(ctx, cs)
+		if err != nil {
+			return err
+		}
 		if !ok {
-			su.status = serviceUserClosed
 			return fmt.Errorf("Connection closed while waiting for C-GET response")
 		}
-		doassert(event.eventType == upcallEventData)
-		doassert(event.command != nil)
+		event.data.Close()
 		resp, ok := event.command.(*dimse.CGetRsp)
 		if !ok {
 			return fmt.Errorf("Found wrong response for C-GET: %v", event.command)
@@ -416,9 +637,17 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	return nil
 }
 
-// Release shuts down the connection. It must be called exactly once.  After
-// Release(), no other operation can be performed on the ServiceUser object.
+// Release shuts down the connection. Commands still in progress fail. After
+// Release(), no other operation can be performed on the ServiceUser object;
+// calling it again has no effect.
 func (su *ServiceUser) Release() {
+	su.mu.Lock()
+	if su.released {
+		su.mu.Unlock()
+		return
+	}
+	su.released = true
+	su.mu.Unlock()
 	su.disp.downcallCh <- stateEvent{event: evt11}
 	su.mu.Lock()
 	defer su.mu.Unlock()
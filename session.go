@@ -0,0 +1,229 @@
+package dicompot
+
+// This file keeps track of the associations served by a ServiceProvider, so
+// that they can be inspected and aborted at runtime.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nsmfoo/dicompot/dimse"
+	"github.com/sirupsen/logrus"
+)
+
+// Max number of commands kept in the history of a session. Older entries are
+// dropped.
+const maxSessionHistory = 256
+
+// Time given to the state machine of a session to take a request primitive.
+const signalTimeout = time.Second
+
+// ErrNoSuchSession is returned for sessions that are not active, or that
+// ended while being aborted.
+var ErrNoSuchSession = errors.New("dicom.serviceProvider: no such session")
+
+// CommandRecord is an entry in the command history of a session.
+type CommandRecord struct {
+	Time    time.Time
+	Command string // E.g., "C-FIND", "N-ACTION"
+	Status  dimse.Status
+}
+
+// SessionInfo describes an active association of a ServiceProvider.
+type SessionInfo struct {
+	// ID is the label used in the log messages of the session.
+	ID              string
+	Start           time.Time
+	ConnectionState ConnectionState
+	// Number of commands handled so far.
+	Commands int
+	// Fingerprint of the A-ASSOCIATE-RQ. Empty until the handshake
+	// completes.
+	Fingerprint ClientFingerprint
+}
+
+type providerSession struct {
+	id    string
+	conn  net.Conn
+	start time.Time
+	disp  *serviceDispatcher // For releasing or aborting the association.
+	// Scores the commands of the session. Nil if there is no tarpit.
+	tarpit *tarpit
+
+	mu       sync.Mutex
+	cm       *contextManager // Set once the handshake completes.
+	commands int
+	history  []CommandRecord
+	released bool // A-RELEASE requested by Shutdown.
+}
+
+func (s *providerSession) setContextManager(cm *contextManager) {
+	s.mu.Lock()
+	s.cm = cm
+	s.mu.Unlock()
+}
+
+// Send a request primitive (evt11 A-RELEASE, evt15 A-ABORT) to the state
+// machine. Fails with ErrNoSuchSession if the association ends first, or
+// after signalTimeout if the state machine doesn't take it.
+func (s *providerSession) signal(event eventType) error {
+	timer := time.NewTimer(signalTimeout)
+	defer timer.Stop()
+	select {
+	case s.disp.downcallCh <- stateEvent{event: event}:
+		return nil
+	case <-s.disp.done:
+		return fmt.Errorf("%w %s", ErrNoSuchSession, s.id)
+	case <-timer.C:
+		return fmt.Errorf("dicom.serviceProvider: session %s did not take %s within %v", s.id, event.String(), signalTimeout)
+	}
+}
+
+func (s *providerSession) record(command string, status dimse.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+	if len(s.history) >= maxSessionHistory {
+		s.history = s.history[1:]
+	}
+	s.history = append(s.history, CommandRecord{Time: time.Now(), Command: command, Status: status})
+}
+
+func (s *providerSession) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SessionInfo{
+		ID:              s.id,
+		Start:           s.start,
+		ConnectionState: getConnState(s.conn, s.cm),
+		Commands:        s.commands,
+	}
+	if s.cm != nil {
+		info.Fingerprint = s.cm.fingerprint
+	}
+	return info
+}
+
+// Record a DIMSE request handled by the provider, in the metrics and in the
+// history of the session.
+func recordCommand(cs *serviceCommandState, command string, status dimse.Status) {
+	observeCommand(command, status)
+	if s := cs.disp.session; s != nil {
+		s.record(command, status)
+		s.tarpit.addScore(remoteIP(s.conn), command)
+	}
+}
+
+func (sp *ServiceProvider) addSession(s *providerSession) {
+	sp.mu.Lock()
+	sp.sessions[s.id] = s
+	sp.mu.Unlock()
+}
+
+func (sp *ServiceProvider) removeSession(id string) {
+	sp.mu.Lock()
+	delete(sp.sessions, id)
+	sp.mu.Unlock()
+}
+
+func (sp *ServiceProvider) activeSessions() []*providerSession {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sessions := make([]*providerSession, 0, len(sp.sessions))
+	for _, s := range sp.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (sp *ServiceProvider) findSession(id string) (*providerSession, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	s, ok := sp.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrNoSuchSession, id)
+	}
+	return s, nil
+}
+
+// Sessions lists the active associations, oldest first.
+func (sp *ServiceProvider) Sessions() []SessionInfo {
+	sessions := sp.activeSessions()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+// SessionHistory returns the commands handled in the given session, oldest
+// first. Only the last 256 commands are kept.
+func (sp *ServiceProvider) SessionHistory(id string) ([]CommandRecord, error) {
+	s, err := sp.findSession(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CommandRecord(nil), s.history...), nil
+}
+
+// AbortSession sends an A-ABORT to the peer of the given session and closes
+// the connection. Returns an error if the abort couldn't be delivered to the
+// session; ErrNoSuchSession if it isn't active.
+func (sp *ServiceProvider) AbortSession(id string) error {
+	s, err := sp.findSession(id)
+	if err != nil {
+		return err
+	}
+	if err := s.signal(evt15); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"Status": "Aborted by admin",
+		"ID":     id,
+	}).Warn("Connection")
+	return nil
+}
+
+// DenyIP makes Run close connections from the given address right after
+// accepting them.
+func (sp *ServiceProvider) DenyIP(ip net.IP) {
+	sp.mu.Lock()
+	sp.deniedIPs[ip.String()] = true
+	sp.mu.Unlock()
+}
+
+// AllowIP removes the address from the deny list.
+func (sp *ServiceProvider) AllowIP(ip net.IP) {
+	sp.mu.Lock()
+	delete(sp.deniedIPs, ip.String())
+	sp.mu.Unlock()
+}
+
+// DeniedIPs lists the addresses in the deny list.
+func (sp *ServiceProvider) DeniedIPs() []string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	ips := make([]string, 0, len(sp.deniedIPs))
+	for ip := range sp.deniedIPs {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func (sp *ServiceProvider) isDenied(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.deniedIPs[tcpAddr.IP.String()]
+}
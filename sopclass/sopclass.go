@@ -19,6 +19,35 @@ var VerificationClasses = []string{
 	standardUID("1.2.840.10008.1.1"),
 }
 
+// StorageCommitmentPushModel is the SOP class of Storage Commitment N-ACTION
+// and N-EVENT-REPORT requests. StorageCommitmentPushModelInstance is its
+// well-known SOP instance.
+var (
+	StorageCommitmentPushModel         = standardUID("1.2.840.10008.1.20.1")
+	StorageCommitmentPushModelInstance = standardUID("1.2.840.10008.1.20.1.1")
+)
+
+// StorageCommitmentClasses is for issuing Storage Commitment requests.
+var StorageCommitmentClasses = []string{
+	StorageCommitmentPushModel,
+}
+
+// ModalityPerformedProcedureStep is the SOP class of MPPS N-CREATE and N-SET
+// requests.
+var ModalityPerformedProcedureStep = standardUID("1.2.840.10008.3.1.2.3.3")
+
+// Basic Grayscale Print Management. Peers negotiate the meta SOP class and
+// address the individual classes in DIMSE-N requests. PrinterInstance is the
+// well-known Printer SOP instance.
+var (
+	BasicGrayscalePrintManagementMeta = standardUID("1.2.840.10008.5.1.1.9")
+	BasicFilmSession                  = standardUID("1.2.840.10008.5.1.1.1")
+	BasicFilmBox                      = standardUID("1.2.840.10008.5.1.1.2")
+	BasicGrayscaleImageBox            = standardUID("1.2.840.10008.5.1.1.4")
+	Printer                           = standardUID("1.2.840.10008.5.1.1.16")
+	PrinterInstance                   = standardUID("1.2.840.10008.5.1.1.17")
+)
+
 // StorageClasses for issuing C-STORE requests.
 var StorageClasses = []string{
 	standardUID("1.2.840.10008.5.1.1.27"),
@@ -4,6 +4,9 @@ package dicompot
 // http://dicom.nema.org/medical/dicom/current/output/pdf/part08.pdf
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -157,12 +160,12 @@ var actionAe1 = &stateAction{"AE-1",
 
 var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. Send A-ASSOCIATE-RQ-PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
-		doassert(event.conn != nil)
-		sm.conn = event.conn
-		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
+		sm.conn = event.conn // Not nil: see getNextEvent.
+		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.timeouts, sm.label, nil)
 		items := sm.contextManager.generateAssociateRequest(
 			sm.userParams.SOPClasses,
-			sm.userParams.TransferSyntaxes)
+			sm.userParams.TransferSyntaxes,
+			sm.userParams.SCPRoleSOPClasses)
 
 		pdu := &pdu.AAssociate{
 			Type:            pdu.TypeAAssociateRq,
@@ -181,7 +184,6 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 	func(sm *stateMachine, event stateEvent) stateType {
 		stopTimer(sm)
 		v := event.pdu.(*pdu.AAssociate)
-		doassert(v.Type == pdu.TypeAAssociateAc)
 		err := sm.contextManager.onAssociateResponse(v.Items)
 
 		if err == nil {
@@ -191,6 +193,7 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 			}
 			return sta06
 		}
+		event.err = err
 		return actionAa8.Callback(sm, event)
 	}}
 
@@ -202,11 +205,18 @@ var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) pr
 
 var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primitive; start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
-		doassert(event.conn != nil)
+		if event.conn == nil {
+			closeConnection(sm)
+			return sta01
+		}
 		startTimer(sm)
+		if sm.signatures.needsSourceName() {
+			sm.source = lookupSourceName(remoteIP(event.conn))
+		}
+		sm.probe = &probeRecorder{Conn: event.conn}
 		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
-		}(sm.netCh, event.conn)
+			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.timeouts, sm.label, sm.anomalies)
+		}(sm.netCh, sm.probe)
 		return sta02
 	}}
 
@@ -216,21 +226,32 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 	func(sm *stateMachine, event stateEvent) stateType {
 		stopTimer(sm)
 		v := event.pdu.(*pdu.AAssociate)
+		ip := remoteIP(sm.conn)
 
-		if sm.enforceStatus != "no" {
-			if strings.TrimSpace(v.CalledAETitle) != strings.TrimSpace(sm.clientAETitleStatus) {
+		setFingerprint(sm, fingerprintAssociate(v))
+
+		var reject *pdu.AAssociateRj
+		checkCalled := sm.enforceStatus != "no" || (sm.accessPolicy != nil && len(sm.accessPolicy.CalledAETitles) > 0)
+		wrongAETitle := !sm.accessPolicy.calledAETitleAllowed(strings.TrimSpace(v.CalledAETitle), sm.clientAETitleStatus, sm.enforceStatus)
+		if sm.aeTitles.attempt(ip, strings.TrimSpace(v.CalledAETitle), strings.TrimSpace(v.CallingAETitle), wrongAETitle, sm.label) {
+			wrongAETitle = false
+			sm.contextManager.postBruteForce = true
+		}
+		if checkCalled {
+			if wrongAETitle {
 
 				logrus.WithFields(logrus.Fields{
 					"AETitle": strings.TrimSpace(v.CalledAETitle),
 					"ID":      sm.label,
 				}).Error("Connection")
-				// Sleep to prevent overload in case of an extended brutefoce attempt
-				time.Sleep(5 * time.Second)
-
-				rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
-				sendPDU(sm, &rj)
-				startTimer(sm)
-				return sta13
+				observeAssociationRejected(rejectCalledAETitle)
+				// Brute force attempts end up in the tarpit.
+				sm.tarpit.addScore(ip, "rejected")
+				reject = &pdu.AAssociateRj{
+					Result: pdu.ResultRejectedPermanent,
+					Source: pdu.SourceULServiceUser,
+					Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+				}
 			} else {
 
 				logrus.WithFields(logrus.Fields{
@@ -244,29 +265,60 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 			}
 		}
 
-		if v.ProtocolVersion != 0x0001 {
-			rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
-
-			sendPDU(sm, &rj)
-			startTimer(sm)
-
-			return sta13
+		sm.contextManager.callingAETitle = strings.TrimSpace(v.CallingAETitle)
+		sm.contextManager.calledAETitle = strings.TrimSpace(v.CalledAETitle)
+		if reject == nil {
+			rule, err := sm.accessPolicy.match(sm.contextManager.callingAETitle, ip)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"Error": err,
+					"IP":    ip,
+					"ID":    sm.label,
+				}).Warn("Access denied")
+				observeAssociationRejected(rejectCallingAETitle)
+				reject = &pdu.AAssociateRj{
+					Result: pdu.ResultRejectedPermanent,
+					Source: pdu.SourceULServiceUser,
+					Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+				}
+			}
+			sm.contextManager.access = rule
+		}
+		sm.contextManager.tarpit = sm.tarpit.admit(ip, sm.contextManager.callingAETitle, sm.label)
+		delay := sm.contextManager.tarpit.associateDelay()
+
+		if reject == nil && v.ProtocolVersion != 0x0001 {
+			observeAssociationRejected(rejectProtocolVersion)
+			reject = &pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceProviderACSE,
+				Reason: 2, // Protocol version not supported.
+			}
+		}
+		if reject != nil {
+			scheduleEvent(sm, stateEvent{event: evt08, pdu: reject}, delay)
+			return sta03
 		}
 		responses, err := sm.contextManager.onAssociateRequest(v.Items)
+		if err == nil && (v.CalledAETitle == "" || v.CallingAETitle == "") {
+			err = fmt.Errorf("dicom.stateMachine(%s): empty AE title in A-ASSOCIATE-RQ", sm.label)
+		}
 		if err != nil {
-			sm.downcallCh <- stateEvent{
+			logrus.WithFields(logrus.Fields{
+				"Error": err,
+				"ID":    sm.label,
+			}).Warn("Association rejected")
+			observeAssociationRejected(rejectAssociateRequest)
+			scheduleEvent(sm, stateEvent{
 				event: evt08,
 				pdu: &pdu.AAssociateRj{
 					Result: pdu.ResultRejectedPermanent,
 					Source: pdu.SourceULServiceProviderACSE,
 					Reason: 1,
 				},
-			}
+			}, delay)
 		} else {
-			doassert(len(responses) > 0)
-			doassert(v.CalledAETitle != "")
-			doassert(v.CallingAETitle != "")
-			sm.downcallCh <- stateEvent{
+			scheduleEvent(sm, stateEvent{
 				event: evt07,
 				pdu: &pdu.AAssociate{
 					Type:            pdu.TypeAAssociateAc,
@@ -275,14 +327,46 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 					CallingAETitle:  v.CallingAETitle,
 					Items:           responses,
 				},
-			}
+			}, delay)
 		}
 		return sta03
 	}}
+
+// Name the tool behind "fp" and log it.
+func setFingerprint(sm *stateMachine, fp ClientFingerprint) {
+	sm.signatures.identify(&fp, sm.source)
+	sm.contextManager.fingerprint = fp
+	observeFingerprint(fp.Tool)
+	logrus.WithFields(logrus.Fields{
+		"Fingerprint": fp.Hash,
+		"Tool":        fp.Tool,
+		"ID":          sm.label,
+	}).Info("Client fingerprint")
+	logrus.WithFields(logrus.Fields{
+		"Fingerprint": fp.Hash,
+		"Canonical":   fp.Canonical,
+		"ID":          sm.label,
+	}).Debug("Client fingerprint")
+}
+
+// Feed "event" to the statemachine after "delay". The statemachine keeps
+// serving other events, e.g., an A-ABORT from the peer, in the meantime. The
+// event has a channel of its own, so it isn't lost if downcallCh is full.
+func scheduleEvent(sm *stateMachine, event stateEvent, delay time.Duration) {
+	ch := make(chan stateEvent, 1)
+	sm.scheduledCh = ch
+	if delay <= 0 {
+		ch <- event
+		return
+	}
+	time.AfterFunc(delay, func() { ch <- event })
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 
 		sendPDU(sm, event.pdu.(*pdu.AAssociate))
+		observeAssociationAccepted(sm.contextManager.callingAETitle)
 
 		sm.upcallCh <- upcallEvent{
 			eventType: upcallEventHandshakeCompleted,
@@ -301,15 +385,21 @@ var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM ti
 	}}
 
 // Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.PDataTf {
-	doassert(len(data) > 0)
+func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) ([]pdu.PDataTf, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("dicom.stateMachine(%s): Empty P-DATA for syntax %s", sm.label, dicomuid.UIDString(abstractSyntaxName))
+	}
 	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
 	if err != nil {
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
+		return nil, fmt.Errorf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err)
 	}
 	var pdus []pdu.PDataTf
 	// two byte header overhead.
 	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
+	if maxChunkSize <= 0 {
+		// Zero means no limit (P3.8 D.1). Anything else this small is bogus.
+		maxChunkSize = DefaultMaxPDUSize - 8
+	}
 	for len(data) > 0 {
 		chunkSize := len(data)
 		if chunkSize > maxChunkSize {
@@ -328,31 +418,84 @@ func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool
 	if len(pdus) > 0 {
 		pdus[len(pdus)-1].Items[0].Last = true
 	}
-	return pdus
+	return pdus, nil
+}
+
+// Encode a DIMSE message and send it as P_DATA_TF PDUs.
+func sendDIMSEMessage(sm *stateMachine, payload *stateEventDIMSEPayload) error {
+	if payload == nil || payload.command == nil {
+		return fmt.Errorf("dicom.stateMachine(%s): P-DATA request without a DIMSE command", sm.label)
+	}
+	command := payload.command
+	if !command.HasData() && len(payload.data) > 0 {
+		return fmt.Errorf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(payload.data), command)
+	}
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dimse.EncodeMessage(e, command)
+	if e.Error() != nil {
+		return fmt.Errorf("dicom.stateMachine(%s): Failed to encode DIMSE cmd %v: %v", sm.label, command, e.Error())
+	}
+	pdus, err := splitDataIntoPDUs(sm, payload.abstractSyntaxName, true /*command*/, e.Bytes())
+	if err != nil {
+		return err
+	}
+	if command.HasData() && payload.dataReader == nil {
+		dataPDUs, err := splitDataIntoPDUs(sm, payload.abstractSyntaxName, false /*data*/, payload.data)
+		if err != nil {
+			return err
+		}
+		pdus = append(pdus, dataPDUs...)
+	}
+	for _, pdu := range pdus {
+		sendPDU(sm, &pdu)
+	}
+	if command.HasData() && payload.dataReader != nil {
+		return streamDataPDUs(sm, payload)
+	}
+	return nil
+}
+
+// Send the data payload read from payload.dataReader, one P_DATA_TF PDU at a
+// time.
+func streamDataPDUs(sm *stateMachine, payload *stateEventDIMSEPayload) error {
+	if payload.dataSize <= 0 {
+		return fmt.Errorf("dicom.stateMachine(%s): Empty P-DATA for syntax %s", sm.label, dicomuid.UIDString(payload.abstractSyntaxName))
+	}
+	context, err := sm.contextManager.lookupByAbstractSyntaxUID(payload.abstractSyntaxName)
+	if err != nil {
+		return fmt.Errorf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(payload.abstractSyntaxName), err)
+	}
+	maxChunkSize := int64(sm.contextManager.peerMaxPDUSize - 8)
+	if maxChunkSize <= 0 {
+		maxChunkSize = DefaultMaxPDUSize - 8
+	}
+	chunk := make([]byte, maxChunkSize)
+	for remaining := payload.dataSize; remaining > 0; {
+		n := maxChunkSize
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(payload.dataReader, chunk[:n]); err != nil {
+			return fmt.Errorf("dicom.stateMachine(%s): Failed to read DIMSE data: %v", sm.label, err)
+		}
+		remaining -= n
+		sendPDU(sm, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+			pdu.PresentationDataValueItem{
+				ContextID: context.contextID,
+				Command:   false,
+				Last:      remaining == 0,
+				Value:     chunk[:n],
+			}}})
+	}
+	return nil
 }
 
 // Data transfer related actions
 var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
-		doassert(event.dimsePayload != nil)
-		command := event.dimsePayload.command
-		doassert(command != nil)
-		e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-		dimse.EncodeMessage(e, command)
-		if e.Error() != nil {
-			panic(fmt.Sprintf("Failed to encode DIMSE cmd %v: %v", command, e.Error()))
-		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
-		} else if len(event.dimsePayload.data) > 0 {
-			panic(fmt.Sprintf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command))
+		if err := sendDIMSEMessage(sm, event.dimsePayload); err != nil {
+			event.err = err
+			return actionAa8.Callback(sm, event)
 		}
 		return sta06
 	}}
@@ -360,6 +503,7 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
 		contextID, command, data, err := sm.commandAssembler.AddDataPDU(event.pdu.(*pdu.PDataTf))
+		sm.anomalies.inspectPData(sm.contextManager, event.pdu.(*pdu.PDataTf), err)
 		if err == nil {
 			if command != nil { // All fragments received
 				sm.upcallCh <- upcallEvent{
@@ -371,6 +515,10 @@ var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 			}
 			return sta06
 		}
+		// Give the fragments received back to the byte budgets now, not
+		// when the peer closes the connection.
+		sm.commandAssembler.Discard()
+		event.err = err
 		return actionAa8.Callback(sm, event)
 	}}
 
@@ -412,25 +560,9 @@ var actionAr6 = &stateAction{"AR-6", "Issue P-DATA indication",
 
 var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
-		doassert(event.dimsePayload != nil)
-		command := event.dimsePayload.command
-		doassert(command != nil)
-		e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-		dimse.EncodeMessage(e, command)
-		if e.Error() != nil {
-			panic(fmt.Sprintf("dicom.StateMachine %s: Failed to encode DIMSE cmd %v: %v", sm.label, command, e.Error()))
-		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
-		} else {
-			doassert(len(event.dimsePayload.data) == 0)
+		if err := sendDIMSEMessage(sm, event.dimsePayload); err != nil {
+			event.err = err
+			return actionAa8.Callback(sm, event)
 		}
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
@@ -439,6 +571,8 @@ var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 var actionAr8 = &stateAction{"AR-8", "Issue A-RELEASE indication (release collision): if association-requestor, next state is Sta09, if not next state is Sta10",
 	func(sm *stateMachine, event stateEvent) stateType {
 		if sm.isUser {
+			// Like AR-2, the release is accepted right away.
+			sm.downcallCh <- stateEvent{event: evt14}
 			return sta09
 		}
 		return sta10
@@ -452,12 +586,14 @@ var actionAr9 = &stateAction{"AR-9", "Send A-RELEASE-RP PDU",
 
 var actionAr10 = &stateAction{"AR-10", "Issue A-RELEASE confimation primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
+		sm.downcallCh <- stateEvent{event: evt14}
 		return sta12
 	}}
 
 // Association abort related actions
 var actionAa1 = &stateAction{"AA-1", "Send A-ABORT PDU (service-user source) and start (or restart if already started) ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
+		logAbort(sm, event)
 		diagnostic := pdu.AbortReasonType(0)
 		if sm.currentState == sta02 {
 			diagnostic = pdu.AbortReasonUnexpectedPDU
@@ -498,12 +634,14 @@ var actionAa6 = &stateAction{"AA-6", "Ignore PDU",
 
 var actionAa7 = &stateAction{"AA-7", "Send A-ABORT PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
+		logAbort(sm, event)
 		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: 0})
 		return sta13
 	}}
 
 var actionAa8 = &stateAction{"AA-8", "Send A-ABORT PDU (service-dul source), issue an A-P-ABORT indication and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
+		logAbort(sm, event)
 		sendPDU(sm, &pdu.AAbort{Source: 2, Reason: 0})
 		startTimer(sm)
 		return sta13
@@ -550,7 +688,7 @@ type upcallEvent struct {
 	contextID byte
 
 	command dimse.Message
-	data    []byte
+	data    *dimse.Data // Nil if the command has no data. Closed by the receiver.
 }
 
 type stateEventDIMSEPayload struct {
@@ -564,6 +702,11 @@ type stateEventDIMSEPayload struct {
 	// Ditto, but for the data payload. The data PDU is sent iff.
 	// command.HasData()==true.
 	data []byte
+
+	// Else, the data payload is read from dataReader, dataSize bytes, as
+	// the PDUs are sent.
+	dataReader io.Reader
+	dataSize   int64
 }
 
 type stateEventDebugInfo struct {
@@ -737,6 +880,7 @@ type stateMachine struct {
 
 	clientAETitleStatus string
 	enforceStatus       string
+	accessPolicy        *AccessPolicy // Provider side only. May be nil.
 
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
@@ -764,12 +908,52 @@ type stateMachine struct {
 	// For Timer expiration event
 	timerCh chan stateEvent
 
+	// For the event fed by scheduleEvent.
+	scheduledCh chan stateEvent
+
 	// The socket to the remote peer.
 	conn         net.Conn
 	currentState stateType
 
 	// For assembling DIMSE command from multiple P_DATA_TF fragments.
 	commandAssembler dimse.CommandAssembler
+
+	timeouts stateMachineTimeouts
+
+	// Set on the provider side if a TarpitPolicy is configured.
+	tarpit *tarpit
+
+	// Set on the provider side.
+	anomalies *anomalyDetector
+	// Names the tool behind the client fingerprint. May be nil.
+	signatures *signatureDB
+	// Reverse DNS name of the peer, for the signatures. May be nil.
+	source *sourceName
+	// First bytes received, for the fingerprint of clients that don't
+	// send an A-ASSOCIATE-RQ. Provider side only.
+	probe *probeRecorder
+	// Records the AE titles tried and applies the LurePolicy. May be nil.
+	aeTitles *aeTitleTracker
+}
+
+// DefaultARTIMTimeout is the default duration of the ARTIM timer. P3.8 9.1.5
+// leaves the value to the implementation.
+const DefaultARTIMTimeout = 10 * time.Second
+
+type stateMachineTimeouts struct {
+	artim time.Duration // ARTIM timer. Zero means DefaultARTIMTimeout.
+	idle  time.Duration // Max wait for the next PDU. Zero means no limit.
+	read  time.Duration // Max time to receive a PDU once it started. Zero means no limit.
+}
+
+// pduTimeoutError is reported by networkReaderThread when the peer is too slow.
+type pduTimeoutError struct {
+	timer string // "Idle" or "Read"
+	err   error
+}
+
+func (e *pduTimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout: %v", e.timer, e.err)
 }
 
 func closeConnection(sm *stateMachine) {
@@ -780,7 +964,10 @@ func closeConnection(sm *stateMachine) {
 }
 
 func sendPDU(sm *stateMachine, v pdu.PDU) {
-	doassert(sm.conn != nil)
+	if sm.conn == nil {
+		// The connection is gone already: nobody to send to.
+		return
+	}
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
 		sm.conn.Close()
@@ -788,6 +975,10 @@ func sendPDU(sm *stateMachine, v pdu.PDU) {
 		return
 	}
 
+	if ts := sm.contextManager.tarpit; ts.dribbles() {
+		ts.send(sm.conn, data, sm.errorCh)
+		return
+	}
 	n, err := sm.conn.Write(data)
 	if n != len(data) || err != nil {
 		sm.conn.Close()
@@ -800,7 +991,11 @@ func startTimer(sm *stateMachine) {
 	ch := make(chan stateEvent, 1)
 	sm.timerCh = ch
 	currentState := sm.currentState
-	time.AfterFunc(time.Duration(10)*time.Second,
+	artim := sm.timeouts.artim
+	if artim <= 0 {
+		artim = DefaultARTIMTimeout
+	}
+	time.AfterFunc(artim,
 		func() {
 			ch <- stateEvent{event: evt18, debug: &stateEventDebugInfo{currentState}}
 			close(ch)
@@ -815,10 +1010,69 @@ func stopTimer(sm *stateMachine) {
 	sm.timerCh = make(chan stateEvent, 1)
 }
 
-func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
-	doassert(maxPDUSize > 16*1024)
+// Read a PDU. The idle timeout applies to its first byte, the read timeout to
+// the rest. The raw PDU is shown to the anomaly detector before it is decoded.
+func readPDU(conn net.Conn, maxPDUSize int, timeouts stateMachineTimeouts, ad *anomalyDetector) (pdu.PDU, error) {
+	deadline := func(d time.Duration) {
+		if timeouts.idle <= 0 && timeouts.read <= 0 {
+			return
+		}
+		if d > 0 {
+			conn.SetReadDeadline(time.Now().Add(d))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+	}
+	// Type, reserved byte, length.
+	var header [6]byte
+	deadline(timeouts.idle)
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, timeoutError("Idle", err)
+	}
+	deadline(timeouts.read)
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, timeoutError("Read", err)
+	}
+	pduType := pdu.Type(header[0])
+	length := binary.BigEndian.Uint32(header[2:])
+	ad.inspectPDUHeader(pduType, length, maxPDUSize)
+	if length >= uint32(maxPDUSize)*2 {
+		// Let ReadPDU refuse it.
+		return pdu.ReadPDU(bytes.NewReader(header[:]), maxPDUSize)
+	}
+	// The buffer grows with the data received, not with the length claimed.
+	payload, err := io.ReadAll(io.LimitReader(conn, int64(length)))
+	if err == nil && len(payload) < int(length) {
+		ad.report(AnomalyPDULength, "PDU 0x%02x of %d bytes, connection closed after %d", byte(pduType), length, len(payload))
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, timeoutError("Read", err)
+	}
+	ad.inspectPDU(pduType, payload)
+	v, err := pdu.ReadPDU(io.MultiReader(bytes.NewReader(header[:]), bytes.NewReader(payload)), maxPDUSize)
+	if errors.Is(err, pdu.ErrJunk) {
+		ad.report(AnomalyPDULength, "PDU 0x%02x of %d bytes: %v", byte(pduType), length, err)
+	}
+	return v, err
+}
+
+func timeoutError(timer string, err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &pduTimeoutError{timer: timer, err: err}
+	}
+	return err
+}
+
+func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, timeouts stateMachineTimeouts, smName string, ad *anomalyDetector) {
+	if maxPDUSize <= 16*1024 {
+		maxPDUSize = DefaultMaxPDUSize
+	}
 	for {
-		v, err := pdu.ReadPDU(conn, maxPDUSize)
+		v, err := readPDU(conn, maxPDUSize, timeouts, ad)
 		if err != nil {
 			if err == io.EOF {
 				ch <- stateEvent{event: evt17, pdu: nil, err: nil}
@@ -828,15 +1082,16 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			close(ch)
 			break
 		}
-		doassert(v != nil)
 		switch n := v.(type) {
 		case *pdu.AAssociate:
 
 			if n.Type == pdu.TypeAAssociateRq {
 				ch <- stateEvent{event: evt06, pdu: n, err: nil}
-			} else {
-				doassert(n.Type == pdu.TypeAAssociateAc)
+			} else if n.Type == pdu.TypeAAssociateAc {
 				ch <- stateEvent{event: evt03, pdu: n, err: nil}
+			} else {
+				err := fmt.Errorf("dicom.StateMachine %s: Unknown A-ASSOCIATE type: %v", smName, n.Type)
+				ch <- stateEvent{event: evt19, pdu: v, err: err}
 			}
 			continue
 		case *pdu.AAssociateRj:
@@ -855,7 +1110,7 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			ch <- stateEvent{event: evt16, pdu: n, err: nil}
 			continue
 		default:
-			err := fmt.Errorf("dicom.StateMachine %s: Unknown PDU type: %v", v.String(), smName)
+			err := fmt.Errorf("dicom.StateMachine %s: Unknown PDU type: %v", smName, v)
 			ch <- stateEvent{event: evt19, pdu: v, err: err}
 			continue
 		}
@@ -877,6 +1132,7 @@ func getNextEvent(sm *stateMachine) stateEvent {
 			if !ok {
 				sm.timerCh = nil
 			}
+		case event = <-sm.scheduledCh:
 		case event, ok = <-sm.downcallCh:
 			if !ok {
 				sm.downcallCh = nil
@@ -885,7 +1141,11 @@ func getNextEvent(sm *stateMachine) stateEvent {
 	}
 	switch event.event {
 	case evt02:
-		doassert(event.conn != nil)
+		if event.conn == nil {
+			event = stateEvent{event: evt17, err: fmt.Errorf("dicom.stateMachine(%s): No connection", sm.label)}
+			close(sm.upcallCh)
+			break
+		}
 		sm.conn = event.conn
 	case evt17:
 		close(sm.upcallCh)
@@ -903,8 +1163,43 @@ func findAction(currentState stateType, event *stateEvent, smName string) *state
 	return nil
 }
 
+// Log why the statemachine aborts the association, unless it is a timeout,
+// which logTimeout reports.
+func logAbort(sm *stateMachine, event stateEvent) {
+	if event.err == nil {
+		return
+	}
+	if _, ok := event.err.(*pduTimeoutError); ok {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"Error": event.err.Error(),
+		"State": sm.currentState.String(),
+		"ID":    sm.label,
+	}).Warn("Abort")
+}
+
+// Log aborts caused by the ARTIM timer or by a slow peer, with the state they
+// happened in.
+func logTimeout(sm *stateMachine, event stateEvent) {
+	var timer string
+	if event.event == evt18 {
+		timer = "ARTIM"
+	} else if e, ok := event.err.(*pduTimeoutError); ok {
+		timer = e.timer
+	} else {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"Timer": timer,
+		"State": sm.currentState.String(),
+		"ID":    sm.label,
+	}).Warn("Timeout")
+}
+
 func runOneStep(sm *stateMachine) {
 	event := getNextEvent(sm)
+	logTimeout(sm, event)
 	action := findAction(sm.currentState, &event, sm.label)
 
 	if action == nil {
@@ -919,9 +1214,7 @@ func runStateMachineForServiceUser(
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
 	label string) {
-	doassert(params.CallingAETitle != "")
-	doassert(len(params.SOPClasses) > 0)
-	doassert(len(params.TransferSyntaxes) > 0)
+	// The params were checked by validateServiceUserParams.
 	sm := &stateMachine{
 		label:          label,
 		isUser:         true,
@@ -932,6 +1225,7 @@ func runStateMachineForServiceUser(
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
 	}
+	defer sm.commandAssembler.Discard()
 
 	event := stateEvent{event: evt01}
 	action := findAction(sta01, &event, sm.label)
@@ -948,10 +1242,17 @@ func runStateMachineForServiceProvider(
 	label string,
 	clientAETitle string,
 	enforce string,
+	access *AccessPolicy,
+	timeouts stateMachineTimeouts,
+	tp *tarpit,
+	sigs *signatureDB,
+	aeTitles *aeTitleTracker,
+	assembler dimse.CommandAssembler,
 ) {
 	sm := &stateMachine{
 		clientAETitleStatus: clientAETitle,
 		enforceStatus:       enforce,
+		accessPolicy:        access,
 		label:               label,
 		isUser:              false,
 		contextManager:      newContextManager(label),
@@ -960,7 +1261,15 @@ func runStateMachineForServiceProvider(
 		errorCh:             make(chan stateEvent, 128),
 		downcallCh:          downcallCh,
 		upcallCh:            upcallCh,
+		timeouts:            timeouts,
+		tarpit:              tp,
+		anomalies:           newAnomalyDetector(label, remoteIP(conn)),
+		signatures:          sigs,
+		aeTitles:            aeTitles,
+		commandAssembler:    assembler,
 	}
+	defer func() { sm.contextManager.tarpit.release() }()
+	defer sm.commandAssembler.Discard()
 
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event, sm.label)
@@ -969,4 +1278,9 @@ func runStateMachineForServiceProvider(
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
+	if sm.contextManager.fingerprint.Hash == "" && sm.probe != nil {
+		if data := sm.probe.bytes(); len(data) > 0 {
+			setFingerprint(sm, fingerprintProbe(data))
+		}
+	}
 }
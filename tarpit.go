@@ -0,0 +1,351 @@
+package dicompot
+
+// This file implements the tarpit, which slows down abusive clients: it
+// stretches the association handshake, delays C-FIND pending responses and
+// dribbles PDUs byte by byte.
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TarpitPolicy decides which clients are slowed down, and by how much.
+//
+// A client is tarpitted if its source address is in IPs, its calling AE title
+// in CallingAETitles, or the behavior score of its source address has reached
+// ScoreThreshold. Every tarpitted association from the same address doubles
+// the delays, up to MaxDelay.
+type TarpitPolicy struct {
+	IPs             []*net.IPNet
+	CallingAETitles []string
+	// Score that puts a source address in the tarpit. Zero disables the
+	// score trigger. See tarpitScores for what adds to the score.
+	ScoreThreshold int
+
+	// Delay of the A-ASSOCIATE-AC or -RJ response.
+	AssociateDelay time.Duration
+	// Delay before each C-FIND pending response.
+	CFindDelay time.Duration
+	// Pause between the bytes of a dribbled PDU. Zero disables dribbling.
+	DribbleInterval time.Duration
+	// Upper bound of the escalated delays, and of the time spent dribbling
+	// one PDU. Default: 1 minute.
+	MaxDelay time.Duration
+	// Offenses and scores of an address are forgotten after this long
+	// without activity. Default: 1 hour.
+	ForgetAfter time.Duration
+	// Max number of associations in the tarpit at once. Beyond that,
+	// clients are served without delay. Default: 64.
+	MaxActive int
+}
+
+// Behavior scores, added to the source address of the association.
+var tarpitScores = map[string]int{
+	"rejected": 10, // A-ASSOCIATE-RQ with the wrong called AE title
+	"C-STORE":  5,
+	"C-GET":    3,
+	"C-MOVE":   3,
+	"C-FIND":   1,
+}
+
+// Max number of source addresses remembered.
+const maxTarpitSources = 10000
+
+type tarpitSource struct {
+	score    int
+	offenses int
+	lastSeen time.Time
+}
+
+type tarpit struct {
+	policy TarpitPolicy
+
+	mu      sync.Mutex
+	sources map[string]*tarpitSource // Keyed by IP address.
+	active  int                      // Associations in the tarpit.
+}
+
+// The tarpit settings of one association. A nil *tarpitSession means no
+// delays.
+type tarpitSession struct {
+	tp    *tarpit
+	level int // Number of offenses, including this one.
+
+	mu     sync.Mutex
+	writer *dribbleWriter // Nil until the first PDU is dribbled.
+}
+
+func newTarpit(policy TarpitPolicy) *tarpit {
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = time.Minute
+	}
+	if policy.ForgetAfter <= 0 {
+		policy.ForgetAfter = time.Hour
+	}
+	if policy.MaxActive <= 0 {
+		policy.MaxActive = 64
+	}
+	return &tarpit{policy: policy, sources: make(map[string]*tarpitSource)}
+}
+
+func remoteIP(conn net.Conn) string {
+	if conn == nil {
+		return ""
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return host
+}
+
+// Must be called with tp.mu held.
+func (tp *tarpit) source(ip string) *tarpitSource {
+	now := time.Now()
+	s, ok := tp.sources[ip]
+	if ok && now.Sub(s.lastSeen) > tp.policy.ForgetAfter {
+		ok = false
+	}
+	if !ok {
+		if len(tp.sources) >= maxTarpitSources {
+			// Evict an arbitrary entry, the map must stay bounded.
+			for k := range tp.sources {
+				delete(tp.sources, k)
+				break
+			}
+		}
+		s = &tarpitSource{}
+		tp.sources[ip] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// Add the score of "behavior" to the address.
+func (tp *tarpit) addScore(ip string, behavior string) {
+	if tp == nil || ip == "" || tarpitScores[behavior] == 0 {
+		return
+	}
+	tp.mu.Lock()
+	tp.source(ip).score += tarpitScores[behavior]
+	tp.mu.Unlock()
+}
+
+// Decide whether a new association goes to the tarpit. The caller must call
+// release on the result when the association is over.
+func (tp *tarpit) admit(ip string, callingAETitle string, label string) *tarpitSession {
+	if tp == nil || ip == "" {
+		return nil
+	}
+	trigger := ""
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, ipNet := range tp.policy.IPs {
+			if ipNet.Contains(parsed) {
+				trigger = "IP"
+				break
+			}
+		}
+	}
+	if trigger == "" {
+		for _, ae := range tp.policy.CallingAETitles {
+			if ae == callingAETitle {
+				trigger = "AETitle"
+				break
+			}
+		}
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	s := tp.source(ip)
+	if trigger == "" && tp.policy.ScoreThreshold > 0 && s.score >= tp.policy.ScoreThreshold {
+		trigger = "Score"
+	}
+	if trigger == "" {
+		return nil
+	}
+	if tp.active >= tp.policy.MaxActive {
+		logrus.WithFields(logrus.Fields{
+			"IP":      ip,
+			"Trigger": trigger,
+			"ID":      label,
+		}).Warn("Tarpit full")
+		return nil
+	}
+	tp.active++
+	s.offenses++
+	logrus.WithFields(logrus.Fields{
+		"IP":      ip,
+		"AETitle": callingAETitle,
+		"Trigger": trigger,
+		"Score":   s.score,
+		"Level":   s.offenses,
+		"ID":      label,
+	}).Warn("Tarpit")
+	return &tarpitSession{tp: tp, level: s.offenses}
+}
+
+func (ts *tarpitSession) release() {
+	if ts == nil {
+		return
+	}
+	ts.mu.Lock()
+	if ts.writer != nil {
+		ts.writer.closed = true
+		ts.writer.cond.Signal()
+	}
+	ts.mu.Unlock()
+	ts.tp.mu.Lock()
+	ts.tp.active--
+	ts.tp.mu.Unlock()
+}
+
+// Escalate the base delay: doubled for every earlier offense, capped at
+// MaxDelay.
+func (ts *tarpitSession) delay(base time.Duration) time.Duration {
+	if ts == nil || base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < ts.level && d < ts.tp.policy.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > ts.tp.policy.MaxDelay {
+		d = ts.tp.policy.MaxDelay
+	}
+	return d
+}
+
+func (ts *tarpitSession) associateDelay() time.Duration {
+	if ts == nil {
+		return 0
+	}
+	return ts.delay(ts.tp.policy.AssociateDelay)
+}
+
+func (ts *tarpitSession) cFindDelay() time.Duration {
+	if ts == nil {
+		return 0
+	}
+	return ts.delay(ts.tp.policy.CFindDelay)
+}
+
+// Write data one byte at a time, until the whole PDU is written or MaxDelay
+// is spent; the rest is written at once.
+func (ts *tarpitSession) write(conn net.Conn, data []byte) (int, error) {
+	if !ts.dribbles() {
+		return conn.Write(data)
+	}
+	deadline := time.Now().Add(ts.tp.policy.MaxDelay)
+	n := 0
+	for n < len(data)-1 && time.Now().Before(deadline) {
+		m, err := conn.Write(data[n : n+1])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		time.Sleep(ts.tp.policy.DribbleInterval)
+	}
+	m, err := conn.Write(data[n:])
+	return n + m, err
+}
+
+func (ts *tarpitSession) dribbles() bool {
+	return ts != nil && ts.tp.policy.DribbleInterval > 0
+}
+
+// Queue a PDU for the dribbleWriter of the session, which is started on first
+// use. A failed write is reported as evt17 on errorCh.
+func (ts *tarpitSession) send(conn net.Conn, data []byte, errorCh chan stateEvent) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.writer == nil {
+		ts.writer = &dribbleWriter{ts: ts, conn: conn, errorCh: errorCh, written: make(chan struct{})}
+		ts.writer.cond = sync.NewCond(&ts.mu)
+		go ts.writer.run()
+	}
+	w := ts.writer
+	if w.closed || w.failed {
+		return
+	}
+	w.queue = append(w.queue, data)
+	w.cond.Signal()
+}
+
+// Wait until the PDUs queued for dribbling are written, or "done" is closed.
+// The DIMSE handlers call it before sending a message, so that they don't
+// queue PDUs faster than they are dribbled.
+func (ts *tarpitSession) waitWritten(done <-chan struct{}) {
+	if !ts.dribbles() {
+		return
+	}
+	for {
+		ts.mu.Lock()
+		w := ts.writer
+		if w == nil || len(w.queue) == 0 && !w.busy || w.closed {
+			ts.mu.Unlock()
+			return
+		}
+		written := w.written
+		ts.mu.Unlock()
+		select {
+		case <-written:
+		case <-done:
+			return
+		}
+	}
+}
+
+// dribbleWriter dribbles the PDUs of an association in the background, in
+// order, so that the state machine keeps serving events, e.g., the ARTIM
+// timer or an A-ABORT, in the meantime. Its fields are guarded by
+// tarpitSession.mu.
+type dribbleWriter struct {
+	ts      *tarpitSession
+	conn    net.Conn
+	errorCh chan stateEvent
+
+	cond    *sync.Cond
+	queue   [][]byte
+	busy    bool          // A PDU is being written.
+	written chan struct{} // Closed and replaced after each PDU.
+	failed  bool
+	closed  bool // Set by release.
+}
+
+func (w *dribbleWriter) run() {
+	ts := w.ts
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for {
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.queue = nil
+			close(w.written)
+			return
+		}
+		data := w.queue[0]
+		w.queue = w.queue[1:]
+		w.busy = true
+		ts.mu.Unlock()
+		n, err := ts.write(w.conn, data)
+		ts.mu.Lock()
+		w.busy = false
+		if n != len(data) || err != nil {
+			w.failed = true
+			w.queue = nil
+			w.conn.Close()
+			select {
+			case w.errorCh <- stateEvent{event: evt17, err: err}:
+			default:
+			}
+		}
+		close(w.written)
+		w.written = make(chan struct{})
+	}
+}
@@ -0,0 +1,204 @@
+package dicompot
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testTarpitPolicy() TarpitPolicy {
+	_, ipNet, _ := net.ParseCIDR("192.0.2.0/24")
+	return TarpitPolicy{
+		IPs:             []*net.IPNet{ipNet},
+		CallingAETitles: []string{"BADAE"},
+		ScoreThreshold:  10,
+		AssociateDelay:  time.Second,
+		CFindDelay:      100 * time.Millisecond,
+		MaxDelay:        5 * time.Second,
+		MaxActive:       2,
+	}
+}
+
+func TestTarpitAdmit(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		ae       string
+		behavior []string // Scored before admit
+		want     bool
+	}{
+		{"clean", "198.51.100.1", "SCU", nil, false},
+		{"IP", "192.0.2.7", "SCU", nil, true},
+		{"AE title", "198.51.100.1", "BADAE", nil, true},
+		{"score", "198.51.100.1", "SCU", []string{"rejected"}, true},
+		{"score below threshold", "198.51.100.1", "SCU", []string{"C-STORE", "C-FIND"}, false},
+		{"score reached", "198.51.100.1", "SCU", []string{"C-STORE", "C-GET", "C-MOVE"}, true},
+		{"unscored behavior", "198.51.100.1", "SCU", []string{"C-ECHO", "C-ECHO"}, false},
+		{"no address", "", "BADAE", nil, false},
+	}
+	for _, test := range tests {
+		tp := newTarpit(testTarpitPolicy())
+		for _, b := range test.behavior {
+			tp.addScore(test.ip, b)
+		}
+		ts := tp.admit(test.ip, test.ae, "1")
+		if (ts != nil) != test.want {
+			t.Errorf("%s: admit(%q, %q) = %v, want tarpitted %v", test.name, test.ip, test.ae, ts, test.want)
+		}
+		ts.release()
+		if tp.active != 0 {
+			t.Errorf("%s: %d active after release", test.name, tp.active)
+		}
+	}
+}
+
+func TestTarpitNil(t *testing.T) {
+	var tp *tarpit
+	tp.addScore("192.0.2.7", "rejected")
+	ts := tp.admit("192.0.2.7", "BADAE", "1")
+	if ts != nil {
+		t.Fatalf("nil tarpit admitted %v", ts)
+	}
+	ts.release()
+	if d := ts.associateDelay(); d != 0 {
+		t.Errorf("associateDelay() = %v, want 0", d)
+	}
+	if d := ts.cFindDelay(); d != 0 {
+		t.Errorf("cFindDelay() = %v, want 0", d)
+	}
+}
+
+func TestTarpitEscalation(t *testing.T) {
+	tp := newTarpit(testTarpitPolicy())
+	tests := []struct {
+		associate time.Duration
+		cFind     time.Duration
+	}{
+		{time.Second, 100 * time.Millisecond},
+		{2 * time.Second, 200 * time.Millisecond},
+		{4 * time.Second, 400 * time.Millisecond},
+		{5 * time.Second, 800 * time.Millisecond},
+		{5 * time.Second, 1600 * time.Millisecond},
+	}
+	for i, test := range tests {
+		ts := tp.admit("192.0.2.7", "SCU", "1")
+		if ts.level != i+1 {
+			t.Errorf("offense %d: level = %d", i+1, ts.level)
+		}
+		if got := ts.associateDelay(); got != test.associate {
+			t.Errorf("offense %d: associateDelay() = %v, want %v", i+1, got, test.associate)
+		}
+		if got := ts.cFindDelay(); got != test.cFind {
+			t.Errorf("offense %d: cFindDelay() = %v, want %v", i+1, got, test.cFind)
+		}
+		ts.release()
+	}
+}
+
+func TestTarpitMaxActive(t *testing.T) {
+	tp := newTarpit(testTarpitPolicy())
+	var sessions []*tarpitSession
+	for i := 0; i < 3; i++ {
+		sessions = append(sessions, tp.admit("192.0.2."+strconv.Itoa(i), "SCU", "1"))
+	}
+	if sessions[0] == nil || sessions[1] == nil || sessions[2] != nil {
+		t.Fatalf("admit with MaxActive 2 = %v", sessions)
+	}
+	sessions[0].release()
+	if ts := tp.admit("192.0.2.9", "SCU", "1"); ts == nil {
+		t.Errorf("admit after release = nil")
+	}
+}
+
+func TestTarpitForget(t *testing.T) {
+	policy := testTarpitPolicy()
+	policy.ForgetAfter = time.Millisecond
+	tp := newTarpit(policy)
+	tp.addScore("198.51.100.1", "rejected")
+	time.Sleep(5 * time.Millisecond)
+	if ts := tp.admit("198.51.100.1", "SCU", "1"); ts != nil {
+		t.Errorf("admit after the score was forgotten = %v, want nil", ts)
+	}
+}
+
+func TestTarpitSourcesBounded(t *testing.T) {
+	tp := newTarpit(testTarpitPolicy())
+	for i := 0; i < maxTarpitSources+10; i++ {
+		tp.addScore("10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256), "C-FIND")
+	}
+	if len(tp.sources) != maxTarpitSources {
+		t.Errorf("len(sources) = %d, want %d", len(tp.sources), maxTarpitSources)
+	}
+}
+
+func TestTarpitDribble(t *testing.T) {
+	policy := testTarpitPolicy()
+	policy.DribbleInterval = time.Millisecond
+	tp := newTarpit(policy)
+	ts := tp.admit("192.0.2.7", "SCU", "1")
+	defer ts.release()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	errorCh := make(chan stateEvent, 1)
+	pdus := [][]byte{[]byte("first"), []byte("second")}
+	for _, pdu := range pdus {
+		ts.send(server, pdu, errorCh)
+	}
+	// The PDUs come out in order, one byte per write.
+	var got []byte
+	buf := make([]byte, 16)
+	for len(got) < len("firstsecond") {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("read %q, want one byte", buf[:n])
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, []byte("firstsecond")) {
+		t.Errorf("dribbled %q, want %q", got, "firstsecond")
+	}
+	done := make(chan struct{})
+	go func() {
+		ts.waitWritten(nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("waitWritten did not return once the queue was written")
+	}
+	select {
+	case e := <-errorCh:
+		t.Errorf("unexpected %v", e.event)
+	default:
+	}
+}
+
+func TestTarpitDribbleFailure(t *testing.T) {
+	policy := testTarpitPolicy()
+	policy.DribbleInterval = time.Millisecond
+	tp := newTarpit(policy)
+	ts := tp.admit("192.0.2.7", "SCU", "1")
+	defer ts.release()
+
+	client, server := net.Pipe()
+	errorCh := make(chan stateEvent, 1)
+	ts.send(server, []byte("pdu"), errorCh)
+	io.ReadFull(client, make([]byte, 1))
+	client.Close()
+	select {
+	case e := <-errorCh:
+		if e.event != evt17 {
+			t.Errorf("event = %v, want evt17", e.event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no evt17 after the peer closed the connection")
+	}
+}
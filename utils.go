@@ -8,18 +8,17 @@ import (
 
 var idSeq int64
 
+// A time based ID, unique even when ServiceUsers are created concurrently.
 func newUID() string {
-	now := time.Now()
-	idSeq = now.UnixNano()
-	return fmt.Sprintf("%d", atomic.AddInt64(&idSeq, 1))
-}
-
-func doassert(cond bool, values ...interface{}) {
-	if !cond {
-		var s string
-		for _, value := range values {
-			s += fmt.Sprintf("%v ", value)
+	now := time.Now().UnixNano() + 1
+	for {
+		last := atomic.LoadInt64(&idSeq)
+		id := now
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&idSeq, last, id) {
+			return fmt.Sprintf("%d", id)
 		}
-		panic(s)
 	}
 }